@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// handleArchiveRoom is POST /rooms/{roomID}/archive. Archived rooms stay
+// readable, searchable and exportable, but nobody can post, react, vote,
+// pin or start calls (see archivedDenies) until DELETE .../archive.
+func (s *Server) handleArchiveRoom(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, true)
+}
+
+// handleUnarchiveRoom is DELETE /rooms/{roomID}/archive.
+func (s *Server) handleUnarchiveRoom(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, false)
+}
+
+func (s *Server) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	actor, ok := s.requirePerm(w, r, roomID, permEditSettings)
+	if !ok {
+		return
+	}
+	if actor.Archived == archived {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.store.SetArchived(r.Context(), roomID, archived); err != nil {
+		log.Println("setArchived db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// cached memberships carry the archived flag
+	s.hub.forgetMember(roomID, 0)
+
+	email := emailFromCtx(r)
+	typ, text := "room_archived", "🗄️ "+email+" archived the room; it's read-only now"
+	if !archived {
+		typ, text = "room_unarchived", "📂 "+email+" unarchived the room"
+	}
+	s.hub.BroadcastToRoom(roomID, map[string]any{
+		"type":   typ,
+		"roomId": roomID,
+		"by":     email,
+	})
+	s.broadcastSystem(roomID, text)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestoreRoom is POST /rooms/{roomID}/restore: the owner undoes a
+// delete, as long as the purger hasn't got to it yet.
+func (s *Server) handleRestoreRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.store.RestoreRoom(r.Context(), roomID, userIDFromCtx(r), time.Now().Add(-s.restoreWindow))
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "no deleted room of yours to restore")
+		return
+	}
+	if err != nil {
+		log.Println("handleRestoreRoom db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if room, err := s.store.GetRoom(r.Context(), roomID); err == nil {
+		if members, err := s.store.MemberEmails(r.Context(), roomID); err == nil {
+			s.hub.notifyUsers(members, userEventRoomRestored, roomID, map[string]any{"name": room.Name})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"status": "restored", "room_id": roomID})
+}
+
+// runRoomPurger hard-deletes rooms that have been soft-deleted for longer
+// than keep.
+func runRoomPurger(ctx context.Context, store Store, keep time.Duration) {
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := store.PurgeDeletedRooms(ctx, time.Now().Add(-keep))
+		if err != nil {
+			log.Println("room purge error:", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("room purge removed", n, "rooms")
+		}
+	}
+}
+
+const exportPageSize = 500
+
+// RoomExport is the head of an export; handleExportRoom streams "messages"
+// (oldest first, deleted ones left out) after it.
+type RoomExport struct {
+	Room       RoomExportInfo `json:"room"`
+	ExportedAt int64          `json:"exportedAt"` // unix ms
+	Members    []MemberDTO    `json:"members"`
+}
+
+type RoomExportInfo struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+	CreatedAt  int64  `json:"createdAt"`
+	ArchivedAt int64  `json:"archivedAt,omitempty"`
+}
+
+// handleExportRoom is GET /rooms/{roomID}/export: the room's whole history
+// as one JSON download, for any member. Works on archived rooms. Messages
+// are written a page at a time, so a big room is never held in memory.
+func (s *Server) handleExportRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	userID := userIDFromCtx(r)
+
+	if ok, err := s.store.IsMember(r.Context(), roomID, userID); err != nil || !ok {
+		writeErr(w, http.StatusForbidden, "not a room member")
+		return
+	}
+	room, err := s.store.GetRoom(r.Context(), roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	members, err := s.store.ListMembers(r.Context(), roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	head := RoomExport{
+		Room: RoomExportInfo{
+			ID:         room.ID,
+			Name:       room.Name,
+			Visibility: room.Visibility,
+			CreatedAt:  room.CreatedAt.UnixMilli(),
+		},
+		ExportedAt: time.Now().UnixMilli(),
+		Members:    make([]MemberDTO, 0, len(members)),
+	}
+	if !room.ArchivedAt.IsZero() {
+		head.Room.ArchivedAt = room.ArchivedAt.UnixMilli()
+	}
+	for _, m := range members {
+		head.Members = append(head.Members, memberDTO(m))
+	}
+	b, err := json.Marshal(head)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "encode error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="room-%d-export.json"`, roomID))
+	w.WriteHeader(http.StatusOK)
+
+	// {"room":...,"members":[...] then ,"messages":[...]}
+	w.Write(b[:len(b)-1])
+	io.WriteString(w, `,"messages":[`)
+
+	enc := json.NewEncoder(w)
+	rc := http.NewResponseController(w)
+	q := MessageQuery{RoomID: roomID, ViewerID: userID, Forward: true, Limit: exportPageSize}
+	first := true
+	for {
+		page, err := s.exportPage(r.Context(), q)
+		if err != nil {
+			// too late for a 500: drop the connection so the download fails
+			// instead of ending in a file that looks complete
+			log.Println("handleExportRoom query error:", err)
+			panic(http.ErrAbortHandler)
+		}
+		for _, m := range page.msgs {
+			if !first {
+				io.WriteString(w, ",")
+			}
+			first = false
+			if err := enc.Encode(m); err != nil {
+				return // client went away
+			}
+		}
+		rc.Flush()
+		if !page.more {
+			break
+		}
+		q.AfterID = page.lastID
+	}
+	io.WriteString(w, "]}\n")
+}
+
+type exportPage struct {
+	msgs   []MessageDTO // live messages only, hydrated
+	lastID int64
+	more   bool
+}
+
+// exportPage reads the page of q for handleExportRoom.
+func (s *Server) exportPage(ctx context.Context, q MessageQuery) (exportPage, error) {
+	page, err := s.store.ListMessages(ctx, q)
+	if err != nil {
+		return exportPage{}, err
+	}
+	out := exportPage{more: len(page) == q.Limit}
+	if len(page) > 0 {
+		out.lastID = page[len(page)-1].ID
+	}
+	for _, m := range page {
+		if !m.Deleted {
+			out.msgs = append(out.msgs, m)
+		}
+	}
+	if err := hydratePolls(ctx, s.store, out.msgs, q.ViewerID); err != nil {
+		return out, err
+	}
+	if err := hydrateReactions(ctx, s.store, out.msgs, q.ViewerID); err != nil {
+		return out, err
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestArchivedRoomIsReadOnly(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	msgID := ts.message(roomID, aliceID, "before")
+	archive := fmt.Sprintf("/rooms/%d/archive", roomID)
+
+	conn := ts.ws(bob)
+	wsSend(t, conn, WSIn{Type: "join_room", RoomID: roomID})
+	readUntil(t, conn, "user_list")
+
+	ts.expect(http.StatusForbidden, bob, "POST", archive, nil)
+	ts.expect(http.StatusNoContent, alice, "POST", archive, nil)
+	readUntil(t, conn, "room_archived")
+
+	// reading still works; writing doesn't, over REST or WS
+	ts.expect(http.StatusOK, bob, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil)
+	ts.expect(http.StatusOK, bob, "GET", fmt.Sprintf("/rooms/%d/export", roomID), nil)
+	ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/polls", roomID),
+		createPollReq{Question: "q", Options: []string{"a", "b"}})
+	ts.expect(http.StatusForbidden, alice, "POST", fmt.Sprintf("/messages/%d/pin", msgID), nil)
+	wsSend(t, conn, WSIn{Type: "message", RoomID: roomID, Body: "hello?"})
+	if f := readUntil(t, conn, "message_error"); !jsonHas(f.raw, `"code":"archived"`) {
+		t.Errorf("post while archived: got %s", f.raw)
+	}
+
+	ts.expect(http.StatusNoContent, alice, "DELETE", archive, nil)
+	wsSend(t, conn, WSIn{Type: "message", RoomID: roomID, Body: "back"})
+	readUntil(t, conn, "message_ack")
+}
+
+func TestExportRoom(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+
+	var ids []int64
+	for _, body := range []string{"one", "two", "three"} {
+		ids = append(ids, ts.message(roomID, aliceID, body))
+	}
+	ts.expect(http.StatusNoContent, alice, "DELETE", fmt.Sprintf("/messages/%d", ids[1]), nil)
+	ts.expect(http.StatusNoContent, alice, "POST", fmt.Sprintf("/rooms/%d/archive", roomID), nil)
+
+	path := fmt.Sprintf("/rooms/%d/export", roomID)
+	ts.expect(http.StatusForbidden, bob, "GET", path, nil)
+
+	var out struct {
+		RoomExport
+		Messages []MessageDTO `json:"messages"`
+	}
+	if st, msg := ts.call(alice, "GET", path, nil, &out); st != http.StatusOK {
+		t.Fatalf("export: status %d (%q)", st, msg)
+	}
+	if out.Room.ID != roomID || out.Room.ArchivedAt == 0 || len(out.Members) != 1 {
+		t.Errorf("head: got %+v", out.RoomExport)
+	}
+	if len(out.Messages) != 2 || out.Messages[0].ID != ids[0] || out.Messages[1].ID != ids[2] {
+		t.Errorf("messages: got %+v, want one and three, oldest first", out.Messages)
+	}
+}
+
+func TestDeleteAndRestoreRoom(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	del, restore := fmt.Sprintf("/rooms/%d", roomID), fmt.Sprintf("/rooms/%d/restore", roomID)
+
+	ts.expect(http.StatusForbidden, bob, "DELETE", del, nil)
+	ts.expect(http.StatusOK, alice, "DELETE", del, nil)
+
+	var rooms []Room
+	ts.call(bob, "GET", "/rooms", nil, &rooms)
+	for _, r := range rooms {
+		if r.ID == roomID {
+			t.Error("deleted room still listed")
+		}
+	}
+
+	ts.expect(http.StatusNotFound, bob, "POST", restore, nil) // owner only
+	ts.expect(http.StatusOK, alice, "POST", restore, nil)
+	ts.expect(http.StatusOK, bob, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil)
+
+	// past the window it's gone for good
+	ts.expect(http.StatusOK, alice, "DELETE", del, nil)
+	ts.s.restoreWindow = -time.Second
+	ts.expect(http.StatusNotFound, alice, "POST", restore, nil)
+}
@@ -0,0 +1,154 @@
+package main
+
+import "encoding/json"
+
+// callOp is one change to a room's call. The node that handles it applies
+// it and forwards it, and every other node applies the same op to its own
+// Server.calls. Forwarding whole snapshots instead would let two nodes that
+// change a call at the same moment overwrite each other's participants.
+type callOp struct {
+	Op    string `json:"op"` // start | join | leave | end | share_start | share_stop
+	Email string `json:"email"`
+	At    int64  `json:"at"` // unix ms on the node that handled it
+
+	// the sender's state after the op, for nodes that never saw the call
+	// start (they joined the cluster, or restarted, since)
+	Call CallState `json:"call"`
+}
+
+type callResult struct {
+	started bool   // start: there was no call, now there is
+	ended   bool   // the call is over
+	reject  string // share_start / share_stop: why it was refused
+}
+
+// apply is the one place call state changes. It must give the same result
+// on every node whatever order concurrent ops arrive in.
+func (cs *CallState) apply(op callOp) (res callResult) {
+	switch op.Op {
+	case "start":
+		switch {
+		case !cs.Active:
+			cs.Active = true
+			cs.HostEmail = op.Email
+			cs.StartedAtMS = op.At
+			cs.Participants = nil
+			cs.ScreenSharing, cs.ScreenSharer = false, ""
+			res.started = true
+		case op.At < cs.StartedAtMS || (op.At == cs.StartedAtMS && op.Email < cs.HostEmail):
+			// started on two nodes at once: the earlier start hosts, everywhere
+			cs.HostEmail, cs.StartedAtMS = op.Email, op.At
+		}
+		if !contains(cs.Participants, op.Email) {
+			cs.Participants = append(cs.Participants, op.Email)
+		}
+
+	case "join":
+		if cs.Active && !contains(cs.Participants, op.Email) {
+			cs.Participants = append(cs.Participants, op.Email)
+		}
+
+	case "leave":
+		if !cs.Active {
+			return res
+		}
+		cs.Participants = remove(cs.Participants, op.Email)
+		// the host leaving ends the call (simple prototype rule), as does the
+		// last participant leaving
+		if cs.HostEmail == op.Email || len(cs.Participants) == 0 {
+			cs.end()
+			res.ended = true
+		} else if cs.ScreenSharing && cs.ScreenSharer == op.Email {
+			cs.ScreenSharing, cs.ScreenSharer = false, ""
+		}
+
+	case "end":
+		// only host can end (prototype rule)
+		if cs.Active && cs.HostEmail == op.Email {
+			cs.end()
+			res.ended = true
+		}
+
+	case "share_start":
+		switch {
+		case !cs.Active:
+			res.reject = "no active call"
+		case cs.ScreenSharing && cs.ScreenSharer != "" && cs.ScreenSharer != op.Email:
+			// only one sharer at a time
+			res.reject = "someone is already sharing: " + cs.ScreenSharer
+		default:
+			cs.ScreenSharing, cs.ScreenSharer = true, op.Email
+		}
+
+	case "share_stop":
+		// only the sharer can stop (simple rule)
+		if cs.ScreenSharing {
+			if cs.ScreenSharer != op.Email {
+				res.reject = "only current sharer can stop sharing"
+			} else {
+				cs.ScreenSharing, cs.ScreenSharer = false, ""
+			}
+		}
+	}
+	return res
+}
+
+func (cs *CallState) end() {
+	cs.lastEnded = cs.StartedAtMS
+	cs.Active = false
+	cs.HostEmail = ""
+	cs.Participants = nil
+	cs.StartedAtMS = 0
+	cs.ScreenSharing, cs.ScreenSharer = false, ""
+}
+
+// snapshot copies cs for sending; Participants is [] rather than null.
+func (cs *CallState) snapshot() CallState {
+	out := *cs
+	out.Participants = append([]string{}, cs.Participants...)
+	return out
+}
+
+// callOp applies op to roomID's call on this node and forwards it to the
+// others. Refused ops, and ops on a room with no call, stay local.
+func (s *Server) callOp(roomID int64, op, email string) callResult {
+	o := callOp{Op: op, Email: email, At: nowMS()}
+
+	s.callMu.Lock()
+	cs := s.getCall(roomID)
+	wasActive := cs.Active
+	res := cs.apply(o)
+	o.Call = cs.snapshot()
+	s.callMu.Unlock()
+
+	if res.reject == "" && (wasActive || o.Call.Active) {
+		b, _ := json.Marshal(o)
+		s.hub.sendRemote(roomID, "call_op", b)
+	}
+	return res
+}
+
+// applyRemoteCallOp is the call_op hook: it replays another node's change
+// here and shows this node's clients the merged state.
+func (s *Server) applyRemoteCallOp(roomID int64, b []byte) {
+	var o callOp
+	if err := json.Unmarshal(b, &o); err != nil {
+		return
+	}
+
+	s.callMu.Lock()
+	cs := s.getCall(roomID)
+	if (!cs.Active || cs.restored) && o.Call.Active && o.Call.StartedAtMS > cs.lastEnded {
+		// a call we never saw start, or only know from before a restart:
+		// take the sender's view, then the op
+		lastEnded := cs.lastEnded
+		*cs = o.Call
+		cs.RoomID = roomID
+		cs.Participants = append([]string(nil), o.Call.Participants...)
+		cs.lastEnded = lastEnded
+	}
+	cs.apply(o)
+	s.callMu.Unlock()
+
+	s.broadcastCallState(roomID)
+}
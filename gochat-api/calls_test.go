@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+func TestCallOpsConvergeInAnyOrder(t *testing.T) {
+	// two nodes start the same call at once, then people join and leave
+	// through either. The broker keeps cause before effect, but concurrent
+	// ops can land in any order; every order must end in the same state.
+	starts := []callOp{
+		{Op: "start", Email: "bob@x", At: 200},
+		{Op: "start", Email: "alice@x", At: 100},
+	}
+	changes := []callOp{
+		{Op: "join", Email: "carol@x", At: 300},
+		{Op: "join", Email: "dave@x", At: 300},
+		{Op: "leave", Email: "bob@x", At: 300},
+	}
+
+	var want *CallState
+	permute(starts, func(starts []callOp) {
+		permute(changes, func(changes []callOp) {
+			var cs CallState
+			for _, op := range append(slices.Clone(starts), changes...) {
+				cs.apply(op)
+			}
+			cs.apply(callOp{Op: "share_start", Email: "carol@x", At: 400})
+			slices.Sort(cs.Participants)
+
+			if want == nil {
+				want = &cs
+				return
+			}
+			if cs.HostEmail != want.HostEmail || cs.StartedAtMS != want.StartedAtMS ||
+				!slices.Equal(cs.Participants, want.Participants) || cs.ScreenSharer != want.ScreenSharer {
+				t.Fatalf("order %v %v: got %+v, want %+v", starts, changes, cs, *want)
+			}
+		})
+	})
+
+	if want.HostEmail != "alice@x" || want.StartedAtMS != 100 {
+		t.Errorf("host: got %s at %d, want the earlier start (alice@x at 100)", want.HostEmail, want.StartedAtMS)
+	}
+	if !slices.Equal(want.Participants, []string{"alice@x", "carol@x", "dave@x"}) {
+		t.Errorf("participants: got %v", want.Participants)
+	}
+	if want.ScreenSharer != "carol@x" {
+		t.Errorf("sharer: got %q", want.ScreenSharer)
+	}
+}
+
+func TestCallOpLeave(t *testing.T) {
+	var cs CallState
+	cs.apply(callOp{Op: "start", Email: "alice@x", At: 100})
+	cs.apply(callOp{Op: "join", Email: "bob@x"})
+	cs.apply(callOp{Op: "share_start", Email: "bob@x"})
+
+	if res := cs.apply(callOp{Op: "share_stop", Email: "alice@x"}); res.reject == "" {
+		t.Error("share_stop by someone else was accepted")
+	}
+	if res := cs.apply(callOp{Op: "leave", Email: "bob@x"}); res.ended || cs.ScreenSharing {
+		t.Errorf("sharer leaving: ended=%v sharing=%v, want the call on and the share off", res.ended, cs.ScreenSharing)
+	}
+	if res := cs.apply(callOp{Op: "end", Email: "bob@x"}); res.ended {
+		t.Error("non-host ended the call")
+	}
+	if res := cs.apply(callOp{Op: "leave", Email: "alice@x"}); !res.ended || cs.Active {
+		t.Error("host leaving didn't end the call")
+	}
+	if cs.lastEnded != 100 {
+		t.Errorf("lastEnded: got %d, want 100", cs.lastEnded)
+	}
+}
+
+func TestApplyRemoteCallOp(t *testing.T) {
+	s := &Server{hub: NewHub("test", nil, nil), calls: make(map[int64]*CallState)}
+
+	remote := func(op callOp, after CallState) {
+		op.Call = after
+		b, _ := json.Marshal(op)
+		s.applyRemoteCallOp(1, b)
+	}
+
+	// a join on a call this node never saw start adopts the sender's view
+	remote(callOp{Op: "join", Email: "bob@x", At: 150},
+		CallState{Active: true, HostEmail: "alice@x", StartedAtMS: 100, Participants: []string{"alice@x", "bob@x"}})
+	if cs := s.calls[1]; !cs.Active || cs.HostEmail != "alice@x" || len(cs.Participants) != 2 {
+		t.Fatalf("after remote join: %+v", *cs)
+	}
+
+	// a local join racing it is kept, not overwritten by the next remote op
+	s.callOp(1, "join", "carol@x")
+	remote(callOp{Op: "join", Email: "dave@x", At: 160},
+		CallState{Active: true, HostEmail: "alice@x", StartedAtMS: 100, Participants: []string{"alice@x", "bob@x", "dave@x"}})
+	got := append([]string(nil), s.calls[1].Participants...)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"alice@x", "bob@x", "carol@x", "dave@x"}) {
+		t.Errorf("participants: got %v", got)
+	}
+
+	// once it ends here, a late op carrying the old call doesn't revive it
+	remote(callOp{Op: "end", Email: "alice@x", At: 170}, CallState{})
+	remote(callOp{Op: "join", Email: "erin@x", At: 165},
+		CallState{Active: true, HostEmail: "alice@x", StartedAtMS: 100, Participants: []string{"alice@x", "erin@x"}})
+	if s.calls[1].Active {
+		t.Errorf("stale op revived the ended call: %+v", *s.calls[1])
+	}
+}
+
+func TestSignalingGoesToThePeer(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	_, carol := ts.user("carol@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+
+	conns := map[string]*websocket.Conn{}
+	for name, tok := range map[string]string{"alice": alice, "bob": bob, "carol": carol} {
+		if name != "alice" {
+			ts.expect(http.StatusOK, tok, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+		}
+		conns[name] = ts.ws(tok)
+		wsSend(t, conns[name], WSIn{Type: "join_room", RoomID: roomID})
+		readUntil(t, conns[name], "user_list")
+	}
+
+	wsSend(t, conns["alice"], WSIn{Type: "call_start", RoomID: roomID})
+	readUntil(t, conns["alice"], "call_state")
+	wsSend(t, conns["bob"], WSIn{Type: "call_join", RoomID: roomID})
+	for {
+		var st WSOut
+		if err := json.Unmarshal(readUntil(t, conns["alice"], "call_state").raw, &st); err != nil {
+			t.Fatal(err)
+		}
+		if len(st.Call.Participants) == 2 {
+			break
+		}
+	}
+
+	// the recipient is named by email, in any case
+	wsSend(t, conns["alice"], WSIn{Type: "webrtc_offer", RoomID: roomID, To: "Bob@Example.com", SDP: "v=0"})
+	var offer struct {
+		From string `json:"from"`
+		SDP  string `json:"sdp"`
+	}
+	if err := json.Unmarshal(readUntil(t, conns["bob"], "webrtc_offer").raw, &offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.From != "alice@example.com" || offer.SDP != "v=0" {
+		t.Errorf("offer: got %+v", offer)
+	}
+
+	// carol isn't in the call: she can't be signaled, and sees none of it
+	for _, tt := range []struct {
+		to, code string
+	}{
+		{"carol@example.com", "not_in_call"},
+		{"alice@example.com", "bad_target"},
+	} {
+		wsSend(t, conns["alice"], WSIn{Type: "webrtc_ice", RoomID: roomID, To: tt.to, ICE: "candidate"})
+		var e WSOut
+		if err := json.Unmarshal(readUntil(t, conns["alice"], "error").raw, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != tt.code || e.Ref != "webrtc_ice" {
+			t.Errorf("to %s: got code %q ref %q, want %q", tt.to, e.Code, e.Ref, tt.code)
+		}
+	}
+	wsSend(t, conns["alice"], WSIn{Type: "message", RoomID: roomID, Body: "done"})
+	for {
+		f := readFrame(t, conns["carol"])
+		if strings.HasPrefix(f.Type, "webrtc_") {
+			t.Fatalf("carol got %s", f.raw)
+		}
+		if f.Type == "message" {
+			break
+		}
+	}
+}
+
+// permute calls fn with every ordering of ops.
+func permute(ops []callOp, fn func([]callOp)) {
+	var rec func(int)
+	rec = func(k int) {
+		if k == len(ops) {
+			fn(ops)
+			return
+		}
+		for i := k; i < len(ops); i++ {
+			ops[k], ops[i] = ops[i], ops[k]
+			rec(k + 1)
+			ops[k], ops[i] = ops[i], ops[k]
+		}
+	}
+	rec(0)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxDMParticipants caps group DMs, you included; anything bigger should be
+// a room.
+const maxDMParticipants = 9
+
+// dmKey is rooms.dm_key for a participant set: the sorted ids, so the same
+// people always map to the same conversation. ids must already be sorted.
+func dmKey(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// userStatus is email's presence anywhere, not just in one room: "active"
+// if any connection is, "idle" if all are idle, else "offline". Other nodes
+// only report users focused on a room, so it's best effort across replicas.
+func (h *Hub) userStatus(email string) string {
+	key := strings.ToLower(email)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := "offline"
+	for c := range h.users[key] {
+		if c.status == "" || c.status == "active" {
+			return "active"
+		}
+		status = "idle"
+	}
+	for _, nodes := range h.remote {
+		for _, rp := range nodes {
+			for _, p := range rp.Users {
+				if strings.ToLower(p.Email) != key {
+					continue
+				}
+				if p.Status == "" || p.Status == "active" {
+					return "active"
+				}
+				status = "idle"
+			}
+		}
+	}
+	return status
+}
+
+type openDMReq struct {
+	Emails []string `json:"emails"` // everyone else in the conversation
+}
+
+// handleOpenDM is POST /dms: the DM with exactly these people (and you),
+// created on first use. Asking again for the same set, in any order, gets
+// the same room back; it puts you back in if you'd left, but never the
+// others.
+func (s *Server) handleOpenDM(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+	me := strings.ToLower(emailFromCtx(r))
+
+	var req openDMReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	emails := []string{}
+	for _, e := range req.Emails {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" && e != me && !slices.Contains(emails, e) {
+			emails = append(emails, e)
+		}
+	}
+	if len(emails) == 0 {
+		writeErr(w, http.StatusBadRequest, "emails required")
+		return
+	}
+	if len(emails) >= maxDMParticipants {
+		writeErr(w, http.StatusBadRequest, "too many participants; create a room instead")
+		return
+	}
+
+	ids := []int64{userID}
+	byID := map[int64]string{userID: me}
+	for _, e := range emails {
+		u, err := s.store.UserByEmail(r.Context(), e)
+		if errors.Is(err, ErrNotFound) {
+			writeErr(w, http.StatusNotFound, "no user with email "+e)
+			return
+		}
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		ids = append(ids, u.ID)
+		byID[u.ID] = u.Email
+	}
+	slices.Sort(ids)
+
+	roomID, added, err := s.store.OpenDM(r.Context(), userID, ids)
+	if err != nil {
+		log.Println("handleOpenDM db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	participants := make([]UserPresence, 0, len(emails))
+	for _, id := range ids {
+		if id != userID {
+			participants = append(participants, UserPresence{Email: byID[id], Status: s.hub.userStatus(byID[id])})
+		}
+	}
+
+	// everyone newly in it (your other tabs included) picks the DM up
+	for _, id := range added {
+		others := []string{}
+		for _, p := range ids {
+			if p != id {
+				others = append(others, byID[p])
+			}
+		}
+		s.hub.notifyUser(byID[id], userEventRoomAdded, roomID, map[string]any{"kind": roomKindDM, "participants": others})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":           roomID,
+		"kind":         roomKindDM,
+		"participants": participants,
+	})
+}
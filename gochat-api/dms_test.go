@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestOpenDMDedupe(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	ts.user("carol@example.com")
+	_, dave := ts.user("dave@example.com")
+
+	open := func(token string, emails ...string) int64 {
+		t.Helper()
+		var out struct {
+			ID int64 `json:"id"`
+		}
+		if st, msg := ts.call(token, "POST", "/dms", map[string][]string{"emails": emails}, &out); st != http.StatusOK {
+			t.Fatalf("open DM %v: status %d (%q)", emails, st, msg)
+		}
+		return out.ID
+	}
+
+	group := open(alice, "bob@example.com", "carol@example.com")
+	if again := open(bob, " Carol@Example.com", "ALICE@example.com", "carol@example.com"); again != group {
+		t.Errorf("same people in another order: room %d, want %d", again, group)
+	}
+	if pair := open(alice, "bob@example.com"); pair == group {
+		t.Errorf("alice+bob reused the group DM %d", group)
+	}
+	if pair, again := open(alice, "bob@example.com"), open(bob, "alice@example.com"); pair != again {
+		t.Errorf("alice+bob: rooms %d and %d", pair, again)
+	}
+
+	ts.expect(http.StatusBadRequest, alice, "POST", "/dms", map[string][]string{"emails": {"alice@example.com"}})
+	ts.expect(http.StatusNotFound, alice, "POST", "/dms", map[string][]string{"emails": {"nobody@example.com"}})
+	if msg := ts.expect(http.StatusForbidden, dave, "POST", fmt.Sprintf("/rooms/%d/join", group), nil); msg != "direct messages can't be joined" {
+		t.Errorf("outsider joining a DM: error %q", msg)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// EventLog stamps durable room events with a per-room sequence number and
+// keeps them around so reconnecting clients can replay what they missed.
+type EventLog interface {
+	// Append assigns the next seq for roomID and stores the (unstamped) frame.
+	Append(ctx context.Context, roomID int64, typ string, frame []byte) (seq int64, err error)
+
+	// Since returns the stamped frames logged after sinceSeq, oldest first,
+	// plus the room's latest seq. ok=false means the gap is larger than max,
+	// has already been pruned, or sinceSeq is ahead of the log (the client saw
+	// a log that has since been lost), and the client has to do a full resync.
+	Since(ctx context.Context, roomID, sinceSeq int64, max int) (frames [][]byte, lastSeq int64, ok bool, err error)
+
+	// Prune drops events older than keep.
+	Prune(ctx context.Context, keep time.Duration) (int64, error)
+}
+
+// durableEvents are the frame types that get a seq and go into the log.
+// Ephemeral frames (typing, presence, user_list, call_state, ...) are not
+// sequenced: replaying them after a reconnect would be wrong, not just noisy.
+var durableEvents = map[string]bool{
+	"message":          true,
+	"message_edited":   true,
+	"message_deleted":  true,
+	"reaction_added":   true,
+	"reaction_removed": true,
+	"poll_updated":     true,
+	"system":           true,
+	"thread_reply":     true,
+
+	"member_role_changed": true,
+	"owner_changed":       true,
+	"room_archived":       true,
+	"room_unarchived":     true,
+	"room_updated":        true,
+	"message_pinned":      true,
+	"message_unpinned":    true,
+}
+
+// stampSeq injects "seq":N as the first field of a JSON object frame.
+func stampSeq(b []byte, seq int64) []byte {
+	if len(b) < 2 || b[0] != '{' {
+		return b
+	}
+	out := make([]byte, 0, len(b)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendInt(out, seq, 10)
+	if len(b) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, b[1:]...)
+}
+
+type pgEventLog struct {
+	db *pgxpool.Pool
+}
+
+func newPGEventLog(db *pgxpool.Pool) *pgEventLog {
+	return &pgEventLog{db: db}
+}
+
+func (l *pgEventLog) Append(ctx context.Context, roomID int64, typ string, frame []byte) (int64, error) {
+	var seq int64
+	err := l.db.QueryRow(ctx, `
+		WITH next AS (
+			INSERT INTO room_seqs (room_id, last_seq) VALUES ($1, 1)
+			ON CONFLICT (room_id) DO UPDATE SET last_seq = room_seqs.last_seq + 1
+			RETURNING last_seq
+		)
+		INSERT INTO room_events (room_id, seq, type, frame)
+		SELECT $1, last_seq, $2, $3 FROM next
+		RETURNING seq
+	`, roomID, typ, string(frame)).Scan(&seq)
+	return seq, err
+}
+
+func (l *pgEventLog) Since(ctx context.Context, roomID, sinceSeq int64, max int) ([][]byte, int64, bool, error) {
+	var lastSeq int64
+	err := l.db.QueryRow(ctx, `
+		SELECT COALESCE((SELECT last_seq FROM room_seqs WHERE room_id=$1), 0)
+	`, roomID).Scan(&lastSeq)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if sinceSeq <= 0 || sinceSeq == lastSeq {
+		return nil, lastSeq, true, nil
+	}
+	if sinceSeq > lastSeq || lastSeq-sinceSeq > int64(max) {
+		return nil, lastSeq, false, nil
+	}
+
+	rows, err := l.db.Query(ctx, `
+		SELECT seq, frame
+		FROM room_events
+		WHERE room_id=$1 AND seq > $2 AND seq <= $3
+		ORDER BY seq
+	`, roomID, sinceSeq, lastSeq)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer rows.Close()
+
+	frames := make([][]byte, 0, lastSeq-sinceSeq)
+	want := sinceSeq + 1
+	for rows.Next() {
+		var seq int64
+		var frame string
+		if err := rows.Scan(&seq, &frame); err != nil {
+			return nil, 0, false, err
+		}
+		if seq != want {
+			// pruned (or never logged): can't replay a hole
+			return nil, lastSeq, false, nil
+		}
+		frames = append(frames, stampSeq([]byte(frame), seq))
+		want++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	if want != lastSeq+1 {
+		return nil, lastSeq, false, nil
+	}
+
+	return frames, lastSeq, true, nil
+}
+
+func (l *pgEventLog) Prune(ctx context.Context, keep time.Duration) (int64, error) {
+	tag, err := l.db.Exec(ctx, `
+		DELETE FROM room_events WHERE created_at < now() - ($1::bigint * interval '1 second')
+	`, int64(keep.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// memEventLog is the EventLog for STORE=memory.
+type memEventLog struct {
+	mu    sync.Mutex
+	rooms map[int64][]memEvent
+	last  map[int64]int64
+}
+
+type memEvent struct {
+	seq   int64
+	frame []byte
+	at    time.Time
+}
+
+func newMemEventLog() *memEventLog {
+	return &memEventLog{rooms: map[int64][]memEvent{}, last: map[int64]int64{}}
+}
+
+func (l *memEventLog) Append(ctx context.Context, roomID int64, typ string, frame []byte) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last[roomID]++
+	seq := l.last[roomID]
+	l.rooms[roomID] = append(l.rooms[roomID], memEvent{seq: seq, frame: frame, at: time.Now()})
+	return seq, nil
+}
+
+func (l *memEventLog) Since(ctx context.Context, roomID, sinceSeq int64, max int) ([][]byte, int64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lastSeq := l.last[roomID]
+	if sinceSeq <= 0 || sinceSeq == lastSeq {
+		return nil, lastSeq, true, nil
+	}
+	if sinceSeq > lastSeq || lastSeq-sinceSeq > int64(max) {
+		return nil, lastSeq, false, nil
+	}
+
+	evs := l.rooms[roomID]
+	if len(evs) == 0 || evs[0].seq > sinceSeq+1 {
+		return nil, lastSeq, false, nil // pruned
+	}
+
+	frames := make([][]byte, 0, lastSeq-sinceSeq)
+	for _, ev := range evs {
+		if ev.seq > sinceSeq {
+			frames = append(frames, stampSeq(ev.frame, ev.seq))
+		}
+	}
+	return frames, lastSeq, true, nil
+}
+
+func (l *memEventLog) Prune(ctx context.Context, keep time.Duration) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-keep)
+	var n int64
+	for roomID, evs := range l.rooms {
+		i := 0
+		for i < len(evs) && evs[i].at.Before(cutoff) {
+			i++
+		}
+		n += int64(i)
+		l.rooms[roomID] = evs[i:]
+	}
+	return n, nil
+}
+
+func runEventLogPruner(ctx context.Context, events EventLog, keep time.Duration) {
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := events.Prune(ctx, keep)
+		if err != nil {
+			log.Println("event log prune error:", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("event log pruned", n, "events")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventLogSince(t *testing.T) {
+	ctx := context.Background()
+	l := newMemEventLog()
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(ctx, 1, "message", []byte(fmt.Sprintf(`{"type":"message","n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		sinceSeq int64
+		max      int
+		frames   int
+		ok       bool
+	}{
+		{"first join", 0, 10, 0, true},
+		{"caught up", 5, 10, 0, true},
+		{"small gap", 2, 10, 3, true},
+		{"gap over max", 2, 2, 0, false},
+		{"ahead of the log", 9, 10, 0, false},
+	}
+	for _, tt := range tests {
+		frames, lastSeq, ok, err := l.Since(ctx, 1, tt.sinceSeq, tt.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != tt.frames || ok != tt.ok || lastSeq != 5 {
+			t.Errorf("%s: got %d frames, ok=%v, lastSeq=%d; want %d frames, ok=%v, lastSeq=5",
+				tt.name, len(frames), ok, lastSeq, tt.frames, tt.ok)
+		}
+	}
+
+	frames, _, _, _ := l.Since(ctx, 1, 3, 10)
+	if want := `{"seq":4,"type":"message","n":3}`; string(frames[0]) != want {
+		t.Errorf("frame: got %s, want %s", frames[0], want)
+	}
+
+	if _, err := l.Prune(ctx, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := l.Since(ctx, 1, 3, 10); ok {
+		t.Error("replay across pruned events reported ok")
+	}
+}
+
+func TestPublishDeliversInSeqOrder(t *testing.T) {
+	const publishers, each = 8, 50
+
+	h := NewHub("test", nil, slowAppendLog{newMemEventLog()})
+	h.sendBuffer = publishers * each
+	c := h.newClient(nil, 1, "alice@x")
+	h.join(c, 1)
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				h.publish(1, "message", []byte(`{"type":"message"}`))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for want := int64(1); want <= publishers*each; want++ {
+		var f struct{ Seq int64 }
+		if err := json.Unmarshal(<-c.send, &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Seq != want {
+			t.Fatalf("got seq %d, want %d", f.Seq, want)
+		}
+	}
+}
+
+// slowAppendLog widens the gap between a seq being assigned and its frame
+// being delivered, the way a database round trip does.
+type slowAppendLog struct{ *memEventLog }
+
+func (l slowAppendLog) Append(ctx context.Context, roomID int64, typ string, frame []byte) (int64, error) {
+	seq, err := l.memEventLog.Append(ctx, roomID, typ, frame)
+	time.Sleep(time.Duration(seq%3) * 100 * time.Microsecond)
+	return seq, err
+}
+
+func TestReplay(t *testing.T) {
+	h := NewHub("test", nil, newMemEventLog())
+	h.replayMax = 3
+	for i := 0; i < 5; i++ {
+		h.publish(1, "message", []byte(`{"type":"message","roomId":1}`))
+	}
+	h.publish(1, "typing", []byte(`{"type":"typing","roomId":1}`)) // not logged
+	ctx := context.Background()
+
+	c, peer := wsClient(t, h, 1, "alice@x")
+	h.replay(ctx, c, 1, 3)
+	for _, want := range []int64{4, 5} {
+		if f := readFrame(t, peer); f.Type != "message" || f.Seq != want {
+			t.Errorf("got %s, want message seq %d", f.raw, want)
+		}
+	}
+	if f := readFrame(t, peer); f.Type != "room_synced" || f.Seq != 5 {
+		t.Errorf("got %s, want room_synced at 5", f.raw)
+	}
+
+	for _, since := range []int64{1, 7} { // too far behind; ahead of the log
+		h.replay(ctx, c, 1, since)
+		if f := readFrame(t, peer); f.Type != "resync_required" || f.Seq != 5 {
+			t.Errorf("since %d: got %s, want resync_required at 5", since, f.raw)
+		}
+	}
+}
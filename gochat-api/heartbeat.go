@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const statusHeartbeatTimeout websocket.StatusCode = 4010 // no pong within WS_PING_TIMEOUT_SECONDS
+
+// pingLoop catches half-open connections: if the peer stops answering pings
+// the socket is closed, which ends handleWS's read loop and runs the normal
+// leave + callRemoveParticipant cleanup.
+func (h *Hub) pingLoop(c *Client) {
+	if h.pingInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(h.pingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.pingTimeout)
+		err := c.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			h.stats.heartbeatTimeouts.Add(1)
+			log.Println("ws: heartbeat timeout for", c.email, err)
+			c.close(statusHeartbeatTimeout, "heartbeat timeout")
+			return
+		}
+	}
+}
+
+// touch records inbound activity. An idle client that does something real
+// (anything but an explicit "presence: idle") becomes active again.
+func (h *Hub) touch(c *Client, in WSIn) {
+	if in.Type == "presence" && in.Status == "idle" {
+		return
+	}
+	c.lastActive.Store(time.Now().UnixMilli())
+
+	if in.Type == "presence" {
+		return // the presence case sets the status itself
+	}
+
+	h.mu.Lock()
+	roomID := c.room
+	wasIdle := roomID != 0 && c.status == "idle"
+	if wasIdle {
+		c.status = "active"
+	}
+	h.mu.Unlock()
+
+	if wasIdle {
+		h.broadcastStatus(roomID, c.email)
+	}
+}
+
+// setStatus changes c's status and reports the room it applies to (0 if the
+// client isn't in a room or nothing changed).
+func (h *Hub) setStatus(c *Client, st string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.room == 0 || c.status == st {
+		return 0
+	}
+	c.status = st
+	return c.room
+}
+
+// broadcastStatus announces email's merged status (active if any tab is)
+// plus the refreshed user_list for roomID.
+func (h *Hub) broadcastStatus(roomID int64, email string) {
+	h.mu.Lock()
+	users := h.listPresencesLocked(roomID)
+	h.mu.Unlock()
+
+	st := "inactive"
+	for _, u := range users {
+		if u.Email == email {
+			st = u.Status
+			break
+		}
+	}
+
+	h.announcePresence(roomID)
+
+	h.broadcast(roomID, WSOut{
+		Type:      "presence",
+		RoomID:    roomID,
+		UserEmail: email,
+		Status:    st,
+	})
+	h.broadcast(roomID, WSOut{
+		Type:   "user_list",
+		RoomID: roomID,
+		Users:  users,
+	})
+}
+
+// runIdleSweeper marks clients idle server-side once they've gone
+// idleAfter without inbound activity, instead of trusting the client to say so.
+func (h *Hub) runIdleSweeper(ctx context.Context) {
+	if h.idleAfter <= 0 {
+		return
+	}
+
+	every := h.idleAfter / 4
+	if every < 5*time.Second {
+		every = 5 * time.Second
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		h.sweepIdle(time.Now().Add(-h.idleAfter))
+	}
+}
+
+// sweepIdle marks clients with no inbound activity since cutoff idle.
+func (h *Hub) sweepIdle(cutoff time.Time) {
+	type change struct {
+		roomID int64
+		email  string
+	}
+	var changed []change
+
+	h.mu.Lock()
+	for roomID, clients := range h.rooms {
+		for c := range clients {
+			if c.status == "idle" || c.lastActive.Load() > cutoff.UnixMilli() {
+				continue
+			}
+			c.status = "idle"
+			changed = append(changed, change{roomID: roomID, email: c.email})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, ch := range changed {
+		h.broadcastStatus(ch.roomID, ch.email)
+	}
+}
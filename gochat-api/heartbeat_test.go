@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatTimeout(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.pingInterval = 20 * time.Millisecond
+	h.pingTimeout = 50 * time.Millisecond
+
+	// a peer that never reads never answers a ping
+	dead, _ := wsClient(t, h, 1, "dead@x")
+	live, peer := wsClient(t, h, 2, "live@x")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer.CloseRead(ctx)
+
+	go h.pingLoop(dead)
+	go h.pingLoop(live)
+
+	select {
+	case <-dead.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unanswered pings didn't close the connection")
+	}
+	if n := h.stats.heartbeatTimeouts.Load(); n != 1 {
+		t.Errorf("heartbeatTimeouts: got %d, want 1", n)
+	}
+	select {
+	case <-live.done:
+		t.Error("a peer answering pings was closed")
+	default:
+	}
+}
+
+func TestIdleSweep(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	alice, _ := dialHub(t, h, 1, "alice@x", false)
+	bob, _ := dialHub(t, h, 2, "bob@x", false)
+	h.join(alice, 1)
+	h.join(bob, 1)
+	alice.lastActive.Store(time.Now().Add(-time.Hour).UnixMilli())
+
+	h.sweepIdle(time.Now().Add(-time.Minute))
+	if st := presenceOf(h, 1, "alice@x"); st != "idle" {
+		t.Errorf("alice after the sweep: %q, want idle", st)
+	}
+	if st := presenceOf(h, 1, "bob@x"); st != "active" {
+		t.Errorf("bob after the sweep: %q, want active", st)
+	}
+
+	// an explicit "still idle" isn't activity; anything else is
+	h.touch(alice, WSIn{Type: "presence", Status: "idle"})
+	if st := presenceOf(h, 1, "alice@x"); st != "idle" {
+		t.Errorf("alice after presence idle: %q, want idle", st)
+	}
+	h.touch(alice, WSIn{Type: "typing"})
+	if st := presenceOf(h, 1, "alice@x"); st != "active" {
+		t.Errorf("alice after typing: %q, want active", st)
+	}
+}
+
+func presenceOf(h *Hub, roomID int64, email string) string {
+	for _, u := range h.listPresences(roomID) {
+		if u.Email == email {
+			return u.Status
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// wsClient connects a real WebSocket to h and registers it the way handleWS
+// does, minus auth and frame handling. It returns the hub's side and the
+// peer's.
+func wsClient(t *testing.T, h *Hub, userID int64, email string) (*Client, *websocket.Conn) {
+	t.Helper()
+	return dialHub(t, h, userID, email, true)
+}
+
+// dialHub is wsClient; writer=false leaves the client's queue undrained.
+func dialHub(t *testing.T, h *Hub, userID int64, email string, writer bool) (*Client, *websocket.Conn) {
+	t.Helper()
+	ready := make(chan *Client, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.beginConn() {
+			http.Error(w, "server restarting", http.StatusServiceUnavailable)
+			return
+		}
+		defer h.endConn()
+
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := h.newClient(conn, userID, email)
+		h.register(c)
+		if writer {
+			go h.writeLoop(c)
+		}
+		ready <- c
+
+		for {
+			if _, _, err := conn.Read(context.Background()); err != nil {
+				break
+			}
+		}
+		h.leave(c)
+		h.unregister(c)
+		c.close(websocket.StatusNormalClosure, "bye")
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.CloseNow() })
+	return <-ready, peer
+}
+
+// wsFrame is the part of an outgoing frame the tests look at.
+type wsFrame struct {
+	Type   string `json:"type"`
+	RoomID int64  `json:"roomId"`
+	Seq    int64  `json:"seq"`
+	Text   string `json:"text"`
+	Event  string `json:"event"`
+
+	raw []byte
+}
+
+// readFrame reads the peer's next frame, failing the test after 5s.
+func readFrame(t *testing.T, peer *websocket.Conn) wsFrame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, b, err := peer.Read(ctx)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var f wsFrame
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatalf("bad frame %s: %v", b, err)
+	}
+	f.raw = b
+	return f
+}
+
+// readUntil skips frames until one of type typ arrives.
+func readUntil(t *testing.T, peer *websocket.Conn, typ string) wsFrame {
+	t.Helper()
+	for {
+		if f := readFrame(t, peer); f.Type == typ {
+			return f
+		}
+	}
+}
+
+func TestSlowConsumerEvicted(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.sendBuffer = 4
+	slow, peer := dialHub(t, h, 1, "slow@x", false)
+	fast, _ := wsClient(t, h, 2, "fast@x")
+	h.join(slow, 1)
+	h.join(fast, 1)
+
+	for i := 0; i < 5; i++ {
+		h.publish(1, "typing", []byte(`{"type":"typing"}`))
+	}
+
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("client with a full queue wasn't evicted")
+	}
+	select {
+	case <-fast.done:
+		t.Fatal("a client keeping up was evicted too")
+	default:
+	}
+	if n := h.stats.clientsEvicted.Load(); n != 1 {
+		t.Errorf("clientsEvicted: got %d, want 1", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := peer.Read(ctx)
+	if websocket.CloseStatus(err) != statusSlowConsumer {
+		t.Errorf("got %v, want close %d", err, statusSlowConsumer)
+	}
+}
+
+func TestLiveFramesHeldDuringReplay(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.sendBuffer = 2
+	c, _ := dialHub(t, h, 1, "alice@x", false)
+
+	// more live frames than the queue holds arrive while the replay is going
+	h.holdLive(c)
+	h.join(c, 1)
+	for i := 0; i < 5; i++ {
+		h.deliverLocal(1, "typing", []byte(fmt.Sprintf(`{"type":"typing","n":%d}`, i)))
+	}
+	if len(c.send) != 0 {
+		t.Fatalf("%d live frames got ahead of the replay", len(c.send))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.releaseLive(c)
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		var f struct{ N int }
+		_ = json.Unmarshal(<-c.send, &f)
+		if f.N != i {
+			t.Fatalf("frame %d came out as %d", i, f.N)
+		}
+	}
+	<-done
+
+	select {
+	case <-c.done:
+		t.Fatal("client evicted for frames held during its replay")
+	default:
+	}
+}
+
+func jsonHas(b []byte, s string) bool { return strings.Contains(string(b), s) }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var validVisibility = map[string]bool{
+	visibilityPublic:     true,
+	visibilityInviteOnly: true,
+	visibilityPrivate:    true,
+}
+
+const (
+	inviteDefaultTTL = 7 * 24 * time.Hour
+	inviteMaxUses    = 10000
+)
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func roomIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return 0, false
+	}
+	return roomID, true
+}
+
+type setVisibilityReq struct {
+	Visibility string `json:"visibility"`
+}
+
+// handleSetVisibility is PUT /rooms/{roomID}/visibility.
+func (s *Server) handleSetVisibility(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var req setVisibilityReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !validVisibility[req.Visibility] {
+		writeErr(w, http.StatusBadRequest, "bad visibility")
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permEditSettings); !ok {
+		return
+	}
+
+	if err := s.store.SetVisibility(r.Context(), roomID, req.Visibility); err != nil {
+		log.Println("handleSetVisibility db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.broadcastSystem(roomID, "🔒 "+emailFromCtx(r)+" made the room "+req.Visibility)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type createInviteReq struct {
+	ExpiresInMinutes *int `json:"expiresInMinutes"` // omitted = 7 days, 0 = never
+	MaxUses          int  `json:"maxUses"`          // 0 = unlimited
+}
+
+type InviteDTO struct {
+	Token     string `json:"token"`
+	RoomID    int64  `json:"roomId"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // unix ms; absent = never
+	MaxUses   int    `json:"maxUses,omitempty"`
+	Uses      int    `json:"uses"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+func inviteDTO(inv Invite) InviteDTO {
+	dto := InviteDTO{Token: inv.Token, RoomID: inv.RoomID, MaxUses: inv.MaxUses, Uses: inv.Uses, CreatedAt: inv.CreatedAt.UnixMilli()}
+	if !inv.ExpiresAt.IsZero() {
+		dto.ExpiresAt = inv.ExpiresAt.UnixMilli()
+	}
+	return dto
+}
+
+// handleCreateInvite is POST /rooms/{roomID}/invites.
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var req createInviteReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	if req.MaxUses < 0 || req.MaxUses > inviteMaxUses {
+		writeErr(w, http.StatusBadRequest, "bad maxUses")
+		return
+	}
+	if req.ExpiresInMinutes != nil && (*req.ExpiresInMinutes < 0 || *req.ExpiresInMinutes > maxModerationMinutes) {
+		writeErr(w, http.StatusBadRequest, "bad expiresInMinutes")
+		return
+	}
+
+	member, ok := s.requirePerm(w, r, roomID, permInvite)
+	if !ok {
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "server error")
+		return
+	}
+	inv := Invite{Token: token, RoomID: roomID, CreatedBy: member.UserID, MaxUses: req.MaxUses, CreatedAt: time.Now()}
+	switch {
+	case req.ExpiresInMinutes == nil:
+		inv.ExpiresAt = time.Now().Add(inviteDefaultTTL)
+	case *req.ExpiresInMinutes > 0:
+		inv.ExpiresAt = time.Now().Add(time.Duration(*req.ExpiresInMinutes) * time.Minute)
+	}
+
+	if err := s.store.CreateInvite(r.Context(), inv); err != nil {
+		log.Println("handleCreateInvite db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, inviteDTO(inv))
+}
+
+// handleListInvites is GET /rooms/{roomID}/invites: links that still work.
+func (s *Server) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permInvite); !ok {
+		return
+	}
+
+	invites, err := s.store.ListInvites(r.Context(), roomID)
+	if err != nil {
+		log.Println("handleListInvites db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	out := make([]InviteDTO, 0, len(invites))
+	for _, inv := range invites {
+		out = append(out, inviteDTO(inv))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleRevokeInvite is DELETE /rooms/{roomID}/invites/{token}.
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permInvite); !ok {
+		return
+	}
+
+	err := s.store.RevokeInvite(r.Context(), roomID, chi.URLParam(r, "token"))
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "invite not found")
+		return
+	}
+	if err != nil {
+		log.Println("handleRevokeInvite db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAcceptInvite is POST /invites/{token}/accept. Works for every
+// visibility; bans still apply.
+func (s *Server) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+	token := chi.URLParam(r, "token")
+
+	inv, err := s.store.GetInvite(r.Context(), token)
+	if errors.Is(err, ErrNotFound) || (err == nil && !inv.usable(time.Now())) {
+		writeErr(w, http.StatusNotFound, "invite not found or expired")
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	// deleted rooms keep their invites until the purge, but they don't work
+	room, err := s.store.GetRoom(r.Context(), inv.RoomID)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "invite not found or expired")
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if _, err := s.store.ActiveBan(r.Context(), inv.RoomID, userID); err == nil {
+		writeErr(w, http.StatusForbidden, "banned from this room")
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	roomID, added, err := s.store.RedeemInvite(r.Context(), token, userID)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "invite not found or expired")
+		return
+	}
+	if err != nil {
+		log.Println("handleAcceptInvite db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if added {
+		s.hub.notifyUser(emailFromCtx(r), userEventRoomAdded, roomID, map[string]any{"name": room.Name})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "joined",
+		"room_id": roomID,
+	})
+}
+
+type joinReq struct {
+	Note string `json:"note"` // shown to approvers of invite_only rooms
+}
+
+// requestJoin files a join request for an invite_only room and pings the
+// people who can approve it.
+func (s *Server) requestJoin(w http.ResponseWriter, r *http.Request, room RoomInfo) {
+	var req joinReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	if len(req.Note) > 500 {
+		writeErr(w, http.StatusBadRequest, "note too long")
+		return
+	}
+
+	created, err := s.store.RequestJoin(r.Context(), room.ID, userIDFromCtx(r), req.Note)
+	if err != nil {
+		log.Println("requestJoin db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if created {
+		if members, err := s.store.ListMembers(r.Context(), room.ID); err == nil {
+			for _, m := range members {
+				if roleCan(m.Role, permManageMembers) {
+					s.hub.notifyUser(m.Email, userEventJoinRequest, room.ID, map[string]any{
+						"email": emailFromCtx(r),
+						"note":  req.Note,
+					})
+				}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"status":  "requested",
+		"room_id": room.ID,
+	})
+}
+
+type JoinRequestDTO struct {
+	UserID    int64  `json:"userId"`
+	Email     string `json:"email"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// handleListJoinRequests is GET /rooms/{roomID}/join-requests.
+func (s *Server) handleListJoinRequests(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permManageMembers); !ok {
+		return
+	}
+
+	reqs, err := s.store.ListJoinRequests(r.Context(), roomID)
+	if err != nil {
+		log.Println("handleListJoinRequests db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	out := make([]JoinRequestDTO, 0, len(reqs))
+	for _, jr := range reqs {
+		out = append(out, JoinRequestDTO{UserID: jr.UserID, Email: jr.Email, Note: jr.Note, CreatedAt: jr.CreatedAt.UnixMilli()})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleApproveJoinRequest is POST /rooms/{roomID}/join-requests/{userID}/approve.
+func (s *Server) handleApproveJoinRequest(w http.ResponseWriter, r *http.Request) {
+	s.resolveJoinRequest(w, r, true)
+}
+
+// handleDenyJoinRequest is POST /rooms/{roomID}/join-requests/{userID}/deny.
+func (s *Server) handleDenyJoinRequest(w http.ResponseWriter, r *http.Request) {
+	s.resolveJoinRequest(w, r, false)
+}
+
+func (s *Server) resolveJoinRequest(w http.ResponseWriter, r *http.Request, approve bool) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	targetID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || targetID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad user id")
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permManageMembers); !ok {
+		return
+	}
+
+	room, err := s.store.GetRoom(r.Context(), roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	target, err := s.store.UserByID(r.Context(), targetID)
+	if err != nil {
+		writeErr(w, http.StatusNotFound, "join request not found")
+		return
+	}
+
+	if approve {
+		if _, err := s.store.ActiveBan(r.Context(), roomID, targetID); err == nil {
+			writeErr(w, http.StatusConflict, "user is banned from this room")
+			return
+		} else if !errors.Is(err, ErrNotFound) {
+			writeErr(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	err = s.store.ResolveJoinRequest(r.Context(), roomID, targetID, approve)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "join request not found")
+		return
+	}
+	if err != nil {
+		log.Println("resolveJoinRequest db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if approve {
+		s.hub.notifyUser(target.Email, userEventRoomAdded, roomID, map[string]any{"name": room.Name})
+		s.broadcastSystem(roomID, "👋 "+target.Email+" joined (approved by "+emailFromCtx(r)+")")
+	} else {
+		s.hub.notifyUser(target.Email, userEventJoinDenied, roomID, map[string]any{"name": room.Name})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
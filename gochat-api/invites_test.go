@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInviteMaxUsesAndExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	_, carol := ts.user("carol@example.com")
+
+	roomID := ts.room(alice, "secret", visibilityPrivate)
+	invites := fmt.Sprintf("/rooms/%d/invites", roomID)
+
+	ts.expect(http.StatusBadRequest, alice, "POST", invites, map[string]int{"maxUses": -1})
+	ts.expect(http.StatusBadRequest, alice, "POST", invites, map[string]int{"expiresInMinutes": -1})
+
+	var once InviteDTO
+	if st, msg := ts.call(alice, "POST", invites, map[string]int{"maxUses": 1}, &once); st != http.StatusCreated {
+		t.Fatalf("create invite: status %d (%q)", st, msg)
+	}
+	if week := time.Now().Add(inviteDefaultTTL).UnixMilli(); once.ExpiresAt < week-60_000 || once.ExpiresAt > week {
+		t.Errorf("default expiry %d, want about %d", once.ExpiresAt, week)
+	}
+
+	ts.expect(http.StatusOK, bob, "POST", "/invites/"+once.Token+"/accept", nil)
+	if msg := ts.expect(http.StatusNotFound, carol, "POST", "/invites/"+once.Token+"/accept", nil); msg != "invite not found or expired" {
+		t.Errorf("used-up invite: error %q", msg)
+	}
+
+	// the API can't mint an already-expired link, so plant one
+	err := ts.s.store.CreateInvite(context.Background(), Invite{
+		Token: "expired", RoomID: roomID, CreatedBy: aliceID,
+		ExpiresAt: time.Now().Add(-time.Minute), CreatedAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusNotFound, carol, "POST", "/invites/expired/accept", nil)
+
+	var forever InviteDTO
+	if st, msg := ts.call(alice, "POST", invites, map[string]int{"expiresInMinutes": 0}, &forever); st != http.StatusCreated {
+		t.Fatalf("create invite: status %d (%q)", st, msg)
+	}
+	if forever.ExpiresAt != 0 {
+		t.Errorf("expiresInMinutes 0: expiresAt %d, want none", forever.ExpiresAt)
+	}
+	ts.expect(http.StatusOK, carol, "POST", "/invites/"+forever.Token+"/accept", nil)
+	ts.expect(http.StatusOK, carol, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil)
+}
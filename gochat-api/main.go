@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"bytes"
 	"fmt"
 	"io"
@@ -21,8 +25,6 @@ import (
 	"github.com/coder/websocket"
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/joho/godotenv"  
@@ -31,10 +33,13 @@ import (
 )
 
 type Server struct {
-  db        *pgxpool.Pool
+  store     Store
   jwtSecret []byte
   hub       *Hub
   uploadsDir string
+  restoreWindow time.Duration // how long a deleted room can be restored
+  pinLimit int // max pinned messages per room
+  hubAdmins map[string]bool // lowercased emails allowed to read /debug/hub (HUB_ADMIN_EMAILS)
 
   callMu sync.Mutex
   calls  map[int64]*CallState // roomID -> state
@@ -54,12 +59,26 @@ type Room struct {
 	Name     string `json:"name"`
 	OwnerID  int64  `json:"owner_id"`
 	IsOwner  bool   `json:"is_owner"`
+	Role     string `json:"role"` // your role in the room (see roles.go)
+	Visibility string `json:"visibility"`
 	CreatedAt time.Time `json:"created_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // only in ?view=deleted
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	AvatarURL string `json:"avatar_url"`
+	Settings RoomSettingsDTO `json:"settings"`
 	UnreadCount int64 `json:"unreadCount"`
+	MentionCount int64 `json:"mentionCount"` // unread mentions of you
+	Kind string `json:"kind"` // room | dm
+	Participants []UserPresence `json:"participants,omitempty"` // ?view=dms: everyone else, with presence
 }
 
 type CreateRoomRequest struct {
 	Name string `json:"name"`
+	Visibility string `json:"visibility"` // public (default) | invite_only | private
+	Topic string `json:"topic"`
+	Description string `json:"description"`
 }
 
 type WSIn struct {
@@ -70,6 +89,9 @@ type WSIn struct {
 	Status   string `json:"status"` // ✅ "active" | "idle"
 	Attachment *Attachment `json:"attachment"`
 	ReplyToID  int64       `json:"replyToId"`
+	RoomIDs    []int64     `json:"roomIds"`  // subscribe / unsubscribe
+	SinceSeq   int64       `json:"sinceSeq"` // join_room: last seq the client saw
+	ClientMsgID string     `json:"clientMsgId"` // message: client-generated idempotency key
 	 // WebRTC signaling
     To   string `json:"to,omitempty"`
     SDP  any    `json:"sdp,omitempty"`
@@ -78,7 +100,7 @@ type WSIn struct {
 
 type UserPresence struct {
 	Email  string `json:"email"`
-	Status string `json:"status"` // "active" | "idle"
+	Status string `json:"status"` // "active" | "idle"; DM participants can also be "offline"
 }
 
 type WSOut struct {
@@ -95,22 +117,92 @@ type WSOut struct {
 	Status    string         `json:"status,omitempty"`
 	Attachment *Attachment   `json:"attachment,omitempty"`
 	ReplyToID int64          `json:"replyToId,omitempty"` // (if you're doing replies)
+	ThreadRootID int64       `json:"threadRootId,omitempty"` // thread a reply is filed under
 	Deleted   bool           `json:"deleted,omitempty"`   // (optional)
 	Call      CallState      `json:"call,omitempty"`
 	Error string `json:"error,omitempty"`
+	Seq   int64  `json:"seq,omitempty"` // latest room seq (room_synced / resync_required)
+	Code     string  `json:"code,omitempty"` // error / message_error / room_evicted: machine-readable reason
+	Ref      string  `json:"ref,omitempty"`  // error: type of the frame that was rejected
+	RoomIDs  []int64 `json:"roomIds,omitempty"`  // subscribed / unsubscribed
+	Rejected []int64 `json:"rejected,omitempty"` // subscribed: rooms refused (not a member / over the cap)
+
+	ClientMsgID string `json:"clientMsgId,omitempty"` // message / message_ack / message_error
+	Duplicate   bool   `json:"duplicate,omitempty"`   // message_ack for an already-stored clientMsgId
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"` // server_restarting: reconnect hint; message_error slow_mode: when to resend
 }
 
 type Hub struct {
 	mu    sync.Mutex
 	rooms map[int64]map[*Client]bool
+	subs  map[int64]map[*Client]bool // background subscriptions (see subscriptions.go)
+	users map[string]map[*Client]bool // lowercased email -> every connection of that user (see userchan.go)
+
+	activityFn      ActivityFunc
+	activityPending map[int64]bool
+
+	onEvict func(roomID int64, c *Client) // focused client removed by evict()
+
+	// cross-node fan-out (see pubsub.go)
+	nodeID string
+	broker Broker
+	remote map[int64]map[string]remotePresence // roomID -> nodeID -> snapshot
+	hooks  map[string]func(roomID int64, b []byte)
+	outbox chan []byte // envelopes waiting for runPublisher
+
+	events    EventLog // nil = no seq stamping / replay
+	replayMax int      // larger gaps get resync_required instead of a replay
+	seqMu     [64]sync.Mutex // by roomID%64: held from Append to delivery, so seqs go out in order
+
+	sendBuffer   int           // per-client outbound queue length
+	writeTimeout time.Duration // deadline for a single WS write
+	stats        hubStats
+
+	pingInterval time.Duration // 0 disables heartbeats
+	pingTimeout  time.Duration
+	idleAfter    time.Duration // 0 disables server-side idle detection
+
+	draining bool           // shutting down: no new WS connections (see shutdown.go)
+	wsConns  sync.WaitGroup // live handleWS calls
 }
 
 type Client struct {
 	conn  *websocket.Conn
+	userID int64
 	email string
-	room  int64
+	room  int64            // focused room: full event stream + presence
+	subs  map[int64]bool   // background rooms: room_activity only (guarded by Hub.mu)
+	members map[int64]memberCacheEntry // membership/role cache by roomID (guarded by Hub.mu)
 	status string
 	send chan []byte
+
+	done      chan struct{} // closed once the client is being torn down
+	closeOnce sync.Once
+	flushed   chan struct{} // closed when writeLoop returns (see drain)
+
+	lastActive atomic.Int64 // unix ms of the last inbound frame that counts as activity
+
+	// while a join_room replay is being written, live frames wait in held
+	// instead of competing with it for send (see holdLive)
+	holdMu  sync.Mutex
+	holding bool
+	held    [][]byte
+}
+
+// WS close codes we send ourselves (4000-4999 is the application range).
+const (
+	statusSlowConsumer websocket.StatusCode = 4008 // outbound queue overflowed
+	statusWriteTimeout websocket.StatusCode = 4009 // a single write exceeded the deadline
+)
+
+// hubStats are exposed on /debug/hub to help tune WS_SEND_BUFFER.
+type hubStats struct {
+	framesSent     atomic.Int64
+	framesDropped  atomic.Int64
+	clientsEvicted atomic.Int64
+	writeErrors    atomic.Int64
+	heartbeatTimeouts atomic.Int64
+	envelopesDropped atomic.Int64 // outbox full: the broker couldn't keep up
 }
 
 type Attachment struct {
@@ -128,14 +220,26 @@ type MessageDTO struct {
 	CreatedAt  int64       `json:"createdAt"` // unix ms
 
 	ReplyToID  int64       `json:"replyToId,omitempty"`
+	ThreadRootID int64     `json:"threadRootId,omitempty"` // thread a reply is filed under
 	Deleted    bool        `json:"deleted,omitempty"`
 
 	Attachment *Attachment `json:"attachment,omitempty"`
 	Edited bool `json:"edited,omitempty"`
+	RevisionCount int64 `json:"revisionCount,omitempty"` // see /messages/{id}/revisions
 	Starred bool `json:"starred,omitempty"`
+	Pinned bool `json:"pinned,omitempty"` // room-wide, see /rooms/{id}/pins
 	Reactions []ReactionDTO `json:"reactions"` 
 	Kind string   `json:"kind"` 
 	Poll *PollDTO `json:"poll,omitempty"`
+
+	// thread roots only (see hydrateThreads)
+	ReplyCount         int64    `json:"replyCount,omitempty"`
+	LastReplyAt        int64    `json:"lastReplyAt,omitempty"` // unix ms
+	ThreadParticipants []string `json:"threadParticipants,omitempty"`
+
+	// search results only
+	Rank    float32 `json:"rank,omitempty"`
+	Snippet string  `json:"snippet,omitempty"` // matched text, HTML-escaped, hits wrapped in <mark></mark>
 }
 
 type StarredMessageDTO struct {
@@ -215,6 +319,9 @@ type CallState struct {
 
   ScreenSharing bool   `json:"screenSharing"`
   ScreenSharer  string `json:"screenSharer"`
+
+  lastEnded int64 // StartedAtMS of the last call that ended here (see applyRemoteCallOp)
+  restored  bool  // taken back from the store at startup, not seen live yet (see restoreCalls)
 }
 
 
@@ -235,43 +342,10 @@ func remove(ss []string, x string) []string {
   return out
 }
 
+// callRemoveParticipant takes email out of roomID's call (disconnects,
+// evictions) and reports whether that ended it.
 func (s *Server) callRemoveParticipant(roomID int64, email string) (ended bool) {
-	s.callMu.Lock()
-	defer s.callMu.Unlock()
-
-	cs := s.getCall(roomID)
-	if !cs.Active {
-		return false
-	}
-
-	cs.Participants = remove(cs.Participants, email)
-
-	// if host left, you can either end call or reassign host:
-	if cs.HostEmail == email {
-		// simplest prototype: end call when host disconnects
-		cs.Active = false
-		cs.HostEmail = ""
-		cs.Participants = nil
-		cs.StartedAtMS = 0
-		return true
-	}
-
-	// if nobody left, end
-	if len(cs.Participants) == 0 {
-		cs.Active = false
-		cs.HostEmail = ""
-		cs.StartedAtMS = 0
-		return true
-	}
-
-
-	if cs.ScreenSharing && cs.ScreenSharer == email {
-		cs.ScreenSharing = false
-		cs.ScreenSharer = ""
-	}
-
-
-	return false
+	return s.callOp(roomID, "leave", email).ended
 }
 
 func (s *Server) getCall(roomID int64) *CallState {
@@ -287,38 +361,23 @@ func (s *Server) getCall(roomID int64) *CallState {
 }
 
 
+// broadcastCallState shows this node's clients in roomID the call as this
+// node sees it. It isn't published: every node applies the same call ops
+// (see calls.go) and renders its own.
 func (s *Server) broadcastCallState(roomID int64) {
-	// Take a snapshot under lock
 	s.callMu.Lock()
-	cs := s.getCall(roomID)
-
-	out := CallState{
-		Active:        cs.Active,
-		RoomID:        roomID,
-		HostEmail:     cs.HostEmail,
-		StartedAtMS:   cs.StartedAtMS,
-		ScreenSharing: cs.ScreenSharing,
-		ScreenSharer:  cs.ScreenSharer,
-	}
-
-	// Always send participants as [] not null
-	if cs.Participants != nil {
-		out.Participants = append([]string(nil), cs.Participants...)
-	} else {
-		out.Participants = []string{}
-	}
-
+	out := s.getCall(roomID).snapshot()
 	s.callMu.Unlock()
+	out.RoomID = roomID
 
-	// Broadcast ONCE
-	s.hub.broadcast(roomID, WSOut{
+	b, _ := json.Marshal(WSOut{
 		Type:   "call_state",
 		RoomID: roomID,
 		Call:   out,
 	})
+	s.hub.deliverLocal(roomID, "call_state", b)
 }
 
-
 func (s *Server) broadcastSystem(roomID int64, text string) {
   
 	s.hub.BroadcastToRoom(roomID, map[string]any{
@@ -342,13 +401,7 @@ func (s *Server) handleBulkStarMessages(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Insert stars; conflicts ignored
-	// NOTE: for pgx, sending []int64 to ANY($2) is okay
-	_, err := s.db.Exec(r.Context(), `
-		INSERT INTO message_stars(user_id, message_id)
-		SELECT $1, unnest($2::bigint[])
-		ON CONFLICT DO NOTHING
-	`, userID, body.MessageIDs)
-	if err != nil {
+	if err := s.store.StarMessages(r.Context(), userID, body.MessageIDs); err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
@@ -365,12 +418,7 @@ func (s *Server) handleBulkUnstarMessages(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	_, err := s.db.Exec(r.Context(), `
-		DELETE FROM message_stars
-		WHERE user_id = $1
-		  AND message_id = ANY($2)
-	`, userID, body.MessageIDs)
-	if err != nil {
+	if err := s.store.UnstarMessages(r.Context(), userID, body.MessageIDs); err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
@@ -388,44 +436,22 @@ func (s *Server) handleBulkDeleteMessages(w http.ResponseWriter, r *http.Request
 	}
 
 	// Update only messages owned by this user + not already deleted
-	// Return ids + room_id so we can broadcast
-	rows, err := s.db.Query(r.Context(), `
-		UPDATE messages
-		SET deleted_at = now(), body = ''
-		WHERE id = ANY($1)
-		  AND user_id = $2
-		  AND deleted_at IS NULL
-		RETURNING id, room_id
-	`, body.MessageIDs, userID)
+	deleted, err := s.store.DeleteOwnMessages(r.Context(), userID, body.MessageIDs)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	defer rows.Close()
-
-	type delRow struct{ mid, rid int64 }
-	var deleted []delRow
-
-	for rows.Next() {
-		var mid, rid int64
-		if err := rows.Scan(&mid, &rid); err != nil {
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-		deleted = append(deleted, delRow{mid: mid, rid: rid})
-	}
-	if err := rows.Err(); err != nil {
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
 
 	// Broadcast same event type your frontend already handles
 	for _, d := range deleted {
-		s.hub.broadcast(d.rid, WSOut{
+		s.hub.broadcast(d.RoomID, WSOut{
 			Type:      "message_deleted",
-			RoomID:    d.rid,
-			MessageID: d.mid,
+			RoomID:    d.RoomID,
+			MessageID: d.ID,
 		})
+		if d.Unpinned {
+			s.broadcastUnpinned(d.RoomID, d.ID, emailFromCtx(r))
+		}
 	}
 
 	// Return list (handy for UI)
@@ -433,7 +459,7 @@ func (s *Server) handleBulkDeleteMessages(w http.ResponseWriter, r *http.Request
 		"deletedIds": func() []int64 {
 			out := make([]int64, 0, len(deleted))
 			for _, d := range deleted {
-				out = append(out, d.mid)
+				out = append(out, d.ID)
 			}
 			return out
 		}(),
@@ -450,32 +476,20 @@ func (s *Server) handleEditPoll(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  var roomID int64
-  var ownerID int64
-  var kind string
-  var pollJSON string
-  err = s.db.QueryRow(r.Context(), `
-    SELECT room_id, user_id, kind, COALESCE(poll::text,'')
-    FROM messages
-    WHERE id=$1 AND deleted_at IS NULL
-  `, msgID).Scan(&roomID, &ownerID, &kind, &pollJSON)
-  if err != nil || kind != "poll" || pollJSON == "" {
+  msg, err := s.store.GetMessage(r.Context(), msgID)
+  if err != nil || msg.Deleted || msg.Kind != "poll" || msg.PollJSON == "" {
     writeErr(w, 404, "poll not found")
     return
   }
+  roomID, pollJSON := msg.RoomID, msg.PollJSON
 
-  if ownerID != userID {
+  if msg.UserID != userID {
     writeErr(w, 403, "only poll creator can edit")
     return
   }
 
-  // must still be room member (optional but recommended)
-  var ok bool
-  _ = s.db.QueryRow(r.Context(), `
-    SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)
-  `, roomID, userID).Scan(&ok)
-  if !ok {
-    writeErr(w, 403, "not a room member")
+  // must still be a member allowed to post
+  if _, ok := s.requirePerm(w, r, roomID, permPost); !ok {
     return
   }
 
@@ -511,14 +525,24 @@ func (s *Server) handleEditPoll(w http.ResponseWriter, r *http.Request) {
   }
   _ = json.Unmarshal([]byte(pollJSON), &old)
 
+  // votes follow their option's text; options that are gone lose theirs
+  remap := make([]int, len(old.Options))
+  taken := make([]bool, len(opts))
   optionsChanged := len(old.Options) != len(opts)
-  if !optionsChanged {
-    for i := range opts {
-      if old.Options[i].Text != opts[i] {
-        optionsChanged = true
+  for i, o := range old.Options {
+    remap[i] = -1
+    for j, t := range opts {
+      if !taken[j] && t == o.Text {
+        remap[i], taken[j] = j, true
         break
       }
     }
+    if remap[i] != i {
+      optionsChanged = true
+    }
+  }
+  if !optionsChanged {
+    remap = nil
   }
 
   // build new poll json
@@ -534,42 +558,35 @@ func (s *Server) handleEditPoll(w http.ResponseWriter, r *http.Request) {
   }
   pollBytes, _ := json.Marshal(stored)
 
-  // transaction: update poll + maybe reset votes
-  tx, err := s.db.Begin(r.Context())
-  if err != nil { writeErr(w, 500, "db error"); return }
-  defer tx.Rollback(r.Context())
-
-  if _, err := tx.Exec(r.Context(), `
-    UPDATE messages
-    SET poll = $2::jsonb, edited_at = now()
-    WHERE id = $1
-  `, msgID, string(pollBytes)); err != nil {
-    writeErr(w, 500, "db error")
+  // update poll + move votes to where their options went
+  err = s.store.UpdatePoll(r.Context(), msgID, userID, string(pollBytes), remap)
+  if errors.Is(err, ErrNotFound) {
+    writeErr(w, 404, "poll not found")
     return
   }
-
-  if optionsChanged {
-    if _, err := tx.Exec(r.Context(), `DELETE FROM poll_votes WHERE message_id=$1`, msgID); err != nil {
-      writeErr(w, 500, "db error")
-      return
-    }
+  if err != nil {
+    writeErr(w, 500, "db error")
+    return
   }
 
-  if err := tx.Commit(r.Context()); err != nil {
+  // return updated poll with the counts that survived + myVote
+  tallies, err := s.store.PollTallies(r.Context(), []int64{msgID}, userID)
+  if err != nil {
     writeErr(w, 500, "db error")
     return
   }
-
-  // return updated poll with counts (0 if reset) + myVote (-1 if reset)
-  // easiest: reuse your vote handler’s “counts + myVote” builder logic here
+  tally, ok := tallies[msgID]
+  if !ok {
+    tally.MyVote = -1
+  }
 
   outPoll := &PollDTO{
     Question: body.Question,
     Options:  make([]PollOptionDTO, 0, len(opts)),
-    MyVote:   -1,
+    MyVote:   tally.MyVote,
   }
-  for _, t := range opts {
-    outPoll.Options = append(outPoll.Options, PollOptionDTO{Text: t, Count: 0})
+  for i, t := range opts {
+    outPoll.Options = append(outPoll.Options, PollOptionDTO{Text: t, Count: tally.Counts[i]})
   }
 
   s.hub.BroadcastToRoom(roomID, map[string]any{
@@ -577,20 +594,44 @@ func (s *Server) handleEditPoll(w http.ResponseWriter, r *http.Request) {
     "roomId":    roomID,
     "messageId": msgID,
     "poll":      outPoll,
+    "userEmail": emailFromCtx(r),
   })
 
   writeJSON(w, 200, map[string]any{
     "messageId": msgID,
     "poll":      outPoll,
-    "resetVotes": optionsChanged,
   })
 }
 
-func (c *Client) writeLoop() {
-  ctx := context.Background()
-  for b := range c.send {
-    _ = c.conn.Write(ctx, websocket.MessageText, b)
-  }
+// writeLoop drains c.send onto the socket. A nil frame is drain's goodbye:
+// everything queued before it has been written, so close the connection.
+func (h *Hub) writeLoop(c *Client) {
+	defer close(c.flushed)
+	for {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.send:
+			if b == nil {
+				c.close(websocket.StatusGoingAway, "server restarting")
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), h.writeTimeout)
+			err := c.conn.Write(ctx, websocket.MessageText, b)
+			cancel()
+			if err != nil {
+				h.stats.writeErrors.Add(1)
+				if errors.Is(err, context.DeadlineExceeded) {
+					c.close(statusWriteTimeout, "write timeout")
+				} else {
+					// the connection is already gone; there's no one to send a close frame to
+					c.abort()
+				}
+				return
+			}
+			h.stats.framesSent.Add(1)
+		}
+	}
 }
 
 func (s *Server) handleListMessageReactions(w http.ResponseWriter, r *http.Request) {
@@ -604,41 +645,21 @@ func (s *Server) handleListMessageReactions(w http.ResponseWriter, r *http.Reque
 	}
 
 	// ✅ ensure the requester is a member of the room containing this message
-	var roomID int64
-	if err := s.db.QueryRow(r.Context(), `SELECT room_id FROM messages WHERE id=$1`, msgID).Scan(&roomID); err != nil {
+	msg, err := s.store.GetMessage(r.Context(), msgID)
+	if err != nil {
 		writeErr(w, http.StatusNotFound, "message not found")
 		return
 	}
-	var ok bool
-	if err := s.db.QueryRow(r.Context(), `
-		SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)
-	`, roomID, userID).Scan(&ok); err != nil || !ok {
+	if ok, err := s.store.IsMember(r.Context(), msg.RoomID, userID); err != nil || !ok {
 		writeErr(w, http.StatusForbidden, "not a room member")
 		return
 	}
 
-	rows, err := s.db.Query(r.Context(), `
-		SELECT mr.emoji, u.email
-		FROM message_reactions mr
-		JOIN users u ON u.id = mr.user_id
-		WHERE mr.message_id = $1
-		ORDER BY mr.emoji, u.email
-	`, msgID)
+	byEmoji, err := s.store.ReactionUsers(r.Context(), msgID)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	defer rows.Close()
-
-	byEmoji := map[string][]string{}
-	for rows.Next() {
-		var emoji, email string
-		if err := rows.Scan(&emoji, &email); err != nil {
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-		byEmoji[emoji] = append(byEmoji[emoji], email)
-	}
 
 	out := MessageReactionsDetailDTO{MessageID: msgID}
 	for emoji, users := range byEmoji {
@@ -648,73 +669,27 @@ func (s *Server) handleListMessageReactions(w http.ResponseWriter, r *http.Reque
 	writeJSON(w, http.StatusOK, out)
 }
 
-func toggleReaction(ctx context.Context, db *pgxpool.Pool, roomID, messageID, userID int64, emoji string) (added bool, newCount int64, err error) {
-  tx, err := db.Begin(ctx)
-  if err != nil {
-    return false, 0, err
-  }
-  defer func() {
-    if err != nil {
-      _ = tx.Rollback(ctx)
-    }
-  }()
-
-  // Try delete first (toggle behavior)
-  tag, err := tx.Exec(ctx,
-    `DELETE FROM message_reactions
-     WHERE message_id=$1 AND user_id=$2 AND emoji=$3`,
-    messageID, userID, emoji,
-  )
-  if err != nil {
-    return false, 0, err
-  }
-
-  if tag.RowsAffected() > 0 {
-    added = false
-  } else {
-    _, err = tx.Exec(ctx,
-      `INSERT INTO message_reactions(message_id, user_id, emoji)
-       VALUES ($1, $2, $3)
-       ON CONFLICT DO NOTHING`,
-      messageID, userID, emoji,
-    )
-    if err != nil {
-      return false, 0, err
-    }
-    added = true
-  }
-
-  // Count current reactions for that emoji on that message
-  err = tx.QueryRow(ctx,
-    `SELECT COUNT(*) FROM message_reactions WHERE message_id=$1 AND emoji=$2`,
-    messageID, emoji,
-  ).Scan(&newCount)
-  if err != nil {
-    return false, 0, err
-  }
-
-  if err = tx.Commit(ctx); err != nil {
-    return false, 0, err
-  }
-  return added, newCount, nil
-}
-
 func (h *Hub) BroadcastToRoom(roomID int64, v any) {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return
 	}
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	h.publish(roomID, frameType(b), b)
+}
 
+// deliverLocal queues b for every client connected to this node in roomID,
+// and nudges background subscribers with room_activity.
+func (h *Hub) deliverLocal(roomID int64, typ string, b []byte) {
+	h.mu.Lock()
 	clients := h.rooms[roomID]
 	for c := range clients {
-		select {
-		case c.send <- b:
-		default:
-			// drop or disconnect slow client
-		}
+		h.enqueue(c, b)
+	}
+	h.mu.Unlock()
+
+	if activityEvents[typ] {
+		h.roomActivity(roomID)
 	}
 }
 
@@ -731,7 +706,16 @@ func (s *Server) handleToggleReaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	added, count, err := toggleReaction(r.Context(), s.db, body.RoomID, body.MessageID, userID, body.Emoji)
+	msg, err := s.store.GetMessage(r.Context(), body.MessageID)
+	if err != nil || msg.RoomID != body.RoomID {
+		writeErr(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if _, ok := s.requirePerm(w, r, body.RoomID, permReact); !ok {
+		return
+	}
+
+	added, count, err := s.store.ToggleReaction(r.Context(), body.MessageID, userID, body.Emoji)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
@@ -773,10 +757,10 @@ func (s *Server) handleListStarred(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromCtx(r)
 	log.Println("handleListStarred userID=", userID)
 
-	limit := int32(50)
+	limit := 50
 	if v := r.URL.Query().Get("limit"); v != "" {
 		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
-			limit = int32(n)
+			limit = n
 		}
 	}
 
@@ -793,96 +777,12 @@ func (s *Server) handleListStarred(w http.ResponseWriter, r *http.Request) {
 		before = time.Now().Add(24 * time.Hour) // safely in the future
 	}
 
-	rows, err := s.db.Query(r.Context(), `
-		SELECT
-			m.id,
-			m.room_id,
-			COALESCE(r.name, '') AS room_name,
-			u.email,
-			m.body,
-			(EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
-			COALESCE(m.reply_to_id, 0) AS reply_to_id,
-			(m.deleted_at IS NOT NULL) AS deleted,
-			(m.edited_at IS NOT NULL) AS edited,
-			TRUE AS starred,
-			m.attachment_url,
-			m.attachment_mime,
-			m.attachment_filename,
-			COALESCE(m.attachment_size, 0)
-		FROM message_stars ms
-		JOIN messages m ON m.id = ms.message_id
-		JOIN users u ON u.id = m.user_id
-		LEFT JOIN rooms r ON r.id = m.room_id
-		-- safety: only return messages in rooms you're a member of
-	
-		WHERE ms.user_id = $1 AND ms.created_at < $2
-		ORDER BY ms.created_at DESC
-		LIMIT $3
-	`, userID, before, limit)
+	out, err := s.store.ListStarred(r.Context(), userID, before, limit)
 	if err != nil {
 		log.Println("handleListStarred db error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	defer rows.Close()
-
-	out := []StarredMessageDTO{}
-
-	for rows.Next() {
-		var m StarredMessageDTO
-		var createdMS int64
-		var replyToID int64
-		var deleted, edited, starred bool
-		var url, mime, filename *string
-		var size int64
-
-		if err := rows.Scan(
-			&m.ID,
-			&m.RoomID,
-			&m.RoomName,
-			&m.UserEmail,
-			&m.Body,
-			&createdMS,
-			&replyToID,
-			&deleted,
-			&edited,
-			&starred,
-			&url,
-			&mime,
-			&filename,
-			&size,
-		); err != nil {
-			log.Println("handleListStarred scan error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-
-		m.CreatedAt = createdMS
-		m.ReplyToID = replyToID
-		m.Deleted = deleted
-		m.Edited = edited
-		m.Starred = starred
-
-		if m.Deleted {
-			m.Body = ""
-			m.Attachment = nil
-		} else if url != nil && *url != "" {
-			m.Attachment = &Attachment{
-				URL:      *url,
-				Mime:     derefStr(mime),
-				Filename: derefStr(filename),
-				Size:     size,
-			}
-		}
-
-		out = append(out, m)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Println("handleListStarred rows error:", err)
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
 
 	log.Println("handleListStarred returning", len(out), "rows")
 
@@ -898,18 +798,23 @@ func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
 
 	userID := userIDFromCtx(r)
 
-	var roomID int64
-	var msgUserID int64
-	err := s.db.QueryRow(r.Context(), `SELECT room_id, user_id FROM messages WHERE id=$1`, mid).
-		Scan(&roomID, &msgUserID)
+	msg, err := s.store.GetMessage(r.Context(), mid)
 	if err != nil {
 		writeErr(w, http.StatusNotFound, "not found")
 		return
 	}
-	if msgUserID != userID {
+	if msg.Deleted {
+		writeErr(w, http.StatusConflict, "message was deleted")
+		return
+	}
+	roomID := msg.RoomID
+	if msg.UserID != userID {
 		writeErr(w, http.StatusForbidden, "not allowed")
 		return
 	}
+	if _, ok := s.requirePerm(w, r, roomID, permPost); !ok {
+		return
+	}
 
 	var req editReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -926,14 +831,16 @@ func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = s.db.Exec(r.Context(),
-		`UPDATE messages SET body=$1, edited_at=now() WHERE id=$2`,
-		req.Body, mid,
-	)
+	changed, err := s.store.EditMessage(r.Context(), mid, userID, req.Body)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
+	if !changed {
+		// same body: no revision, nothing to tell the room
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
 	// Broadcast to everyone in room
 	s.hub.broadcast(roomID, WSOut{
@@ -944,6 +851,9 @@ func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
 		// You can also include EditedAt if you add it to WSOut
 	})
 
+	// mentions follow the new body: dropped ones go away, new ones get notified
+	s.recordMentions(r.Context(), roomID, mid, userID, emailFromCtx(r), req.Body, true)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -980,31 +890,140 @@ func cors(next http.Handler) http.Handler {
 	})
 }
 
-func NewHub() *Hub {
-	return &Hub{rooms: make(map[int64]map[*Client]bool)}
+func NewHub(nodeID string, broker Broker, events EventLog) *Hub {
+	if broker == nil {
+		broker = localBroker{}
+	}
+	return &Hub{
+		rooms:  make(map[int64]map[*Client]bool),
+		subs:   make(map[int64]map[*Client]bool),
+		users:  make(map[string]map[*Client]bool),
+		activityPending: make(map[int64]bool),
+		nodeID: nodeID,
+		broker: broker,
+		remote: make(map[int64]map[string]remotePresence),
+		hooks:  make(map[string]func(roomID int64, b []byte)),
+		outbox: make(chan []byte, publishQueueLen),
+		events: events,
+		replayMax: 500,
+		sendBuffer: 32,
+		writeTimeout: 10 * time.Second,
+		pingInterval: 25 * time.Second,
+		pingTimeout: 10 * time.Second,
+		idleAfter: 5 * time.Minute,
+	}
+}
+
+func (h *Hub) newClient(conn *websocket.Conn, userID int64, email string) *Client {
+	c := &Client{
+		conn:  conn,
+		userID: userID,
+		email: email,
+		send:  make(chan []byte, h.sendBuffer),
+		done:  make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+	c.lastActive.Store(time.Now().UnixMilli())
+	return c
+}
+
+// close tears the client down once; the read loop in handleWS then errors out
+// and runs the usual leave/call cleanup.
+func (c *Client) close(code websocket.StatusCode, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		// Close waits for the peer's close frame; don't make callers wait on it
+		go c.conn.Close(code, reason)
+	})
+}
+
+// abort drops the connection without a close handshake, for when it's
+// already broken.
+func (c *Client) abort() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.CloseNow()
+	})
+}
+
+// enqueue never blocks: a full queue means the client can't keep up with the
+// room, so it gets evicted instead of silently missing frames.
+func (h *Hub) enqueue(c *Client, b []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	c.holdMu.Lock()
+	holding, room := c.holding, len(c.held) < h.replayMax
+	if holding && room {
+		c.held = append(c.held, b)
+	}
+	c.holdMu.Unlock()
+	if holding {
+		if !room {
+			h.evictSlow(c, "held frames over WS_REPLAY_MAX during replay")
+		}
+		return
+	}
+
+	select {
+	case c.send <- b:
+	case <-c.done:
+	default:
+		h.evictSlow(c, fmt.Sprint("queue full at ", cap(c.send)))
+	}
+}
+
+func (h *Hub) evictSlow(c *Client, why string) {
+	h.stats.framesDropped.Add(1)
+	h.stats.clientsEvicted.Add(1)
+	log.Println("ws: evicting slow consumer", c.email, why)
+	c.close(statusSlowConsumer, "slow consumer")
 }
 
+// join focuses c on roomID, as active. c.room and c.status are shared with
+// evictions and the idle sweeper, so they're only touched under h.mu.
 func (h *Hub) join(c *Client, roomID int64) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
 	if h.rooms[roomID] == nil {
 		h.rooms[roomID] = make(map[*Client]bool)
 	}
 	h.rooms[roomID][c] = true
 	c.room = roomID
+	c.status = "active"
+	h.mu.Unlock()
+
+	h.announcePresence(roomID)
 }
 
 
-func (h *Hub) leave(c *Client) {
-    oldRoom := c.room
-    if oldRoom == 0 {
-        return
-    }
+// focusedRoom is c's focused room, 0 if none.
+func (h *Hub) focusedRoom(c *Client) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return c.room
+}
+
+// leave unfocuses c and returns the room it left (0 if it wasn't in one, or
+// something else, like an eviction, got there first).
+func (h *Hub) leave(c *Client) int64 {
+    return h.leaveRoom(c, 0)
+}
 
+// leaveRoom is leave, but only if c is still focused on only (0 = any room).
+func (h *Hub) leaveRoom(c *Client, only int64) int64 {
     // snapshot built while holding lock
     var users []UserPresence
 
     h.mu.Lock()
+    oldRoom := c.room
+    if oldRoom == 0 || (only != 0 && oldRoom != only) {
+        h.mu.Unlock()
+        return 0
+    }
+
     // remove client from room
     if m := h.rooms[oldRoom]; m != nil {
         delete(m, c)
@@ -1018,6 +1037,8 @@ func (h *Hub) leave(c *Client) {
     users = h.listPresencesLocked(oldRoom)
     h.mu.Unlock()
 
+    h.announcePresence(oldRoom)
+
     // broadcast AFTER unlock
     h.broadcast(oldRoom, WSOut{
         Type:      "presence",
@@ -1031,6 +1052,7 @@ func (h *Hub) leave(c *Client) {
         RoomID: oldRoom,
         Users:  users,
     })
+    return oldRoom
 }
 
 
@@ -1046,61 +1068,135 @@ func (h *Hub) broadcastExcept(roomID int64, except *Client, msg WSOut) {
 
     b, _ := json.Marshal(msg)
     for _, c := range conns {
-        _ = c.conn.Write(context.Background(), websocket.MessageText, b)
+        h.enqueue(c, b)
     }
 }
 
 func (h *Hub) broadcast(roomID int64, msg WSOut) {
+	b, _ := json.Marshal(msg)
+	h.publish(roomID, msg.Type, b)
+}
+
+// handleHubStats is GET /debug/hub, for the HUB_ADMIN_EMAILS accounts only;
+// everyone else gets a 404 so the endpoint isn't advertised.
+func (s *Server) handleHubStats(w http.ResponseWriter, r *http.Request) {
+	if !s.hubAdmins[strings.ToLower(emailFromCtx(r))] {
+		writeErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	h := s.hub
+
 	h.mu.Lock()
-	conns := make([]*Client, 0, len(h.rooms[roomID]))
-	for c := range h.rooms[roomID] {
-		conns = append(conns, c)
+	clients := map[*Client]bool{}
+	for _, m := range h.rooms {
+		for c := range m {
+			clients[c] = true
+		}
 	}
+	rooms := len(h.rooms)
 	h.mu.Unlock()
 
-	b, _ := json.Marshal(msg)
-	for _, c := range conns {
-		_ = c.conn.Write(context.Background(), websocket.MessageText, b)
-	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"nodeId":         h.nodeID,
+		"rooms":          rooms,
+		"clients":        len(clients),
+		"sendBuffer":     h.sendBuffer,
+		"writeTimeoutMs": h.writeTimeout.Milliseconds(),
+		"framesSent":     h.stats.framesSent.Load(),
+		"framesDropped":  h.stats.framesDropped.Load(),
+		"clientsEvicted": h.stats.clientsEvicted.Load(),
+		"writeErrors":    h.stats.writeErrors.Load(),
+		"heartbeatTimeouts": h.stats.heartbeatTimeouts.Load(),
+		"envelopesDropped": h.stats.envelopesDropped.Load(),
+	})
 }
 
 func (h *Hub) listPresences(roomID int64) []UserPresence {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	return h.listPresencesLocked(roomID)
-
-	out := []UserPresence{}
-	for c := range h.rooms[roomID] {
-		st := c.status
-		if st == "" {
-			st = "active"
-		}
-		out = append(out, UserPresence{Email: c.email, Status: st})
-	}
-	return out
 }
 
 func (h *Hub) sendToClient(c *Client, msg WSOut) {
 	b, _ := json.Marshal(msg)
-	// _ = c.conn.Write(context.Background(), websocket.MessageText, b)
+	h.sendWait(c, b)
+}
+
+// sendWait queues a reply to c's own request. Unlike room fan-out it waits for
+// room in the queue: the only goroutine it can stall is c's read loop.
+func (h *Hub) sendWait(c *Client, b []byte) {
+	select {
+	case c.send <- b:
+	case <-c.done:
+	}
+}
+
+// replay sends c everything logged in roomID after sinceSeq, then a
+// room_synced marker with the latest seq. The client is already joined, so
+// live frames may duplicate replayed ones (dedupe by seq); they're held until
+// releaseLive rather than interleaved.
+func (h *Hub) replay(ctx context.Context, c *Client, roomID, sinceSeq int64) {
+	if h.events == nil {
+		return
+	}
+
+	frames, lastSeq, ok, err := h.events.Since(ctx, roomID, sinceSeq, h.replayMax)
+	if err != nil {
+		log.Println("replay error:", err)
+		ok = false
+	}
+	if !ok {
+		h.sendToClient(c, WSOut{Type: "resync_required", RoomID: roomID, Seq: lastSeq})
+		return
+	}
+
+	for _, b := range frames {
+		h.sendWait(c, b)
+	}
+	h.sendToClient(c, WSOut{Type: "room_synced", RoomID: roomID, Seq: lastSeq})
+}
 
-	c.send <- b
+// holdLive parks c's live frames until releaseLive, so a replay that fills
+// the send queue isn't mistaken for a slow consumer. Call it before joining
+// the room so nothing live gets ahead of the replay.
+func (h *Hub) holdLive(c *Client) {
+	c.holdMu.Lock()
+	c.holding = true
+	c.holdMu.Unlock()
+}
+
+// releaseLive writes out what piled up during the replay, in order, then
+// lets live frames through again. Like replay, it waits for queue space.
+func (h *Hub) releaseLive(c *Client) {
+	for {
+		c.holdMu.Lock()
+		batch := c.held
+		c.held = nil
+		if len(batch) == 0 {
+			c.holding = false
+			c.holdMu.Unlock()
+			return
+		}
+		c.holdMu.Unlock()
+
+		for _, b := range batch {
+			h.sendWait(c, b)
+		}
+	}
 }
 
 func (h *Hub) listPresencesLocked(roomID int64) []UserPresence {
     m := h.rooms[roomID]
-    if m == nil {
+    if m == nil && h.remote[roomID] == nil {
         return nil
     }
 
     // Deduplicate by email (multiple tabs = multiple clients)
     seen := map[string]UserPresence{}
-    for c := range m {
-        em := c.email
+    add := func(em, st string) {
         if em == "" {
-            continue
+            return
         }
-        st := c.status
         if st == "" {
             st = "active"
         }
@@ -1110,11 +1206,21 @@ func (h *Hub) listPresencesLocked(roomID int64) []UserPresence {
             if prev.Status == "idle" && st == "active" {
                 seen[em] = UserPresence{Email: em, Status: "active"}
             }
-            continue
+            return
         }
         seen[em] = UserPresence{Email: em, Status: st}
     }
 
+    for c := range m {
+        add(c.email, c.status)
+    }
+    // users connected to other nodes
+    for _, rp := range h.remote[roomID] {
+        for _, p := range rp.Users {
+            add(p.Email, p.Status)
+        }
+    }
+
     out := make([]UserPresence, 0, len(seen))
     for _, p := range seen {
         out = append(out, p)
@@ -1138,86 +1244,64 @@ func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var roomID int64
-	err := s.db.QueryRow(r.Context(),
-		`INSERT INTO rooms (name, created_by) VALUES ($1, $2) RETURNING id`,
-		name, userID,
-	).Scan(&roomID)
-	if err != nil {
-		writeErr(w, http.StatusInternalServerError, "db error")
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = visibilityPublic
+	}
+	if !validVisibility[visibility] {
+		writeErr(w, http.StatusBadRequest, "bad visibility")
+		return
+	}
+	topic, description := strings.TrimSpace(req.Topic), strings.TrimSpace(req.Description)
+	if len(topic) > maxTopicLen || len(description) > maxDescriptionLen {
+		writeErr(w, http.StatusBadRequest, "topic or description too long")
 		return
 	}
 
 	// creator becomes a member (owner)
-	_, err = s.db.Exec(r.Context(),
-		`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, 'owner')
-		 ON CONFLICT (room_id, user_id) DO NOTHING`,
-		roomID, userID,
-	)
+	roomID, err := s.store.CreateRoom(r.Context(), NewRoom{
+		Name: name, OwnerID: userID, Visibility: visibility,
+		Topic: topic, Description: description,
+	})
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
 
+	s.hub.notifyUser(emailFromCtx(r), userEventRoomAdded, roomID, map[string]any{"name": name})
+
 	writeJSON(w, http.StatusCreated, map[string]any{
-		"id":   roomID,
-		"name": name,
+		"id":         roomID,
+		"name":       name,
+		"visibility": visibility,
 	})
 }
 
 func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromCtx(r)
 
-	rows, err := s.db.Query(r.Context(), `
-		SELECT
-  r.id,
-  r.name,
-  r.created_by,
-  (r.created_by = $1) AS is_owner,
-  r.created_at,
-  COALESCE((
-    SELECT COUNT(*)
-    FROM messages m
-    LEFT JOIN room_reads rr ON rr.room_id = r.id AND rr.user_id = $1
-    WHERE m.room_id = r.id
-      AND m.id > COALESCE(rr.last_read_message_id, 0)
-      AND m.deleted_at IS NULL
-  ), 0)::bigint AS unread_count
-FROM rooms r
-JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = $1
-ORDER BY r.id DESC;
-	`, userID)
+	// ?view=archived|all|deleted|dms; archived rooms and DMs are left out by default
+	view := r.URL.Query().Get("view")
+	switch view {
+	case "":
+		view = roomViewActive
+	case roomViewActive, roomViewArchived, roomViewAll, roomViewDeleted, roomViewDMs:
+	default:
+		writeErr(w, http.StatusBadRequest, "bad view")
+		return
+	}
 
+	out, err := s.store.ListRooms(r.Context(), userID, view)
 	if err != nil {
 		log.Println("handleListRooms query error:", err) // ✅ add
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-
-	defer rows.Close()
-
-	out := []Room{}
-	for rows.Next() {
-		var it Room
-if err := rows.Scan(
-  &it.ID,
-  &it.Name,
-  &it.OwnerID,
-  &it.IsOwner,
-  &it.CreatedAt,
-  &it.UnreadCount,
-); err != nil {
-			log.Println("handleListRooms scan error:", err) // ✅ add
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-			}
-			out = append(out, it)
-		}
-		if err := rows.Err(); err != nil {
-			log.Println("handleListRooms rows error:", err) // ✅ add
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
+	for i := range out {
+		for j, p := range out[i].Participants {
+			out[i].Participants[j].Status = s.hub.userStatus(p.Email)
 		}
+	}
 
 	writeJSON(w, http.StatusOK, out)
 }
@@ -1232,11 +1316,10 @@ func (s *Server) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// only creator can delete
-	var ownerID int64
-	err = s.db.QueryRow(r.Context(), `SELECT created_by FROM rooms WHERE id=$1`, roomID).Scan(&ownerID)
+	// only the owner can delete
+	room, err := s.store.GetRoom(r.Context(), roomID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, ErrNotFound) {
 			writeErr(w, http.StatusNotFound, "room not found")
 			return
 		}
@@ -1244,19 +1327,32 @@ func (s *Server) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ownerID != userID {
-		writeErr(w, http.StatusForbidden, "only room creator can delete")
+	if role, err := s.roomRole(r.Context(), roomID, userID); err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	} else if role != roleOwner {
+		writeErr(w, http.StatusForbidden, "only room owner can delete")
 		return
 	}
 
-	_, err = s.db.Exec(r.Context(), `DELETE FROM rooms WHERE id=$1`, roomID)
+	// grab members before the room disappears from view
+	members, err := s.store.MemberEmails(r.Context(), roomID)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
 
-	// cascades will remove room_members/messages due to ON DELETE CASCADE
-	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	// soft delete: runRoomPurger removes it for good once restoreWindow is up
+	if err := s.store.SoftDeleteRoom(r.Context(), roomID); err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	restoreUntil := time.Now().Add(s.restoreWindow).UnixMilli()
+
+	s.hub.evict(roomID, 0, "room_deleted")
+	s.hub.notifyUsers(members, userEventRoomDeleted, roomID, map[string]any{"name": room.Name, "restoreUntil": restoreUntil})
+
+	writeJSON(w, http.StatusOK, map[string]any{"status": "deleted", "restore_until": restoreUntil})
 }
 
 func nullIfZero(v int64) any {
@@ -1264,6 +1360,11 @@ func nullIfZero(v int64) any {
   return v
 }
 
+func nullIfEmpty(v string) any {
+  if v == "" { return nil }
+  return v
+}
+
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 
 	tokenStr := r.URL.Query().Get("token")
@@ -1294,6 +1395,13 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 
+	if !s.hub.beginConn() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "server restarting", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.hub.endConn()
+
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{
 			"http://localhost:5173",
@@ -1307,20 +1415,24 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close(websocket.StatusNormalClosure, "bye")
 
-	client := &Client{conn: conn, email: email, send: make(chan []byte, 32)}
-	go client.writeLoop()
+	client := s.hub.newClient(conn, userID, email)
+	s.hub.register(client)
+	go s.hub.writeLoop(client)
+	go s.hub.pingLoop(client)
 
 
 	defer func() {
-		// capture before leave() resets room to 0
-		roomID := client.room
 		em := client.email
 
 		// 1) leave room -> broadcasts presence inactive + refreshed user_list
-		s.hub.leave(client)
-
-		// 2) remove from call state and broadcast call updates
-		if roomID != 0 && em != "" {
+		roomID := s.hub.leave(client)
+		s.hub.unsubscribeAll(client)
+		s.hub.unregister(client)
+
+		// 2) remove from call state and broadcast call updates. Not when
+		// we're shutting down: the call was saved with them in it, and
+		// they'll be back on whichever node they reconnect to.
+		if roomID != 0 && em != "" && !s.hub.isDraining() {
 			ended := s.callRemoveParticipant(roomID, em)
 
 			s.broadcastCallState(roomID)
@@ -1330,7 +1442,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		close(client.send)
+		client.close(websocket.StatusNormalClosure, "bye")
 	}()
 
 
@@ -1344,6 +1456,28 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 		if err := json.Unmarshal(data, &in); err != nil {
 			continue
 		}
+		s.hub.touch(client, in)
+
+		var member Member
+		if roomScopedEvents[in.Type] {
+			m, err := s.authorizeRoom(r.Context(), client, in.RoomID)
+			if err != nil {
+				log.Println("ws authorize error:", err)
+				s.rejectWS(client, in, "server_error", "server error")
+				continue
+			}
+			if m.Role == "" {
+				s.rejectWS(client, in, "not_member", "not a room member")
+				continue
+			}
+			member = m
+			if p, gated := wsPermissions[in.Type]; gated {
+				if code := denyReason(member, p); code != "" {
+					s.rejectWS(client, in, code, denyMessages[code])
+					continue
+				}
+			}
+		}
 
 		// ✅ THIS is the “message switch”
 		switch in.Type {
@@ -1353,17 +1487,28 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 				}
 
 				// if already in that room, ignore
-				if client.room == in.RoomID {
+				current := s.hub.focusedRoom(client)
+				if current == in.RoomID {
 					continue
 				}
 
 				// if switching rooms, leave old one first (optional)
-				if client.room != 0 && client.room != in.RoomID {
+				if current != 0 {
 					s.hub.leave(client)
 				}
-				client.status = "active" // ✅ default when joining
+				s.hub.holdLive(client)
 				s.hub.join(client, in.RoomID)
 
+				// a kick can land between the check above and the join. It
+				// evicts whoever is in the room by the time it gets there, so
+				// asking the store again now that we're in closes the gap.
+				if m, err := s.roomMember(r.Context(), in.RoomID, userID); err != nil || m.Role == "" {
+					s.hub.leaveRoom(client, in.RoomID)
+					s.hub.releaseLive(client)
+					s.rejectWS(client, in, "not_member", "not a room member")
+					continue
+				}
+
 				// send snapshot to joiner
 				users := s.hub.listPresences(in.RoomID)
 
@@ -1375,27 +1520,76 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 				Users:  users,
 				})
 
+				// catch up on anything missed while disconnected (sinceSeq=0 just reports the current seq)
+				s.hub.replay(r.Context(), client, in.RoomID, in.SinceSeq)
+				s.hub.releaseLive(client)
+
 				// announce joined (optional)
 				s.hub.broadcast(in.RoomID, WSOut{
 					Type:      "user_joined",
 					RoomID:    in.RoomID,
 					UserEmail: client.email,
-					Status:    client.status,
+					Status:    "active",
 				})
 
 				
+			case "subscribe":
+				// background rooms get room_activity instead of the full stream
+				want := in.RoomIDs
+				if len(want) == 0 && in.RoomID > 0 {
+					want = []int64{in.RoomID}
+				}
+				if len(want) == 0 {
+					continue
+				}
+
+				allowed, err := s.store.MemberRooms(r.Context(), userID, want)
+				if err != nil {
+					log.Println("ws subscribe membership error:", err)
+					continue
+				}
+				accepted := s.hub.subscribe(client, allowed)
+
+				ok := map[int64]bool{}
+				for _, id := range accepted {
+					ok[id] = true
+				}
+				rejected := []int64{}
+				for _, id := range want {
+					if !ok[id] {
+						rejected = append(rejected, id)
+					}
+				}
+
+				s.hub.sendToClient(client, WSOut{
+					Type:     "subscribed",
+					RoomIDs:  accepted,
+					Rejected: rejected,
+				})
+
+				// initial sidebar state
+				for _, id := range accepted {
+					s.hub.sendActivity(id, client)
+				}
+
+			case "unsubscribe":
+				want := in.RoomIDs
+				if len(want) == 0 && in.RoomID > 0 {
+					want = []int64{in.RoomID}
+				}
+				s.hub.unsubscribe(client, want)
+				s.hub.sendToClient(client, WSOut{Type: "unsubscribed", RoomIDs: want})
+
 			case "leave_room":
 				if in.RoomID <= 0 {
 					continue
 				}
 				// only leave if they're leaving the room they're in
-				if client.room == int64(in.RoomID) {
-					s.hub.leave(client) // this will broadcast presence inactive + user_list (with your updated leave())
-				}
+				s.hub.leaveRoom(client, in.RoomID) // this will broadcast presence inactive + user_list (with your updated leave())
 
 
 			case "presence":
-				if client.room == 0 || client.room != in.RoomID {
+				if in.RoomID == 0 || s.hub.focusedRoom(client) != in.RoomID {
 					continue
 				}
 
@@ -1404,62 +1598,104 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				client.status = st
-
-				s.hub.broadcast(in.RoomID, WSOut{
-					Type:      "presence",
-					RoomID:    in.RoomID,
-					UserEmail: client.email,
-					Status:    st,
-				})
-
-				users := s.hub.listPresences(in.RoomID)
-
-				s.hub.broadcast(in.RoomID, WSOut{
-				Type:  "user_list",
-				RoomID: in.RoomID,
-				Users: users,
-				})
+				if s.hub.setStatus(client, st) == 0 {
+					continue // unchanged
+				}
+				s.hub.broadcastStatus(in.RoomID, client.email)
 
 
 			case "message":
-				if client.room == 0 || client.room != in.RoomID {
+				// every send is answered with message_ack or message_error so the
+				// client can settle its pending bubble (keyed by clientMsgId)
+				fail := func(reason string) {
+					s.hub.sendToClient(client, WSOut{
+						Type:        "message_error",
+						RoomID:      in.RoomID,
+						ClientMsgID: in.ClientMsgID,
+						Error:       reason,
+					})
+				}
+
+				if in.RoomID == 0 || s.hub.focusedRoom(client) != in.RoomID {
+					fail("not in room")
+					continue
+				}
+				if strings.TrimSpace(in.Body) == "" && in.Attachment == nil {
+					fail("empty message")
+					continue
+				}
+				if len(in.Body) > 4000 {
+					fail("message too long")
+					continue
+				}
+				if len(in.ClientMsgID) > 64 {
+					fail("clientMsgId too long")
+					continue
+				}
+				if wait, err := s.slowModeWait(r.Context(), in.RoomID, member, in.ClientMsgID); err != nil {
+					log.Println("ws slow mode lookup error:", err)
+					fail("server error")
+					continue
+				} else if wait > 0 {
+					s.hub.sendToClient(client, WSOut{
+						Type:         "message_error",
+						RoomID:       in.RoomID,
+						ClientMsgID:  in.ClientMsgID,
+						Code:         "slow_mode",
+						Error:        "slow mode is on",
+						RetryAfterMs: wait.Milliseconds(),
+					})
 					continue
 				}
 
-				// Find user_id by email (or store user_id in Client at connect time)
-				var userID int64
-				err := s.db.QueryRow(r.Context(), `SELECT id FROM users WHERE email=$1`, client.email).Scan(&userID)
+				// replies hang off the thread root, in this room, that still exists;
+				// replyToId itself is kept as sent
+				var threadRootID int64
+				if in.ReplyToID > 0 {
+					threadRootID, err = s.threadRoot(r.Context(), in.RoomID, in.ReplyToID, userID)
+					if err != nil {
+						fail("bad reply target")
+						continue
+					}
+				}
+
+				// retries reuse the same clientMsgId -> the store hands back the original
+				msgID, createdAt, dup, err := s.store.InsertMessage(r.Context(), NewMessage{
+					RoomID:      in.RoomID,
+					UserID:      userID,
+					Body:        in.Body,
+					ReplyToID:   in.ReplyToID,
+					ThreadRootID: threadRootID,
+					Attachment:  in.Attachment,
+					ClientMsgID: in.ClientMsgID,
+				})
 				if err != nil {
+					log.Println("ws message insert error:", err)
+					fail("server error")
 					continue
 				}
 
-				var msgID int64
-				var createdAt time.Time
-
-				att := in.Attachment
-				_, _ = att, createdAt
-
-				err = s.db.QueryRow(r.Context(), `
-					INSERT INTO messages (
-						room_id, user_id, body,
-						reply_to_id,
-						attachment_url, attachment_mime, attachment_filename, attachment_size
-					) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
-					RETURNING id, created_at
-				`,
-					in.RoomID, userID, in.Body,
-					nullIfZero(in.ReplyToID),
-					nullableStr(att, func(a *Attachment) string { return a.URL }),
-					nullableStr(att, func(a *Attachment) string { return a.Mime }),
-					nullableStr(att, func(a *Attachment) string { return a.Filename }),
-					nullableSize(att),
-				).Scan(&msgID, &createdAt)
-
-				if err != nil {
+				if dup {
+					// duplicate send: ack the original, don't broadcast again
+					s.hub.sendToClient(client, WSOut{
+						Type:        "message_ack",
+						RoomID:      in.RoomID,
+						MessageID:   msgID,
+						ClientMsgID: in.ClientMsgID,
+						CreatedAt:   createdAt.UnixMilli(),
+						Duplicate:   true,
+					})
 					continue
 				}
 
+				s.hub.sendToClient(client, WSOut{
+					Type:        "message_ack",
+					RoomID:      in.RoomID,
+					MessageID:   msgID,
+					ClientMsgID: in.ClientMsgID,
+					CreatedAt:   createdAt.UnixMilli(),
+				})
+
 				s.hub.broadcast(in.RoomID, WSOut{
 					Type:       "message",
 					RoomID:     in.RoomID,
@@ -1467,9 +1703,15 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 					UserEmail:  client.email,
 					Body:       in.Body,
 					ReplyToID:  in.ReplyToID,           // if you have it
+					ThreadRootID: threadRootID,
 					Attachment: in.Attachment,
 					CreatedAt:  createdAt.UnixMilli(),
+					ClientMsgID: in.ClientMsgID,        // lets the sender's other tabs reconcile
 				})
+				if threadRootID > 0 {
+					s.broadcastThreadReply(r.Context(), in.RoomID, threadRootID, msgID, client.email)
+				}
+				s.recordMentions(r.Context(), in.RoomID, msgID, userID, client.email, in.Body, false)
 
 				// 2) Broadcast join to everyone (including joiner is okay; UI can ignore)
 				s.hub.broadcast(in.RoomID, WSOut{
@@ -1478,7 +1720,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 					UserEmail: client.email,
 				})
 		case "typing":
-			if client.room == 0 || client.room != in.RoomID {
+			if in.RoomID == 0 || s.hub.focusedRoom(client) != in.RoomID {
 				continue
 			}
 			s.hub.broadcast(in.RoomID, WSOut{
@@ -1500,20 +1742,17 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	roomID := int64(in.RoomID)
 	email := client.email
 
-	s.callMu.Lock()
-	cs := s.getCall(roomID)
-	if !cs.Active {
-		cs.Active = true
-		cs.HostEmail = email
-		cs.StartedAtMS = time.Now().UnixMilli()
-		cs.Participants = []string{email}
-	} else if !contains(cs.Participants, email) {
-		cs.Participants = append(cs.Participants, email)
-	}
-	s.callMu.Unlock()
+	res := s.callOp(roomID, "start", email)
 
 	s.broadcastCallState(roomID)
 	s.broadcastSystem(roomID, "📹 "+email+" started a call")
+
+	// ring every other member, wherever they are in the app
+	if res.started {
+		if members, err := s.store.MemberEmails(r.Context(), roomID); err == nil {
+			s.hub.notifyUsers(remove(members, email), userEventCallRinging, roomID, map[string]any{"host": email})
+		}
+	}
 	}
 
 
@@ -1524,14 +1763,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			email = "unknown"
 		}
 
-		s.callMu.Lock()
-		cs := s.getCall(roomID)
-		if cs.Active {
-			if !contains(cs.Participants, email) {
-				cs.Participants = append(cs.Participants, email)
-			}
-		}
-		s.callMu.Unlock()
+		s.callOp(roomID, "join", email)
 
 		s.broadcastCallState(roomID)
 		s.broadcastSystem(roomID, "📹 "+email+" joined the call")
@@ -1544,24 +1776,7 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			email = "unknown"
 		}
 
-		s.callMu.Lock()
-		cs := s.getCall(roomID)
-		if cs.Active {
-			cs.Participants = remove(cs.Participants, email)
-
-			// optional: if host leaves, end call (simple prototype)
-			if cs.HostEmail == email {
-				cs.Active = false
-				cs.HostEmail = ""
-				cs.Participants = nil
-				cs.StartedAtMS = 0
-			} else if len(cs.Participants) == 0 {
-				cs.Active = false
-				cs.HostEmail = ""
-				cs.StartedAtMS = 0
-			}
-		}
-		s.callMu.Unlock()
+		s.callOp(roomID, "leave", email)
 
 		s.broadcastCallState(roomID)
 		s.broadcastSystem(roomID, "📹 "+email+" left the call")
@@ -1574,39 +1789,53 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			email = "unknown"
 		}
 
-		s.callMu.Lock()
-		cs := s.getCall(roomID)
-
 		// only host can end (prototype rule)
-		if cs.Active && cs.HostEmail == email {
-			cs.Active = false
-			cs.HostEmail = ""
-			cs.Participants = nil
-			cs.StartedAtMS = 0
-		}
-		s.callMu.Unlock()
+		s.callOp(roomID, "end", email)
 
 		s.broadcastCallState(roomID)
 		s.broadcastSystem(roomID, "📹 "+email+" ended the call")
 	}
 
 	case "webrtc_offer", "webrtc_answer", "webrtc_ice":
-		// relay to everyone else in the room
+		// deliver only to the named peer, and only between call participants:
+		// SDP / ICE never reaches people who aren't in the call
 		roomID := int64(in.RoomID)
 		if roomID <= 0 {
 			continue
 		}
+		if in.To == "" || strings.EqualFold(in.To, client.email) {
+			s.rejectWS(client, in, "bad_target", "to must name another participant")
+			continue
+		}
+
+		// participants are stored as each client's email; compare case-insensitively
+		to := strings.ToLower(in.To)
+		s.callMu.Lock()
+		cs := s.getCall(roomID)
+		inCall := false
+		if cs.Active {
+			lower := make([]string, len(cs.Participants))
+			for i, p := range cs.Participants {
+				lower[i] = strings.ToLower(p)
+			}
+			inCall = contains(lower, strings.ToLower(client.email)) && contains(lower, to)
+		}
+		s.callMu.Unlock()
+		if !inCall {
+			s.rejectWS(client, in, "not_in_call", "sender and recipient must both be in the call")
+			continue
+		}
 
 		// Important: include sender so peers can map connections
-		// Assume client.email is set from token during WS auth
-		s.hub.BroadcastToRoom(roomID, map[string]any{
+		b, _ := json.Marshal(map[string]any{
 			"type":   in.Type,
 			"roomId": roomID,
 			"from":   client.email,
-			"to":     in.To,     // optional (can be empty)
+			"to":     to,
 			"sdp":    in.SDP,    // offer/answer
 			"ice":    in.ICE,    // ice candidate
 		})
+		s.hub.sendToUser(to, roomID, b)
 
 	
 	case "call_share_start": {
@@ -1616,30 +1845,14 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
         continue
     }
 
-    var rejectReason string
-
-    s.callMu.Lock()
-    cs := s.getCall(roomID)
-    if !cs.Active {
-        rejectReason = "no active call"
-    } else if cs.ScreenSharing && cs.ScreenSharer != "" && cs.ScreenSharer != email {
-        // ✅ Only one sharer at a time
-        rejectReason = "someone is already sharing: " + cs.ScreenSharer
-    } else {
-        cs.ScreenSharing = true
-        cs.ScreenSharer = email
-    }
-    s.callMu.Unlock()
-
-    if rejectReason != "" {
+    // ✅ Only one sharer at a time
+    if res := s.callOp(roomID, "share_start", email); res.reject != "" {
         // send only to requester (not broadcast)
         s.hub.sendToClient(client, WSOut{
             Type:   "call_share_rejected",
             RoomID: roomID,
-            Error:  rejectReason,
+            Error:  res.reject,
         })
-        // optional: also send a system message ONLY to requester, not everyone
-        // s.hub.sendToClient(client, WSOut{Type:"system", RoomID:roomID, Text:"🛑 Share rejected: "+rejectReason, CreatedAt: time.Now().UnixMilli()})
         continue
     }
 
@@ -1647,7 +1860,6 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
     s.broadcastSystem(roomID, "🖥️ "+email+" started screen sharing")
 }
 
-
 case "call_share_stop": {
     roomID := int64(in.RoomID)
     email := client.email
@@ -1655,34 +1867,12 @@ case "call_share_stop": {
         continue
     }
 
-    var rejectReason string
-
-    s.callMu.Lock()
-    cs := s.getCall(roomID)
-
-    if cs.ScreenSharing {
-        // ✅ only sharer can stop (simple rule)
-        if cs.ScreenSharer != email {
-            // OPTIONAL: allow host to stop anyone
-            // if cs.HostEmail != email {
-            //     rejectReason = "only current sharer (or host) can stop sharing"
-            // } else {
-            //     cs.ScreenSharing = false
-            //     cs.ScreenSharer = ""
-            // }
-            rejectReason = "only current sharer can stop sharing"
-        } else {
-            cs.ScreenSharing = false
-            cs.ScreenSharer = ""
-        }
-    }
-    s.callMu.Unlock()
-
-    if rejectReason != "" {
+    // ✅ only sharer can stop (simple rule)
+    if res := s.callOp(roomID, "share_stop", email); res.reject != "" {
         s.hub.sendToClient(client, WSOut{
             Type:   "call_share_rejected",
             RoomID: roomID,
-            Error:  rejectReason,
+            Error:  res.reject,
         })
         continue
     }
@@ -1729,10 +1919,9 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Ensure room exists
-	var exists bool
-	err = s.db.QueryRow(r.Context(), `SELECT true FROM rooms WHERE id=$1`, roomID).Scan(&exists)
+	room, err := s.store.GetRoom(r.Context(), roomID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, ErrNotFound) {
 			writeErr(w, http.StatusNotFound, "room not found")
 			return
 		}
@@ -1740,17 +1929,48 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// banned users stay out until the ban expires or is lifted
+	if _, err := s.store.ActiveBan(r.Context(), roomID, userID); err == nil {
+		writeErr(w, http.StatusForbidden, "banned from this room")
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	// only public rooms take plain joins; members re-joining is always a no-op
+	if room.Visibility != visibilityPublic {
+		if ok, err := s.store.IsMember(r.Context(), roomID, userID); err != nil {
+			writeErr(w, http.StatusInternalServerError, "db error")
+			return
+		} else if ok {
+			writeJSON(w, http.StatusOK, map[string]any{"status": "joined", "room_id": roomID})
+			return
+		}
+		if room.Kind == roomKindDM {
+			writeErr(w, http.StatusForbidden, "direct messages can't be joined")
+			return
+		}
+		if room.Visibility == visibilityInviteOnly {
+			s.requestJoin(w, r, room)
+			return
+		}
+		writeErr(w, http.StatusForbidden, "room is private; join with an invite")
+		return
+	}
+
 	// Add membership (idempotent)
-	_, err = s.db.Exec(r.Context(), `
-		INSERT INTO room_members (room_id, user_id, role)
-		VALUES ($1, $2, 'member')
-		ON CONFLICT (room_id, user_id) DO NOTHING
-	`, roomID, userID)
+	added, err := s.store.AddMember(r.Context(), roomID, userID, roleMember)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
 
+	// let the user's other tabs / devices pick the room up
+	if added {
+		s.hub.notifyUser(emailFromCtx(r), userEventRoomAdded, roomID, map[string]any{"name": room.Name})
+	}
+
 	writeJSON(w, http.StatusOK, map[string]any{
 		"status":  "joined",
 		"room_id": roomID,
@@ -1883,13 +2103,7 @@ func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromCtx(r)
 
 	// Must be a member
-	var ok bool
-	err = s.db.QueryRow(r.Context(), `
-		SELECT EXISTS(
-			SELECT 1 FROM room_members
-			WHERE room_id=$1 AND user_id=$2
-		)
-	`, roomID, userID).Scan(&ok)
+	ok, err := s.store.IsMember(r.Context(), roomID, userID)
 	if err != nil {
 		log.Println("handleListMessages membership error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
@@ -1901,308 +2115,56 @@ func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query params
-	limit := int32(50)
+	q := MessageQuery{RoomID: roomID, ViewerID: userID, Limit: 50, SinceDays: 10}
 	if v := r.URL.Query().Get("limit"); v != "" {
 		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
-			limit = int32(n)
+			q.Limit = n
 		}
 	}
 
-	sinceDays := 10
+	// ✅ initial load: only last N days; load older (before=): no date restriction
 	if v := r.URL.Query().Get("sinceDays"); v != "" {
 		if n, _ := strconv.Atoi(v); n >= 1 && n <= 365 {
-			sinceDays = n
+			q.SinceDays = n
 		}
 	}
 
-	beforeID := int64(1<<62)
-	beforeProvided := false
 	if v := r.URL.Query().Get("before"); v != "" {
 		if n, e := strconv.ParseInt(v, 10, 64); e == nil && n > 0 {
-			beforeID = n
-			beforeProvided = true
-		}
-	}
-
-	// Fetch messages
-	var rows pgx.Rows
-	
-if !beforeProvided {
-  // ✅ initial load: only last N days
-  rows, err = s.db.Query(r.Context(), `
-    SELECT
-      m.id, m.room_id, u.email, m.body, m.kind,
-      COALESCE(m.poll::text, '') AS poll_json,
-      (EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
-      COALESCE(m.reply_to_id, 0) AS reply_to_id,
-      (m.deleted_at IS NOT NULL) AS deleted,
-      (m.edited_at IS NOT NULL) AS edited,
-      (ms.message_id IS NOT NULL) AS starred,
-      m.attachment_url, m.attachment_mime, m.attachment_filename,
-      COALESCE(m.attachment_size, 0)
-    FROM messages m
-    JOIN users u ON u.id = m.user_id
-    LEFT JOIN message_stars ms ON ms.message_id=m.id AND ms.user_id=$4
-    WHERE m.room_id=$1
-      AND m.id < $2
-      AND m.created_at >= now() - ($3::int * interval '1 day')
-    ORDER BY m.id DESC
-    LIMIT $5
-  `, roomID, beforeID, sinceDays, userID, limit)
-
-} else {
-  // ✅ load older: no date restriction
-  rows, err = s.db.Query(r.Context(), `
-    SELECT
-      m.id, m.room_id, u.email, m.body, m.kind,
-      COALESCE(m.poll::text, '') AS poll_json,
-      (EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
-      COALESCE(m.reply_to_id, 0) AS reply_to_id,
-      (m.deleted_at IS NOT NULL) AS deleted,
-      (m.edited_at IS NOT NULL) AS edited,
-      (ms.message_id IS NOT NULL) AS starred,
-      m.attachment_url, m.attachment_mime, m.attachment_filename,
-      COALESCE(m.attachment_size, 0)
-    FROM messages m
-    JOIN users u ON u.id = m.user_id
-    LEFT JOIN message_stars ms ON ms.message_id=m.id AND ms.user_id=$3
-    WHERE m.room_id=$1
-      AND m.id < $2
-    ORDER BY m.id DESC
-    LIMIT $4
-  `, roomID, beforeID, userID, limit)
-}
-
-if err != nil {
-  log.Println("handleListMessages query error:", err)
-  writeErr(w, http.StatusInternalServerError, "db error")
-  return
-}
-defer rows.Close()
-
-	out := make([]MessageDTO, 0, limit)
-
-	for rows.Next() {
-		var m MessageDTO
-		var createdMS int64
-		var replyToID int64
-		var deleted, edited, starred bool
-		var url, mime, filename *string
-		var size int64
-		var kind string
-		var pollJSON string
-
-		if err := rows.Scan(
-			&m.ID,
-			&m.RoomID,
-			&m.UserEmail,
-			&m.Body,
-			&kind,
-			&pollJSON,
-			&createdMS,
-			&replyToID,
-			&deleted,
-			&edited,
-			&starred,
-			&url,
-			&mime,
-			&filename,
-			&size,
-		); err != nil {
-			log.Println("handleListMessages scan error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-
-		m.CreatedAt = createdMS
-		m.ReplyToID = replyToID
-		m.Deleted = deleted
-		m.Edited = edited
-		m.Starred = starred
-		m.Kind = kind
-
-		if m.Deleted {
-			m.Body = ""
-			m.Attachment = nil
-		} else if url != nil && *url != "" {
-			m.Attachment = &Attachment{
-				URL:      *url,
-				Mime:     derefStr(mime),
-				Filename: derefStr(filename),
-				Size:     size,
-			}
+			q.BeforeID = n
 		}
-
-		// Basic poll reconstruction (counts added later)
-		if kind == "poll" && pollJSON != "" && !m.Deleted {
-			var stored struct {
-				Question string `json:"question"`
-				Options  []struct {
-					Text string `json:"text"`
-				} `json:"options"`
-			}
-			if err := json.Unmarshal([]byte(pollJSON), &stored); err == nil {
-				p := &PollDTO{Question: stored.Question, MyVote: -1}
-				for _, o := range stored.Options {
-					p.Options = append(p.Options, PollOptionDTO{Text: o.Text, Count: 0})
-				}
-				m.Poll = p
-			}
-		}
-
-		out = append(out, m)
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Println("handleListMessages rows error:", err)
+	out, err := s.store.ListMessages(r.Context(), q)
+	if err != nil {
+		log.Println("handleListMessages query error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
 
-	// ---- rebuild poll counts + myVote on refresh ----
-	pollIDs := make([]int64, 0)
-	pollIndex := make(map[int64]int)
-	for i := range out {
-		if out[i].Deleted {
-			continue
-		}
-		if out[i].Kind == "poll" && out[i].Poll != nil {
-			pollIDs = append(pollIDs, out[i].ID)
-			pollIndex[out[i].ID] = i
-		}
-	}
-
-	if len(pollIDs) > 0 {
-		type key struct{ mid int64; idx int }
-		counts := make(map[key]int64)
-
-		r1, e := s.db.Query(r.Context(), `
-			SELECT message_id, option_idx, COUNT(*)::bigint
-			FROM poll_votes
-			WHERE message_id = ANY($1)
-			GROUP BY message_id, option_idx
-		`, pollIDs)
-		if e != nil {
-			writeErr(w, 500, "failed to load poll counts")
-			return
-		}
-		for r1.Next() {
-			var mid int64
-			var idx int
-			var cnt int64
-			if err := r1.Scan(&mid, &idx, &cnt); err == nil {
-				counts[key{mid: mid, idx: idx}] = cnt
-			}
-		}
-		r1.Close()
-
-		myVotes := make(map[int64]int)
-		r2, e := s.db.Query(r.Context(), `
-			SELECT message_id, option_idx
-			FROM poll_votes
-			WHERE message_id = ANY($1) AND user_id = $2
-		`, pollIDs, userID)
-		if e != nil {
-			writeErr(w, 500, "failed to load my poll votes")
-			return
-		}
-		for r2.Next() {
-			var mid int64
-			var idx int
-			if err := r2.Scan(&mid, &idx); err == nil {
-				myVotes[mid] = idx
-			}
-		}
-		r2.Close()
-
-		for _, mid := range pollIDs {
-			i := pollIndex[mid]
-			p := out[i].Poll
-			if p == nil {
-				continue
-			}
-			if v, ok := myVotes[mid]; ok {
-				p.MyVote = v
-			} else {
-				p.MyVote = -1
-			}
-			for optIdx := range p.Options {
-				p.Options[optIdx].Count = counts[key{mid: mid, idx: optIdx}]
-			}
-		}
+	// rebuild poll counts + myVote on refresh
+	if err := hydratePolls(r.Context(), s.store, out, userID); err != nil {
+		log.Println("handleListMessages poll counts error:", err)
+		writeErr(w, 500, "failed to load poll counts")
+		return
 	}
-	// ---- end poll rebuild ----
 
-	
-	if err := rows.Err(); err != nil {
-		log.Println("handleListMessages db error:", err)
+	if err := hydrateReactions(r.Context(), s.store, out, userID); err != nil {
+		log.Println("handleListMessages reactions query error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
 
-		// 1) collect message ids (these are DB ids: m.id)
-	ids := make([]int64, 0, len(out))
-	for _, m := range out {
-		ids = append(ids, m.ID)
-	}
-
-	// 2) load reactions for those ids
-	reactionsByMsg := map[int64][]ReactionDTO{}
-
-	if len(ids) > 0 {
-		rxRows, err := s.db.Query(r.Context(), `
-			SELECT
-				message_id,
-				emoji,
-				COUNT(*)::bigint AS cnt,
-				BOOL_OR(user_id = $2) AS me
-			FROM message_reactions
-			WHERE message_id = ANY($1)
-			GROUP BY message_id, emoji
-			ORDER BY message_id, emoji
-		`, ids, userID)
-		if err != nil {
-			log.Println("handleListMessages reactions query error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-		defer rxRows.Close()
-
-		for rxRows.Next() {
-			var mid int64
-			var emoji string
-			var cnt int64
-			var me bool
-			if err := rxRows.Scan(&mid, &emoji, &cnt, &me); err != nil {
-				log.Println("handleListMessages reactions scan error:", err)
-				writeErr(w, http.StatusInternalServerError, "db error")
-				return
-			}
-			reactionsByMsg[mid] = append(reactionsByMsg[mid], ReactionDTO{
-				Emoji: emoji,
-				Count: cnt,
-				Me:    me,
-			})
-		}
-		if err := rxRows.Err(); err != nil {
-			log.Println("handleListMessages reactions rows error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-	}
-
-	// 3) attach to messages
-	for i := range out {
-		mid := out[i].ID
-		out[i].Reactions = reactionsByMsg[mid]
+	if err := hydrateThreads(r.Context(), s.store, out); err != nil {
+		log.Println("handleListMessages thread summary error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
 	}
 
 	log.Println("handleListMessages roomID=", roomID, "userID=", userID, "messages=", len(out))
-	log.Println("reaction groups found=", len(reactionsByMsg))
 
-	// 4) respond (newest->oldest; frontend can reverse)
+	// respond (newest->oldest; frontend can reverse)
 	writeJSON(w, http.StatusOK, out)
-
 }
 
 func derefStr(s *string) string {
@@ -2242,28 +2204,127 @@ func initDB() (*sql.DB, error) {
 }
 
 func main() {
-	dsn := mustEnv("DATABASE_URL")
-	secret := mustEnv("JWT_SECRET")
 	_ = godotenv.Load()
 
-	ctx := context.Background()
-	db, err := pgxpool.New(ctx, dsn)
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCmd(os.Args[2:])
+		return
 	}
-	defer db.Close()
+
+	secret := mustEnv("JWT_SECRET")
+
+	// background loops (hub, pruners) outlive the signal: they stop after draining
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	uploadsDir := filepath.Join(mustGetwd(), "uploads")
 	_ = os.MkdirAll(uploadsDir, 0755)
 
+	// STORE=memory runs without Postgres (single node, nothing persisted)
+	var store Store
+	var events EventLog
+	var broker Broker = localBroker{}
+
+	switch envOr("STORE", "postgres") {
+	case "memory":
+		log.Println("STORE=memory: data is lost on restart")
+		store = newMemStore()
+		events = newMemEventLog()
+
+	case "postgres":
+		db, err := pgxpool.New(ctx, mustEnv("DATABASE_URL"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+
+		// bring the schema up to date (set MIGRATE_ON_START=false to run `migrate` by hand)
+		if envOr("MIGRATE_ON_START", "true") == "true" {
+			if err := migrateUp(ctx, db); err != nil {
+				log.Fatal("migrate: ", err)
+			}
+		}
+
+		// HUB_BROKER=postgres fans WS events out to every replica via LISTEN/NOTIFY
+		switch envOr("HUB_BROKER", "local") {
+		case "local":
+		case "postgres":
+			broker = newPGBroker(db, envOr("HUB_CHANNEL", "gochat_hub"))
+		default:
+			log.Fatalf("unknown HUB_BROKER %q (want local|postgres)", os.Getenv("HUB_BROKER"))
+		}
+
+		store = newPGStore(db)
+		events = newPGEventLog(db)
+
+	default:
+		log.Fatalf("unknown STORE %q (want postgres|memory)", os.Getenv("STORE"))
+	}
+
+	go runEventLogPruner(ctx, events, time.Duration(envInt("EVENT_LOG_RETENTION_HOURS", 72))*time.Hour)
+
 	s := &Server{
-		db: db,
+		store: store,
 		jwtSecret: []byte(secret),
-		hub: NewHub(),
+		hub: NewHub(newNodeID(), broker, events),
 		uploadsDir: uploadsDir,
 		calls: make(map[int64]*CallState),
+		restoreWindow: time.Duration(envInt("ROOM_RESTORE_DAYS", 30)) * 24 * time.Hour,
+		pinLimit:      envInt("ROOM_PIN_LIMIT", 50),
+		hubAdmins:     map[string]bool{},
+	}
+	for _, e := range strings.Split(os.Getenv("HUB_ADMIN_EMAILS"), ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			s.hubAdmins[e] = true
+		}
+	}
+	s.hub.replayMax = envInt("WS_REPLAY_MAX", 500)
+	s.hub.sendBuffer = envInt("WS_SEND_BUFFER", 32)
+	s.hub.writeTimeout = time.Duration(envInt("WS_WRITE_TIMEOUT_SECONDS", 10)) * time.Second
+	s.hub.pingInterval = time.Duration(envInt("WS_PING_INTERVAL_SECONDS", 25)) * time.Second
+	s.hub.pingTimeout = time.Duration(envInt("WS_PING_TIMEOUT_SECONDS", 10)) * time.Second
+	s.hub.idleAfter = time.Duration(envInt("WS_IDLE_AFTER_SECONDS", 300)) * time.Second
+	s.hub.OnRemote("call_op", s.applyRemoteCallOp)
+	s.hub.activityFn = s.store.RoomActivity
+	s.hub.onEvict = s.dropFromCall
+	s.restoreCalls(ctx)
+	go s.hub.Run(ctx)
+	go s.hub.runIdleSweeper(ctx)
+	go runRoomPurger(ctx, s.store, s.restoreWindow)
+	go runRetentionPurger(ctx, s.store)
+
+	addr := envOr("ADDR", ":8080")
+	srv := &http.Server{Addr: addr, Handler: s.routes()}
+
+	go func() {
+		log.Println("API listening on", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-sigCtx.Done()
+	stop() // a second signal kills us the hard way
+
+	timeout := time.Duration(envInt("SHUTDOWN_TIMEOUT_SECONDS", 25)) * time.Second
+	log.Println("shutting down, draining for up to", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.shutdown(shutdownCtx, srv)
+
+	stopBackground()
+	if err := broker.Close(); err != nil {
+		log.Println("shutdown: hub broker:", err)
 	}
+	log.Println("bye")
+}
 
+// routes is the HTTP API; main serves it and the tests drive it directly.
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(cors)
 	r.Use(middleware.Logger)
@@ -2279,10 +2340,14 @@ func main() {
 	r.With(s.requireAuth).Post("/reactions/toggle", s.handleToggleReaction)
 
 	r.Get("/ws", s.handleWS)
+	r.With(s.requireAuth).Get("/debug/hub", s.handleHubStats)
 
 	r.With(s.requireAuth).Get("/me", s.handleMe)
+	r.With(s.requireAuth).Delete("/me", s.handleDeleteMe)
 	r.With(s.requireAuth).Get("/rooms", s.handleListRooms)
 	r.With(s.requireAuth).Post("/rooms", s.handleCreateRoom)
+	r.With(s.requireAuth).Patch("/rooms/{roomID}", s.handlePatchRoom)
+	r.With(s.requireAuth).Post("/dms", s.handleOpenDM)
 	r.With(s.requireAuth).Delete("/rooms/{roomID}", s.handleDeleteRoom)
 	r.With(s.requireAuth).Post("/rooms/{roomID}/join", s.handleJoinRoom)
 	r.With(s.requireAuth).Post("/upload", s.handleUpload)
@@ -2292,10 +2357,39 @@ func main() {
 	r.With(s.requireAuth).Post("/messages/{messageID}/star", s.handleStarMessage)
 	r.With(s.requireAuth).Get("/starred", s.handleListStarred)
 	r.With(s.requireAuth).Delete("/messages/{messageID}/star", s.handleUnstarMessage)
+	r.With(s.requireAuth).Post("/messages/{messageID}/pin", s.handlePinMessage)
+	r.With(s.requireAuth).Delete("/messages/{messageID}/pin", s.handleUnpinMessage)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/pins", s.handleListPins)
 	r.With(s.requireAuth).Get("/rooms/{roomID}/messages/search", s.handleSearchMessages)
+	r.With(s.requireAuth).Get("/search", s.handleSearch)
 	r.With(s.requireAuth).Post("/rooms/{roomID}/read", s.handleMarkRoomRead)
 	r.With(s.requireAuth).Post("/rooms/{roomID}/leave", s.handleLeaveRoom)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/members", s.handleListMembers)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/transfer", s.handleTransferOwnership)
+	r.With(s.requireAuth).Put("/rooms/{roomID}/members/{userID}/role", s.handleSetMemberRole)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/members/{userID}/kick", s.handleKickMember)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/members/{userID}/ban", s.handleBanMember)
+	r.With(s.requireAuth).Delete("/rooms/{roomID}/members/{userID}/ban", s.handleUnbanMember)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/members/{userID}/mute", s.handleMuteMember)
+	r.With(s.requireAuth).Delete("/rooms/{roomID}/members/{userID}/mute", s.handleUnmuteMember)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/bans", s.handleListBans)
+	r.With(s.requireAuth).Put("/rooms/{roomID}/visibility", s.handleSetVisibility)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/archive", s.handleArchiveRoom)
+	r.With(s.requireAuth).Delete("/rooms/{roomID}/archive", s.handleUnarchiveRoom)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/restore", s.handleRestoreRoom)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/export", s.handleExportRoom)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/invites", s.handleCreateInvite)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/invites", s.handleListInvites)
+	r.With(s.requireAuth).Delete("/rooms/{roomID}/invites/{token}", s.handleRevokeInvite)
+	r.With(s.requireAuth).Post("/invites/{token}/accept", s.handleAcceptInvite)
+	r.With(s.requireAuth).Get("/rooms/{roomID}/join-requests", s.handleListJoinRequests)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/join-requests/{userID}/approve", s.handleApproveJoinRequest)
+	r.With(s.requireAuth).Post("/rooms/{roomID}/join-requests/{userID}/deny", s.handleDenyJoinRequest)
 	r.With(s.requireAuth).Get("/messages/{messageID}/reactions", s.handleListMessageReactions)
+	r.With(s.requireAuth).Get("/messages/{messageID}/thread", s.handleThread)
+	r.With(s.requireAuth).Get("/messages/{messageID}/revisions", s.handleListRevisions)
+	r.With(s.requireAuth).Get("/mentions", s.handleListMentions)
+	r.With(s.requireAuth).Post("/mentions/read", s.handleMarkMentionsRead)
 	r.With(s.requireAuth).Post("/rooms/{roomID}/polls", s.handleCreatePoll)
 	r.With(s.requireAuth).Post("/polls/{messageID}/vote", s.handleVotePoll)
 	r.With(s.requireAuth).Put("/polls/{messageID}", s.handleEditPoll)
@@ -2303,15 +2397,12 @@ func main() {
 	r.With(s.requireAuth).Post("/messages/bulk/unstar", s.handleBulkUnstarMessages)
 	r.With(s.requireAuth).Post("/messages/bulk/delete", s.handleBulkDeleteMessages)
 
-
 	// ✅ serve uploaded files
 	r.Handle("/uploads/*",
-		http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadsDir))),
+		http.StripPrefix("/uploads/", http.FileServer(http.Dir(s.uploadsDir))),
 	)
 
-	addr := envOr("ADDR", ":8080")
-	log.Println("API listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	return r
 }
 
 type votePollReq struct {
@@ -2330,25 +2421,15 @@ func (s *Server) handleVotePoll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// load poll message + room + poll json
-	var roomID int64
-	var kind string
-	var pollJSON *string
-	err = s.db.QueryRow(r.Context(), `
-		SELECT room_id, kind, poll::text
-		FROM messages
-		WHERE id=$1 AND deleted_at IS NULL
-	`, msgID).Scan(&roomID, &kind, &pollJSON)
-	if err != nil || kind != "poll" || pollJSON == nil || *pollJSON == "" {
+	msg, err := s.store.GetMessage(r.Context(), msgID)
+	if err != nil || msg.Deleted || msg.Kind != "poll" || msg.PollJSON == "" {
 		writeErr(w, http.StatusNotFound, "poll not found")
 		return
 	}
+	roomID := msg.RoomID
 
-	// must be member
-	var ok bool
-	if err := s.db.QueryRow(r.Context(), `
-		SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)
-	`, roomID, userID).Scan(&ok); err != nil || !ok {
-		writeErr(w, http.StatusForbidden, "not a room member")
+	// must be member, and the room not archived
+	if _, ok := s.requirePerm(w, r, roomID, permReact); !ok {
 		return
 	}
 
@@ -2359,13 +2440,8 @@ func (s *Server) handleVotePoll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse stored poll to validate option range
-	var stored struct {
-		Question string `json:"question"`
-		Options  []struct {
-			Text string `json:"text"`
-		} `json:"options"`
-	}
-	if err := json.Unmarshal([]byte(*pollJSON), &stored); err != nil {
+	var stored pollStoredJSON
+	if err := json.Unmarshal([]byte(msg.PollJSON), &stored); err != nil {
 		writeErr(w, http.StatusInternalServerError, "bad poll data")
 		return
 	}
@@ -2374,98 +2450,13 @@ func (s *Server) handleVotePoll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ---- TOGGLE / SWITCH VOTE (transaction recommended) ----
-	tx, err := s.db.Begin(r.Context())
-	if err != nil {
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
-	defer tx.Rollback(r.Context())
-
-	// read existing vote (if any)
-	existing := -1
-	err = tx.QueryRow(r.Context(), `
-		SELECT option_idx
-		FROM poll_votes
-		WHERE message_id=$1 AND user_id=$2
-	`, msgID, userID).Scan(&existing)
-
-	myVote := -1
-
-	if err == nil {
-		// had a vote already
-		if existing == body.OptionIdx {
-			// ✅ clicked same option -> cancel vote
-			if _, err := tx.Exec(r.Context(), `
-				DELETE FROM poll_votes
-				WHERE message_id=$1 AND user_id=$2
-			`, msgID, userID); err != nil {
-				log.Println("vote poll delete error:", err)
-				writeErr(w, http.StatusInternalServerError, "db error")
-				return
-			}
-			myVote = -1
-		} else {
-			// ✅ switch vote
-			if _, err := tx.Exec(r.Context(), `
-				UPDATE poll_votes
-				SET option_idx=$3, created_at=now()
-				WHERE message_id=$1 AND user_id=$2
-			`, msgID, userID, body.OptionIdx); err != nil {
-				log.Println("vote poll update error:", err)
-				writeErr(w, http.StatusInternalServerError, "db error")
-				return
-			}
-			myVote = body.OptionIdx
-		}
-	} else if errors.Is(err, pgx.ErrNoRows) {
-		// no previous vote -> insert
-		if _, err := tx.Exec(r.Context(), `
-			INSERT INTO poll_votes (message_id, user_id, option_idx)
-			VALUES ($1, $2, $3)
-		`, msgID, userID, body.OptionIdx); err != nil {
-			log.Println("vote poll insert error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-		myVote = body.OptionIdx
-	} else {
-		log.Println("vote poll read existing error:", err)
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
-
-	// counts (inside same tx so it's consistent)
-	counts := make([]int64, len(stored.Options))
-	rows, err := tx.Query(r.Context(), `
-		SELECT option_idx, COUNT(*)::bigint
-		FROM poll_votes
-		WHERE message_id=$1
-		GROUP BY option_idx
-	`, msgID)
+	// toggle / switch vote; same option again cancels it
+	myVote, counts, err := s.store.VotePoll(r.Context(), msgID, userID, body.OptionIdx, len(stored.Options))
 	if err != nil {
+		log.Println("vote poll error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var idx int
-		var cnt int64
-		if err := rows.Scan(&idx, &cnt); err == nil && idx >= 0 && idx < len(counts) {
-			counts[idx] = cnt
-		}
-	}
-	if err := rows.Err(); err != nil {
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
-
-	if err := tx.Commit(r.Context()); err != nil {
-		writeErr(w, http.StatusInternalServerError, "db error")
-		return
-	}
-	// ---- END TOGGLE / SWITCH ----
 
 	outPoll := &PollDTO{
 		Question: stored.Question,
@@ -2499,13 +2490,6 @@ type createPollReq struct {
 	Options  []string `json:"options"`
 }
 
-type pollStoredJSON struct {
-	Question string `json:"question"`
-	Options  []struct {
-		Text string `json:"text"`
-	} `json:"options"`
-}
-
 func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromCtx(r)
 	email := emailFromCtx(r) // if you have it; if not, remove this line and the field below
@@ -2517,12 +2501,17 @@ func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// must be member
-	var ok bool
-	if err := s.db.QueryRow(r.Context(), `
-		SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)
-	`, roomID, userID).Scan(&ok); err != nil || !ok {
-		writeErr(w, http.StatusForbidden, "not a room member")
+	// must be a member allowed to post
+	member, ok := s.requirePerm(w, r, roomID, permPost)
+	if !ok {
+		return
+	}
+	if wait, err := s.slowModeWait(r.Context(), roomID, member, ""); err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	} else if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeErr(w, http.StatusTooManyRequests, "slow mode is on")
 		return
 	}
 
@@ -2570,20 +2559,14 @@ func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
 
 	pollBytes, _ := json.Marshal(stored)
 
-	var msgID int64
-	var createdMS int64
-
 	// Insert poll as a message
-	err = s.db.QueryRow(r.Context(), `
-		INSERT INTO messages (room_id, user_id, body, kind, poll, created_at)
-		VALUES ($1, $2, '', 'poll', $3::jsonb, now())
-		RETURNING id, (EXTRACT(EPOCH FROM created_at) * 1000)::bigint
-	`, roomID, userID, string(pollBytes)).Scan(&msgID, &createdMS)
+	msgID, createdAt, err := s.store.CreatePoll(r.Context(), roomID, userID, string(pollBytes))
 	if err != nil {
 		log.Println("create poll insert error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
+	createdMS := createdAt.UnixMilli()
 
 	out := MessageDTO{
 		ID:        msgID,
@@ -2624,24 +2607,23 @@ func (s *Server) handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  // optional: prevent owner leaving their own room
-  var ownerID int64
-  if err := s.db.QueryRow(r.Context(), `SELECT owner_id FROM rooms WHERE id=$1`, roomID).Scan(&ownerID); err == nil {
-    if ownerID == userID {
-      writeErr(w, http.StatusBadRequest, "owner cannot leave their own room")
-      return
-    }
+  // the owner hands the room over first (see handOffOwnership)
+  if role, err := s.roomRole(r.Context(), roomID, userID); err != nil {
+    writeErr(w, http.StatusInternalServerError, "db error")
+    return
+  } else if role == roleOwner && !s.handOffOwnership(w, r, roomID) {
+    return
   }
 
-  _, err = s.db.Exec(r.Context(), `
-    DELETE FROM room_members
-    WHERE room_id=$1 AND user_id=$2
-  `, roomID, userID)
-  if err != nil {
+  if err := s.store.RemoveMember(r.Context(), roomID, userID); err != nil {
     writeErr(w, http.StatusInternalServerError, "db error")
     return
   }
 
+  // drop any live sockets still focused on / subscribed to the room
+  s.hub.evict(roomID, userID, "left")
+  s.hub.notifyUser(emailFromCtx(r), userEventRoomRemoved, roomID, nil)
+
   w.WriteHeader(http.StatusNoContent)
 }
 
@@ -2663,14 +2645,7 @@ func (s *Server) handleMarkRoomRead(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  _, err = s.db.Exec(r.Context(), `
-    INSERT INTO room_reads(room_id, user_id, last_read_message_id, updated_at)
-    VALUES ($1, $2, $3, now())
-    ON CONFLICT (room_id, user_id)
-    DO UPDATE SET last_read_message_id = GREATEST(room_reads.last_read_message_id, EXCLUDED.last_read_message_id),
-                  updated_at = now()
-  `, roomID, userID, body.LastReadMessageID)
-  if err != nil {
+  if err := s.store.MarkRead(r.Context(), roomID, userID, body.LastReadMessageID); err != nil {
     writeErr(w, http.StatusInternalServerError, "db error")
     return
   }
@@ -2688,13 +2663,7 @@ func (s *Server) handleSearchMessages(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromCtx(r)
 
 	// membership check
-	var ok bool
-	err = s.db.QueryRow(r.Context(), `
-		SELECT EXISTS(
-			SELECT 1 FROM room_members
-			WHERE room_id=$1 AND user_id=$2
-		)
-	`, roomID, userID).Scan(&ok)
+	ok, err := s.store.IsMember(r.Context(), roomID, userID)
 	if err != nil {
 		log.Println("handleSearchMessages db error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
@@ -2715,167 +2684,56 @@ func (s *Server) handleSearchMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit := int32(50)
+	limit := 50
 	if v := r.URL.Query().Get("limit"); v != "" {
 		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
-			limit = int32(n)
+			limit = n
 		}
 	}
 
 	// optional pagination: results before message id
-	var beforeID int64 = 1<<62
+	var beforeID int64
 	if v := r.URL.Query().Get("before"); v != "" {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
 			beforeID = n
 		}
 	}
 
-	// Pattern for ILIKE
-	pat := "%" + q + "%"
-
-	rows, err := s.db.Query(r.Context(), `
-	SELECT
-		m.id, m.room_id, u.email, m.body,
-		(EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
-		COALESCE(m.reply_to_id, 0) AS reply_to_id,
-		(m.deleted_at IS NOT NULL) AS deleted,
-		(m.edited_at IS NOT NULL) AS edited,
-		(ms.message_id IS NOT NULL) AS starred,
-		m.attachment_url, m.attachment_mime, m.attachment_filename,
-		COALESCE(m.attachment_size, 0), m.kind, COALESCE(m.poll::text, '') AS poll_json
-	FROM messages m
-	JOIN users u ON u.id = m.user_id
-	LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $4
-	WHERE m.room_id = $1
-		AND m.deleted_at IS NULL
-		AND m.id < $3
-		AND (
-		m.body ILIKE $2
-		OR u.email ILIKE $2
-		OR COALESCE(m.attachment_filename,'') ILIKE $2
-		OR (
-			m.kind = 'poll' AND (
-			COALESCE(m.poll->>'question','') ILIKE $2
-			OR EXISTS (
-				SELECT 1
-				FROM jsonb_array_elements(COALESCE(m.poll->'options','[]'::jsonb)) opt
-				WHERE COALESCE(opt->>'text','') ILIKE $2
-			)
-			)
-		)
-		)
-	ORDER BY m.id DESC
-	LIMIT $5
-	`, roomID, pat, beforeID, userID, limit)
+	// sort=recent (default, page with before=) | relevance (page with offset=)
+	sortBy := r.URL.Query().Get("sort")
+	switch sortBy {
+	case "":
+		sortBy = searchSortRecent
+	case searchSortRecent, searchSortRelevance:
+	default:
+		writeErr(w, http.StatusBadRequest, "sort must be recent or relevance")
+		return
+	}
 
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 1000 {
+			offset = n
+		}
+	}
 
+	out, err := s.store.SearchMessages(r.Context(), MessageSearch{
+		RoomID:   roomID,
+		ViewerID: userID,
+		Query:    q,
+		BeforeID: beforeID,
+		Sort:     sortBy,
+		Offset:   offset,
+		Limit:    limit,
+	})
 	if err != nil {
 		log.Println("handleSearchMessages db error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	defer rows.Close()
-
-	out := []MessageDTO{}
-
-	for rows.Next() {
-		var m MessageDTO
-		var createdMS int64
-		var replyToID int64
-		var deleted, edited, starred bool
-		var url, mime, filename *string
-		var size int64
-		var kind string
-		var pollJSON string
-
-		if err := rows.Scan(
-			&m.ID,
-			&m.RoomID,
-			&m.UserEmail,
-			&m.Body,
-			&createdMS,
-			&replyToID,
-			&deleted,
-			&edited,
-			&starred,
-			&url,
-			&mime,
-			&filename,
-			&size,
-			&kind,
-			&pollJSON,
-
-		); err != nil {
-			log.Println("handleSearchMessages scan error:", err)
-			writeErr(w, http.StatusInternalServerError, "db error")
-			return
-		}
-
-		m.CreatedAt = createdMS
-		m.ReplyToID = replyToID
-		m.Deleted = deleted
-		m.Edited = edited
-		m.Starred = starred
-		m.Kind = kind
-
-		if kind == "poll" && pollJSON != "" && !m.Deleted {
-		// parse stored poll
-		var stored struct {
-			Question string `json:"question"`
-			Options  []struct{ Text string `json:"text"` } `json:"options"`
-		}
-		if err := json.Unmarshal([]byte(pollJSON), &stored); err == nil {
-			// counts
-			counts := make([]int64, len(stored.Options))
-			r2, err := s.db.Query(r.Context(), `
-			SELECT option_idx, COUNT(*)::bigint
-			FROM poll_votes
-			WHERE message_id=$1
-			GROUP BY option_idx
-			`, m.ID)
-			if err == nil {
-			for r2.Next() {
-				var idx int
-				var cnt int64
-				if r2.Scan(&idx, &cnt) == nil && idx >= 0 && idx < len(counts) {
-				counts[idx] = cnt
-				}
-			}
-			r2.Close()
-			}
-
-			// myVote
-			myVote := -1
-			_ = s.db.QueryRow(r.Context(), `
-			SELECT COALESCE((SELECT option_idx FROM poll_votes WHERE message_id=$1 AND user_id=$2), -1)
-			`, m.ID, userID).Scan(&myVote)
-
-			outPoll := &PollDTO{Question: stored.Question, MyVote: myVote}
-			for i, o := range stored.Options {
-			outPoll.Options = append(outPoll.Options, PollOptionDTO{Text: o.Text, Count: counts[i]})
-			}
-			m.Poll = outPoll
-		}
-		}
-
-
-		if m.Deleted {
-			m.Body = ""
-			m.Attachment = nil
-		} else if url != nil && *url != "" {
-			m.Attachment = &Attachment{
-				URL:      *url,
-				Mime:     derefStr(mime),
-				Filename: derefStr(filename),
-				Size:     size,
-			}
-		}
-
-		out = append(out, m)
-	}
 
-	if err := rows.Err(); err != nil {
-		log.Println("handleSearchMessages rows error:", err)
+	if err := hydrateSearchHits(r.Context(), s.store, out, userID); err != nil {
+		log.Println("handleSearchMessages hydrate error:", err)
 		writeErr(w, http.StatusInternalServerError, "db error")
 		return
 	}
@@ -2889,12 +2747,7 @@ func (s *Server) handleStarMessage(w http.ResponseWriter, r *http.Request) {
   userID := userIDFromCtx(r)
 
   // optional: ensure user can see the message (member of room)
-  _, err := s.db.Exec(r.Context(), `
-    INSERT INTO message_stars(user_id, message_id)
-    VALUES ($1,$2)
-    ON CONFLICT DO NOTHING
-  `, userID, mid)
-  if err != nil { writeErr(w, 500, "db error"); return }
+  if err := s.store.StarMessages(r.Context(), userID, []int64{mid}); err != nil { writeErr(w, 500, "db error"); return }
 
   w.WriteHeader(http.StatusNoContent)
 }
@@ -2904,10 +2757,7 @@ func (s *Server) handleUnstarMessage(w http.ResponseWriter, r *http.Request) {
   if mid <= 0 { writeErr(w, 400, "invalid message id"); return }
   userID := userIDFromCtx(r)
 
-  _, err := s.db.Exec(r.Context(), `
-    DELETE FROM message_stars WHERE user_id=$1 AND message_id=$2
-  `, userID, mid)
-  if err != nil { writeErr(w, 500, "db error"); return }
+  if err := s.store.UnstarMessages(r.Context(), userID, []int64{mid}); err != nil { writeErr(w, 500, "db error"); return }
 
   w.WriteHeader(http.StatusNoContent)
 }
@@ -2937,16 +2787,10 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userID int64
-	err = s.db.QueryRow(r.Context(),
-		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
-		email, string(hash),
-	).Scan(&userID)
-
+	userID, err := s.store.CreateUser(r.Context(), email, string(hash))
 	if err != nil {
-		// handle unique violation (email already exists)
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// email already exists
+		if errors.Is(err, ErrConflict) {
 			writeErr(w, http.StatusConflict, "email already registered")
 			return
 		}
@@ -2982,14 +2826,8 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userID int64
-	var hash string
-	err := s.db.QueryRow(r.Context(),
-		`SELECT id, password_hash FROM users WHERE email=$1`,
-		email,
-	).Scan(&userID, &hash)
-
-	if errors.Is(err, pgx.ErrNoRows) {
+	user, err := s.store.UserByEmail(r.Context(), email)
+	if errors.Is(err, ErrNotFound) {
   writeErr(w, http.StatusUnauthorized, "invalid credentials")
   return
 }
@@ -2999,12 +2837,12 @@ if err != nil {
   return
 }
 
-	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
 		writeErr(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
-	token, err := s.makeJWT(userID, email)
+	token, err := s.makeJWT(user.ID, email)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "failed to create token")
 		return
@@ -3018,9 +2856,7 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 	email := emailFromCtx(r)
 
 	// optional: verify user still exists in DB
-	var exists bool
-	err := s.db.QueryRow(r.Context(), `SELECT true FROM users WHERE id=$1`, id).Scan(&exists)
-	if err != nil {
+	if _, err := s.store.UserByID(r.Context(), id); err != nil {
 		writeErr(w, http.StatusUnauthorized, "user not found")
 		return
 	}
@@ -3140,6 +2976,18 @@ func envOr(k, def string) string {
 	return v
 }
 
+func envInt(k string, def int) int {
+	v := strings.TrimSpace(os.Getenv(k))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("env %s: %v", k, err)
+	}
+	return n
+}
+
 func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
   mid, _ := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
   if mid <= 0 { writeErr(w, 400, "invalid message id"); return }
@@ -3147,22 +2995,18 @@ func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
   userID := userIDFromCtx(r)
 
   // get room_id + owner check
-  var roomID int64
-  var msgUserID int64
-  err := s.db.QueryRow(r.Context(), `SELECT room_id, user_id FROM messages WHERE id=$1`, mid).
-    Scan(&roomID, &msgUserID)
+  msg, err := s.store.GetMessage(r.Context(), mid)
   if err != nil { writeErr(w, 404, "not found"); return }
+  roomID := msg.RoomID
 
-  if msgUserID != userID {
-    writeErr(w, 403, "not allowed")
-    return
+  // your own messages, or anyone's with delete_others
+  if msg.UserID != userID {
+    if _, ok := s.requirePerm(w, r, roomID, permDeleteOthers); !ok {
+      return
+    }
   }
 
-  _, err = s.db.Exec(r.Context(), `
-    UPDATE messages
-    SET deleted_at = now(), body = ''
-    WHERE id=$1
-  `, mid)
+  unpinned, err := s.store.DeleteMessage(r.Context(), mid)
   if err != nil { writeErr(w, 500, "db error"); return }
 
   // broadcast delete to room
@@ -3171,6 +3015,9 @@ func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
 		RoomID:    roomID,
 		MessageID: mid,
 	})
+	if unpinned {
+		s.broadcastUnpinned(roomID, mid, emailFromCtx(r))
+	}
 
   w.WriteHeader(http.StatusNoContent)
 }
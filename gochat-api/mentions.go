@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mentionRe matches @name, @first.last and @user@example.com. The leading
+// group keeps plain email addresses in a body from counting as mentions.
+var mentionRe = regexp.MustCompile(`(?:^|[^\w.@])@([\w.+-]+(?:@[\w-]+(?:\.[\w-]+)+)?)`)
+
+type parsedMentions struct {
+	names map[string]bool // lowercased emails and email local parts
+	room  bool
+	here  bool
+}
+
+func (p parsedMentions) empty() bool {
+	return len(p.names) == 0 && !p.room && !p.here
+}
+
+func parseMentions(body string) parsedMentions {
+	p := parsedMentions{names: map[string]bool{}}
+	for _, m := range mentionRe.FindAllStringSubmatch(body, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		switch name {
+		case "":
+		case "room":
+			p.room = true
+		case "here":
+			p.here = true
+		default:
+			p.names[name] = true
+		}
+	}
+	return p
+}
+
+// resolveMentions maps parsed mentions onto roomID's members (userID ->
+// mentionKind*). The author is never mentioned; a direct mention wins over
+// @room/@here. @here means members currently active in the room.
+//
+// Accounts have no display name, so @name matches the local part of a
+// member's email instead. Two members with the same local part at
+// different domains are both mentioned; @alice@example.com picks one.
+func (s *Server) resolveMentions(ctx context.Context, roomID, authorID int64, p parsedMentions) (map[int64]string, []Member, error) {
+	out := map[int64]string{}
+	if p.empty() {
+		return out, nil, nil
+	}
+
+	members, err := s.store.ListMembers(ctx, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// presence carries emails as each client logged in with; compare lowercased
+	active := map[string]bool{}
+	if p.here {
+		for _, up := range s.hub.listPresences(roomID) {
+			if up.Status == "active" {
+				active[strings.ToLower(up.Email)] = true
+			}
+		}
+	}
+
+	for _, m := range members {
+		if m.UserID == authorID {
+			continue
+		}
+		email := strings.ToLower(m.Email)
+		local, _, _ := strings.Cut(email, "@")
+		switch {
+		case p.names[email] || p.names[local]:
+			out[m.UserID] = mentionKindUser
+		case p.room:
+			out[m.UserID] = mentionKindRoom
+		case p.here && active[email]:
+			out[m.UserID] = mentionKindHere
+		}
+	}
+	return out, members, nil
+}
+
+// recordMentions stores who body mentions and pushes a `mention` user_event
+// to anyone newly mentioned. Called on send and on edit; isEdit=false skips
+// the store entirely for bodies without mentions.
+func (s *Server) recordMentions(ctx context.Context, roomID, messageID, authorID int64, authorEmail, body string, isEdit bool) {
+	p := parseMentions(body)
+	if p.empty() && !isEdit {
+		return
+	}
+
+	mentions, members, err := s.resolveMentions(ctx, roomID, authorID, p)
+	if err != nil {
+		log.Println("mention resolve error:", err)
+		return
+	}
+	added, err := s.store.SetMentions(ctx, messageID, mentions)
+	if err != nil {
+		log.Println("mention store error:", err)
+		return
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	emails := map[int64]string{}
+	for _, m := range members {
+		emails[m.UserID] = m.Email
+	}
+	preview := body
+	if len(preview) > 140 {
+		preview = strings.ToValidUTF8(preview[:140], "") + "…"
+	}
+	for _, uid := range added {
+		s.hub.notifyUser(emails[uid], userEventMention, roomID, map[string]any{
+			"messageId": messageID,
+			"kind":      mentions[uid],
+			"from":      authorEmail,
+			"body":      preview,
+		})
+	}
+}
+
+type MentionDTO struct {
+	MessageDTO
+	RoomName    string `json:"roomName"`
+	MentionKind string `json:"mentionKind"` // user | room | here
+	Read        bool   `json:"read"`
+}
+
+type MentionsDTO struct {
+	Mentions   []MentionDTO `json:"mentions"`
+	NextCursor string       `json:"nextCursor,omitempty"` // pass back as ?before= for the next page
+}
+
+// handleListMentions is GET /mentions?unread=true&before=&limit=: messages
+// that mention the caller, newest first.
+func (s *Server) handleListMentions(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+
+	q := MentionQuery{UserID: userID, Limit: 50}
+	q.UnreadOnly, _ = strconv.ParseBool(r.URL.Query().Get("unread"))
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
+			q.Limit = n
+		}
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeErr(w, http.StatusBadRequest, "bad before")
+			return
+		}
+		q.BeforeID = n
+	}
+
+	mentions, err := s.store.ListMentions(r.Context(), q)
+	if err != nil {
+		log.Println("handleListMentions db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	msgs := make([]MessageDTO, len(mentions))
+	for i := range mentions {
+		msgs[i] = mentions[i].MessageDTO
+	}
+	if err := hydratePolls(r.Context(), s.store, msgs, userID); err != nil {
+		log.Println("handleListMentions poll counts error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := MentionsDTO{Mentions: make([]MentionDTO, 0, len(mentions))}
+	for i, m := range mentions {
+		out.Mentions = append(out.Mentions, MentionDTO{
+			MessageDTO:  msgs[i],
+			RoomName:    m.RoomName,
+			MentionKind: m.Kind,
+			Read:        m.Read,
+		})
+	}
+	if len(mentions) == q.Limit {
+		out.NextCursor = strconv.FormatInt(mentions[len(mentions)-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type markMentionsReadReq struct {
+	MessageIDs []int64 `json:"messageIds"` // empty = all
+}
+
+// handleMarkMentionsRead is POST /mentions/read.
+func (s *Server) handleMarkMentionsRead(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+
+	var req markMentionsReadReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	if len(req.MessageIDs) > 500 {
+		writeErr(w, http.StatusBadRequest, "too many ids")
+		return
+	}
+
+	if err := s.store.MarkMentionsRead(r.Context(), userID, req.MessageIDs); err != nil {
+		log.Println("handleMarkMentionsRead db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
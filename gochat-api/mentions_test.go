@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	p := parseMentions("hey @Alice, ask @bob@example.com. cc bob@example.com @room!")
+	if !p.names["alice"] || !p.names["bob@example.com"] || len(p.names) != 2 {
+		t.Errorf("names: got %v", p.names)
+	}
+	if !p.room || p.here {
+		t.Errorf("room=%v here=%v, want room only", p.room, p.here)
+	}
+	if p := parseMentions("mail carol@example.com"); !p.empty() {
+		t.Errorf("a plain email is not a mention: %+v", p)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	aliceID, alice := ts.user("alice@x")
+	_, bob := ts.user("bob@y")
+	carolID, carol := ts.user("carol@x")
+	roomID := ts.room(alice, "general", "public")
+	for _, tok := range []string{bob, carol} {
+		ts.expect(http.StatusOK, tok, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	}
+
+	// presence has emails as the client logged in with, not as stored
+	c, peer := wsClient(t, ts.s.hub, carolID, "Carol@X")
+	ts.s.hub.join(c, roomID)
+
+	msgID := ts.message(roomID, aliceID, "@bob and @here")
+	ts.s.recordMentions(ctx, roomID, msgID, aliceID, "alice@x", "@bob and @here", false)
+
+	inbox := func(token string) []MentionDTO {
+		t.Helper()
+		var out MentionsDTO
+		if st, msg := ts.call(token, "GET", "/mentions?unread=true", nil, &out); st != http.StatusOK {
+			t.Fatalf("mentions: %d %q", st, msg)
+		}
+		return out.Mentions
+	}
+	if got := inbox(bob); len(got) != 1 || got[0].MentionKind != mentionKindUser || got[0].ID != msgID {
+		t.Errorf("bob: got %+v, want a user mention of %d", got, msgID)
+	}
+	if got := inbox(carol); len(got) != 1 || got[0].MentionKind != mentionKindHere {
+		t.Errorf("carol: got %+v, want an @here mention", got)
+	}
+	if got := inbox(alice); len(got) != 0 {
+		t.Errorf("the author was mentioned: %+v", got)
+	}
+
+	if f := readUntil(t, peer, "user_event"); f.Event != userEventMention {
+		t.Errorf("carol got %s, want a mention user_event", f.raw)
+	}
+
+	// an edit only notifies whoever it adds
+	ts.s.recordMentions(ctx, roomID, msgID, aliceID, "alice@x", "@bob only", true)
+	if got := inbox(carol); len(got) != 0 {
+		t.Errorf("carol still mentioned after the edit: %+v", got)
+	}
+
+	ts.expect(http.StatusNoContent, bob, "POST", "/mentions/read", nil)
+	if got := inbox(bob); len(got) != 0 {
+		t.Errorf("bob's mentions still unread: %+v", got)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary but fixed: replicas starting together take turns migrating.
+const migrationLockID = 727_001
+
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads migrations/NNNN_name.{up,down}.sql, sorted by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	for _, e := range entries {
+		name := e.Name()
+
+		var dir string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			dir = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			dir = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+dir+".sql")
+		num, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.%s.sql", name, dir)
+		}
+		version, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", name, err)
+		}
+
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+name)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if dir == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	out := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the migration
+// advisory lock, with schema_migrations guaranteed to exist.
+func withMigrationLock(ctx context.Context, db *pgxpool.Pool, fn func(conn *pgx.Conn) error) error {
+	pooled, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer pooled.Release()
+	conn := pooled.Conn()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    BIGINT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *pgx.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]time.Time{}
+	for rows.Next() {
+		var v int64
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		out[v] = at
+	}
+	return out, rows.Err()
+}
+
+// migrateUp applies every pending migration, each in its own transaction.
+func migrateUp(ctx context.Context, db *pgxpool.Pool) error {
+	all, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, func(conn *pgx.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range all {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			// no args -> simple protocol, so a file can hold several statements
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Printf("migrate: applied %04d_%s", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// migrateDown rolls back the last n applied migrations.
+func migrateDown(ctx context.Context, db *pgxpool.Pool, n int) error {
+	all, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, func(conn *pgx.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(all) - 1; i >= 0 && n > 0; i-- {
+			m := all[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+			}
+
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version=$1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s (down): %w", m.Version, m.Name, err)
+			}
+			log.Printf("migrate: rolled back %04d_%s", m.Version, m.Name)
+			n--
+		}
+		return nil
+	})
+}
+
+func migrateStatus(ctx context.Context, db *pgxpool.Pool) error {
+	all, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, func(conn *pgx.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range all {
+			state := "pending"
+			if at, ok := applied[m.Version]; ok {
+				state = "applied " + at.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-40s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	})
+}
+
+// runMigrateCmd implements `gochat-api migrate [up | down [n] | status]`.
+func runMigrateCmd(args []string) {
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, mustEnv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "up":
+		err = migrateUp(ctx, db)
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				log.Fatalf("migrate down: bad step count %q", args[1])
+			}
+		}
+		err = migrateDown(ctx, db, n)
+	case "status":
+		err = migrateStatus(ctx, db)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: gochat-api migrate [up | down [n] | status]")
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
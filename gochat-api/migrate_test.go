@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	// versions run 1, 2, 3... with no gaps, so a missing file can't be
+	// skipped silently, and each one can be rolled back
+	for i, m := range all {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %d: version %04d, want %04d", i, m.Version, i+1)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+		if strings.TrimSpace(m.Up) == "" {
+			t.Errorf("migration %04d_%s has an empty up file", m.Version, m.Name)
+		}
+	}
+}
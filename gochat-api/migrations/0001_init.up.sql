@@ -1,9 +1,9 @@
 -- Users
 CREATE TABLE IF NOT EXISTS users (
-  id           BIGSERIAL PRIMARY KEY,
-  email        TEXT UNIQUE NOT NULL,
+  id            BIGSERIAL PRIMARY KEY,
+  email         TEXT UNIQUE NOT NULL,
   password_hash TEXT NOT NULL,
-  created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 -- Rooms (group chats)
@@ -23,14 +23,17 @@ CREATE TABLE IF NOT EXISTS room_members (
   PRIMARY KEY (room_id, user_id)
 );
 
+CREATE INDEX IF NOT EXISTS idx_room_members_user_id
+  ON room_members (user_id);
+
 -- Messages
 CREATE TABLE IF NOT EXISTS messages (
   id         BIGSERIAL PRIMARY KEY,
   room_id    BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
   user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  body       TEXT NOT NULL CHECK (length(body) <= 4000),
+  body       TEXT NOT NULL DEFAULT '',
   created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 CREATE INDEX IF NOT EXISTS idx_messages_room_created_at
-ON messages (room_id, created_at DESC);
+  ON messages (room_id, created_at DESC);
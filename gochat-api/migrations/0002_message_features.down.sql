@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_messages_room_id_id;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS reply_to_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS poll;
+ALTER TABLE messages DROP COLUMN IF EXISTS kind;
+ALTER TABLE messages DROP COLUMN IF EXISTS attachment_size;
+ALTER TABLE messages DROP COLUMN IF EXISTS attachment_filename;
+ALTER TABLE messages DROP COLUMN IF EXISTS attachment_mime;
+ALTER TABLE messages DROP COLUMN IF EXISTS attachment_url;
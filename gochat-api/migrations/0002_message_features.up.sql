@@ -0,0 +1,17 @@
+-- Attachments (file bytes live in uploads/, the DB only keeps metadata)
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_url      TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_mime     TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_filename TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_size     BIGINT;
+
+-- 'text' | 'poll'; poll holds {"question": ..., "options": [{"text": ...}]}
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'text';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS poll JSONB;
+
+-- Replies, edits, soft deletes
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id BIGINT REFERENCES messages(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at   TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at  TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room_id_id
+  ON messages (room_id, id DESC);
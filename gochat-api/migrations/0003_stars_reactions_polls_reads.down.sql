@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS room_reads;
+DROP TABLE IF EXISTS poll_votes;
+DROP TABLE IF EXISTS message_reactions;
+DROP TABLE IF EXISTS message_stars;
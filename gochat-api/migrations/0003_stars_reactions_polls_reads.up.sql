@@ -0,0 +1,37 @@
+-- Personal stars
+CREATE TABLE IF NOT EXISTS message_stars (
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_stars_user_created_at
+  ON message_stars (user_id, created_at DESC);
+
+-- Emoji reactions
+CREATE TABLE IF NOT EXISTS message_reactions (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  emoji      TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (message_id, user_id, emoji)
+);
+
+-- One vote per user per poll
+CREATE TABLE IF NOT EXISTS poll_votes (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  option_idx INT NOT NULL CHECK (option_idx >= 0),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (message_id, user_id)
+);
+
+-- Read markers (unread counts)
+CREATE TABLE IF NOT EXISTS room_reads (
+  room_id              BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  user_id              BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  last_read_message_id BIGINT NOT NULL DEFAULT 0,
+  updated_at           TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (room_id, user_id)
+);
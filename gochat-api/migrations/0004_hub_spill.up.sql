@@ -0,0 +1,9 @@
+-- Oversized cross-node hub frames (pg_notify payloads max out at 8000 bytes)
+CREATE TABLE IF NOT EXISTS hub_spill (
+  id         BIGSERIAL PRIMARY KEY,
+  payload    TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_hub_spill_created_at
+  ON hub_spill (created_at);
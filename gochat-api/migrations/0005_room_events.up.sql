@@ -0,0 +1,17 @@
+-- Per-room sequence numbers + durable WS event log (replayed on reconnect)
+CREATE TABLE IF NOT EXISTS room_seqs (
+  room_id  BIGINT PRIMARY KEY REFERENCES rooms(id) ON DELETE CASCADE,
+  last_seq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS room_events (
+  room_id    BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  seq        BIGINT NOT NULL,
+  type       TEXT NOT NULL,
+  frame      TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (room_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_room_events_created_at
+  ON room_events (created_at);
@@ -0,0 +1,6 @@
+-- Client-generated idempotency key for WS "message" sends
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uq_messages_client_msg_id
+  ON messages (room_id, user_id, client_msg_id)
+  WHERE client_msg_id IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Calls that were live when a node shut down (see shutdown.go). The next
+-- node to start takes them back into memory and deletes the rows.
+CREATE TABLE IF NOT EXISTS room_calls (
+  room_id  BIGINT PRIMARY KEY REFERENCES rooms(id) ON DELETE CASCADE,
+  state    JSONB NOT NULL,
+  saved_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
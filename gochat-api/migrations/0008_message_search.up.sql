@@ -0,0 +1,11 @@
+-- Full-text search over message body, attachment filename and poll text.
+-- Body ranks above the rest; jsonb_to_tsvector with '["string"]' indexes the
+-- poll's question and option texts but not its keys.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_tsv tsvector
+  GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(body, '')), 'A') ||
+    setweight(to_tsvector('simple', COALESCE(attachment_filename, '')), 'B') ||
+    setweight(jsonb_to_tsvector('english', COALESCE(poll, '{}'::jsonb), '["string"]'), 'B')
+  ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search_tsv ON messages USING GIN (search_tsv);
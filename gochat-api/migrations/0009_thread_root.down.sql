@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_messages_thread_root_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS thread_root_id;
@@ -0,0 +1,24 @@
+-- replyToId keeps the message actually replied to; the thread it belongs to
+-- (its top-level ancestor) lives in thread_root_id.
+ALTER TABLE messages
+  ADD COLUMN IF NOT EXISTS thread_root_id BIGINT REFERENCES messages(id) ON DELETE SET NULL;
+
+-- Existing replies can answer other replies: walk each chain up to its root.
+WITH RECURSIVE chain AS (
+  SELECT id, id AS root_id
+  FROM messages
+  WHERE reply_to_id IS NULL
+  UNION ALL
+  SELECT m.id, c.root_id
+  FROM messages m
+  JOIN chain c ON m.reply_to_id = c.id
+)
+UPDATE messages m
+SET thread_root_id = c.root_id
+FROM chain c
+WHERE c.id = m.id AND m.reply_to_id IS NOT NULL AND m.thread_root_id IS NULL;
+
+-- Thread lookups: replies of a root, oldest first
+CREATE INDEX IF NOT EXISTS idx_messages_thread_root_id
+  ON messages (thread_root_id, id)
+  WHERE thread_root_id IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS revision_count;
+DROP TABLE IF EXISTS message_revisions;
@@ -0,0 +1,18 @@
+-- Edit history: one row per edit, holding the content it replaced
+CREATE TABLE IF NOT EXISTS message_revisions (
+  id          BIGSERIAL PRIMARY KEY,
+  message_id  BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  editor_id   BIGINT REFERENCES users(id) ON DELETE SET NULL,
+  body        TEXT NOT NULL,
+  poll        JSONB,
+  vote_counts BIGINT[], -- poll tallies per option, kept when the edit moved or dropped votes
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id
+  ON message_revisions (message_id, id);
+
+-- Kept in step with message_revisions by the stores, so listing messages
+-- doesn't count revisions row by row.
+ALTER TABLE messages
+  ADD COLUMN IF NOT EXISTS revision_count INT NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+-- Who a message mentions; read_at is set from the mentions inbox
+CREATE TABLE IF NOT EXISTS message_mentions (
+  message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind       TEXT NOT NULL CHECK (kind IN ('user', 'room', 'here')),
+  read_at    TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_mentions_user_message
+  ON message_mentions (user_id, message_id DESC);
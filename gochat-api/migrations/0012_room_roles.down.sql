@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_room_members_one_owner;
+ALTER TABLE room_members DROP CONSTRAINT IF EXISTS room_members_role_check;
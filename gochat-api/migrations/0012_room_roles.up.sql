@@ -0,0 +1,19 @@
+-- Roles drive permissions now (see roles.go): make sure every creator is
+-- their room's owner, nobody else is, and nothing outside the known set sneaks in.
+UPDATE room_members rm
+SET role = CASE WHEN r.created_by = rm.user_id THEN 'owner' ELSE 'member' END
+FROM rooms r
+WHERE r.id = rm.room_id
+  AND (
+    (r.created_by = rm.user_id AND rm.role <> 'owner')
+    OR (r.created_by <> rm.user_id AND rm.role NOT IN ('admin', 'moderator', 'member', 'readonly'))
+  );
+
+ALTER TABLE room_members
+  ADD CONSTRAINT room_members_role_check
+  CHECK (role IN ('owner', 'admin', 'moderator', 'member', 'readonly'));
+
+-- At most one owner per room
+CREATE UNIQUE INDEX IF NOT EXISTS idx_room_members_one_owner
+  ON room_members (room_id)
+  WHERE role = 'owner';
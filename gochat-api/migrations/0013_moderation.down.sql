@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS room_bans;
+ALTER TABLE room_members DROP COLUMN IF EXISTS muted_until;
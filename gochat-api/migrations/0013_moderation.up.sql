@@ -0,0 +1,13 @@
+-- Mutes / timeouts live on the membership; kicking or banning clears them
+ALTER TABLE room_members ADD COLUMN IF NOT EXISTS muted_until TIMESTAMPTZ;
+
+-- Bans outlive membership; expires_at NULL = permanent
+CREATE TABLE IF NOT EXISTS room_bans (
+  room_id    BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  banned_by  BIGINT REFERENCES users(id) ON DELETE SET NULL,
+  reason     TEXT NOT NULL DEFAULT '',
+  expires_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (room_id, user_id)
+);
@@ -0,0 +1,27 @@
+-- Existing rooms keep today's join-by-id behaviour
+ALTER TABLE rooms
+  ADD COLUMN IF NOT EXISTS visibility TEXT NOT NULL DEFAULT 'public'
+  CHECK (visibility IN ('public', 'invite_only', 'private'));
+
+CREATE TABLE IF NOT EXISTS room_invites (
+  token      TEXT PRIMARY KEY,
+  room_id    BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  created_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+  expires_at TIMESTAMPTZ,           -- NULL = never
+  max_uses   INT NOT NULL DEFAULT 0, -- 0 = unlimited
+  uses       INT NOT NULL DEFAULT 0,
+  revoked_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_room_invites_room_id
+  ON room_invites (room_id, created_at DESC);
+
+-- Pending /join requests for invite_only rooms
+CREATE TABLE IF NOT EXISTS room_join_requests (
+  room_id    BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+  user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  note       TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (room_id, user_id)
+);
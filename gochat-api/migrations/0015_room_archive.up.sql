@@ -0,0 +1,9 @@
+-- Archived rooms are read-only; deleted rooms are hidden until the purger
+-- removes them for good (see runRoomPurger).
+ALTER TABLE rooms
+  ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS deleted_at  TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_rooms_deleted_at
+  ON rooms (deleted_at)
+  WHERE deleted_at IS NOT NULL;
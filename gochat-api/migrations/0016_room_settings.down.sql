@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_messages_room_user_id;
+ALTER TABLE rooms
+  DROP COLUMN IF EXISTS slow_mode_seconds,
+  DROP COLUMN IF EXISTS call_role,
+  DROP COLUMN IF EXISTS retention_days,
+  DROP COLUMN IF EXISTS avatar_url,
+  DROP COLUMN IF EXISTS description,
+  DROP COLUMN IF EXISTS topic;
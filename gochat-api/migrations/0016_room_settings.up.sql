@@ -0,0 +1,13 @@
+-- Room metadata and settings (see settings.go)
+ALTER TABLE rooms
+  ADD COLUMN IF NOT EXISTS topic             TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS description       TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS avatar_url        TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS retention_days    INT  NOT NULL DEFAULT 0 CHECK (retention_days >= 0),   -- 0 = keep forever
+  ADD COLUMN IF NOT EXISTS call_role         TEXT NOT NULL DEFAULT 'member'
+    CHECK (call_role IN ('owner', 'admin', 'moderator', 'member')),                                  -- lowest role that can start calls
+  ADD COLUMN IF NOT EXISTS slow_mode_seconds INT  NOT NULL DEFAULT 0 CHECK (slow_mode_seconds >= 0); -- 0 = off
+
+-- slow mode looks up a member's latest post
+CREATE INDEX IF NOT EXISTS idx_messages_room_user_id
+  ON messages (room_id, user_id, id DESC);
@@ -0,0 +1,4 @@
+DELETE FROM rooms WHERE kind = 'dm';
+ALTER TABLE rooms
+  DROP COLUMN IF EXISTS dm_key,
+  DROP COLUMN IF EXISTS kind;
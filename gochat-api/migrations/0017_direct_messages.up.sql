@@ -0,0 +1,5 @@
+-- Direct messages are rooms with kind 'dm'. dm_key is the sorted participant
+-- ids, so the same set of people always lands in the same conversation.
+ALTER TABLE rooms
+  ADD COLUMN IF NOT EXISTS kind   TEXT NOT NULL DEFAULT 'room' CHECK (kind IN ('room', 'dm')),
+  ADD COLUMN IF NOT EXISTS dm_key TEXT UNIQUE;
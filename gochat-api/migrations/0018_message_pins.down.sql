@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_messages_room_pinned;
+ALTER TABLE messages
+  DROP COLUMN IF EXISTS pinned_by,
+  DROP COLUMN IF EXISTS pinned_at;
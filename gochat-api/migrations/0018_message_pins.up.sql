@@ -0,0 +1,9 @@
+-- Room-wide pins (see pins.go). A deleted message drops out of the pin list;
+-- pinned_by goes NULL if the pinner's account is deleted.
+ALTER TABLE messages
+  ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS pinned_by BIGINT REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room_pinned
+  ON messages (room_id, pinned_at DESC)
+  WHERE pinned_at IS NOT NULL;
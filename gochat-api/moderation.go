@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxModerationMinutes = 365 * 24 * 60
+
+type moderationReq struct {
+	Reason          string `json:"reason"`
+	DurationMinutes int    `json:"durationMinutes"` // 0 = no expiry
+}
+
+// decodeModeration reads an optional moderationReq body.
+func decodeModeration(w http.ResponseWriter, r *http.Request) (moderationReq, bool) {
+	var req moderationReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return req, false
+		}
+	}
+	if req.DurationMinutes < 0 || req.DurationMinutes > maxModerationMinutes {
+		writeErr(w, http.StatusBadRequest, "bad durationMinutes")
+		return req, false
+	}
+	if len(req.Reason) > 500 {
+		writeErr(w, http.StatusBadRequest, "reason too long")
+		return req, false
+	}
+	return req, true
+}
+
+// moderationTarget resolves /rooms/{roomID}/members/{userID}/... for a
+// moderation action: the caller needs permModerate and must outrank the
+// target. target.Role is "" when they aren't in the room; only allowMissing
+// actions (ban) accept that.
+func (s *Server) moderationTarget(w http.ResponseWriter, r *http.Request, allowMissing bool) (roomID int64, actor, target Member, ok bool) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return
+	}
+	targetID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || targetID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad user id")
+		return
+	}
+
+	if actor, ok = s.requirePerm(w, r, roomID, permModerate); !ok {
+		return
+	}
+	ok = false
+	if targetID == actor.UserID {
+		writeErr(w, http.StatusBadRequest, "cannot moderate yourself")
+		return
+	}
+
+	target, err = s.roomMember(r.Context(), roomID, targetID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if target.Role == "" {
+		if !allowMissing {
+			writeErr(w, http.StatusNotFound, "not a room member")
+			return
+		}
+		u, err := s.store.UserByID(r.Context(), targetID)
+		if errors.Is(err, ErrNotFound) {
+			writeErr(w, http.StatusNotFound, "user not found")
+			return
+		}
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		target.Email = u.Email
+	} else if roleRank[target.Role] >= roleRank[actor.Role] {
+		writeErr(w, http.StatusForbidden, "not allowed")
+		return
+	}
+
+	if actor.Email == "" {
+		actor.Email = emailFromCtx(r)
+	}
+	return roomID, actor, target, true
+}
+
+func durationText(minutes int) string {
+	switch {
+	case minutes%(24*60) == 0:
+		return fmt.Sprintf("%d day(s)", minutes/(24*60))
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d hour(s)", minutes/60)
+	}
+	return fmt.Sprintf("%d min", minutes)
+}
+
+// handleKickMember is POST /rooms/{roomID}/members/{userID}/kick. They can
+// come straight back via /join; ban them to keep them out.
+func (s *Server) handleKickMember(w http.ResponseWriter, r *http.Request) {
+	roomID, actor, target, ok := s.moderationTarget(w, r, false)
+	if !ok {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.store.RemoveMember(r.Context(), roomID, target.UserID); err != nil {
+		log.Println("handleKickMember db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	s.hub.evict(roomID, target.UserID, "kicked")
+	s.hub.notifyUser(target.Email, userEventRoomRemoved, roomID, map[string]any{"reason": "kicked", "note": req.Reason})
+	s.broadcastSystem(roomID, fmt.Sprintf("👢 %s was removed by %s", target.Email, actor.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBanMember is POST /rooms/{roomID}/members/{userID}/ban. Works on
+// non-members too, to keep someone out pre-emptively.
+func (s *Server) handleBanMember(w http.ResponseWriter, r *http.Request) {
+	roomID, actor, target, ok := s.moderationTarget(w, r, true)
+	if !ok {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	b := Ban{RoomID: roomID, UserID: target.UserID, BannedBy: actor.UserID, Reason: req.Reason}
+	if req.DurationMinutes > 0 {
+		b.ExpiresAt = time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute)
+	}
+	if err := s.store.Ban(r.Context(), b); err != nil {
+		log.Println("handleBanMember db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	text := fmt.Sprintf("🚫 %s was banned by %s", target.Email, actor.Email)
+	if req.DurationMinutes > 0 {
+		text += " for " + durationText(req.DurationMinutes)
+	}
+	if target.Role != "" {
+		s.hub.evict(roomID, target.UserID, "banned")
+		s.hub.notifyUser(target.Email, userEventRoomRemoved, roomID, map[string]any{"reason": "banned", "note": req.Reason})
+	}
+	s.broadcastSystem(roomID, text)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUnbanMember is DELETE /rooms/{roomID}/members/{userID}/ban.
+func (s *Server) handleUnbanMember(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return
+	}
+	targetID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || targetID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad user id")
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permModerate); !ok {
+		return
+	}
+
+	err = s.store.Unban(r.Context(), roomID, targetID)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "not banned")
+		return
+	}
+	if err != nil {
+		log.Println("handleUnbanMember db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type BanDTO struct {
+	UserID    int64  `json:"userId"`
+	Email     string `json:"email"`
+	BannedBy  string `json:"bannedBy,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // unix ms; absent = permanent
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// handleListBans is GET /rooms/{roomID}/bans (moderators and up).
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return
+	}
+	if _, ok := s.requirePerm(w, r, roomID, permModerate); !ok {
+		return
+	}
+
+	bans, err := s.store.ListBans(r.Context(), roomID)
+	if err != nil {
+		log.Println("handleListBans db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := make([]BanDTO, 0, len(bans))
+	for _, b := range bans {
+		dto := BanDTO{
+			UserID:    b.UserID,
+			Email:     b.Email,
+			BannedBy:  b.BannedByEmail,
+			Reason:    b.Reason,
+			CreatedAt: b.CreatedAt.UnixMilli(),
+		}
+		if !b.ExpiresAt.IsZero() {
+			dto.ExpiresAt = b.ExpiresAt.UnixMilli()
+		}
+		out = append(out, dto)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleMuteMember is POST /rooms/{roomID}/members/{userID}/mute. With
+// durationMinutes it's a timeout that lifts by itself; without, it lasts
+// until DELETE .../mute. Muted members keep reading but can't post, type
+// or create polls.
+func (s *Server) handleMuteMember(w http.ResponseWriter, r *http.Request) {
+	roomID, actor, target, ok := s.moderationTarget(w, r, false)
+	if !ok {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	until := muteForever
+	if req.DurationMinutes > 0 {
+		until = time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute)
+	}
+	if err := s.store.SetMute(r.Context(), roomID, target.UserID, until); err != nil {
+		log.Println("handleMuteMember db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.hub.forgetMember(roomID, target.UserID)
+
+	var untilMS int64
+	text := fmt.Sprintf("🔇 %s was muted by %s", target.Email, actor.Email)
+	if req.DurationMinutes > 0 {
+		untilMS = until.UnixMilli()
+		text = fmt.Sprintf("⏱️ %s was timed out by %s for %s", target.Email, actor.Email, durationText(req.DurationMinutes))
+	}
+	s.hub.notifyUser(target.Email, userEventMuted, roomID, map[string]any{"until": untilMS, "reason": req.Reason})
+	s.broadcastSystem(roomID, text)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUnmuteMember is DELETE /rooms/{roomID}/members/{userID}/mute.
+func (s *Server) handleUnmuteMember(w http.ResponseWriter, r *http.Request) {
+	roomID, actor, target, ok := s.moderationTarget(w, r, false)
+	if !ok {
+		return
+	}
+	if !target.MutedUntil.After(time.Now()) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.store.SetMute(r.Context(), roomID, target.UserID, time.Time{}); err != nil {
+		log.Println("handleUnmuteMember db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.hub.forgetMember(roomID, target.UserID)
+
+	s.hub.notifyUser(target.Email, userEventUnmuted, roomID, nil)
+	s.broadcastSystem(roomID, fmt.Sprintf("🔊 %s was unmuted by %s", target.Email, actor.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestBanBlocksJoin(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	bobID, bob := ts.user("bob@example.com")
+
+	roomID := ts.room(alice, "general", visibilityPublic)
+	var inv InviteDTO
+	if st, msg := ts.call(alice, "POST", fmt.Sprintf("/rooms/%d/invites", roomID), nil, &inv); st != http.StatusCreated {
+		t.Fatalf("create invite: status %d (%q)", st, msg)
+	}
+
+	// bans work on people who were never in the room
+	ban := fmt.Sprintf("/rooms/%d/members/%d/ban", roomID, bobID)
+	ts.expect(http.StatusNoContent, alice, "POST", ban, map[string]string{"reason": "spam"})
+
+	if msg := ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil); msg != "banned from this room" {
+		t.Errorf("join while banned: error %q", msg)
+	}
+	ts.expect(http.StatusForbidden, bob, "POST", "/invites/"+inv.Token+"/accept", nil)
+
+	ts.expect(http.StatusNoContent, alice, "DELETE", ban, nil)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+}
+
+func TestKickRacesJoin(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	bobID, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	join := fmt.Sprintf("/rooms/%d/join", roomID)
+	kick := fmt.Sprintf("/rooms/%d/members/%d/kick", roomID, bobID)
+
+	conn := ts.ws(bob)
+	for i := 0; i < 20; i++ {
+		ts.expect(http.StatusOK, bob, "POST", join, nil)
+
+		var wg sync.WaitGroup
+		var kicked int
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kicked, _ = ts.call(alice, "POST", kick, nil, nil)
+		}()
+		wsSend(t, conn, map[string]any{"type": "join_room", "roomId": roomID})
+		wg.Wait()
+		if kicked != http.StatusNoContent {
+			t.Fatalf("round %d: kick status %d", i, kicked)
+		}
+
+		// frames are handled in order: once this is answered, so is the join
+		wsSend(t, conn, map[string]any{"type": "unsubscribe", "roomIds": []int64{-1}})
+		readUntil(t, conn, "unsubscribed")
+
+		for _, u := range ts.s.hub.listPresences(roomID) {
+			if u.Email == "bob@example.com" {
+				t.Fatalf("round %d: bob is still in the room after being kicked", i)
+			}
+		}
+	}
+}
+
+func TestMuteBlocksPosting(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	bobID, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+
+	conn := ts.ws(bob)
+	wsSend(t, conn, WSIn{Type: "join_room", RoomID: roomID})
+	readUntil(t, conn, "user_list")
+	post := func() wsFrame {
+		t.Helper()
+		wsSend(t, conn, WSIn{Type: "message", RoomID: roomID, Body: "hi"})
+		for {
+			if f := readFrame(t, conn); f.Type == "message_ack" || f.Type == "message_error" {
+				return f
+			}
+		}
+	}
+	if f := post(); f.Type != "message_ack" {
+		t.Fatalf("before the mute: got %s", f.raw)
+	}
+
+	// a timeout; bob already has his role cached from the post above
+	mute := fmt.Sprintf("/rooms/%d/members/%d/mute", roomID, bobID)
+	ts.expect(http.StatusForbidden, bob, "POST", mute, nil)
+	ts.expect(http.StatusNoContent, alice, "POST", mute, map[string]int{"durationMinutes": 10})
+	if f := readUntil(t, conn, "user_event"); f.Event != userEventMuted {
+		t.Errorf("got %s, want a muted user_event", f.raw)
+	}
+	if f := post(); f.Type != "message_error" || !jsonHas(f.raw, `"code":"muted"`) {
+		t.Errorf("while muted: got %s", f.raw)
+	}
+	ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/polls", roomID),
+		createPollReq{Question: "q", Options: []string{"a", "b"}})
+
+	// still reading
+	ts.expect(http.StatusOK, bob, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil)
+
+	ts.expect(http.StatusNoContent, alice, "DELETE", mute, nil)
+	if f := post(); f.Type != "message_ack" {
+		t.Errorf("after unmute: got %s", f.raw)
+	}
+}
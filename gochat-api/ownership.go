@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ownerSuccessor picks who inherits a room when its owner goes: the
+// longest-standing admin, else the highest-ranked, longest-standing member.
+// members must be in ListMembers order. pgStore.DeleteUser mirrors this.
+func ownerSuccessor(members []Member, ownerID int64) (Member, bool) {
+	var best Member
+	for _, m := range members {
+		if m.UserID == ownerID || m.Role == roleOwner {
+			continue
+		}
+		if best.Role == "" || roleRank[m.Role] > roleRank[best.Role] {
+			best = m
+		}
+	}
+	return best, best.Role != ""
+}
+
+// announceOwnerChange tells the room who owns it now, as a durable
+// owner_changed event plus a system message, and lets the new owner know on
+// their user channel. prevID is 0 when the previous owner's account is gone.
+func (s *Server) announceOwnerChange(roomID, prevID int64, prevEmail string, next Member, text string) {
+	s.hub.forgetMember(roomID, next.UserID)
+	if prevID > 0 {
+		s.hub.forgetMember(roomID, prevID)
+	}
+
+	s.hub.BroadcastToRoom(roomID, map[string]any{
+		"type":          "owner_changed",
+		"roomId":        roomID,
+		"ownerEmail":    next.Email,
+		"previousOwner": prevEmail,
+	})
+	s.broadcastSystem(roomID, text)
+	s.hub.notifyUser(next.Email, userEventOwnerChanged, roomID, map[string]any{"from": prevEmail})
+}
+
+type transferOwnershipReq struct {
+	UserID int64 `json:"userId"`
+}
+
+// handleTransferOwnership is POST /rooms/{roomID}/transfer: the owner hands
+// the room to another member and stays on as an admin.
+func (s *Server) handleTransferOwnership(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var req transferOwnershipReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.UserID <= 0 {
+		writeErr(w, http.StatusBadRequest, "userId required")
+		return
+	}
+
+	actor, err := s.roomMember(r.Context(), roomID, userIDFromCtx(r))
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if actor.Role != roleOwner {
+		writeErr(w, http.StatusForbidden, "only the room owner can transfer ownership")
+		return
+	}
+	if req.UserID == actor.UserID {
+		writeErr(w, http.StatusBadRequest, "you already own this room")
+		return
+	}
+
+	target, err := s.store.GetMember(r.Context(), roomID, req.UserID)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "not a room member")
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if err := s.store.TransferOwnership(r.Context(), roomID, target.UserID); err != nil {
+		log.Println("handleTransferOwnership db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	email := emailFromCtx(r)
+	s.announceOwnerChange(roomID, actor.UserID, email, target,
+		fmt.Sprintf("👑 %s handed ownership to %s", email, target.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerLeaveReq struct {
+	TransferTo int64 `json:"transferTo"` // optional; defaults to ownerSuccessor
+}
+
+// handOffOwnership runs before the owner leaves roomID: it passes the room
+// to req.TransferTo or the default successor. It writes the error response
+// itself and returns false if the owner can't leave.
+func (s *Server) handOffOwnership(w http.ResponseWriter, r *http.Request, roomID int64) bool {
+	var req ownerLeaveReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return false
+		}
+	}
+
+	userID := userIDFromCtx(r)
+	members, err := s.store.ListMembers(r.Context(), roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return false
+	}
+
+	var next Member
+	if req.TransferTo > 0 && req.TransferTo != userID {
+		for _, m := range members {
+			if m.UserID == req.TransferTo {
+				next = m
+			}
+		}
+		if next.Role == "" {
+			writeErr(w, http.StatusNotFound, "transferTo is not a room member")
+			return false
+		}
+	} else if next, _ = ownerSuccessor(members, userID); next.Role == "" {
+		writeErr(w, http.StatusConflict, "you're the only member; delete the room instead")
+		return false
+	}
+
+	if err := s.store.TransferOwnership(r.Context(), roomID, next.UserID); err != nil {
+		log.Println("handOffOwnership db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return false
+	}
+
+	email := emailFromCtx(r)
+	s.announceOwnerChange(roomID, userID, email, next,
+		fmt.Sprintf("👑 %s left; %s is the new owner", email, next.Email))
+	return true
+}
+
+type deleteAccountReq struct {
+	Password string `json:"password"`
+}
+
+// handleDeleteMe is DELETE /me. It asks for the password again. Owned rooms
+// pass to their successor instead of being deleted; the user's messages,
+// reactions and votes stay, under a deleted-user-N tombstone.
+func (s *Server) handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+	email := emailFromCtx(r)
+
+	var req deleteAccountReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		writeErr(w, http.StatusBadRequest, "password required")
+		return
+	}
+
+	user, err := s.store.UserByID(r.Context(), userID)
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		writeErr(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	// grab rooms before the cascade so live sockets can be evicted after
+	rooms, err := s.store.ListRooms(r.Context(), userID, roomViewAll)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	dms, err := s.store.ListRooms(r.Context(), userID, roomViewDMs)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	rooms = append(rooms, dms...)
+
+	changes, err := s.store.DeleteUser(r.Context(), userID)
+	if err != nil {
+		log.Println("handleDeleteMe db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	for _, room := range rooms {
+		s.hub.evict(room.ID, userID, "account_deleted")
+	}
+	for _, c := range changes {
+		if c.NewOwner.UserID == 0 {
+			continue // nobody else was in it; the room went with the account
+		}
+		s.announceOwnerChange(c.RoomID, 0, email, c.NewOwner,
+			fmt.Sprintf("👑 %s deleted their account; %s is the new owner", email, c.NewOwner.Email))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
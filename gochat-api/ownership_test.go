@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// roles returns roomID's members as email -> role.
+func (ts *testServer) roles(token string, roomID int64) map[string]string {
+	ts.t.Helper()
+	var members []MemberDTO
+	if st, msg := ts.call(token, "GET", fmt.Sprintf("/rooms/%d/members", roomID), nil, &members); st != http.StatusOK {
+		ts.t.Fatalf("members: status %d (%q)", st, msg)
+	}
+	out := map[string]string{}
+	for _, m := range members {
+		out[m.Email] = m.Role
+	}
+	return out
+}
+
+func TestTransferOwnership(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	bobID, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	path := fmt.Sprintf("/rooms/%d/transfer", roomID)
+
+	ts.expect(http.StatusForbidden, bob, "POST", path, transferOwnershipReq{UserID: bobID})
+	ts.expect(http.StatusNotFound, alice, "POST", path, transferOwnershipReq{UserID: bobID + 100})
+	ts.expect(http.StatusNoContent, alice, "POST", path, transferOwnershipReq{UserID: bobID})
+
+	got := ts.roles(alice, roomID)
+	if got["bob@example.com"] != roleOwner || got["alice@example.com"] != roleAdmin {
+		t.Errorf("after transfer: got %v, want bob owner, alice admin", got)
+	}
+	if info, _ := ts.s.store.GetRoom(t.Context(), roomID); info.CreatedBy != bobID {
+		t.Errorf("rooms.created_by: got %d, want %d", info.CreatedBy, bobID)
+	}
+}
+
+func TestOwnerLeave(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	carolID, carol := ts.user("carol@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	leave := fmt.Sprintf("/rooms/%d/leave", roomID)
+
+	if msg := ts.expect(http.StatusConflict, alice, "POST", leave, nil); msg != "you're the only member; delete the room instead" {
+		t.Errorf("last member leaving: error %q", msg)
+	}
+
+	// bob has been here longer, but carol is an admin
+	for _, tok := range []string{bob, carol} {
+		ts.expect(http.StatusOK, tok, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	}
+	ts.expect(http.StatusNoContent, alice, "PUT", fmt.Sprintf("/rooms/%d/members/%d/role", roomID, carolID), setRoleReq{Role: roleAdmin})
+
+	conn := ts.ws(carol)
+	ts.expect(http.StatusNoContent, alice, "POST", leave, nil)
+	if f := readUntil(t, conn, "user_event"); f.Event != userEventOwnerChanged || f.RoomID != roomID {
+		t.Errorf("carol: got %s, want room_ownership", f.raw)
+	}
+
+	got := ts.roles(bob, roomID)
+	if _, ok := got["alice@example.com"]; ok || got["carol@example.com"] != roleOwner || got["bob@example.com"] != roleMember {
+		t.Errorf("after the owner left: got %v", got)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ts := newTestServer(t)
+	var reg AuthResponse
+	if st, msg := ts.call("", "POST", "/auth/register", AuthRequest{Email: "alice@example.com", Password: "hunter22"}, &reg); st >= 300 {
+		t.Fatalf("register: status %d (%q)", st, msg)
+	}
+	alice := reg.Token
+	u, err := ts.s.store.UserByEmail(t.Context(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID := u.ID
+	_, bob := ts.user("bob@example.com")
+
+	shared := ts.room(alice, "general", visibilityPublic)
+	solo := ts.room(alice, "notes", visibilityPrivate)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", shared), nil)
+	msgID := ts.message(shared, aliceID, "remember me")
+
+	ts.expect(http.StatusBadRequest, alice, "DELETE", "/me", nil)
+	ts.expect(http.StatusUnauthorized, alice, "DELETE", "/me", deleteAccountReq{Password: "wrong-password"})
+	ts.expect(http.StatusNoContent, alice, "DELETE", "/me", deleteAccountReq{Password: "hunter22"})
+
+	// the old token is dead, the shared room passed to bob, the solo one went
+	ts.expect(http.StatusUnauthorized, alice, "GET", "/me", nil)
+	if got := ts.roles(bob, shared); got["bob@example.com"] != roleOwner {
+		t.Errorf("shared room: got %v, want bob owner", got)
+	}
+	if _, err := ts.s.store.GetRoom(t.Context(), solo); err == nil {
+		t.Error("a room with nobody left outlived its owner's account")
+	}
+
+	// what alice wrote stays, under a tombstone
+	var msgs []MessageDTO
+	ts.call(bob, "GET", fmt.Sprintf("/rooms/%d/messages", shared), nil, &msgs)
+	for _, m := range msgs {
+		if m.ID == msgID && m.UserEmail != deletedUserEmail(aliceID) {
+			t.Errorf("alice's message: got author %q, want %q", m.UserEmail, deletedUserEmail(aliceID))
+		}
+	}
+
+	// and the address is free again
+	if st, msg := ts.call("", "POST", "/auth/register", AuthRequest{Email: "alice@example.com", Password: "hunter22"}, nil); st >= 300 {
+		t.Errorf("re-register: status %d (%q)", st, msg)
+	}
+}
+
+func TestOwnerSuccessor(t *testing.T) {
+	members := []Member{
+		{UserID: 1, Role: roleOwner},
+		{UserID: 2, Role: roleMember},
+		{UserID: 3, Role: roleModerator},
+		{UserID: 4, Role: roleAdmin},
+		{UserID: 5, Role: roleAdmin},
+	}
+	if m, ok := ownerSuccessor(members, 1); !ok || m.UserID != 4 {
+		t.Errorf("got %+v, want the longest-standing admin (4)", m)
+	}
+	if m, ok := ownerSuccessor(members[:3], 1); !ok || m.UserID != 3 {
+		t.Errorf("no admins: got %+v, want the moderator (3)", m)
+	}
+	if _, ok := ownerSuccessor(members[:1], 1); ok {
+		t.Error("picked a successor when the owner is alone")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type PinDTO struct {
+	MessageDTO
+	PinnedBy string `json:"pinnedBy,omitempty"`
+	PinnedAt int64  `json:"pinnedAt"` // unix ms
+}
+
+// pinTarget resolves /messages/{messageID}/pin: the message must exist and
+// the caller needs permPin in its room.
+func (s *Server) pinTarget(w http.ResponseWriter, r *http.Request) (MessageMeta, bool) {
+	msgID, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+	if err != nil || msgID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad message id")
+		return MessageMeta{}, false
+	}
+
+	msg, err := s.store.GetMessage(r.Context(), msgID)
+	if errors.Is(err, ErrNotFound) || (err == nil && msg.Deleted) {
+		writeErr(w, http.StatusNotFound, "message not found")
+		return msg, false
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return msg, false
+	}
+	if _, ok := s.requirePerm(w, r, msg.RoomID, permPin); !ok {
+		return msg, false
+	}
+	return msg, true
+}
+
+// handlePinMessage is POST /messages/{messageID}/pin. Rooms hold at most
+// ROOM_PIN_LIMIT pins; pinning a pinned message is a no-op.
+func (s *Server) handlePinMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.pinTarget(w, r)
+	if !ok {
+		return
+	}
+
+	pinned, err := s.store.PinMessage(r.Context(), msg.ID, userIDFromCtx(r), s.pinLimit)
+	if errors.Is(err, ErrPinLimit) {
+		writeErr(w, http.StatusConflict, fmt.Sprintf("room already has %d pinned messages; unpin one first", s.pinLimit))
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println("handlePinMessage db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if pinned {
+		email := emailFromCtx(r)
+		s.hub.BroadcastToRoom(msg.RoomID, map[string]any{
+			"type":      "message_pinned",
+			"roomId":    msg.RoomID,
+			"messageId": msg.ID,
+			"by":        email,
+			"pinnedAt":  time.Now().UnixMilli(),
+		})
+		s.broadcastSystem(msg.RoomID, "📌 "+email+" pinned a message")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUnpinMessage is DELETE /messages/{messageID}/pin.
+func (s *Server) handleUnpinMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.pinTarget(w, r)
+	if !ok {
+		return
+	}
+
+	unpinned, err := s.store.UnpinMessage(r.Context(), msg.ID)
+	if err != nil {
+		log.Println("handleUnpinMessage db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if unpinned {
+		s.broadcastUnpinned(msg.RoomID, msg.ID, emailFromCtx(r))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// broadcastUnpinned tells the room msgID lost its pin, whether it was
+// unpinned or deleted.
+func (s *Server) broadcastUnpinned(roomID, msgID int64, by string) {
+	s.hub.BroadcastToRoom(roomID, map[string]any{
+		"type":      "message_unpinned",
+		"roomId":    roomID,
+		"messageId": msgID,
+		"by":        by,
+	})
+}
+
+// handleListPins is GET /rooms/{roomID}/pins, for members: the room's
+// pinned messages, most recently pinned first.
+func (s *Server) handleListPins(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+	userID := userIDFromCtx(r)
+
+	if ok, err := s.store.IsMember(r.Context(), roomID, userID); err != nil || !ok {
+		writeErr(w, http.StatusForbidden, "not a room member")
+		return
+	}
+
+	pins, err := s.store.ListPins(r.Context(), roomID, userID)
+	if err != nil {
+		log.Println("handleListPins db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	msgs := make([]MessageDTO, len(pins))
+	for i, p := range pins {
+		msgs[i] = p.MessageDTO
+	}
+	if err := hydratePolls(r.Context(), s.store, msgs, userID); err != nil {
+		log.Println("handleListPins poll counts error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := hydrateReactions(r.Context(), s.store, msgs, userID); err != nil {
+		log.Println("handleListPins reactions error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := make([]PinDTO, len(pins))
+	for i, p := range pins {
+		out[i] = PinDTO{MessageDTO: msgs[i], PinnedBy: p.PinnedBy, PinnedAt: p.PinnedAt.UnixMilli()}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestPinLimit(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	ts.s.pinLimit = 2
+
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+
+	m1 := ts.message(roomID, aliceID, "one")
+	m2 := ts.message(roomID, aliceID, "two")
+	m3 := ts.message(roomID, aliceID, "three")
+	pin := func(id int64) string { return fmt.Sprintf("/messages/%d/pin", id) }
+
+	ts.expect(http.StatusForbidden, bob, "POST", pin(m1), nil) // members can't pin
+
+	ts.expect(http.StatusNoContent, alice, "POST", pin(m1), nil)
+	ts.expect(http.StatusNoContent, alice, "POST", pin(m2), nil)
+	ts.expect(http.StatusNoContent, alice, "POST", pin(m1), nil) // already pinned: no-op, not a third pin
+	ts.expect(http.StatusConflict, alice, "POST", pin(m3), nil)
+
+	ts.expect(http.StatusNoContent, alice, "DELETE", pin(m1), nil)
+	ts.expect(http.StatusNoContent, alice, "POST", pin(m3), nil)
+
+	var pins []PinDTO
+	if st, msg := ts.call(bob, "GET", fmt.Sprintf("/rooms/%d/pins", roomID), nil, &pins); st != http.StatusOK {
+		t.Fatalf("list pins: status %d (%q)", st, msg)
+	}
+	if len(pins) != 2 {
+		t.Fatalf("got %d pins, want 2", len(pins))
+	}
+	for _, p := range pins {
+		if p.ID == m1 {
+			t.Errorf("unpinned message %d still listed", m1)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Broker fans hub envelopes out to every other gochat-api node.
+// Publish must not block on slow listeners; Listen blocks until ctx is done
+// and hands every envelope it receives (including our own) to deliver.
+type Broker interface {
+	Publish(ctx context.Context, payload []byte) error
+	Listen(ctx context.Context, deliver func(payload []byte)) error
+	Close() error
+}
+
+// localBroker is used when running a single node: nothing to fan out.
+type localBroker struct{}
+
+func (localBroker) Publish(ctx context.Context, payload []byte) error { return nil }
+
+func (localBroker) Listen(ctx context.Context, deliver func(payload []byte)) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (localBroker) Close() error { return nil }
+
+// pg_notify payloads are capped at 8000 bytes; anything bigger is spilled to
+// hub_spill and the notification only carries "@<id>".
+const pgNotifyMaxPayload = 7000
+
+type pgBroker struct {
+	db      *pgxpool.Pool
+	channel string
+
+	mu      sync.Mutex
+	closed  bool
+	cancel  context.CancelFunc // stops Listen
+	stopped chan struct{}      // closed once Listen has let go of its conn
+}
+
+func newPGBroker(db *pgxpool.Pool, channel string) *pgBroker {
+	return &pgBroker{db: db, channel: channel}
+}
+
+func (b *pgBroker) Publish(ctx context.Context, payload []byte) error {
+	msg := string(payload)
+
+	if len(payload) > pgNotifyMaxPayload {
+		var id int64
+		err := b.db.QueryRow(ctx, `
+			INSERT INTO hub_spill (payload) VALUES ($1) RETURNING id
+		`, msg).Scan(&id)
+		if err != nil {
+			return err
+		}
+		msg = "@" + strconv.FormatInt(id, 10)
+
+		// listeners fetch spilled rows right away; anything older is garbage
+		_, _ = b.db.Exec(ctx, `DELETE FROM hub_spill WHERE created_at < now() - interval '5 minutes'`)
+	}
+
+	_, err := b.db.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, msg)
+	return err
+}
+
+func (b *pgBroker) Listen(ctx context.Context, deliver func(payload []byte)) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	ctx, b.cancel = context.WithCancel(ctx)
+	b.stopped = make(chan struct{})
+	defer close(b.stopped)
+	b.mu.Unlock()
+
+	for {
+		err := b.listenOnce(ctx, deliver)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Println("hub broker: listen error:", err, "(reconnecting)")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (b *pgBroker) listenOnce(ctx context.Context, deliver func(payload []byte)) error {
+	pooled, err := b.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// take the conn out of the pool so a LISTENing session is never reused
+	conn := pooled.Hijack()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.Close(ctx)
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		payload := n.Payload
+		if strings.HasPrefix(payload, "@") {
+			id, perr := strconv.ParseInt(payload[1:], 10, 64)
+			if perr != nil {
+				continue
+			}
+			if err := b.db.QueryRow(ctx, `SELECT payload FROM hub_spill WHERE id=$1`, id).Scan(&payload); err != nil {
+				if !errors.Is(err, pgx.ErrNoRows) {
+					log.Println("hub broker: spill fetch error:", err)
+				}
+				continue
+			}
+		}
+
+		deliver([]byte(payload))
+	}
+}
+
+// Close stops Listen and waits for it to close its LISTEN connection, which
+// was hijacked from the pool and so isn't closed along with it.
+func (b *pgBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	cancel, stopped := b.cancel, b.stopped
+	b.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+	return nil
+}
+
+// hubEnvelope is what travels between nodes.
+//
+//	kind "room":     Data is a frame to deliver to RoomID's local clients
+//	kind "presence": Data is the sender's local []UserPresence for RoomID
+//	kind "evict":    Data is an evictPayload for RoomID
+//	kind "member":   Data is an evictPayload (UserID only); drop their cached role
+//	kind "user":     Data is a frame for Email's connections (focused on RoomID if > 0)
+//	kind "hook":     Data is for the OnRemote hook for Type only; no client sees it
+type hubEnvelope struct {
+	Node   string          `json:"n"`
+	Kind   string          `json:"k"`
+	RoomID int64           `json:"r"`
+	Type   string          `json:"t,omitempty"`
+	Email  string          `json:"e,omitempty"`
+	Data   json.RawMessage `json:"d"`
+}
+
+type remotePresence struct {
+	Users []UserPresence
+	Seen  time.Time
+}
+
+// publishQueueLen bounds envelopes waiting for the broker. Past that, new
+// ones are dropped rather than stalling the read loops that produce them.
+const publishQueueLen = 1024
+
+const (
+	presenceSyncEvery = 30 * time.Second
+	presenceStaleAge  = 3 * presenceSyncEvery
+)
+
+// OnRemote registers fn to run for frames of type typ that originate on
+// another node, whether published or sent with sendRemote (e.g. call_op,
+// which replays call changes into the local Server.calls).
+func (h *Hub) OnRemote(typ string, fn func(roomID int64, b []byte)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks[typ] = fn
+}
+
+// publish delivers b to local clients and hands it to the broker so every
+// other node delivers it to theirs. Durable frames are logged first, and the
+// room stays locked until they're queued everywhere, so two publishers
+// can't deliver seq N+1 ahead of N.
+func (h *Hub) publish(roomID int64, typ string, b []byte) {
+	if h.events != nil && durableEvents[typ] {
+		mu := &h.seqMu[uint64(roomID)%uint64(len(h.seqMu))]
+		mu.Lock()
+		defer mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		seq, err := h.events.Append(ctx, roomID, typ, b)
+		cancel()
+		if err != nil {
+			log.Println("event log append error:", err)
+		} else {
+			b = stampSeq(b, seq)
+		}
+	}
+
+	h.deliverLocal(roomID, typ, b)
+	h.sendEnvelope(hubEnvelope{Kind: "room", RoomID: roomID, Type: typ, Data: b})
+}
+
+// sendRemote hands b to typ's OnRemote hook on every other node, without
+// delivering it to any client.
+func (h *Hub) sendRemote(roomID int64, typ string, b []byte) {
+	h.sendEnvelope(hubEnvelope{Kind: "hook", RoomID: roomID, Type: typ, Data: b})
+}
+
+// sendEnvelope queues e for the other nodes. It never blocks: callers are
+// WS read loops and request handlers, and one slow broker round trip must
+// not hold all of them up.
+func (h *Hub) sendEnvelope(e hubEnvelope) {
+	if _, single := h.broker.(localBroker); single {
+		return
+	}
+	e.Node = h.nodeID
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	select {
+	case h.outbox <- payload:
+	default:
+		h.stats.envelopesDropped.Add(1)
+		log.Println("hub broker: publish queue full, dropping", e.Kind, "envelope")
+	}
+}
+
+// runPublisher hands queued envelopes to the broker, one at a time. On the
+// way out it flushes what's left (the shutdown goodbyes included).
+func (h *Hub) runPublisher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			h.flushOutbox()
+			return
+		case payload := <-h.outbox:
+			h.publishEnvelope(context.Background(), payload)
+		}
+	}
+}
+
+func (h *Hub) flushOutbox() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for ctx.Err() == nil {
+		select {
+		case payload := <-h.outbox:
+			h.publishEnvelope(ctx, payload)
+		default:
+			return
+		}
+	}
+}
+
+func (h *Hub) publishEnvelope(ctx context.Context, payload []byte) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := h.broker.Publish(ctx, payload); err != nil {
+		log.Println("hub broker: publish error:", err)
+	}
+}
+
+func (h *Hub) handleEnvelope(payload []byte) {
+	var e hubEnvelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return
+	}
+	if e.Node == h.nodeID {
+		return // already delivered locally
+	}
+
+	switch e.Kind {
+	case "room":
+		h.deliverLocal(e.RoomID, e.Type, e.Data)
+
+		h.mu.Lock()
+		fn := h.hooks[e.Type]
+		h.mu.Unlock()
+		if fn != nil {
+			fn(e.RoomID, e.Data)
+		}
+
+	case "hook":
+		h.mu.Lock()
+		fn := h.hooks[e.Type]
+		h.mu.Unlock()
+		if fn != nil {
+			fn(e.RoomID, e.Data)
+		}
+
+	case "user":
+		h.deliverUserLocal(e.Email, e.RoomID, e.Data)
+
+	case "evict":
+		var ev evictPayload
+		if err := json.Unmarshal(e.Data, &ev); err != nil {
+			return
+		}
+		h.evictLocal(e.RoomID, ev.UserID, ev.Reason)
+
+	case "member":
+		var ev evictPayload
+		if err := json.Unmarshal(e.Data, &ev); err != nil {
+			return
+		}
+		h.forgetMemberLocal(e.RoomID, ev.UserID)
+
+	case "presence":
+		var users []UserPresence
+		if err := json.Unmarshal(e.Data, &users); err != nil {
+			return
+		}
+
+		h.mu.Lock()
+		if len(users) == 0 {
+			delete(h.remote[e.RoomID], e.Node)
+			if len(h.remote[e.RoomID]) == 0 {
+				delete(h.remote, e.RoomID)
+			}
+		} else {
+			if h.remote[e.RoomID] == nil {
+				h.remote[e.RoomID] = make(map[string]remotePresence)
+			}
+			h.remote[e.RoomID][e.Node] = remotePresence{Users: users, Seen: time.Now()}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// announcePresence tells the other nodes who is connected to roomID here.
+func (h *Hub) announcePresence(roomID int64) {
+	h.mu.Lock()
+	users := h.localPresencesLocked(roomID)
+	h.mu.Unlock()
+
+	b, _ := json.Marshal(users)
+	h.sendEnvelope(hubEnvelope{Kind: "presence", RoomID: roomID, Data: b})
+}
+
+func (h *Hub) localPresencesLocked(roomID int64) []UserPresence {
+	out := []UserPresence{}
+	for c := range h.rooms[roomID] {
+		st := c.status
+		if st == "" {
+			st = "active"
+		}
+		out = append(out, UserPresence{Email: c.email, Status: st})
+	}
+	return out
+}
+
+// Run listens for other nodes' envelopes and periodically re-announces local
+// presence so a node that crashed without saying goodbye ages out.
+func (h *Hub) Run(ctx context.Context) {
+	go h.runPublisher(ctx)
+	go func() {
+		if err := h.broker.Listen(ctx, h.handleEnvelope); err != nil {
+			log.Println("hub broker: listener stopped:", err)
+		}
+	}()
+
+	t := time.NewTicker(presenceSyncEvery)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		h.mu.Lock()
+		rooms := make([]int64, 0, len(h.rooms))
+		for roomID := range h.rooms {
+			rooms = append(rooms, roomID)
+		}
+		for roomID, nodes := range h.remote {
+			for node, rp := range nodes {
+				if time.Since(rp.Seen) > presenceStaleAge {
+					delete(nodes, node)
+				}
+			}
+			if len(nodes) == 0 {
+				delete(h.remote, roomID)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, roomID := range rooms {
+			h.announcePresence(roomID)
+		}
+	}
+}
+
+// frameType peeks at the "type" field of an outgoing frame.
+func frameType(b []byte) string {
+	var v struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(b, &v)
+	return v.Type
+}
+
+func newNodeID() string {
+	if v := strings.TrimSpace(os.Getenv("NODE_ID")); v != "" {
+		return v
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "node"
+	}
+	return host + "-" + randString(6)
+}
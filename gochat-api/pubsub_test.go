@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBus is a Broker shared by hubs in one process, standing in for
+// Postgres LISTEN/NOTIFY.
+type memBus struct {
+	mu        sync.Mutex
+	listeners []func([]byte)
+}
+
+type memBusBroker struct{ bus *memBus }
+
+func (b memBusBroker) Publish(ctx context.Context, payload []byte) error {
+	b.bus.mu.Lock()
+	ls := append([]func([]byte){}, b.bus.listeners...)
+	b.bus.mu.Unlock()
+	for _, deliver := range ls {
+		deliver(payload)
+	}
+	return nil
+}
+
+func (b memBusBroker) Listen(ctx context.Context, deliver func([]byte)) error {
+	b.bus.mu.Lock()
+	b.bus.listeners = append(b.bus.listeners, deliver)
+	b.bus.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+func (memBusBroker) Close() error { return nil }
+
+// clusterHubs starts n hubs joined by a memBus.
+func clusterHubs(t *testing.T, n int) []*Hub {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	bus := &memBus{}
+	hubs := make([]*Hub, n)
+	for i := range hubs {
+		hubs[i] = NewHub(string(rune('a'+i)), memBusBroker{bus}, nil)
+		go hubs[i].Run(ctx)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		bus.mu.Lock()
+		ready := len(bus.listeners) == n
+		bus.mu.Unlock()
+		if ready {
+			return hubs
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hubs never started listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubFanOut(t *testing.T) {
+	hubs := clusterHubs(t, 2)
+	a, b := hubs[0], hubs[1]
+
+	alice, ap := wsClient(t, a, 1, "alice@x")
+	bob, bp := wsClient(t, b, 2, "Bob@x")
+	a.join(alice, 1)
+	b.join(bob, 1)
+
+	// room frames reach clients on the other node, once
+	a.publish(1, "message", []byte(`{"type":"message","roomId":1,"text":"hi"}`))
+	if f := readUntil(t, bp, "message"); f.Text != "hi" {
+		t.Errorf("bob got %s", f.raw)
+	}
+	if f := readUntil(t, ap, "message"); f.Text != "hi" {
+		t.Errorf("alice got %s", f.raw)
+	}
+
+	// so do frames addressed to a user, whatever case their email is in
+	a.sendToUser("bob@x", 0, []byte(`{"type":"user_event","event":"ping"}`))
+	if f := readUntil(t, bp, "user_event"); f.Event != "ping" {
+		t.Errorf("bob got %s", f.raw)
+	}
+
+	// each node knows who's connected to the other
+	waitFor(t, func() bool { return len(a.listPresences(1)) == 2 && len(b.listPresences(1)) == 2 })
+
+	// and hooks see the other node's frames, not their own
+	got := make(chan string, 2)
+	b.OnRemote("call_op", func(roomID int64, data []byte) { got <- string(data) })
+	a.OnRemote("call_op", func(roomID int64, data []byte) { got <- "echo" })
+	a.sendRemote(1, "call_op", json.RawMessage(`"join"`))
+	select {
+	case s := <-got:
+		if s != `"join"` {
+			t.Errorf("hook got %s", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook never ran on the other node")
+	}
+}
+
+// waitFor polls cond for up to 5s.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type RevisionDTO struct {
+	ID          int64    `json:"id"`
+	Body        string   `json:"body"`
+	Poll        *PollDTO `json:"poll,omitempty"`        // poll edits: the poll as it was, with its tallies if the edit moved or dropped votes
+	EditorEmail string   `json:"editorEmail,omitempty"` // who made the edit that replaced this revision
+	EditedAt    int64    `json:"editedAt"`              // unix ms
+}
+
+// handleListRevisions is GET /messages/{messageID}/revisions: every earlier
+// version of the message, oldest first. The current version is the message itself.
+func (s *Server) handleListRevisions(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+
+	msgID, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+	if err != nil || msgID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad message id")
+		return
+	}
+
+	msg, err := s.store.GetMessage(r.Context(), msgID)
+	if errors.Is(err, ErrNotFound) || (err == nil && msg.Deleted) {
+		writeErr(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println("handleListRevisions message error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if ok, err := s.store.IsMember(r.Context(), msg.RoomID, userID); err != nil || !ok {
+		writeErr(w, http.StatusForbidden, "not a room member")
+		return
+	}
+
+	revs, err := s.store.ListRevisions(r.Context(), msgID)
+	if err != nil {
+		log.Println("handleListRevisions db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := make([]RevisionDTO, 0, len(revs))
+	for _, rev := range revs {
+		dto := RevisionDTO{
+			ID:          rev.ID,
+			Body:        rev.Body,
+			Poll:        pollFromJSON(rev.PollJSON),
+			EditorEmail: rev.EditorEmail,
+			EditedAt:    rev.EditedAt.UnixMilli(),
+		}
+		if dto.Poll != nil {
+			for i := range dto.Poll.Options {
+				if i < len(rev.VoteCounts) {
+					dto.Poll.Options[i].Count = rev.VoteCounts[i]
+				}
+			}
+		}
+		out = append(out, dto)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
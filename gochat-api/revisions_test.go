@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMessageRevisions(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+
+	msgID := ts.message(roomID, aliceID, "v1")
+	path := fmt.Sprintf("/messages/%d", msgID)
+	revs := func() []RevisionDTO {
+		t.Helper()
+		var out []RevisionDTO
+		if st, msg := ts.call(bob, "GET", path+"/revisions", nil, &out); st != http.StatusOK {
+			t.Fatalf("revisions: status %d (%q)", st, msg)
+		}
+		return out
+	}
+
+	ts.expect(http.StatusNoContent, alice, "PUT", path, editReq{Body: "v2"})
+	ts.expect(http.StatusNoContent, alice, "PUT", path, editReq{Body: "v2"}) // unchanged: no revision
+	ts.expect(http.StatusNoContent, alice, "PUT", path, editReq{Body: "v3"})
+	ts.expect(http.StatusForbidden, bob, "PUT", path, editReq{Body: "bob was here"})
+
+	got := revs()
+	if len(got) != 2 || got[0].Body != "v1" || got[1].Body != "v2" {
+		t.Fatalf("revisions: got %+v, want v1 then v2", got)
+	}
+	if got[0].EditorEmail != "alice@example.com" || got[0].EditedAt > got[1].EditedAt {
+		t.Errorf("revision metadata: got %+v", got)
+	}
+
+	var msgs []MessageDTO
+	ts.call(bob, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil, &msgs)
+	if len(msgs) != 1 || msgs[0].Body != "v3" || !msgs[0].Edited || msgs[0].RevisionCount != 2 {
+		t.Errorf("message: got %+v", msgs)
+	}
+
+	// a deleted message can't be edited, and its history goes with it
+	ts.expect(http.StatusNoContent, alice, "DELETE", path, nil)
+	ts.expect(http.StatusConflict, alice, "PUT", path, editReq{Body: "v4"})
+	ts.expect(http.StatusNotFound, bob, "GET", path+"/revisions", nil)
+}
+
+func TestPollEditKeepsVotes(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	_, carol := ts.user("carol@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	for _, tok := range []string{bob, carol} {
+		ts.expect(http.StatusOK, tok, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	}
+
+	var poll MessageDTO
+	req := createPollReq{Question: "lunch?", Options: []string{"pizza", "sushi", "tacos"}}
+	if st, msg := ts.call(alice, "POST", fmt.Sprintf("/rooms/%d/polls", roomID), req, &poll); st != http.StatusOK {
+		t.Fatalf("create poll: status %d (%q)", st, msg)
+	}
+	vote := fmt.Sprintf("/polls/%d/vote", poll.ID)
+	ts.expect(http.StatusOK, bob, "POST", vote, votePollReq{OptionIdx: 2})   // tacos
+	ts.expect(http.StatusOK, carol, "POST", vote, votePollReq{OptionIdx: 0}) // pizza
+
+	// tacos moves to the front, pizza goes: bob's vote follows tacos, carol's
+	// is dropped
+	var out struct {
+		Poll PollDTO `json:"poll"`
+	}
+	edit := editPollReq{Question: "lunch?", Options: []string{"tacos", "sushi"}}
+	if st, msg := ts.call(bob, "PUT", fmt.Sprintf("/polls/%d", poll.ID), edit, &out); st != http.StatusForbidden {
+		t.Errorf("edit by a voter: status %d (%q), want 403", st, msg)
+	}
+	if st, msg := ts.call(alice, "PUT", fmt.Sprintf("/polls/%d", poll.ID), edit, &out); st != http.StatusOK {
+		t.Fatalf("edit poll: status %d (%q)", st, msg)
+	}
+	if c := out.Poll.Options; c[0].Count != 1 || c[1].Count != 0 {
+		t.Errorf("counts after edit: got %+v, want tacos 1, sushi 0", c)
+	}
+
+	var msgs []MessageDTO
+	ts.call(bob, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil, &msgs)
+	if len(msgs) != 1 || msgs[0].Poll == nil || msgs[0].Poll.MyVote != 0 {
+		t.Errorf("bob's vote: got %+v, want option 0 (tacos)", msgs)
+	}
+
+	// the revision keeps the poll as it was, with the tallies it had
+	var revs []RevisionDTO
+	ts.call(carol, "GET", fmt.Sprintf("/messages/%d/revisions", poll.ID), nil, &revs)
+	if len(revs) != 1 || revs[0].Poll == nil || len(revs[0].Poll.Options) != 3 {
+		t.Fatalf("revisions: got %+v", revs)
+	}
+	if c := revs[0].Poll.Options; c[0].Count != 1 || c[1].Count != 0 || c[2].Count != 1 {
+		t.Errorf("old tallies: got %+v, want pizza 1, sushi 0, tacos 1", c)
+	}
+}
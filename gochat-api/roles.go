@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Room roles, stored in room_members.role. rooms.created_by always names
+// the member whose role is roleOwner, except in DMs, where everyone is a
+// roleMember.
+const (
+	roleOwner     = "owner"
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+	roleMember    = "member"
+	roleReadOnly  = "readonly"
+)
+
+// roleRank orders roles for "who can manage whom": you can only change
+// members ranked below you, and only to a role ranked below you.
+var roleRank = map[string]int{
+	roleReadOnly:  1,
+	roleMember:    2,
+	roleModerator: 3,
+	roleAdmin:     4,
+	roleOwner:     5,
+}
+
+type permission string
+
+const (
+	permPost          permission = "post"           // messages, polls, typing, editing your own messages
+	permReact         permission = "react"          // reactions and poll votes
+	permDeleteOthers  permission = "delete_others"  // delete other members' messages
+	permPin           permission = "pin"            // pin / unpin messages
+	permManageMembers permission = "manage_members" // change roles
+	permModerate      permission = "moderate"       // kick, ban, mute
+	permInvite        permission = "invite"         // create / revoke invite links
+	permStartCall     permission = "start_call"     // start a room call (anyone can join one)
+	permEditSettings  permission = "edit_settings"  // rename, topic, room settings
+)
+
+var rolePermissions = map[string]map[permission]bool{
+	roleOwner: {
+		permPost: true, permReact: true, permDeleteOthers: true, permPin: true, permManageMembers: true,
+		permModerate: true, permInvite: true, permStartCall: true, permEditSettings: true,
+	},
+	roleAdmin: {
+		permPost: true, permReact: true, permDeleteOthers: true, permPin: true, permManageMembers: true,
+		permModerate: true, permInvite: true, permStartCall: true, permEditSettings: true,
+	},
+	roleModerator: {
+		permPost: true, permReact: true, permDeleteOthers: true, permPin: true,
+		permModerate: true, permInvite: true, permStartCall: true,
+	},
+	roleMember: {
+		permPost: true, permReact: true, permStartCall: true,
+	},
+	roleReadOnly: {
+		permReact: true,
+	},
+}
+
+// archivedDenies is what nobody can do in an archived room, whatever their
+// role. Moderation, settings and unarchiving still work.
+var archivedDenies = map[permission]bool{
+	permPost:      true,
+	permReact:     true,
+	permPin:       true,
+	permStartCall: true,
+}
+
+// wsPermissions gates WS frames beyond membership (see roomScopedEvents).
+var wsPermissions = map[string]permission{
+	"message":    permPost,
+	"typing":     permPost,
+	"call_start": permStartCall,
+}
+
+func roleCan(role string, p permission) bool {
+	return rolePermissions[role][p]
+}
+
+// denyReason is the one place permissions are decided. It returns "" if m
+// may do p, else an error code: not_member, archived, muted or forbidden. A
+// muted member keeps their role but loses permPost until the mute runs out.
+func denyReason(m Member, p permission) string {
+	switch {
+	case m.Role == "":
+		return "not_member"
+	case m.Archived && archivedDenies[p]:
+		return "archived"
+	case !roleCan(m.Role, p):
+		return "forbidden"
+	case p == permStartCall && roleRank[m.Role] < roleRank[m.CallRole]:
+		return "forbidden"
+	case p == permPost && m.MutedUntil.After(time.Now()):
+		return "muted"
+	}
+	return ""
+}
+
+var denyMessages = map[string]string{
+	"not_member": "not a room member",
+	"forbidden":  "not allowed",
+	"muted":      "you are muted in this room",
+	"archived":   "room is archived",
+}
+
+// roomMember returns userID's membership in roomID; Role is "" if they're
+// not a member.
+func (s *Server) roomMember(ctx context.Context, roomID, userID int64) (Member, error) {
+	m, err := s.store.GetMember(ctx, roomID, userID)
+	if errors.Is(err, ErrNotFound) {
+		return Member{UserID: userID}, nil
+	}
+	return m, err
+}
+
+// roomRole returns userID's role in roomID, or "" if they're not a member.
+func (s *Server) roomRole(ctx context.Context, roomID, userID int64) (string, error) {
+	m, err := s.roomMember(ctx, roomID, userID)
+	return m.Role, err
+}
+
+// requirePerm is the REST side of the permission check: it writes the
+// 403/500 itself and returns the caller's membership when p is allowed.
+func (s *Server) requirePerm(w http.ResponseWriter, r *http.Request, roomID int64, p permission) (Member, bool) {
+	m, err := s.roomMember(r.Context(), roomID, userIDFromCtx(r))
+	if err != nil {
+		log.Println("role lookup error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return m, false
+	}
+	if code := denyReason(m, p); code != "" {
+		writeErr(w, http.StatusForbidden, denyMessages[code])
+		return m, false
+	}
+	return m, true
+}
+
+type MemberDTO struct {
+	UserID     int64  `json:"userId"`
+	Email      string `json:"email"`
+	Role       string `json:"role"`
+	JoinedAt   int64  `json:"joinedAt"` // unix ms
+	Muted      bool   `json:"muted,omitempty"`
+	MutedUntil int64  `json:"mutedUntil,omitempty"` // unix ms; absent for an indefinite mute
+}
+
+func memberDTO(m Member) MemberDTO {
+	dto := MemberDTO{UserID: m.UserID, Email: m.Email, Role: m.Role, JoinedAt: m.JoinedAt.UnixMilli()}
+	if m.MutedUntil.After(time.Now()) {
+		dto.Muted = true
+		if !m.MutedUntil.Equal(muteForever) {
+			dto.MutedUntil = m.MutedUntil.UnixMilli()
+		}
+	}
+	return dto
+}
+
+// handleListMembers is GET /rooms/{roomID}/members, for members.
+func (s *Server) handleListMembers(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return
+	}
+	if ok, err := s.store.IsMember(r.Context(), roomID, userIDFromCtx(r)); err != nil || !ok {
+		writeErr(w, http.StatusForbidden, "not a room member")
+		return
+	}
+
+	members, err := s.store.ListMembers(r.Context(), roomID)
+	if err != nil {
+		log.Println("handleListMembers db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := make([]MemberDTO, 0, len(members))
+	for _, m := range members {
+		out = append(out, memberDTO(m))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type setRoleReq struct {
+	Role string `json:"role"`
+}
+
+// handleSetMemberRole is PUT /rooms/{roomID}/members/{userID}/role.
+// Ownership isn't handed out here; it has its own transfer flow.
+func (s *Server) handleSetMemberRole(w http.ResponseWriter, r *http.Request) {
+	actorID := userIDFromCtx(r)
+
+	roomID, err := strconv.ParseInt(chi.URLParam(r, "roomID"), 10, 64)
+	if err != nil || roomID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad room id")
+		return
+	}
+	targetID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || targetID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad user id")
+		return
+	}
+
+	var req setRoleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if _, ok := roleRank[req.Role]; !ok {
+		writeErr(w, http.StatusBadRequest, "unknown role")
+		return
+	}
+	if req.Role == roleOwner {
+		writeErr(w, http.StatusBadRequest, "use ownership transfer")
+		return
+	}
+
+	actor, ok := s.requirePerm(w, r, roomID, permManageMembers)
+	if !ok {
+		return
+	}
+	actorRole := actor.Role
+	if targetID == actorID {
+		writeErr(w, http.StatusBadRequest, "cannot change your own role")
+		return
+	}
+
+	targetRole, err := s.roomRole(r.Context(), roomID, targetID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if targetRole == "" {
+		writeErr(w, http.StatusNotFound, "not a room member")
+		return
+	}
+	if roleRank[targetRole] >= roleRank[actorRole] || roleRank[req.Role] >= roleRank[actorRole] {
+		writeErr(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	if targetRole == req.Role {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.store.SetMemberRole(r.Context(), roomID, targetID, req.Role); err != nil {
+		log.Println("handleSetMemberRole db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.hub.forgetMember(roomID, targetID)
+
+	target, err := s.store.UserByID(r.Context(), targetID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.hub.BroadcastToRoom(roomID, map[string]any{
+		"type":      "member_role_changed",
+		"roomId":    roomID,
+		"userEmail": target.Email,
+		"role":      req.Role,
+		"by":        emailFromCtx(r),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var allPermissions = []permission{
+	permPost, permReact, permDeleteOthers, permPin, permManageMembers,
+	permModerate, permInvite, permStartCall, permEditSettings,
+}
+
+func TestDenyReasonRoles(t *testing.T) {
+	// what each role may do in an active room; everything else is forbidden
+	allowed := map[string][]permission{
+		roleOwner:     allPermissions,
+		roleAdmin:     allPermissions,
+		roleModerator: {permPost, permReact, permDeleteOthers, permPin, permModerate, permInvite, permStartCall},
+		roleMember:    {permPost, permReact, permStartCall},
+		roleReadOnly:  {permReact},
+	}
+
+	for role, perms := range allowed {
+		can := map[permission]bool{}
+		for _, p := range perms {
+			can[p] = true
+		}
+		for _, p := range allPermissions {
+			want := "forbidden"
+			if can[p] {
+				want = ""
+			}
+			if got := denyReason(Member{UserID: 1, Role: role}, p); got != want {
+				t.Errorf("%s %s: got %q, want %q", role, p, got, want)
+			}
+		}
+	}
+
+	for _, p := range allPermissions {
+		if got := denyReason(Member{UserID: 1}, p); got != "not_member" {
+			t.Errorf("non-member %s: got %q, want not_member", p, got)
+		}
+	}
+}
+
+func TestDenyReasonRoomState(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		m    Member
+		p    permission
+		want string
+	}{
+		{"archived blocks posting", Member{Role: roleOwner, Archived: true}, permPost, "archived"},
+		{"archived blocks reacting", Member{Role: roleMember, Archived: true}, permReact, "archived"},
+		{"archived blocks pinning", Member{Role: roleAdmin, Archived: true}, permPin, "archived"},
+		{"archived blocks calls", Member{Role: roleOwner, Archived: true}, permStartCall, "archived"},
+		{"archived still moderates", Member{Role: roleModerator, Archived: true}, permModerate, ""},
+		{"archived still edits settings", Member{Role: roleOwner, Archived: true}, permEditSettings, ""},
+		{"archived doesn't grant", Member{Role: roleMember, Archived: true}, permEditSettings, "forbidden"},
+		{"archived non-member", Member{Archived: true}, permPost, "not_member"},
+
+		{"muted can't post", Member{Role: roleMember, MutedUntil: now.Add(time.Hour)}, permPost, "muted"},
+		{"muted forever", Member{Role: roleAdmin, MutedUntil: muteForever}, permPost, "muted"},
+		{"muted can react", Member{Role: roleMember, MutedUntil: now.Add(time.Hour)}, permReact, ""},
+		{"mute ran out", Member{Role: roleMember, MutedUntil: now.Add(-time.Second)}, permPost, ""},
+		{"readonly muted", Member{Role: roleReadOnly, MutedUntil: now.Add(time.Hour)}, permPost, "forbidden"},
+		{"archived beats muted", Member{Role: roleMember, Archived: true, MutedUntil: now.Add(time.Hour)}, permPost, "archived"},
+
+		{"call role below", Member{Role: roleMember, CallRole: roleMember}, permStartCall, ""},
+		{"call role above", Member{Role: roleMember, CallRole: roleModerator}, permStartCall, "forbidden"},
+		{"call role met", Member{Role: roleModerator, CallRole: roleModerator}, permStartCall, ""},
+		{"call role only gates calls", Member{Role: roleMember, CallRole: roleOwner}, permPost, ""},
+	}
+	for _, tt := range tests {
+		if got := denyReason(tt.m, tt.p); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	snippetStart = "<mark>"
+	snippetStop  = "</mark>"
+)
+
+// splitPrefixTerms pulls `term*` words out of a websearch query, since
+// websearch_to_tsquery has no prefix syntax of its own. rest keeps
+// everything else untouched.
+func splitPrefixTerms(q string) (rest string, prefixes []string) {
+	var kept []string
+	for _, f := range strings.Fields(q) {
+		if strings.HasSuffix(f, "*") && !strings.ContainsAny(f, `"-`) {
+			if t := searchWord(strings.TrimSuffix(f, "*")); t != "" {
+				prefixes = append(prefixes, t)
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+	return strings.Join(kept, " "), prefixes
+}
+
+// prefixTSQuery renders prefixes for to_tsquery: "foo:* & bar:*".
+func prefixTSQuery(prefixes []string) string {
+	parts := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		parts = append(parts, p+":*")
+	}
+	return strings.Join(parts, " & ")
+}
+
+// searchWord keeps letters and digits only, lowercased.
+func searchWord(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// searchTerm is one piece of a websearch query as understood by memStore,
+// which approximates Postgres FTS with case-insensitive substring matching.
+type searchTerm struct {
+	text   string
+	negate bool
+}
+
+func parseSearchTerms(q string) []searchTerm {
+	var out []searchTerm
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		negate := strings.HasPrefix(q, "-")
+		if negate {
+			q = q[1:]
+		}
+
+		var text string
+		if strings.HasPrefix(q, `"`) {
+			end := strings.Index(q[1:], `"`)
+			if end < 0 {
+				text, q = q[1:], ""
+			} else {
+				text, q = q[1:end+1], q[end+2:]
+			}
+		} else {
+			text, q, _ = strings.Cut(q, " ")
+			text = strings.TrimSuffix(text, "*")
+			if strings.EqualFold(text, "or") {
+				continue // memStore treats everything as AND
+			}
+		}
+
+		if text = strings.ToLower(strings.TrimSpace(text)); text != "" {
+			out = append(out, searchTerm{text: text, negate: negate})
+		}
+	}
+	return out
+}
+
+// matchSearchTerms scores text against terms: 0 means no match.
+func matchSearchTerms(text string, terms []searchTerm) float32 {
+	lower := strings.ToLower(text)
+	var score float32
+	for _, t := range terms {
+		n := strings.Count(lower, t.text)
+		if t.negate && n > 0 {
+			return 0
+		}
+		if !t.negate {
+			if n == 0 {
+				return 0
+			}
+			score += float32(n)
+		}
+	}
+	return score
+}
+
+// highlightTerms HTML-escapes text and wraps every occurrence of the
+// positive terms in it, so the marks are the only markup in the result.
+func highlightTerms(text string, terms []searchTerm) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		return html.EscapeString(text) // case folding changed byte offsets; don't risk mangling it
+	}
+	var b strings.Builder
+	plain := 0 // start of the text not yet written
+	for i := 0; i < len(text); {
+		hit := 0
+		for _, t := range terms {
+			if !t.negate && len(t.text) > hit && strings.HasPrefix(lower[i:], t.text) {
+				hit = len(t.text)
+			}
+		}
+		if hit == 0 {
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(text[plain:i]))
+		b.WriteString(snippetStart)
+		b.WriteString(html.EscapeString(text[i : i+hit]))
+		b.WriteString(snippetStop)
+		i += hit
+		plain = i
+	}
+	b.WriteString(html.EscapeString(text[plain:]))
+	return b.String()
+}
+
+// mimeMatches reports whether mime satisfies a mime: filter ("image" or "image/png").
+func mimeMatches(mime, want string) bool {
+	mime, want = strings.ToLower(mime), strings.ToLower(want)
+	if strings.Contains(want, "/") {
+		return mime == want
+	}
+	return strings.HasPrefix(mime, want+"/")
+}
+
+// splitSearchTokens splits on spaces outside double quotes, keeping the quotes.
+func splitSearchTokens(q string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// parseSearchQuery pulls the filter operators out of a /search query:
+//
+//	from:alice@example.com  in:general  in:"team chat"  in:42
+//	has:attachment  has:poll  is:starred  mime:image  mime:application/pdf
+//	before:2024-05-01  after:2024-04-01   (dates are UTC days; both exclusive)
+//
+// Everything else is free text for full-text search.
+func parseSearchQuery(raw string) (GlobalSearch, error) {
+	var q GlobalSearch
+	var text []string
+
+	for _, tok := range splitSearchTokens(raw) {
+		op, val, ok := strings.Cut(tok, ":")
+		val = strings.Trim(val, `"`)
+		if !ok || val == "" {
+			text = append(text, tok)
+			continue
+		}
+
+		switch strings.ToLower(op) {
+		case "from":
+			q.From = val
+		case "in":
+			q.InRoom = val
+		case "has":
+			switch strings.ToLower(val) {
+			case "attachment", "file":
+				q.HasAttachment = true
+			case "poll":
+				q.HasPoll = true
+			default:
+				return q, fmt.Errorf("unknown has:%s", val)
+			}
+		case "is":
+			if !strings.EqualFold(val, "starred") {
+				return q, fmt.Errorf("unknown is:%s", val)
+			}
+			q.Starred = true
+		case "mime":
+			q.Mime = val
+		case "before", "after":
+			day, err := time.Parse("2006-01-02", val)
+			if err != nil {
+				return q, fmt.Errorf("%s: want YYYY-MM-DD", op)
+			}
+			if strings.EqualFold(op, "before") {
+				q.Before = day
+			} else {
+				q.After = day.AddDate(0, 0, 1)
+			}
+		default:
+			text = append(text, tok) // e.g. "re: deploy" or a URL
+		}
+	}
+
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+type SearchGroupDTO struct {
+	RoomID   int64        `json:"roomId"`
+	RoomName string       `json:"roomName"`
+	Messages []MessageDTO `json:"messages"`
+}
+
+type SearchResultsDTO struct {
+	Groups     []SearchGroupDTO `json:"groups"`
+	NextCursor string           `json:"nextCursor,omitempty"` // pass back as ?cursor= for the next page
+}
+
+// handleSearch is GET /search?q=...&cursor=...&limit=...: every room the
+// caller belongs to, newest first, grouped by room.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+
+	raw := strings.TrimSpace(r.URL.Query().Get("q"))
+	if raw == "" {
+		writeErr(w, http.StatusBadRequest, "missing q")
+		return
+	}
+	if len(raw) > 300 {
+		writeErr(w, http.StatusBadRequest, "query too long")
+		return
+	}
+
+	q, err := parseSearchQuery(raw)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q == (GlobalSearch{}) {
+		writeErr(w, http.StatusBadRequest, "missing q")
+		return
+	}
+	q.ViewerID = userID
+
+	q.Limit = 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
+			q.Limit = n
+		}
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeErr(w, http.StatusBadRequest, "bad cursor")
+			return
+		}
+		q.CursorID = n
+	}
+
+	hits, err := s.store.SearchAll(r.Context(), q)
+	if err != nil {
+		log.Println("handleSearch db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	msgs := make([]MessageDTO, len(hits))
+	for i := range hits {
+		msgs[i] = hits[i].MessageDTO
+	}
+	if err := hydrateSearchHits(r.Context(), s.store, msgs, userID); err != nil {
+		log.Println("handleSearch hydrate error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	// group by room, rooms ordered by their newest hit
+	out := SearchResultsDTO{Groups: []SearchGroupDTO{}}
+	idx := map[int64]int{}
+	for i, h := range hits {
+		g, ok := idx[h.RoomID]
+		if !ok {
+			g = len(out.Groups)
+			idx[h.RoomID] = g
+			out.Groups = append(out.Groups, SearchGroupDTO{RoomID: h.RoomID, RoomName: h.RoomName})
+		}
+		out.Groups[g].Messages = append(out.Groups[g].Messages, msgs[i])
+	}
+	if len(hits) == q.Limit {
+		out.NextCursor = strconv.FormatInt(hits[len(hits)-1].ID, 10)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
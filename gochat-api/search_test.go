@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSearchMessages(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@x")
+	_, bob := ts.user("bob@x")
+	roomID := ts.room(alice, "general", "public")
+
+	ts.message(roomID, aliceID, "deploy <b>tonight</b>")
+	hit := ts.message(roomID, aliceID, "deploy deploy deploy")
+	ts.message(roomID, aliceID, "lunch?")
+	if _, _, err := ts.s.store.ToggleReaction(context.Background(), hit, aliceID, "🚀"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []MessageDTO
+	path := fmt.Sprintf("/rooms/%d/messages/search?q=deploy&sort=relevance", roomID)
+	if st, msg := ts.call(alice, "GET", path, nil, &out); st != http.StatusOK {
+		t.Fatalf("search: %d %q", st, msg)
+	}
+	if len(out) != 2 || out[0].ID != hit {
+		t.Fatalf("got %+v, want the three-match message first of two", out)
+	}
+	if want := "<mark>deploy</mark> &lt;b&gt;tonight&lt;/b&gt;"; out[1].Snippet != want {
+		t.Errorf("snippet: got %q, want %q", out[1].Snippet, want)
+	}
+	if len(out[0].Reactions) != 1 || !out[0].Reactions[0].Me {
+		t.Errorf("reactions not hydrated: %+v", out[0].Reactions)
+	}
+
+	ts.expect(http.StatusForbidden, bob, "GET", path, nil)
+	ts.expect(http.StatusBadRequest, alice, "GET", fmt.Sprintf("/rooms/%d/messages/search?q=", roomID), nil)
+}
+
+func TestGlobalSearch(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@x")
+	bobID, bob := ts.user("bob@x")
+	general := ts.room(alice, "general", "public")
+	team := ts.room(alice, "team chat", "private")
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", general), nil)
+
+	fromBob := ts.message(general, bobID, "release notes")
+	inTeam := ts.message(team, aliceID, "release plan")
+	ts.message(general, aliceID, "release party")
+	if _, _, err := ts.s.store.ToggleReaction(context.Background(), fromBob, aliceID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(token, q string) []int64 {
+		t.Helper()
+		var out SearchResultsDTO
+		if st, msg := ts.call(token, "GET", "/search?q="+url.QueryEscape(q), nil, &out); st != http.StatusOK {
+			t.Fatalf("search %q: %d %q", q, st, msg)
+		}
+		var ids []int64
+		for _, g := range out.Groups {
+			for _, m := range g.Messages {
+				ids = append(ids, m.ID)
+				if m.ID == fromBob && len(m.Reactions) != 1 {
+					t.Errorf("reactions not hydrated: %+v", m.Reactions)
+				}
+			}
+		}
+		return ids
+	}
+
+	if got := search(alice, "release"); len(got) != 3 {
+		t.Errorf("release: got %v, want all three", got)
+	}
+	if got := search(alice, "release from:bob@x"); len(got) != 1 || got[0] != fromBob {
+		t.Errorf("from:bob@x: got %v, want [%d]", got, fromBob)
+	}
+	if got := search(alice, `release in:"team chat"`); len(got) != 1 || got[0] != inTeam {
+		t.Errorf("in:team chat: got %v, want [%d]", got, inTeam)
+	}
+	if got := search(bob, "release"); len(got) != 2 {
+		t.Errorf("bob sees %v; the private room's message must not show", got)
+	}
+	ts.expect(http.StatusBadRequest, alice, "GET", "/search?q=has:nothing", nil)
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := parseSearchQuery(`deploy from:alice@x in:"team chat" has:poll mime:image before:2024-05-01 re:`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Text != "deploy re:" || q.From != "alice@x" || q.InRoom != "team chat" || !q.HasPoll || q.Mime != "image" || q.Before.IsZero() {
+		t.Errorf("got %+v", q)
+	}
+	for _, bad := range []string{"has:nothing", "is:pinned", "after:yesterday"} {
+		if _, err := parseSearchQuery(bad); err == nil {
+			t.Errorf("%s: want an error", bad)
+		}
+	}
+	if !mimeMatches("image/png", "image") || mimeMatches("image/png", "image/jpeg") || mimeMatches("imagex/png", "image") {
+		t.Error("mimeMatches")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// testServer is the real router over a memStore, for handler tests.
+type testServer struct {
+	t   *testing.T
+	s   *Server
+	srv *httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &Server{
+		store:         newMemStore(),
+		jwtSecret:     []byte("test-secret"),
+		hub:           NewHub("test", nil, nil),
+		uploadsDir:    t.TempDir(),
+		calls:         make(map[int64]*CallState),
+		restoreWindow: 24 * time.Hour,
+		pinLimit:      50,
+		hubAdmins:     map[string]bool{},
+	}
+	srv := httptest.NewServer(s.routes())
+	t.Cleanup(srv.Close)
+	return &testServer{t: t, s: s, srv: srv}
+}
+
+// user creates an account straight in the store (skipping bcrypt) and
+// returns its id and a bearer token.
+func (ts *testServer) user(email string) (int64, string) {
+	ts.t.Helper()
+	id, err := ts.s.store.CreateUser(context.Background(), email, "x")
+	if err != nil {
+		ts.t.Fatalf("create user %s: %v", email, err)
+	}
+	tok, err := ts.s.makeJWT(id, email)
+	if err != nil {
+		ts.t.Fatalf("token for %s: %v", email, err)
+	}
+	return id, tok
+}
+
+// call sends body (if any) as JSON and decodes the response into out (if
+// any). It returns the status and, for errors, the "error" message.
+func (ts *testServer) call(token, method, path string, body, out any) (int, string) {
+	ts.t.Helper()
+	var rd bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		rd.Reset(b)
+	}
+	req, err := http.NewRequest(method, ts.srv.URL+path, &rd)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.srv.Client().Do(req)
+	if err != nil {
+		ts.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, e.Error
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			ts.t.Fatalf("%s %s: decode: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, ""
+}
+
+// expect fails the test unless method path answers with status.
+func (ts *testServer) expect(status int, token, method, path string, body any) string {
+	ts.t.Helper()
+	got, msg := ts.call(token, method, path, body, nil)
+	if got != status {
+		ts.t.Fatalf("%s %s: status %d (%q), want %d", method, path, got, msg, status)
+	}
+	return msg
+}
+
+func (ts *testServer) room(token, name, visibility string) int64 {
+	ts.t.Helper()
+	var out struct {
+		ID int64 `json:"id"`
+	}
+	req := map[string]string{"name": name, "visibility": visibility}
+	if st, msg := ts.call(token, "POST", "/rooms", req, &out); st != http.StatusCreated {
+		ts.t.Fatalf("create room: status %d (%q)", st, msg)
+	}
+	return out.ID
+}
+
+func (ts *testServer) message(roomID, userID int64, body string) int64 {
+	ts.t.Helper()
+	id, _, _, err := ts.s.store.InsertMessage(context.Background(), NewMessage{RoomID: roomID, UserID: userID, Body: body})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return id
+}
+
+// ws opens a WebSocket to the real /ws handler as token's user.
+func (ts *testServer) ws(token string) *websocket.Conn {
+	ts.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.srv.URL, "http")+"/ws?token="+url.QueryEscape(token), nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+// wsSend writes v to conn as a JSON frame.
+func wsSend(t *testing.T, conn *websocket.Conn, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMembershipRequired(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+
+	pub := ts.room(alice, "general", visibilityPublic)
+	priv := ts.room(alice, "secret", visibilityPrivate)
+
+	ts.expect(http.StatusUnauthorized, "", "GET", "/rooms", nil)
+	ts.expect(http.StatusUnauthorized, "not-a-jwt", "GET", "/rooms", nil)
+
+	for _, path := range []string{
+		fmt.Sprintf("/rooms/%d/messages", pub),
+		fmt.Sprintf("/rooms/%d/members", pub),
+		fmt.Sprintf("/rooms/%d/pins", pub),
+	} {
+		if msg := ts.expect(http.StatusForbidden, bob, "GET", path, nil); msg != "not a room member" {
+			t.Errorf("GET %s: error %q", path, msg)
+		}
+	}
+	ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/invites", pub), nil)
+
+	// a plain member can read but not invite or change settings
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", pub), nil)
+	ts.expect(http.StatusOK, bob, "GET", fmt.Sprintf("/rooms/%d/messages", pub), nil)
+	if msg := ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/invites", pub), nil); msg != "not allowed" {
+		t.Errorf("member invite: error %q", msg)
+	}
+	ts.expect(http.StatusForbidden, bob, "PUT", fmt.Sprintf("/rooms/%d/visibility", pub), map[string]string{"visibility": visibilityPrivate})
+
+	// private rooms only take invites
+	if msg := ts.expect(http.StatusForbidden, bob, "POST", fmt.Sprintf("/rooms/%d/join", priv), nil); msg != "room is private; join with an invite" {
+		t.Errorf("private join: error %q", msg)
+	}
+	ts.expect(http.StatusForbidden, bob, "GET", fmt.Sprintf("/rooms/%d/messages", priv), nil)
+}
+
+func TestMessageErrorsCarryClientMsgID(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	other := ts.room(alice, "random", visibilityPublic)
+
+	conn := ts.ws(alice)
+	wsSend(t, conn, WSIn{Type: "join_room", RoomID: roomID})
+	readUntil(t, conn, "user_list")
+
+	tests := []struct {
+		in   WSIn
+		want string
+	}{
+		{WSIn{RoomID: other, Body: "hi"}, "not in room"},
+		{WSIn{RoomID: roomID, Body: "  "}, "empty message"},
+		{WSIn{RoomID: roomID, Body: strings.Repeat("x", 4001)}, "message too long"},
+		{WSIn{RoomID: roomID, Body: "hi", ClientMsgID: strings.Repeat("c", 65)}, "clientMsgId too long"},
+	}
+	for i, tt := range tests {
+		tt.in.Type = "message"
+		if tt.in.ClientMsgID == "" {
+			tt.in.ClientMsgID = "c-" + string(rune('a'+i))
+		}
+		wsSend(t, conn, tt.in)
+
+		var out WSOut
+		if err := json.Unmarshal(readUntil(t, conn, "message_error").raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Error != tt.want || out.ClientMsgID != tt.in.ClientMsgID || out.RoomID != tt.in.RoomID {
+			t.Errorf("%s: got %+v", tt.want, out)
+		}
+	}
+}
+
+func TestMessageClientMsgIDDedupe(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+
+	conn := ts.ws(alice)
+	wsSend(t, conn, WSIn{Type: "join_room", RoomID: roomID})
+	readUntil(t, conn, "user_list")
+
+	// a retry after a lost ack reuses the clientMsgId
+	send := WSIn{Type: "message", RoomID: roomID, Body: "hello", ClientMsgID: "c-1"}
+	var acks []WSOut
+	for i := 0; i < 2; i++ {
+		wsSend(t, conn, send)
+		var ack WSOut
+		if err := json.Unmarshal(readUntil(t, conn, "message_ack").raw, &ack); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}
+	if acks[0].Duplicate || !acks[1].Duplicate {
+		t.Errorf("duplicate flags: got %v, %v; want false, true", acks[0].Duplicate, acks[1].Duplicate)
+	}
+	if acks[0].MessageID == 0 || acks[1].MessageID != acks[0].MessageID || acks[1].ClientMsgID != "c-1" {
+		t.Errorf("acks: got %+v and %+v, want the same message", acks[0], acks[1])
+	}
+
+	// a different key is a different message
+	send.ClientMsgID = "c-2"
+	wsSend(t, conn, send)
+	readUntil(t, conn, "message_ack")
+
+	var msgs []MessageDTO
+	if st, msg := ts.call(alice, "GET", fmt.Sprintf("/rooms/%d/messages", roomID), nil, &msgs); st != http.StatusOK {
+		t.Fatalf("list messages: status %d (%q)", st, msg)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("got %d messages stored, want 2", len(msgs))
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxTopicLen        = 250
+	maxDescriptionLen  = 2000
+	maxRetentionDays   = 3650
+	maxSlowModeSeconds = 6 * 60 * 60
+)
+
+// avatarExts are the image types handleUpload hands out.
+var avatarExts = map[string]bool{".png": true, ".jpg": true, ".gif": true, ".webp": true}
+
+type RoomSettingsDTO struct {
+	RetentionDays   int    `json:"retentionDays"` // 0 = keep forever
+	CallRole        string `json:"callRole"`
+	SlowModeSeconds int    `json:"slowModeSeconds"` // 0 = off
+}
+
+func roomSettingsDTO(rs RoomSettings) RoomSettingsDTO {
+	return RoomSettingsDTO{RetentionDays: rs.RetentionDays, CallRole: rs.CallRole, SlowModeSeconds: rs.SlowModeSeconds}
+}
+
+type patchRoomReq struct {
+	Name        *string `json:"name"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	AvatarURL   *string `json:"avatarUrl"` // from POST /upload; "" clears it
+	Settings    *struct {
+		RetentionDays   *int    `json:"retentionDays"`
+		CallRole        *string `json:"callRole"`
+		SlowModeSeconds *int    `json:"slowModeSeconds"`
+	} `json:"settings"`
+}
+
+// validAvatar accepts "" or an image that POST /upload stored.
+func (s *Server) validAvatar(url string) bool {
+	if url == "" {
+		return true
+	}
+	name, ok := strings.CutPrefix(url, "/uploads/")
+	if !ok || name == "" || path.Base(name) != name || !avatarExts[strings.ToLower(path.Ext(name))] {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.uploadsDir, name))
+	return err == nil
+}
+
+// roomPatch validates req and turns it into a RoomPatch plus the list of
+// fields it touches, or returns a message for the 400.
+func (s *Server) roomPatch(req patchRoomReq) (RoomPatch, []string, string) {
+	var p RoomPatch
+	var changed []string
+	trim := func(v *string) *string {
+		t := strings.TrimSpace(*v)
+		return &t
+	}
+
+	if req.Name != nil {
+		if p.Name = trim(req.Name); *p.Name == "" || len(*p.Name) > 80 {
+			return p, nil, "room name must be 1-80 chars"
+		}
+		changed = append(changed, "name")
+	}
+	if req.Topic != nil {
+		if p.Topic = trim(req.Topic); len(*p.Topic) > maxTopicLen {
+			return p, nil, "topic too long"
+		}
+		changed = append(changed, "topic")
+	}
+	if req.Description != nil {
+		if p.Description = trim(req.Description); len(*p.Description) > maxDescriptionLen {
+			return p, nil, "description too long"
+		}
+		changed = append(changed, "description")
+	}
+	if req.AvatarURL != nil {
+		if p.AvatarURL = trim(req.AvatarURL); !s.validAvatar(*p.AvatarURL) {
+			return p, nil, "avatarUrl must be an image from /upload"
+		}
+		changed = append(changed, "avatarUrl")
+	}
+
+	if st := req.Settings; st != nil {
+		if st.RetentionDays != nil {
+			if *st.RetentionDays < 0 || *st.RetentionDays > maxRetentionDays {
+				return p, nil, fmt.Sprintf("retentionDays must be 0-%d", maxRetentionDays)
+			}
+			p.RetentionDays = st.RetentionDays
+			changed = append(changed, "retentionDays")
+		}
+		if st.CallRole != nil {
+			// readonly can't start calls whatever the setting, and the owner
+			// always can
+			switch *st.CallRole {
+			case roleMember, roleModerator, roleAdmin, roleOwner:
+			default:
+				return p, nil, "callRole must be member, moderator, admin or owner"
+			}
+			p.CallRole = st.CallRole
+			changed = append(changed, "callRole")
+		}
+		if st.SlowModeSeconds != nil {
+			if *st.SlowModeSeconds < 0 || *st.SlowModeSeconds > maxSlowModeSeconds {
+				return p, nil, fmt.Sprintf("slowModeSeconds must be 0-%d", maxSlowModeSeconds)
+			}
+			p.SlowModeSeconds = st.SlowModeSeconds
+			changed = append(changed, "slowModeSeconds")
+		}
+	}
+
+	if len(changed) == 0 {
+		return p, nil, "nothing to update"
+	}
+	return p, changed, ""
+}
+
+// handlePatchRoom is PATCH /rooms/{roomID}: name, topic, description, avatar
+// and room settings, for admins and the owner. Only the fields sent change.
+func (s *Server) handlePatchRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var req patchRoomReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	patch, changed, msg := s.roomPatch(req)
+	if msg != "" {
+		writeErr(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if _, ok := s.requirePerm(w, r, roomID, permEditSettings); !ok {
+		return
+	}
+
+	room, err := s.store.UpdateRoom(r.Context(), roomID, patch)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "room not found")
+		return
+	}
+	if err != nil {
+		log.Println("handlePatchRoom db error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// cached memberships carry callRole and slow mode
+	if patch.CallRole != nil || patch.SlowModeSeconds != nil {
+		s.hub.forgetMember(roomID, 0)
+	}
+
+	email := emailFromCtx(r)
+	ev := map[string]any{
+		"type":        "room_updated",
+		"roomId":      roomID,
+		"name":        room.Name,
+		"topic":       room.Topic,
+		"description": room.Description,
+		"avatarUrl":   room.AvatarURL,
+		"settings":    roomSettingsDTO(room.RoomSettings),
+		"changed":     changed,
+		"by":          email,
+	}
+	s.hub.BroadcastToRoom(roomID, ev)
+
+	text := "✏️ " + email + " updated the room's " + strings.Join(changed, ", ")
+	if patch.Name != nil {
+		text = fmt.Sprintf("✏️ %s renamed the room to %q", email, room.Name)
+	} else if patch.SlowModeSeconds != nil && len(changed) == 1 {
+		text = "🐢 " + email + " turned slow mode off"
+		if room.SlowModeSeconds > 0 {
+			text = fmt.Sprintf("🐢 %s set slow mode to %ds", email, room.SlowModeSeconds)
+		}
+	}
+	s.broadcastSystem(roomID, text)
+
+	writeJSON(w, http.StatusOK, ev)
+}
+
+// slowModeWait is how much longer m has to wait before posting again in a
+// slow-mode room; 0 means go ahead. Moderators and up are exempt, and a
+// resend of the last post (same clientMsgID) isn't held back.
+func (s *Server) slowModeWait(ctx context.Context, roomID int64, m Member, clientMsgID string) (time.Duration, error) {
+	if m.SlowModeSeconds <= 0 || roleCan(m.Role, permModerate) {
+		return 0, nil
+	}
+	last, lastClientID, err := s.store.LastPost(ctx, roomID, m.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if clientMsgID != "" && clientMsgID == lastClientID {
+		return 0, nil
+	}
+	if wait := time.Until(last.Add(time.Duration(m.SlowModeSeconds) * time.Second)); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// runRetentionPurger deletes messages that have outlived their room's
+// retentionDays setting.
+func runRetentionPurger(ctx context.Context, store Store) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := store.PurgeExpiredMessages(ctx)
+		if err != nil {
+			log.Println("retention purge error:", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("retention purge removed", n, "messages")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+func TestPatchRoom(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	path := fmt.Sprintf("/rooms/%d", roomID)
+	if err := os.WriteFile(filepath.Join(ts.s.uploadsDir, "cat.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body any
+		msg  string
+	}{
+		{map[string]any{}, "nothing to update"},
+		{map[string]any{"topic": strings.Repeat("x", maxTopicLen+1)}, "topic too long"},
+		{map[string]any{"avatarUrl": "https://example.com/cat.png"}, "avatarUrl must be an image from /upload"},
+		{map[string]any{"avatarUrl": "/uploads/missing.png"}, "avatarUrl must be an image from /upload"},
+		{map[string]any{"settings": map[string]any{"callRole": "readonly"}}, "callRole must be member, moderator, admin or owner"},
+		{map[string]any{"settings": map[string]any{"slowModeSeconds": -1}}, fmt.Sprintf("slowModeSeconds must be 0-%d", maxSlowModeSeconds)},
+	} {
+		if msg := ts.expect(http.StatusBadRequest, alice, "PATCH", path, tt.body); msg != tt.msg {
+			t.Errorf("%v: error %q, want %q", tt.body, msg, tt.msg)
+		}
+	}
+	ts.expect(http.StatusForbidden, bob, "PATCH", path, map[string]any{"topic": "mine now"})
+
+	var ev struct {
+		Topic       string          `json:"topic"`
+		Description string          `json:"description"`
+		AvatarURL   string          `json:"avatarUrl"`
+		Settings    RoomSettingsDTO `json:"settings"`
+		Changed     []string        `json:"changed"`
+	}
+	req := map[string]any{"topic": " lunch plans ", "avatarUrl": "/uploads/cat.png", "settings": map[string]any{"retentionDays": 30}}
+	if st, msg := ts.call(alice, "PATCH", path, req, &ev); st != http.StatusOK {
+		t.Fatalf("patch: status %d (%q)", st, msg)
+	}
+	if ev.Topic != "lunch plans" || ev.AvatarURL != "/uploads/cat.png" || ev.Settings.RetentionDays != 30 || len(ev.Changed) != 3 {
+		t.Errorf("patched: got %+v", ev)
+	}
+
+	// fields left out keep their value
+	if st, _ := ts.call(alice, "PATCH", path, map[string]any{"description": "where we eat"}, &ev); st != http.StatusOK {
+		t.Fatal("second patch failed")
+	}
+	if ev.Topic != "lunch plans" || ev.Description != "where we eat" || ev.Settings.RetentionDays != 30 {
+		t.Errorf("after a partial patch: got %+v", ev)
+	}
+}
+
+func TestSlowModeAndCallRole(t *testing.T) {
+	ts := newTestServer(t)
+	_, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	ts.expect(http.StatusOK, alice, "PATCH", fmt.Sprintf("/rooms/%d", roomID),
+		map[string]any{"settings": map[string]any{"slowModeSeconds": 60, "callRole": roleModerator}})
+
+	conns := map[string]*websocket.Conn{}
+	for name, tok := range map[string]string{"alice": alice, "bob": bob} {
+		conns[name] = ts.ws(tok)
+		wsSend(t, conns[name], WSIn{Type: "join_room", RoomID: roomID})
+		readUntil(t, conns[name], "user_list")
+	}
+	post := func(who, clientMsgID string) wsFrame {
+		t.Helper()
+		wsSend(t, conns[who], WSIn{Type: "message", RoomID: roomID, Body: "hi", ClientMsgID: clientMsgID})
+		for {
+			if f := readFrame(t, conns[who]); f.Type == "message_ack" || f.Type == "message_error" {
+				return f
+			}
+		}
+	}
+
+	if f := post("bob", "b-1"); f.Type != "message_ack" {
+		t.Fatalf("first post: got %s", f.raw)
+	}
+	if f := post("bob", "b-2"); f.Type != "message_error" || !jsonHas(f.raw, `"code":"slow_mode"`) || !jsonHas(f.raw, `"retryAfterMs"`) {
+		t.Errorf("second post: got %s", f.raw)
+	}
+	// a resend of the last post isn't held back, and moderators are exempt
+	if f := post("bob", "b-1"); f.Type != "message_ack" || !jsonHas(f.raw, `"duplicate":true`) {
+		t.Errorf("resend: got %s", f.raw)
+	}
+	for _, id := range []string{"a-1", "a-2"} {
+		if f := post("alice", id); f.Type != "message_ack" {
+			t.Errorf("owner post %s: got %s", id, f.raw)
+		}
+	}
+	if st, _ := ts.call(bob, "POST", fmt.Sprintf("/rooms/%d/polls", roomID), createPollReq{Question: "q", Options: []string{"a", "b"}}, nil); st != http.StatusTooManyRequests {
+		t.Errorf("poll in slow mode: status %d, want 429", st)
+	}
+
+	// callRole moderator: members can't start calls
+	wsSend(t, conns["bob"], WSIn{Type: "call_start", RoomID: roomID})
+	if f := readUntil(t, conns["bob"], "error"); !jsonHas(f.raw, `"code":"forbidden"`) {
+		t.Errorf("member call_start: got %s", f.raw)
+	}
+}
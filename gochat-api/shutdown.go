@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// beginConn registers a WS handler with the drain WaitGroup. It fails once
+// draining has started, so Wait never races a late Add.
+func (h *Hub) beginConn() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.wsConns.Add(1)
+	return true
+}
+
+func (h *Hub) endConn() { h.wsConns.Done() }
+
+func (h *Hub) isDraining() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// drain tells every local client the server is going away (with a jittered
+// reconnect hint so replicas aren't stampeded), waits for its writer to
+// flush that frame, then closes with StatusGoingAway. It returns once every
+// handleWS has finished its cleanup or ctx expires.
+func (h *Hub) drain(ctx context.Context) {
+	h.mu.Lock()
+	h.draining = true
+	clients := make([]*Client, 0)
+	for _, m := range h.users {
+		for c := range m {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+
+			b, _ := json.Marshal(WSOut{
+				Type:         "server_restarting",
+				RetryAfterMs: 1000 + rand.Int63n(4000),
+			})
+
+			// straight onto the queue rather than through enqueue, which
+			// would hold it behind a join_room replay; the nil after it
+			// tells writeLoop to close once it's written
+			timer := time.NewTimer(2 * time.Second)
+			defer timer.Stop()
+			for _, f := range [][]byte{b, nil} {
+				select {
+				case c.send <- f:
+				case <-c.done:
+					return
+				case <-timer.C:
+					c.close(websocket.StatusGoingAway, "server restarting")
+					return
+				}
+			}
+
+			select {
+			case <-c.flushed:
+			case <-timer.C:
+				c.close(websocket.StatusGoingAway, "server restarting")
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		h.wsConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("shutdown: gave up waiting for WS cleanup:", ctx.Err())
+	}
+}
+
+// announceCallsInterrupted posts a system message in every room whose active
+// call has participants connected to this node, before their sockets close.
+func (s *Server) announceCallsInterrupted() {
+	s.callMu.Lock()
+	type call struct {
+		roomID       int64
+		participants []string
+	}
+	var active []call
+	for roomID, cs := range s.calls {
+		if cs.Active {
+			active = append(active, call{roomID: roomID, participants: append([]string(nil), cs.Participants...)})
+		}
+	}
+	s.callMu.Unlock()
+
+	for _, c := range active {
+		local := 0
+		s.hub.mu.Lock()
+		for _, em := range c.participants {
+			local += len(s.hub.users[strings.ToLower(em)])
+		}
+		s.hub.mu.Unlock()
+
+		if local > 0 {
+			log.Println("shutdown: interrupting call in room", c.roomID, "participants:", c.participants)
+			s.broadcastSystem(c.roomID, "📹 server restarting: call participants on this server will reconnect")
+		}
+	}
+}
+
+// callRejoinGrace is how long a restored call keeps participants who
+// haven't reconnected.
+const callRejoinGrace = time.Minute
+
+// saveCalls stores the calls live on this node, so a restart doesn't lose
+// them; restoreCalls picks them up when a node comes back.
+func (s *Server) saveCalls(ctx context.Context) {
+	s.callMu.Lock()
+	var active []CallState
+	for roomID, cs := range s.calls {
+		if cs.Active {
+			out := cs.snapshot()
+			out.RoomID = roomID
+			active = append(active, out)
+		}
+	}
+	s.callMu.Unlock()
+
+	if len(active) == 0 {
+		return
+	}
+	if err := s.store.SaveCalls(ctx, active); err != nil {
+		log.Println("shutdown: saving calls:", err)
+		return
+	}
+	log.Println("shutdown: saved", len(active), "active calls")
+}
+
+// restoreCalls takes back the calls saved by the last shutdown. After
+// callRejoinGrace, participants who haven't reconnected here are dropped,
+// unless another node has told us the call's live state in the meantime.
+func (s *Server) restoreCalls(ctx context.Context) {
+	calls, err := s.store.TakeCalls(ctx)
+	if err != nil {
+		log.Println("restoring calls:", err)
+		return
+	}
+	if len(calls) == 0 {
+		return
+	}
+
+	s.callMu.Lock()
+	for _, cs := range calls {
+		cs.restored = true
+		s.calls[cs.RoomID] = &cs
+	}
+	s.callMu.Unlock()
+
+	log.Println("restored", len(calls), "calls saved at shutdown")
+	time.AfterFunc(callRejoinGrace, s.pruneRestoredCalls)
+}
+
+func (s *Server) pruneRestoredCalls() {
+	s.callMu.Lock()
+	restored := map[int64][]string{}
+	for roomID, cs := range s.calls {
+		if cs.restored {
+			cs.restored = false
+			restored[roomID] = append([]string(nil), cs.Participants...)
+		}
+	}
+	s.callMu.Unlock()
+
+	for roomID, participants := range restored {
+		for _, em := range participants {
+			s.hub.mu.Lock()
+			back := len(s.hub.users[strings.ToLower(em)]) > 0
+			s.hub.mu.Unlock()
+			if !back {
+				s.callOp(roomID, "leave", em)
+			}
+		}
+		s.broadcastCallState(roomID)
+	}
+}
+
+// shutdown saves live calls and drains WebSockets first (they're hijacked,
+// so srv.Shutdown won't wait for them), then lets in-flight HTTP requests
+// such as uploads finish.
+func (s *Server) shutdown(ctx context.Context, srv *http.Server) {
+	s.announceCallsInterrupted()
+	s.saveCalls(ctx)
+	s.hub.drain(ctx)
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown: http server:", err)
+	}
+}
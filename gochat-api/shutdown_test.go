@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestDrainSaysGoodbye(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	_, idle := wsClient(t, h, 1, "alice@x")
+
+	// one client is mid-replay: held live frames must not delay the goodbye
+	replaying, peer := wsClient(t, h, 2, "bob@x")
+	h.holdLive(replaying)
+
+	// what each peer sees: its first frame, then how the socket closed
+	type seen struct {
+		first []byte
+		err   error
+	}
+	got := make(chan seen, 2)
+	for _, p := range []*websocket.Conn{idle, peer} {
+		go func() {
+			_, first, _ := p.Read(context.Background())
+			_, _, err := p.Read(context.Background())
+			got <- seen{first, err}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	h.drain(ctx)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("drain took %v; it should wait for the writers, not a timer", took)
+	}
+
+	for range 2 {
+		s := <-got
+		if frameType(s.first) != "server_restarting" {
+			t.Errorf("got %s, want server_restarting", s.first)
+		}
+		var ce websocket.CloseError
+		if !errors.As(s.err, &ce) || ce.Code != websocket.StatusGoingAway {
+			t.Errorf("after goodbye: got %v, want close %d", s.err, websocket.StatusGoingAway)
+		}
+	}
+
+	if h.beginConn() {
+		t.Error("new connection accepted while draining")
+	}
+}
+
+func TestCallsSurviveRestart(t *testing.T) {
+	store := newMemStore()
+	newServer := func() *Server {
+		return &Server{store: store, hub: NewHub("test", nil, nil), calls: make(map[int64]*CallState)}
+	}
+	ctx := context.Background()
+
+	before := newServer()
+	before.callOp(7, "start", "alice@x")
+	before.callOp(7, "join", "bob@x")
+	before.saveCalls(ctx)
+
+	after := newServer()
+	after.restoreCalls(ctx)
+	cs := after.calls[7]
+	if cs == nil || !cs.Active || cs.HostEmail != "alice@x" || len(cs.Participants) != 2 {
+		t.Fatalf("restored call: %+v", cs)
+	}
+
+	// restored once: a second node starting up doesn't get it too
+	other := newServer()
+	other.restoreCalls(ctx)
+	if len(other.calls) != 0 {
+		t.Errorf("call restored twice: %+v", other.calls)
+	}
+
+	// bob reconnected, alice (the host) didn't
+	wsClient(t, after.hub, 2, "bob@x")
+	after.pruneRestoredCalls()
+	if cs.Active {
+		t.Errorf("call kept after its host didn't come back: %+v", *cs)
+	}
+}
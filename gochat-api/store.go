@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Store is everything the HTTP handlers and the hub need from persistence.
+// pgStore (store_pg.go) is the real thing; memStore (store_mem.go) keeps it
+// all in maps for local runs (STORE=memory) and handler tests.
+type Store interface {
+	UserStore
+	RoomStore
+	MemberStore
+	MessageStore
+	ReactionStore
+	PollStore
+	StarStore
+	PinStore
+	ReadStore
+	ThreadStore
+	RevisionStore
+	MentionStore
+	InviteStore
+	CallStore
+}
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+	ErrPinLimit = errors.New("pin limit reached")
+)
+
+type UserStore interface {
+	// CreateUser returns ErrConflict if the email is taken.
+	CreateUser(ctx context.Context, email, passwordHash string) (int64, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+	UserByID(ctx context.Context, id int64) (User, error)
+	// DeleteUser removes the account. What it wrote (messages, reactions,
+	// votes, edits, pins) stays, moved to a tombstone user of its own named
+	// deletedUserEmail, so counts still add up and old tokens, which carry
+	// the old id, stop working. Rooms the user owns pass to ownerSuccessor
+	// in the same transaction; rooms with nobody else left go with the
+	// account.
+	DeleteUser(ctx context.Context, userID int64) ([]OwnerChange, error)
+}
+
+// deletedUserEmail is what a deleted account's content is shown under. It
+// has no @, so nobody can register or log in as it.
+func deletedUserEmail(userID int64) string {
+	return "deleted-user-" + strconv.FormatInt(userID, 10)
+}
+
+type RoomStore interface {
+	// CreateRoom inserts the room and makes r.OwnerID its owner.
+	CreateRoom(ctx context.Context, r NewRoom) (int64, error)
+	// GetRoom returns ErrNotFound for deleted rooms too.
+	GetRoom(ctx context.Context, id int64) (RoomInfo, error)
+	// ListRooms returns userID's rooms in the given roomView*, newest
+	// first, with unread counts.
+	ListRooms(ctx context.Context, userID int64, view string) ([]Room, error)
+	SetVisibility(ctx context.Context, id int64, visibility string) error
+	// UpdateRoom applies p and returns the updated room.
+	UpdateRoom(ctx context.Context, id int64, p RoomPatch) (RoomInfo, error)
+	// SetArchived archives or unarchives the room; see denyReason.
+	SetArchived(ctx context.Context, id int64, archived bool) error
+	// TransferOwnership makes toID the owner and demotes the current owner
+	// to admin, keeping rooms.created_by in step. ErrNotFound if toID isn't
+	// a member.
+	TransferOwnership(ctx context.Context, roomID, toID int64) error
+	// SoftDeleteRoom hides the room from everyone. Nothing is removed until
+	// PurgeDeletedRooms gets to it.
+	SoftDeleteRoom(ctx context.Context, id int64) error
+	// RestoreRoom undoes SoftDeleteRoom for the room's owner, as long as it
+	// was deleted after since. ErrNotFound otherwise.
+	RestoreRoom(ctx context.Context, id, ownerID int64, since time.Time) error
+	// PurgeDeletedRooms removes rooms deleted before the cutoff, and
+	// everything in them, for good.
+	PurgeDeletedRooms(ctx context.Context, before time.Time) (int64, error)
+	// OpenDM returns the DM between exactly userIDs (sorted, deduplicated,
+	// creatorID among them), creating it with all of them if there isn't one
+	// yet. Reopening it only brings creatorID back if they'd left; anyone
+	// else who left stays out. added lists the users who became members.
+	OpenDM(ctx context.Context, creatorID int64, userIDs []int64) (roomID int64, added []int64, err error)
+}
+
+type MemberStore interface {
+	IsMember(ctx context.Context, roomID, userID int64) (bool, error)
+	// GetMember returns ErrNotFound if userID isn't in roomID.
+	GetMember(ctx context.Context, roomID, userID int64) (Member, error)
+	SetMemberRole(ctx context.Context, roomID, userID int64, role string) error
+	// SetMute mutes userID in roomID until the given time; zero unmutes.
+	SetMute(ctx context.Context, roomID, userID int64, until time.Time) error
+	// MemberRooms filters roomIDs down to the ones userID belongs to.
+	MemberRooms(ctx context.Context, userID int64, roomIDs []int64) ([]int64, error)
+	MemberEmails(ctx context.Context, roomID int64) ([]string, error)
+	// ListMembers returns roomID's members, longest-standing first.
+	ListMembers(ctx context.Context, roomID int64) ([]Member, error)
+	// AddMember is idempotent; added=false means userID was already in.
+	AddMember(ctx context.Context, roomID, userID int64, role string) (added bool, err error)
+	RemoveMember(ctx context.Context, roomID, userID int64) error
+
+	// Ban removes b.UserID from the room (if they're in it) and keeps them
+	// out until b.ExpiresAt (zero = for good). Re-banning replaces the ban.
+	Ban(ctx context.Context, b Ban) error
+	// Unban returns ErrNotFound if there was no ban.
+	Unban(ctx context.Context, roomID, userID int64) error
+	// ActiveBan returns ErrNotFound unless userID is banned from roomID right now.
+	ActiveBan(ctx context.Context, roomID, userID int64) (Ban, error)
+	// ListBans returns roomID's unexpired bans, newest first.
+	ListBans(ctx context.Context, roomID int64) ([]Ban, error)
+}
+
+type MessageStore interface {
+	// InsertMessage stores m. If m.ClientMsgID was already used by the same
+	// user in the same room, nothing is written and the original comes back
+	// with duplicate=true.
+	InsertMessage(ctx context.Context, m NewMessage) (id int64, createdAt time.Time, duplicate bool, err error)
+	// GetMessage returns ErrNotFound for unknown ids; soft-deleted messages
+	// are returned with Deleted set.
+	GetMessage(ctx context.Context, id int64) (MessageMeta, error)
+	// ListMessages returns a page of q.RoomID, newest first unless q.Forward. Polls come back
+	// without counts and no reactions are attached (see hydrate*).
+	ListMessages(ctx context.Context, q MessageQuery) ([]MessageDTO, error)
+	// SearchMessages full-text searches body, attachment filename and poll
+	// text. Hits carry Rank and a highlighted Snippet.
+	SearchMessages(ctx context.Context, q MessageSearch) ([]MessageDTO, error)
+	// SearchAll searches every room q.ViewerID belongs to, newest first.
+	SearchAll(ctx context.Context, q GlobalSearch) ([]SearchHit, error)
+	// EditMessage replaces the body, keeping the old one as a revision. It
+	// reports false, and records nothing, when body is what's already there
+	// or the message is deleted.
+	EditMessage(ctx context.Context, id, editorID int64, body string) (bool, error)
+	// DeleteMessage soft-deletes id and drops its pin, reporting whether it
+	// had one.
+	DeleteMessage(ctx context.Context, id int64) (unpinned bool, err error)
+	// DeleteOwnMessages soft-deletes the ids that belong to userID and aren't
+	// deleted yet, returning what was actually deleted. Pins go too.
+	DeleteOwnMessages(ctx context.Context, userID int64, ids []int64) ([]MessageMeta, error)
+	// LastPost is when userID last posted in roomID, and with which client
+	// id (slow mode). ErrNotFound if they never have.
+	LastPost(ctx context.Context, roomID, userID int64) (time.Time, string, error)
+	// PurgeExpiredMessages removes messages older than their room's
+	// RetentionDays, for good.
+	PurgeExpiredMessages(ctx context.Context) (int64, error)
+}
+
+// A thread is a root message plus every message whose thread_root_id points
+// at it. reply_to_id is what a reply answered, which may be another reply.
+// Deleted replies don't count: they're left out of both the list and the
+// summaries.
+type ThreadStore interface {
+	// MessageByID is the MessageDTO form of GetMessage (ErrNotFound if unknown).
+	MessageByID(ctx context.Context, id, viewerID int64) (MessageDTO, error)
+	// ListReplies pages through rootID's live replies oldest first, ids > afterID.
+	ListReplies(ctx context.Context, rootID, viewerID, afterID int64, limit int) ([]MessageDTO, error)
+	// ThreadSummaries covers the ids that have at least one live reply.
+	ThreadSummaries(ctx context.Context, rootIDs []int64) (map[int64]ThreadSummary, error)
+}
+
+type RevisionStore interface {
+	// ListRevisions returns messageID's edit history, oldest first.
+	ListRevisions(ctx context.Context, messageID int64) ([]MessageRevision, error)
+}
+
+type MentionStore interface {
+	// SetMentions replaces messageID's mentions (userID -> mentionKind*) and
+	// returns the users that weren't mentioned before.
+	SetMentions(ctx context.Context, messageID int64, mentions map[int64]string) (added []int64, err error)
+	// ListMentions pages through q.UserID's mentions, newest first, skipping
+	// deleted messages and rooms they've left.
+	ListMentions(ctx context.Context, q MentionQuery) ([]Mention, error)
+	// MarkMentionsRead marks the given messages' mentions read; no ids means all.
+	MarkMentionsRead(ctx context.Context, userID int64, messageIDs []int64) error
+}
+
+// InviteStore covers invite links and the join-request queue of
+// non-public rooms.
+type InviteStore interface {
+	CreateInvite(ctx context.Context, inv Invite) error
+	// GetInvite returns the invite whether or not it's still usable.
+	GetInvite(ctx context.Context, token string) (Invite, error)
+	// ListInvites returns roomID's usable invites, newest first.
+	ListInvites(ctx context.Context, roomID int64) ([]Invite, error)
+	RevokeInvite(ctx context.Context, roomID int64, token string) error
+	// RedeemInvite adds userID to the invite's room and uses up one use.
+	// Unusable invites give ErrNotFound; already being a member costs
+	// nothing and returns added=false.
+	RedeemInvite(ctx context.Context, token string, userID int64) (roomID int64, added bool, err error)
+
+	// RequestJoin is idempotent; created=false means a request was pending.
+	RequestJoin(ctx context.Context, roomID, userID int64, note string) (created bool, err error)
+	// ListJoinRequests returns roomID's pending requests, oldest first.
+	ListJoinRequests(ctx context.Context, roomID int64) ([]JoinRequest, error)
+	// ResolveJoinRequest drops the request (ErrNotFound if none) and, when
+	// approve is set, adds userID as a member.
+	ResolveJoinRequest(ctx context.Context, roomID, userID int64, approve bool) error
+}
+
+type ReactionStore interface {
+	// ToggleReaction adds userID's emoji or takes it back, and returns the
+	// emoji's new count on the message.
+	ToggleReaction(ctx context.Context, messageID, userID int64, emoji string) (added bool, count int64, err error)
+	ReactionSummaries(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64][]ReactionDTO, error)
+	// ReactionUsers maps emoji -> emails of who reacted, sorted.
+	ReactionUsers(ctx context.Context, messageID int64) (map[string][]string, error)
+}
+
+type PollStore interface {
+	CreatePoll(ctx context.Context, roomID, userID int64, pollJSON string) (id int64, createdAt time.Time, err error)
+	// UpdatePoll replaces the poll and marks it edited, keeping the old one
+	// as a revision. remap is nil if the options didn't change; otherwise
+	// remap[i] is old option i's new index (-1 = removed, its votes go) and
+	// the revision keeps the tallies as they were. ErrNotFound if the
+	// message is gone or deleted.
+	UpdatePoll(ctx context.Context, messageID, editorID int64, pollJSON string, remap []int) error
+	// VotePoll casts, switches or (same option again) withdraws userID's
+	// vote. counts has numOptions entries.
+	VotePoll(ctx context.Context, messageID, userID int64, optionIdx, numOptions int) (myVote int, counts []int64, err error)
+	PollTallies(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64]PollTally, error)
+}
+
+type StarStore interface {
+	StarMessages(ctx context.Context, userID int64, ids []int64) error
+	UnstarMessages(ctx context.Context, userID int64, ids []int64) error
+	// ListStarred pages through userID's stars, most recently starred first.
+	ListStarred(ctx context.Context, userID int64, before time.Time, limit int) ([]StarredMessageDTO, error)
+}
+
+// PinStore covers room-wide pins, as opposed to personal stars.
+type PinStore interface {
+	// PinMessage pins id in its room for everyone. pinned is false if it
+	// already was; ErrPinLimit if the room has limit pins already.
+	PinMessage(ctx context.Context, id, userID int64, limit int) (pinned bool, err error)
+	// UnpinMessage reports false if id wasn't pinned.
+	UnpinMessage(ctx context.Context, id int64) (bool, error)
+	// ListPins is roomID's pinned messages, most recently pinned first.
+	// Deleted messages are left out.
+	ListPins(ctx context.Context, roomID, viewerID int64) ([]PinnedMessage, error)
+}
+
+type PinnedMessage struct {
+	MessageDTO
+	PinnedBy string // email; "" if their account is gone
+	PinnedAt time.Time
+}
+
+type ReadStore interface {
+	// MarkRead only ever moves the read marker forward.
+	MarkRead(ctx context.Context, roomID, userID, lastReadMessageID int64) error
+	// RoomActivity has the ActivityFunc signature so it can feed the hub.
+	RoomActivity(ctx context.Context, roomID int64, userIDs []int64) (latestID int64, unread map[int64]int64, err error)
+}
+
+// CallStore keeps live calls across a restart (see shutdown.go).
+type CallStore interface {
+	// SaveCalls stores calls, replacing what was saved for the same rooms.
+	SaveCalls(ctx context.Context, calls []CallState) error
+	// TakeCalls returns the saved calls and forgets them, so only one node
+	// restores each.
+	TakeCalls(ctx context.Context) ([]CallState, error)
+}
+
+type User struct {
+	ID           int64
+	Email        string
+	PasswordHash string
+}
+
+type Member struct {
+	UserID     int64
+	Email      string
+	Role       string
+	JoinedAt   time.Time
+	MutedUntil time.Time // zero = not muted; see muteForever
+
+	// room-wide, copied in so permission checks need no extra lookup
+	Archived        bool   // the room is archived, so read-only; see denyReason
+	CallRole        string // RoomSettings.CallRole
+	SlowModeSeconds int    // RoomSettings.SlowModeSeconds
+}
+
+// muteForever stands in for "no expiry" in room_members.muted_until
+// (pgx can't scan 'infinity' into a time.Time).
+var muteForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+type Ban struct {
+	RoomID        int64
+	UserID        int64
+	Email         string // filled in by ListBans / ActiveBan
+	BannedBy      int64
+	BannedByEmail string
+	Reason        string
+	ExpiresAt     time.Time // zero = permanent
+	CreatedAt     time.Time
+}
+
+type RoomInfo struct {
+	ID         int64
+	Name       string
+	CreatedBy  int64
+	CreatedAt  time.Time
+	Visibility string    // visibility*
+	Kind       string    // roomKind*
+	ArchivedAt time.Time // zero = not archived
+	RoomSettings
+}
+
+// RoomSettings is the room metadata PATCH /rooms/{id} edits besides the name.
+type RoomSettings struct {
+	Topic           string
+	Description     string
+	AvatarURL       string // an /uploads/ image, or ""
+	RetentionDays   int    // messages older than this are purged; 0 = keep forever
+	CallRole        string // lowest role that can start calls (member and up)
+	SlowModeSeconds int    // minimum gap between a member's posts; 0 = off
+}
+
+// RoomPatch is a partial room update; nil fields are left alone.
+type RoomPatch struct {
+	Name            *string
+	Topic           *string
+	Description     *string
+	AvatarURL       *string
+	RetentionDays   *int
+	CallRole        *string
+	SlowModeSeconds *int
+}
+
+// Which of a user's rooms ListRooms returns.
+const (
+	roomViewActive   = "active"   // the default: not archived
+	roomViewArchived = "archived" // archived only
+	roomViewAll      = "all"      // active and archived
+	roomViewDeleted  = "deleted"  // soft-deleted rooms the user owns, still restorable
+	roomViewDMs      = "dms"      // direct messages; the other views leave them out
+)
+
+// OwnerChange is a room that changed hands because its owner deleted their
+// account. NewOwner.UserID is 0 if nobody was left and the room went too.
+type OwnerChange struct {
+	RoomID   int64
+	RoomName string
+	NewOwner Member
+}
+
+type NewRoom struct {
+	Name        string
+	OwnerID     int64
+	Visibility  string
+	Topic       string
+	Description string
+}
+
+// Room kinds. A DM has no name and no owner: every participant is a plain
+// member, so nothing above roleMember's permissions applies. Its created_by
+// is just whoever opened it.
+const (
+	roomKindRoom = "room"
+	roomKindDM   = "dm"
+)
+
+// Who can get into a room:
+//
+//	public:      anyone with the id, via POST /rooms/{id}/join
+//	invite_only: invite links, or /join files a request owners/admins approve
+//	private:     invite links only; DMs are always private and can't be joined
+const (
+	visibilityPublic     = "public"
+	visibilityInviteOnly = "invite_only"
+	visibilityPrivate    = "private"
+)
+
+type Invite struct {
+	Token     string
+	RoomID    int64
+	CreatedBy int64
+	ExpiresAt time.Time // zero = never
+	MaxUses   int       // 0 = unlimited
+	Uses      int
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+// usable reports whether inv can still be redeemed at t.
+func (inv Invite) usable(t time.Time) bool {
+	return !inv.Revoked &&
+		(inv.ExpiresAt.IsZero() || inv.ExpiresAt.After(t)) &&
+		(inv.MaxUses == 0 || inv.Uses < inv.MaxUses)
+}
+
+type JoinRequest struct {
+	UserID    int64
+	Email     string
+	Note      string
+	CreatedAt time.Time
+}
+
+type MessageMeta struct {
+	ID       int64
+	RoomID   int64
+	UserID   int64
+	Kind     string
+	PollJSON string // "" unless Kind == "poll"
+	Deleted  bool
+	Unpinned bool // DeleteOwnMessages only: the message was pinned until now
+}
+
+type NewMessage struct {
+	RoomID       int64
+	UserID       int64
+	Body         string
+	ReplyToID    int64
+	ThreadRootID int64 // the thread ReplyToID belongs to (see threadRoot)
+	Attachment   *Attachment
+	ClientMsgID  string
+}
+
+type MessageQuery struct {
+	RoomID    int64
+	ViewerID  int64 // for Starred
+	BeforeID  int64 // 0 = latest page, limited to SinceDays
+	SinceDays int
+	Limit     int
+	Forward   bool  // oldest first instead, ids > AfterID, no date limit
+	AfterID   int64 // with Forward
+}
+
+type MessageSearch struct {
+	RoomID   int64
+	ViewerID int64
+	Query    string // websearch syntax: "exact phrase", or, -exclude, prefix*
+	BeforeID int64  // 0 = from the latest
+	Sort     string // searchSortRecent | searchSortRelevance
+	Offset   int    // relevance paging (ids don't follow rank order)
+	Limit    int
+}
+
+// GlobalSearch is a parsed /search query (see parseSearchQuery). Zero
+// values mean "no filter".
+type GlobalSearch struct {
+	ViewerID      int64
+	Text          string // websearch syntax; may be empty if any filter is set
+	From          string // author email
+	InRoom        string // room id or exact name, case-insensitive
+	HasAttachment bool
+	HasPoll       bool
+	Starred       bool
+	Before        time.Time // created_at < Before
+	After         time.Time // created_at >= After
+	Mime          string    // "image" matches image/*; "image/png" is exact
+	CursorID      int64     // only ids below this
+	Limit         int
+}
+
+type SearchHit struct {
+	MessageDTO
+	RoomName string
+}
+
+const (
+	searchSortRecent    = "recent"
+	searchSortRelevance = "relevance"
+)
+
+type ThreadSummary struct {
+	ReplyCount   int64
+	LastReplyAt  time.Time
+	Participants []string // distinct reply authors, sorted, at most threadMaxParticipants
+}
+
+const threadMaxParticipants = 10
+
+// MessageRevision is what a message looked like before one of its edits.
+type MessageRevision struct {
+	ID          int64
+	Body        string
+	PollJSON    string  // "" for plain messages
+	VoteCounts  []int64 // nil unless the edit moved or dropped the poll's votes
+	EditorEmail string  // "" if the editor's account is gone
+	EditedAt    time.Time
+}
+
+// A mention is read once it's marked read or the room's read marker has
+// moved past the message.
+type Mention struct {
+	MessageDTO
+	RoomName string
+	Kind     string // mentionKind*
+	Read     bool
+}
+
+type MentionQuery struct {
+	UserID     int64
+	UnreadOnly bool
+	BeforeID   int64 // 0 = from the latest
+	Limit      int
+}
+
+const (
+	mentionKindUser = "user" // @email or @name
+	mentionKindRoom = "room" // @room
+	mentionKindHere = "here" // @here
+)
+
+type PollTally struct {
+	Counts map[int]int64 // option idx -> votes
+	MyVote int           // -1 if none
+}
+
+// pollStoredJSON is the shape of messages.poll.
+type pollStoredJSON struct {
+	Question string `json:"question"`
+	Options  []struct {
+		Text string `json:"text"`
+	} `json:"options"`
+}
+
+// pollFromJSON builds a zero-count PollDTO from messages.poll.
+func pollFromJSON(pollJSON string) *PollDTO {
+	if pollJSON == "" {
+		return nil
+	}
+	var stored pollStoredJSON
+	if err := json.Unmarshal([]byte(pollJSON), &stored); err != nil {
+		return nil
+	}
+	p := &PollDTO{Question: stored.Question, MyVote: -1}
+	for _, o := range stored.Options {
+		p.Options = append(p.Options, PollOptionDTO{Text: o.Text})
+	}
+	return p
+}
+
+// hydratePolls fills in vote counts and the viewer's vote on every poll in msgs.
+func hydratePolls(ctx context.Context, st PollStore, msgs []MessageDTO, viewerID int64) error {
+	ids := []int64{}
+	for _, m := range msgs {
+		if m.Poll != nil && !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tallies, err := st.PollTallies(ctx, ids, viewerID)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		p := msgs[i].Poll
+		if p == nil || msgs[i].Deleted {
+			continue
+		}
+		t, ok := tallies[msgs[i].ID]
+		if !ok {
+			p.MyVote = -1
+			continue
+		}
+		p.MyVote = t.MyVote
+		for idx := range p.Options {
+			p.Options[idx].Count = t.Counts[idx]
+		}
+	}
+	return nil
+}
+
+// hydrateThreads attaches reply counts and participants to thread roots.
+func hydrateThreads(ctx context.Context, st ThreadStore, msgs []MessageDTO) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+
+	sums, err := st.ThreadSummaries(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if t, ok := sums[msgs[i].ID]; ok {
+			msgs[i].ReplyCount = t.ReplyCount
+			msgs[i].LastReplyAt = t.LastReplyAt.UnixMilli()
+			msgs[i].ThreadParticipants = t.Participants
+		}
+	}
+	return nil
+}
+
+// hydrateReactions attaches grouped reactions to msgs.
+func hydrateReactions(ctx context.Context, st ReactionStore, msgs []MessageDTO, viewerID int64) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+
+	byMsg, err := st.ReactionSummaries(ctx, ids, viewerID)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Reactions = byMsg[msgs[i].ID]
+	}
+	return nil
+}
+
+// hydrateSearchHits fills in everything a search hit shows besides the
+// matched text: poll counts, the viewer's vote and reactions.
+func hydrateSearchHits(ctx context.Context, st Store, msgs []MessageDTO, viewerID int64) error {
+	if err := hydratePolls(ctx, st, msgs, viewerID); err != nil {
+		return err
+	}
+	return hydrateReactions(ctx, st, msgs, viewerID)
+}
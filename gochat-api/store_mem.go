@@ -0,0 +1,1725 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is an in-memory Store. It mirrors the Postgres semantics closely
+// enough for local runs and handler tests; nothing survives a restart.
+type memStore struct {
+	mu     sync.Mutex
+	nextID int64
+
+	users        map[int64]*User
+	usersByEmail map[string]int64
+
+	rooms    map[int64]*RoomInfo
+	dmKeys   map[string]int64               // dmKey -> roomID
+	deleted  map[int64]time.Time            // roomID -> soft-deleted at
+	members  map[int64]map[int64]*memMember // roomID -> userID
+	messages map[int64]*memMessage
+
+	reactions map[int64]map[string]map[int64]bool // messageID -> emoji -> userIDs
+	votes     map[int64]map[int64]int             // messageID -> userID -> option idx
+	stars     map[int64]map[int64]time.Time       // userID -> messageID -> starred at
+	reads     map[int64]map[int64]int64           // roomID -> userID -> last read message id
+	bans      map[int64]map[int64]*Ban            // roomID -> userID
+	invites   map[string]*Invite                  // token ->
+	joinReqs  map[int64]map[int64]*JoinRequest    // roomID -> userID
+	calls     map[int64]CallState                 // roomID -> saved call
+}
+
+type memMember struct {
+	Role       string
+	JoinedAt   time.Time
+	MutedUntil time.Time
+}
+
+type memMessage struct {
+	ID          int64
+	RoomID      int64
+	UserID      int64
+	Body        string
+	Kind        string
+	Poll        string
+	ReplyToID   int64
+	ThreadRoot  int64
+	Attachment  *Attachment
+	ClientMsgID string
+	CreatedAt   time.Time
+	Edited      bool
+	Deleted     bool
+	Revisions   []MessageRevision
+	Mentions    map[int64]*memMention // userID ->
+	PinnedAt    time.Time             // zero = not pinned
+	PinnedBy    int64
+}
+
+type memMention struct {
+	Kind string
+	Read bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:        map[int64]*User{},
+		usersByEmail: map[string]int64{},
+		rooms:        map[int64]*RoomInfo{},
+		dmKeys:       map[string]int64{},
+		deleted:      map[int64]time.Time{},
+		members:      map[int64]map[int64]*memMember{},
+		messages:     map[int64]*memMessage{},
+		reactions:    map[int64]map[string]map[int64]bool{},
+		votes:        map[int64]map[int64]int{},
+		stars:        map[int64]map[int64]time.Time{},
+		reads:        map[int64]map[int64]int64{},
+		bans:         map[int64]map[int64]*Ban{},
+		invites:      map[string]*Invite{},
+		joinReqs:     map[int64]map[int64]*JoinRequest{},
+		calls:        map[int64]CallState{},
+	}
+}
+
+func (m *memStore) newIDLocked() int64 {
+	m.nextID++
+	return m.nextID
+}
+
+// roomMessagesLocked returns roomID's messages, newest first.
+func (m *memStore) roomMessagesLocked(roomID int64) []*memMessage {
+	out := []*memMessage{}
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID {
+			out = append(out, msg)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out
+}
+
+// newestFirstLocked returns every message, newest first.
+func (m *memStore) newestFirstLocked() []*memMessage {
+	out := make([]*memMessage, 0, len(m.messages))
+	for _, msg := range m.messages {
+		out = append(out, msg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out
+}
+
+// liveMemberLocked is userID's membership in roomID, unless the room is
+// soft-deleted.
+func (m *memStore) liveMemberLocked(roomID, userID int64) (*memMember, bool) {
+	if _, gone := m.deleted[roomID]; gone {
+		return nil, false
+	}
+	mem, ok := m.members[roomID][userID]
+	return mem, ok
+}
+
+func (m *memStore) unreadLocked(roomID, userID int64) int64 {
+	last := m.reads[roomID][userID]
+	var n int64
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.ID > last && !msg.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// mentionReadLocked: see Mention.
+func (m *memStore) mentionReadLocked(msg *memMessage, userID int64) bool {
+	mm := msg.Mentions[userID]
+	return mm == nil || mm.Read || msg.ID <= m.reads[msg.RoomID][userID]
+}
+
+func (m *memStore) unreadMentionsLocked(roomID, userID int64) int64 {
+	var n int64
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && !msg.Deleted && !m.mentionReadLocked(msg, userID) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memStore) messageDTOLocked(msg *memMessage, viewerID int64) MessageDTO {
+	dto := MessageDTO{
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		Body:      msg.Body,
+		CreatedAt: msg.CreatedAt.UnixMilli(),
+		ReplyToID: msg.ReplyToID,
+		Deleted:   msg.Deleted,
+		Edited:    msg.Edited,
+		Kind:      msg.Kind,
+
+		ThreadRootID:  msg.ThreadRoot,
+		RevisionCount: int64(len(msg.Revisions)),
+	}
+	if u := m.users[msg.UserID]; u != nil {
+		dto.UserEmail = u.Email
+	}
+	_, dto.Starred = m.stars[viewerID][msg.ID]
+
+	if msg.Deleted {
+		dto.Body = ""
+		return dto
+	}
+	dto.Pinned = !msg.PinnedAt.IsZero()
+	if msg.Attachment != nil {
+		att := *msg.Attachment
+		dto.Attachment = &att
+	}
+	if msg.Kind == "poll" {
+		dto.Poll = pollFromJSON(msg.Poll)
+	}
+	return dto
+}
+
+// ---- users ----
+
+func (m *memStore) CreateUser(ctx context.Context, email, passwordHash string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.usersByEmail[email]; ok {
+		return 0, ErrConflict
+	}
+	id := m.newIDLocked()
+	m.users[id] = &User{ID: id, Email: email, PasswordHash: passwordHash}
+	m.usersByEmail[email] = id
+	return id, nil
+}
+
+func (m *memStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.usersByEmail[email]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return *m.users[id], nil
+}
+
+func (m *memStore) UserByID(ctx context.Context, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return *u, nil
+}
+
+func (m *memStore) DeleteUser(ctx context.Context, userID int64) ([]OwnerChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	owned := []int64{}
+	for id, ri := range m.rooms {
+		if ri.CreatedBy != userID {
+			continue
+		}
+		if ri.Kind == roomKindRoom {
+			owned = append(owned, id)
+			continue
+		}
+		// DMs have no owner; created_by just moves to whoever's left
+		var next int64
+		for _, o := range m.listMembersLocked(id) {
+			if o.UserID != userID {
+				next = o.UserID
+				break
+			}
+		}
+		if next > 0 {
+			ri.CreatedBy = next
+		} else {
+			m.deleteRoomLocked(id)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i] < owned[j] })
+
+	changes := []OwnerChange{}
+	for _, roomID := range owned {
+		c := OwnerChange{RoomID: roomID, RoomName: m.rooms[roomID].Name}
+		if next, ok := ownerSuccessor(m.listMembersLocked(roomID), userID); ok {
+			m.transferOwnerLocked(roomID, next.UserID)
+			next.Role, next.MutedUntil = roleOwner, time.Time{}
+			c.NewOwner = next
+		} else {
+			m.deleteRoomLocked(roomID)
+		}
+		changes = append(changes, c)
+	}
+
+	// their content moves to a tombstone; the rest is what ON DELETE
+	// CASCADE / SET NULL does in Postgres
+	tomb := &User{ID: m.newIDLocked(), Email: deletedUserEmail(userID)}
+	m.users[tomb.ID] = tomb
+	m.usersByEmail[tomb.Email] = tomb.ID
+	for mid, msg := range m.messages {
+		if msg.UserID == userID {
+			msg.UserID = tomb.ID
+		}
+		if msg.PinnedBy == userID {
+			msg.PinnedBy = tomb.ID
+		}
+		for i := range msg.Revisions {
+			if msg.Revisions[i].EditorEmail == u.Email {
+				msg.Revisions[i].EditorEmail = tomb.Email
+			}
+		}
+		delete(msg.Mentions, userID)
+		if idx, ok := m.votes[mid][userID]; ok {
+			delete(m.votes[mid], userID)
+			m.votes[mid][tomb.ID] = idx
+		}
+		for _, users := range m.reactions[mid] {
+			if users[userID] {
+				delete(users, userID)
+				users[tomb.ID] = true
+			}
+		}
+	}
+	for roomID := range m.members {
+		delete(m.members[roomID], userID)
+		delete(m.reads[roomID], userID)
+		delete(m.bans[roomID], userID)
+		delete(m.joinReqs[roomID], userID)
+		for _, b := range m.bans[roomID] {
+			if b.BannedBy == userID {
+				b.BannedBy = 0
+			}
+		}
+	}
+	for _, inv := range m.invites {
+		if inv.CreatedBy == userID {
+			inv.CreatedBy = 0
+		}
+	}
+	delete(m.stars, userID)
+	delete(m.usersByEmail, u.Email)
+	delete(m.users, userID)
+	return changes, nil
+}
+
+// ---- rooms ----
+
+func (m *memStore) CreateRoom(ctx context.Context, r NewRoom) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.newIDLocked()
+	m.rooms[id] = &RoomInfo{
+		ID: id, Name: r.Name, CreatedBy: r.OwnerID, CreatedAt: time.Now(), Visibility: r.Visibility, Kind: roomKindRoom,
+		RoomSettings: RoomSettings{Topic: r.Topic, Description: r.Description, CallRole: roleMember},
+	}
+	m.members[id] = map[int64]*memMember{r.OwnerID: {Role: roleOwner, JoinedAt: time.Now()}}
+	return id, nil
+}
+
+func (m *memStore) OpenDM(ctx context.Context, creatorID int64, userIDs []int64) (int64, []int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := dmKey(userIDs)
+	join := userIDs
+	id, ok := m.dmKeys[key]
+	if ok {
+		join = []int64{creatorID} // only the caller comes back
+	} else {
+		id = m.newIDLocked()
+		m.rooms[id] = &RoomInfo{
+			ID: id, CreatedBy: creatorID, CreatedAt: time.Now(), Visibility: visibilityPrivate, Kind: roomKindDM,
+			RoomSettings: RoomSettings{CallRole: roleMember},
+		}
+		m.members[id] = map[int64]*memMember{}
+		m.dmKeys[key] = id
+	}
+
+	added := []int64{}
+	for _, uid := range join {
+		if _, ok := m.members[id][uid]; !ok {
+			m.members[id][uid] = &memMember{Role: roleMember, JoinedAt: time.Now()}
+			added = append(added, uid)
+		}
+	}
+	return id, added, nil
+}
+
+func (m *memStore) GetRoom(ctx context.Context, id int64) (RoomInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ri, ok := m.rooms[id]
+	if _, gone := m.deleted[id]; !ok || gone {
+		return RoomInfo{}, ErrNotFound
+	}
+	return *ri, nil
+}
+
+func (m *memStore) SetVisibility(ctx context.Context, id int64, visibility string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ri, ok := m.rooms[id]
+	if !ok {
+		return ErrNotFound
+	}
+	ri.Visibility = visibility
+	return nil
+}
+
+func (m *memStore) ListRooms(ctx context.Context, userID int64, view string) ([]Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []Room{}
+	for id, ri := range m.rooms {
+		mem, ok := m.members[id][userID]
+		if !ok {
+			continue
+		}
+		deletedAt, gone := m.deleted[id]
+		archived := !ri.ArchivedAt.IsZero()
+		dm := ri.Kind == roomKindDM
+		switch view {
+		case roomViewActive:
+			ok = !dm && !gone && !archived
+		case roomViewArchived:
+			ok = !dm && !gone && archived
+		case roomViewAll:
+			ok = !dm && !gone
+		case roomViewDeleted:
+			ok = !dm && gone && mem.Role == roleOwner
+		case roomViewDMs:
+			ok = dm && !gone
+		default:
+			return nil, fmt.Errorf("unknown room view %q", view)
+		}
+		if !ok {
+			continue
+		}
+		it := Room{
+			ID:          ri.ID,
+			Name:        ri.Name,
+			OwnerID:     ri.CreatedBy,
+			IsOwner:     mem.Role == roleOwner,
+			Role:        mem.Role,
+			Visibility:  ri.Visibility,
+			CreatedAt:   ri.CreatedAt,
+			UnreadCount: m.unreadLocked(id, userID),
+
+			MentionCount: m.unreadMentionsLocked(id, userID),
+
+			Topic:       ri.Topic,
+			Description: ri.Description,
+			AvatarURL:   ri.AvatarURL,
+			Settings:    roomSettingsDTO(ri.RoomSettings),
+			Kind:        ri.Kind,
+		}
+		if dm {
+			for uid := range m.members[id] {
+				if uid != userID {
+					it.Participants = append(it.Participants, UserPresence{Email: m.users[uid].Email})
+				}
+			}
+			sort.Slice(it.Participants, func(i, j int) bool { return it.Participants[i].Email < it.Participants[j].Email })
+		}
+		if archived {
+			it.ArchivedAt = &ri.ArchivedAt
+		}
+		if gone {
+			it.DeletedAt = &deletedAt
+		}
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+func (m *memStore) UpdateRoom(ctx context.Context, id int64, p RoomPatch) (RoomInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ri, ok := m.rooms[id]
+	if _, gone := m.deleted[id]; !ok || gone {
+		return RoomInfo{}, ErrNotFound
+	}
+	set := func(dst *string, v *string) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&ri.Name, p.Name)
+	set(&ri.Topic, p.Topic)
+	set(&ri.Description, p.Description)
+	set(&ri.AvatarURL, p.AvatarURL)
+	set(&ri.CallRole, p.CallRole)
+	if p.RetentionDays != nil {
+		ri.RetentionDays = *p.RetentionDays
+	}
+	if p.SlowModeSeconds != nil {
+		ri.SlowModeSeconds = *p.SlowModeSeconds
+	}
+	return *ri, nil
+}
+
+func (m *memStore) SetArchived(ctx context.Context, id int64, archived bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ri, ok := m.rooms[id]
+	if _, gone := m.deleted[id]; !ok || gone {
+		return ErrNotFound
+	}
+	switch {
+	case !archived:
+		ri.ArchivedAt = time.Time{}
+	case ri.ArchivedAt.IsZero():
+		ri.ArchivedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *memStore) TransferOwnership(ctx context.Context, roomID, toID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.transferOwnerLocked(roomID, toID)
+}
+
+func (m *memStore) transferOwnerLocked(roomID, toID int64) error {
+	to, ok := m.members[roomID][toID]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, mem := range m.members[roomID] {
+		if mem.Role == roleOwner {
+			mem.Role = roleAdmin
+		}
+	}
+	to.Role, to.MutedUntil = roleOwner, time.Time{}
+	m.rooms[roomID].CreatedBy = toID
+	return nil
+}
+
+func (m *memStore) SoftDeleteRoom(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, gone := m.deleted[id]; gone || m.rooms[id] == nil {
+		return ErrNotFound
+	}
+	m.deleted[id] = time.Now()
+	return nil
+}
+
+func (m *memStore) RestoreRoom(ctx context.Context, id, ownerID int64, since time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	at, gone := m.deleted[id]
+	if !gone || !at.After(since) || m.rooms[id].CreatedBy != ownerID {
+		return ErrNotFound
+	}
+	delete(m.deleted, id)
+	return nil
+}
+
+func (m *memStore) PurgeDeletedRooms(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, at := range m.deleted {
+		if at.Before(before) {
+			m.deleteRoomLocked(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memStore) deleteMessageLocked(mid int64) {
+	delete(m.messages, mid)
+	delete(m.reactions, mid)
+	delete(m.votes, mid)
+	for _, starred := range m.stars {
+		delete(starred, mid)
+	}
+}
+
+func (m *memStore) deleteRoomLocked(id int64) {
+	for mid, msg := range m.messages {
+		if msg.RoomID == id {
+			m.deleteMessageLocked(mid)
+		}
+	}
+	if ri := m.rooms[id]; ri != nil && ri.Kind == roomKindDM {
+		for key, roomID := range m.dmKeys {
+			if roomID == id {
+				delete(m.dmKeys, key)
+			}
+		}
+	}
+	delete(m.rooms, id)
+	delete(m.deleted, id)
+	delete(m.members, id)
+	delete(m.reads, id)
+	delete(m.bans, id)
+	delete(m.joinReqs, id)
+	for token, inv := range m.invites {
+		if inv.RoomID == id {
+			delete(m.invites, token)
+		}
+	}
+}
+
+// ---- members ----
+
+func (m *memStore) IsMember(ctx context.Context, roomID, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.liveMemberLocked(roomID, userID)
+	return ok, nil
+}
+
+func (m *memStore) MemberRooms(ctx context.Context, userID int64, roomIDs []int64) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []int64{}
+	for _, id := range roomIDs {
+		if _, ok := m.liveMemberLocked(id, userID); ok {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) MemberEmails(ctx context.Context, roomID int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []string{}
+	for uid := range m.members[roomID] {
+		if u := m.users[uid]; u != nil {
+			out = append(out, u.Email)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) GetMember(ctx context.Context, roomID, userID int64) (Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mem, ok := m.liveMemberLocked(roomID, userID)
+	if !ok {
+		return Member{}, ErrNotFound
+	}
+	return m.memberLocked(roomID, userID, mem), nil
+}
+
+func (m *memStore) memberLocked(roomID, userID int64, mem *memMember) Member {
+	out := Member{UserID: userID, Role: mem.Role, JoinedAt: mem.JoinedAt, MutedUntil: mem.MutedUntil}
+	if ri := m.rooms[roomID]; ri != nil {
+		out.Archived = !ri.ArchivedAt.IsZero()
+		out.CallRole, out.SlowModeSeconds = ri.CallRole, ri.SlowModeSeconds
+	}
+	if u := m.users[userID]; u != nil {
+		out.Email = u.Email
+	}
+	return out
+}
+
+func (m *memStore) SetMemberRole(ctx context.Context, roomID, userID int64, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mem, ok := m.members[roomID][userID]
+	if !ok {
+		return ErrNotFound
+	}
+	mem.Role = role
+	return nil
+}
+
+func (m *memStore) SetMute(ctx context.Context, roomID, userID int64, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mem, ok := m.members[roomID][userID]
+	if !ok {
+		return ErrNotFound
+	}
+	mem.MutedUntil = until
+	return nil
+}
+
+func (m *memStore) ListMembers(ctx context.Context, roomID int64) ([]Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listMembersLocked(roomID), nil
+}
+
+func (m *memStore) listMembersLocked(roomID int64) []Member {
+	out := []Member{}
+	for uid, mem := range m.members[roomID] {
+		out = append(out, m.memberLocked(roomID, uid, mem))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].JoinedAt.Equal(out[j].JoinedAt) {
+			return out[i].JoinedAt.Before(out[j].JoinedAt)
+		}
+		return out[i].UserID < out[j].UserID
+	})
+	return out
+}
+
+func (m *memStore) AddMember(ctx context.Context, roomID, userID int64, role string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[roomID]; !ok {
+		return false, ErrNotFound
+	}
+	if _, ok := m.members[roomID][userID]; ok {
+		return false, nil
+	}
+	if m.members[roomID] == nil {
+		m.members[roomID] = map[int64]*memMember{}
+	}
+	m.members[roomID][userID] = &memMember{Role: role, JoinedAt: time.Now()}
+	return true, nil
+}
+
+func (m *memStore) RemoveMember(ctx context.Context, roomID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members[roomID], userID)
+	return nil
+}
+
+func (m *memStore) Ban(ctx context.Context, b Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.bans[b.RoomID] == nil {
+		m.bans[b.RoomID] = map[int64]*Ban{}
+	}
+	b.CreatedAt = time.Now()
+	m.bans[b.RoomID][b.UserID] = &b
+	delete(m.members[b.RoomID], b.UserID)
+	return nil
+}
+
+func (m *memStore) Unban(ctx context.Context, roomID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bans[roomID][userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.bans[roomID], userID)
+	return nil
+}
+
+func (m *memStore) banLocked(b *Ban) Ban {
+	out := *b
+	if u := m.users[b.UserID]; u != nil {
+		out.Email = u.Email
+	}
+	if u := m.users[b.BannedBy]; u != nil {
+		out.BannedByEmail = u.Email
+	}
+	return out
+}
+
+func (m *memStore) ActiveBan(ctx context.Context, roomID, userID int64) (Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.bans[roomID][userID]
+	if !ok || (!b.ExpiresAt.IsZero() && !b.ExpiresAt.After(time.Now())) {
+		return Ban{}, ErrNotFound
+	}
+	return m.banLocked(b), nil
+}
+
+func (m *memStore) ListBans(ctx context.Context, roomID int64) ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	out := []Ban{}
+	for _, b := range m.bans[roomID] {
+		if b.ExpiresAt.IsZero() || b.ExpiresAt.After(now) {
+			out = append(out, m.banLocked(b))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// ---- messages ----
+
+func (m *memStore) InsertMessage(ctx context.Context, nm NewMessage) (int64, time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if nm.ClientMsgID != "" {
+		for _, msg := range m.messages {
+			if msg.RoomID == nm.RoomID && msg.UserID == nm.UserID && msg.ClientMsgID == nm.ClientMsgID {
+				return msg.ID, msg.CreatedAt, true, nil
+			}
+		}
+	}
+
+	msg := &memMessage{
+		ID:          m.newIDLocked(),
+		RoomID:      nm.RoomID,
+		UserID:      nm.UserID,
+		Body:        nm.Body,
+		Kind:        "text",
+		ReplyToID:   nm.ReplyToID,
+		ThreadRoot:  nm.ThreadRootID,
+		ClientMsgID: nm.ClientMsgID,
+		CreatedAt:   time.Now(),
+	}
+	if nm.Attachment != nil && nm.Attachment.URL != "" {
+		att := *nm.Attachment
+		msg.Attachment = &att
+	}
+	m.messages[msg.ID] = msg
+	return msg.ID, msg.CreatedAt, false, nil
+}
+
+func (m *memStore) GetMessage(ctx context.Context, id int64) (MessageMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return MessageMeta{}, ErrNotFound
+	}
+	return MessageMeta{
+		ID:       msg.ID,
+		RoomID:   msg.RoomID,
+		UserID:   msg.UserID,
+		Kind:     msg.Kind,
+		PollJSON: msg.Poll,
+		Deleted:  msg.Deleted,
+	}, nil
+}
+
+func (m *memStore) ListMessages(ctx context.Context, q MessageQuery) ([]MessageDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	since := time.Now().AddDate(0, 0, -q.SinceDays)
+	msgs := m.roomMessagesLocked(q.RoomID)
+	if q.Forward {
+		slices.Reverse(msgs)
+	}
+	out := []MessageDTO{}
+	for _, msg := range msgs {
+		if len(out) >= q.Limit {
+			break
+		}
+		if q.Forward {
+			if msg.ID <= q.AfterID {
+				continue
+			}
+		} else if q.BeforeID > 0 {
+			if msg.ID >= q.BeforeID {
+				continue
+			}
+		} else if msg.CreatedAt.Before(since) {
+			continue
+		}
+		out = append(out, m.messageDTOLocked(msg, q.ViewerID))
+	}
+	return out, nil
+}
+
+func (m *memStore) SearchMessages(ctx context.Context, q MessageSearch) ([]MessageDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	terms := parseSearchTerms(q.Query)
+	if len(terms) == 0 {
+		return []MessageDTO{}, nil
+	}
+
+	out := []MessageDTO{}
+	for _, msg := range m.roomMessagesLocked(q.RoomID) {
+		if msg.Deleted || (q.BeforeID > 0 && msg.ID >= q.BeforeID) {
+			continue
+		}
+
+		text, shown := memSearchText(msg)
+		rank := matchSearchTerms(text, terms)
+		if rank == 0 {
+			continue
+		}
+		dto := m.messageDTOLocked(msg, q.ViewerID)
+		dto.Rank = rank
+		dto.Snippet = highlightTerms(shown, terms)
+		out = append(out, dto)
+	}
+
+	if q.Sort == searchSortRelevance {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Rank > out[j].Rank })
+	}
+	if q.Offset >= len(out) {
+		return []MessageDTO{}, nil
+	}
+	out = out[q.Offset:]
+	if len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out, nil
+}
+
+func (m *memStore) SearchAll(ctx context.Context, q GlobalSearch) ([]SearchHit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	terms := parseSearchTerms(q.Text)
+
+	out := []SearchHit{}
+	for _, msg := range m.newestFirstLocked() {
+		if len(out) >= q.Limit {
+			break
+		}
+		room := m.rooms[msg.RoomID]
+		if msg.Deleted || room == nil || (q.CursorID > 0 && msg.ID >= q.CursorID) {
+			continue
+		}
+		if _, ok := m.liveMemberLocked(msg.RoomID, q.ViewerID); !ok {
+			continue
+		}
+
+		if q.From != "" {
+			if u := m.users[msg.UserID]; u == nil || !strings.EqualFold(u.Email, q.From) {
+				continue
+			}
+		}
+		if q.InRoom != "" && strconv.FormatInt(room.ID, 10) != q.InRoom && !strings.EqualFold(room.Name, q.InRoom) {
+			continue
+		}
+		if (q.HasAttachment || q.Mime != "") && msg.Attachment == nil {
+			continue
+		}
+		if q.Mime != "" && !mimeMatches(msg.Attachment.Mime, q.Mime) {
+			continue
+		}
+		if q.HasPoll && msg.Kind != "poll" {
+			continue
+		}
+		if _, starred := m.stars[q.ViewerID][msg.ID]; q.Starred && !starred {
+			continue
+		}
+		if (!q.Before.IsZero() && !msg.CreatedAt.Before(q.Before)) || (!q.After.IsZero() && msg.CreatedAt.Before(q.After)) {
+			continue
+		}
+
+		dto := m.messageDTOLocked(msg, q.ViewerID)
+		if len(terms) > 0 {
+			text, shown := memSearchText(msg)
+			if dto.Rank = matchSearchTerms(text, terms); dto.Rank == 0 {
+				continue
+			}
+			dto.Snippet = highlightTerms(shown, terms)
+		}
+		out = append(out, SearchHit{MessageDTO: dto, RoomName: room.Name})
+	}
+	return out, nil
+}
+
+// memSearchText is what memStore searches in (body, filename, poll text) and
+// the part of it that goes into the snippet.
+func memSearchText(msg *memMessage) (text, shown string) {
+	parts := []string{msg.Body}
+	shown = msg.Body
+	if msg.Attachment != nil {
+		parts = append(parts, msg.Attachment.Filename)
+	}
+	if p := pollFromJSON(msg.Poll); p != nil {
+		parts = append(parts, p.Question)
+		for _, o := range p.Options {
+			parts = append(parts, o.Text)
+		}
+		if shown == "" {
+			shown = p.Question
+		}
+	}
+	if shown == "" && msg.Attachment != nil {
+		shown = msg.Attachment.Filename
+	}
+	return strings.Join(parts, "\n"), shown
+}
+
+func (m *memStore) EditMessage(ctx context.Context, id, editorID int64, body string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok || msg.Deleted || msg.Body == body {
+		return false, nil
+	}
+	m.addRevisionLocked(msg, editorID, nil)
+	msg.Body = body
+	msg.Edited = true
+	return true, nil
+}
+
+func (m *memStore) DeleteMessage(ctx context.Context, id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return false, nil
+	}
+	unpinned := !msg.PinnedAt.IsZero()
+	msg.Body = ""
+	msg.Deleted = true
+	msg.PinnedAt, msg.PinnedBy = time.Time{}, 0
+	return unpinned, nil
+}
+
+func (m *memStore) LastPost(ctx context.Context, roomID, userID int64) (time.Time, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var last *memMessage
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && msg.UserID == userID && (last == nil || msg.ID > last.ID) {
+			last = msg
+		}
+	}
+	if last == nil {
+		return time.Time{}, "", ErrNotFound
+	}
+	return last.CreatedAt, last.ClientMsgID, nil
+}
+
+func (m *memStore) PurgeExpiredMessages(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for mid, msg := range m.messages {
+		ri := m.rooms[msg.RoomID]
+		if ri == nil || ri.RetentionDays <= 0 || !msg.PinnedAt.IsZero() {
+			continue
+		}
+		if time.Since(msg.CreatedAt) > time.Duration(ri.RetentionDays)*24*time.Hour {
+			m.deleteMessageLocked(mid)
+			n++
+		}
+	}
+	// ON DELETE SET NULL on reply_to_id and thread_root_id
+	for _, msg := range m.messages {
+		if _, ok := m.messages[msg.ReplyToID]; msg.ReplyToID > 0 && !ok {
+			msg.ReplyToID = 0
+		}
+		if _, ok := m.messages[msg.ThreadRoot]; msg.ThreadRoot > 0 && !ok {
+			msg.ThreadRoot = 0
+		}
+	}
+	return n, nil
+}
+
+func (m *memStore) DeleteOwnMessages(ctx context.Context, userID int64, ids []int64) ([]MessageMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []MessageMeta{}
+	for _, id := range ids {
+		msg, ok := m.messages[id]
+		if !ok || msg.UserID != userID || msg.Deleted {
+			continue
+		}
+		unpinned := !msg.PinnedAt.IsZero()
+		msg.Body = ""
+		msg.Deleted = true
+		msg.PinnedAt, msg.PinnedBy = time.Time{}, 0
+		out = append(out, MessageMeta{ID: msg.ID, RoomID: msg.RoomID, UserID: msg.UserID, Kind: msg.Kind, Deleted: true, Unpinned: unpinned})
+	}
+	return out, nil
+}
+
+// ---- threads ----
+
+func (m *memStore) MessageByID(ctx context.Context, id, viewerID int64) (MessageDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return MessageDTO{}, ErrNotFound
+	}
+	return m.messageDTOLocked(msg, viewerID), nil
+}
+
+func (m *memStore) ListReplies(ctx context.Context, rootID, viewerID, afterID int64, limit int) ([]MessageDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replies := []*memMessage{}
+	for _, msg := range m.messages {
+		if msg.ThreadRoot == rootID && !msg.Deleted && msg.ID > afterID {
+			replies = append(replies, msg)
+		}
+	}
+	sort.Slice(replies, func(i, j int) bool { return replies[i].ID < replies[j].ID })
+	if len(replies) > limit {
+		replies = replies[:limit]
+	}
+
+	out := make([]MessageDTO, 0, len(replies))
+	for _, msg := range replies {
+		out = append(out, m.messageDTOLocked(msg, viewerID))
+	}
+	return out, nil
+}
+
+func (m *memStore) ThreadSummaries(ctx context.Context, rootIDs []int64) (map[int64]ThreadSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	want := make(map[int64]bool, len(rootIDs))
+	for _, id := range rootIDs {
+		want[id] = true
+	}
+
+	out := map[int64]ThreadSummary{}
+	authors := map[int64]map[string]bool{}
+	for _, msg := range m.messages {
+		if msg.Deleted || !want[msg.ThreadRoot] {
+			continue
+		}
+		t := out[msg.ThreadRoot]
+		t.ReplyCount++
+		if msg.CreatedAt.After(t.LastReplyAt) {
+			t.LastReplyAt = msg.CreatedAt
+		}
+		out[msg.ThreadRoot] = t
+
+		if authors[msg.ThreadRoot] == nil {
+			authors[msg.ThreadRoot] = map[string]bool{}
+		}
+		if u := m.users[msg.UserID]; u != nil {
+			authors[msg.ThreadRoot][u.Email] = true
+		}
+	}
+
+	for rootID, t := range out {
+		for em := range authors[rootID] {
+			t.Participants = append(t.Participants, em)
+		}
+		sort.Strings(t.Participants)
+		if len(t.Participants) > threadMaxParticipants {
+			t.Participants = t.Participants[:threadMaxParticipants]
+		}
+		out[rootID] = t
+	}
+	return out, nil
+}
+
+// ---- revisions ----
+
+func (m *memStore) addRevisionLocked(msg *memMessage, editorID int64, voteCounts []int64) {
+	rev := MessageRevision{
+		ID:         m.newIDLocked(),
+		Body:       msg.Body,
+		PollJSON:   msg.Poll,
+		VoteCounts: voteCounts,
+		EditedAt:   time.Now(),
+	}
+	if u := m.users[editorID]; u != nil {
+		rev.EditorEmail = u.Email
+	}
+	msg.Revisions = append(msg.Revisions, rev)
+}
+
+func (m *memStore) ListRevisions(ctx context.Context, messageID int64) ([]MessageRevision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return []MessageRevision{}, nil
+	}
+	return append([]MessageRevision{}, msg.Revisions...), nil
+}
+
+// ---- mentions ----
+
+func (m *memStore) SetMentions(ctx context.Context, messageID int64, mentions map[int64]string) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var added []int64
+	next := make(map[int64]*memMention, len(mentions))
+	for uid, kind := range mentions {
+		mm := msg.Mentions[uid]
+		if mm == nil {
+			mm = &memMention{}
+			added = append(added, uid)
+		}
+		mm.Kind = kind
+		next[uid] = mm
+	}
+	msg.Mentions = next
+	return added, nil
+}
+
+func (m *memStore) ListMentions(ctx context.Context, q MentionQuery) ([]Mention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []Mention{}
+	for _, msg := range m.newestFirstLocked() {
+		mm := msg.Mentions[q.UserID]
+		if mm == nil || msg.Deleted || (q.BeforeID > 0 && msg.ID >= q.BeforeID) {
+			continue
+		}
+		if _, ok := m.liveMemberLocked(msg.RoomID, q.UserID); !ok {
+			continue
+		}
+		read := m.mentionReadLocked(msg, q.UserID)
+		if q.UnreadOnly && read {
+			continue
+		}
+
+		it := Mention{MessageDTO: m.messageDTOLocked(msg, q.UserID), Kind: mm.Kind, Read: read}
+		if ri := m.rooms[msg.RoomID]; ri != nil {
+			it.RoomName = ri.Name
+		}
+		out = append(out, it)
+		if len(out) == q.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) MarkMentionsRead(ctx context.Context, userID int64, messageIDs []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(messageIDs) == 0 {
+		for _, msg := range m.messages {
+			if mm := msg.Mentions[userID]; mm != nil {
+				mm.Read = true
+			}
+		}
+		return nil
+	}
+	for _, id := range messageIDs {
+		if msg := m.messages[id]; msg != nil && msg.Mentions[userID] != nil {
+			msg.Mentions[userID].Read = true
+		}
+	}
+	return nil
+}
+
+// ---- invites ----
+
+func (m *memStore) CreateInvite(ctx context.Context, inv Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.invites[inv.Token]; ok {
+		return ErrConflict
+	}
+	inv.CreatedAt = time.Now()
+	m.invites[inv.Token] = &inv
+	return nil
+}
+
+func (m *memStore) GetInvite(ctx context.Context, token string) (Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invites[token]
+	if !ok {
+		return Invite{}, ErrNotFound
+	}
+	return *inv, nil
+}
+
+func (m *memStore) ListInvites(ctx context.Context, roomID int64) ([]Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	out := []Invite{}
+	for _, inv := range m.invites {
+		if inv.RoomID == roomID && inv.usable(now) {
+			out = append(out, *inv)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memStore) RevokeInvite(ctx context.Context, roomID int64, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invites[token]
+	if !ok || inv.RoomID != roomID || inv.Revoked {
+		return ErrNotFound
+	}
+	inv.Revoked = true
+	return nil
+}
+
+func (m *memStore) RedeemInvite(ctx context.Context, token string, userID int64) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invites[token]
+	if !ok || !inv.usable(time.Now()) || m.rooms[inv.RoomID] == nil {
+		return 0, false, ErrNotFound
+	}
+	if _, ok := m.members[inv.RoomID][userID]; ok {
+		return inv.RoomID, false, nil
+	}
+
+	m.members[inv.RoomID][userID] = &memMember{Role: roleMember, JoinedAt: time.Now()}
+	delete(m.joinReqs[inv.RoomID], userID)
+	inv.Uses++
+	return inv.RoomID, true, nil
+}
+
+func (m *memStore) RequestJoin(ctx context.Context, roomID, userID int64, note string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.joinReqs[roomID][userID]; ok {
+		return false, nil
+	}
+	if m.joinReqs[roomID] == nil {
+		m.joinReqs[roomID] = map[int64]*JoinRequest{}
+	}
+	jr := &JoinRequest{UserID: userID, Note: note, CreatedAt: time.Now()}
+	if u := m.users[userID]; u != nil {
+		jr.Email = u.Email
+	}
+	m.joinReqs[roomID][userID] = jr
+	return true, nil
+}
+
+func (m *memStore) ListJoinRequests(ctx context.Context, roomID int64) ([]JoinRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []JoinRequest{}
+	for _, jr := range m.joinReqs[roomID] {
+		out = append(out, *jr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memStore) ResolveJoinRequest(ctx context.Context, roomID, userID int64, approve bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.joinReqs[roomID][userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.joinReqs[roomID], userID)
+	if approve && m.members[roomID] != nil {
+		if _, ok := m.members[roomID][userID]; !ok {
+			m.members[roomID][userID] = &memMember{Role: roleMember, JoinedAt: time.Now()}
+		}
+	}
+	return nil
+}
+
+// ---- reactions ----
+
+func (m *memStore) ToggleReaction(ctx context.Context, messageID, userID int64, emoji string) (bool, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.messages[messageID]; !ok {
+		return false, 0, ErrNotFound
+	}
+	if m.reactions[messageID] == nil {
+		m.reactions[messageID] = map[string]map[int64]bool{}
+	}
+	users := m.reactions[messageID][emoji]
+	if users == nil {
+		users = map[int64]bool{}
+		m.reactions[messageID][emoji] = users
+	}
+
+	added := !users[userID]
+	if added {
+		users[userID] = true
+	} else {
+		delete(users, userID)
+	}
+	return added, int64(len(users)), nil
+}
+
+func (m *memStore) ReactionSummaries(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64][]ReactionDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := map[int64][]ReactionDTO{}
+	for _, mid := range messageIDs {
+		for emoji, users := range m.reactions[mid] {
+			if len(users) == 0 {
+				continue
+			}
+			out[mid] = append(out[mid], ReactionDTO{Emoji: emoji, Count: int64(len(users)), Me: users[viewerID]})
+		}
+		sort.Slice(out[mid], func(i, j int) bool { return out[mid][i].Emoji < out[mid][j].Emoji })
+	}
+	return out, nil
+}
+
+func (m *memStore) ReactionUsers(ctx context.Context, messageID int64) (map[string][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := map[string][]string{}
+	for emoji, users := range m.reactions[messageID] {
+		for uid := range users {
+			if u := m.users[uid]; u != nil {
+				out[emoji] = append(out[emoji], u.Email)
+			}
+		}
+		sort.Strings(out[emoji])
+	}
+	return out, nil
+}
+
+// ---- polls ----
+
+func (m *memStore) CreatePoll(ctx context.Context, roomID, userID int64, pollJSON string) (int64, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg := &memMessage{
+		ID:        m.newIDLocked(),
+		RoomID:    roomID,
+		UserID:    userID,
+		Kind:      "poll",
+		Poll:      pollJSON,
+		CreatedAt: time.Now(),
+	}
+	m.messages[msg.ID] = msg
+	return msg.ID, msg.CreatedAt, nil
+}
+
+func (m *memStore) UpdatePoll(ctx context.Context, messageID, editorID int64, pollJSON string, remap []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[messageID]
+	if !ok || msg.Deleted {
+		return ErrNotFound
+	}
+
+	var counts []int64
+	if remap != nil {
+		n := 0
+		if p := pollFromJSON(msg.Poll); p != nil {
+			n = len(p.Options)
+		}
+		counts = make([]int64, n)
+		for _, idx := range m.votes[messageID] {
+			if idx < n {
+				counts[idx]++
+			}
+		}
+	}
+	m.addRevisionLocked(msg, editorID, counts)
+
+	msg.Poll = pollJSON
+	msg.Edited = true
+	if remap != nil {
+		votes := m.votes[messageID]
+		for userID, idx := range votes {
+			if idx < len(remap) && remap[idx] >= 0 {
+				votes[userID] = remap[idx]
+			} else {
+				delete(votes, userID)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memStore) VotePoll(ctx context.Context, messageID, userID int64, optionIdx, numOptions int) (int, []int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.votes[messageID] == nil {
+		m.votes[messageID] = map[int64]int{}
+	}
+	votes := m.votes[messageID]
+
+	myVote := optionIdx
+	if prev, ok := votes[userID]; ok && prev == optionIdx {
+		delete(votes, userID)
+		myVote = -1
+	} else {
+		votes[userID] = optionIdx
+	}
+
+	counts := make([]int64, numOptions)
+	for _, idx := range votes {
+		if idx >= 0 && idx < numOptions {
+			counts[idx]++
+		}
+	}
+	return myVote, counts, nil
+}
+
+func (m *memStore) PollTallies(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64]PollTally, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := map[int64]PollTally{}
+	for _, mid := range messageIDs {
+		votes := m.votes[mid]
+		if len(votes) == 0 {
+			continue
+		}
+		t := PollTally{Counts: map[int]int64{}, MyVote: -1}
+		for uid, idx := range votes {
+			t.Counts[idx]++
+			if uid == viewerID {
+				t.MyVote = idx
+			}
+		}
+		out[mid] = t
+	}
+	return out, nil
+}
+
+// ---- stars ----
+
+func (m *memStore) StarMessages(ctx context.Context, userID int64, ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stars[userID] == nil {
+		m.stars[userID] = map[int64]time.Time{}
+	}
+	for _, id := range ids {
+		if _, ok := m.messages[id]; !ok {
+			continue
+		}
+		if _, ok := m.stars[userID][id]; !ok {
+			m.stars[userID][id] = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *memStore) UnstarMessages(ctx context.Context, userID int64, ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		delete(m.stars[userID], id)
+	}
+	return nil
+}
+
+func (m *memStore) ListStarred(ctx context.Context, userID int64, before time.Time, limit int) ([]StarredMessageDTO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type starred struct {
+		msg *memMessage
+		at  time.Time
+	}
+	all := []starred{}
+	for mid, at := range m.stars[userID] {
+		if msg, ok := m.messages[mid]; ok && at.Before(before) {
+			if _, gone := m.deleted[msg.RoomID]; gone {
+				continue
+			}
+			all = append(all, starred{msg, at})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].at.After(all[j].at) })
+	if len(all) > limit {
+		all = all[:limit]
+	}
+
+	out := []StarredMessageDTO{}
+	for _, st := range all {
+		dto := m.messageDTOLocked(st.msg, userID)
+		var roomName string
+		if ri := m.rooms[dto.RoomID]; ri != nil {
+			roomName = ri.Name
+		}
+		out = append(out, StarredMessageDTO{
+			ID:         dto.ID,
+			RoomID:     dto.RoomID,
+			RoomName:   roomName,
+			UserEmail:  dto.UserEmail,
+			Body:       dto.Body,
+			CreatedAt:  dto.CreatedAt,
+			ReplyToID:  dto.ReplyToID,
+			Deleted:    dto.Deleted,
+			Edited:     dto.Edited,
+			Starred:    true,
+			Attachment: dto.Attachment,
+		})
+	}
+	return out, nil
+}
+
+// ---- pins ----
+
+func (m *memStore) PinMessage(ctx context.Context, id, userID int64, limit int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok || msg.Deleted {
+		return false, ErrNotFound
+	}
+	if !msg.PinnedAt.IsZero() {
+		return false, nil
+	}
+	n := 0
+	for _, other := range m.messages {
+		if other.RoomID == msg.RoomID && !other.PinnedAt.IsZero() && !other.Deleted {
+			n++
+		}
+	}
+	if n >= limit {
+		return false, ErrPinLimit
+	}
+	msg.PinnedAt, msg.PinnedBy = time.Now(), userID
+	return true, nil
+}
+
+func (m *memStore) UnpinMessage(ctx context.Context, id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok || msg.PinnedAt.IsZero() {
+		return false, nil
+	}
+	msg.PinnedAt, msg.PinnedBy = time.Time{}, 0
+	return true, nil
+}
+
+func (m *memStore) ListPins(ctx context.Context, roomID, viewerID int64) ([]PinnedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []PinnedMessage{}
+	for _, msg := range m.roomMessagesLocked(roomID) {
+		if msg.PinnedAt.IsZero() || msg.Deleted {
+			continue
+		}
+		pm := PinnedMessage{MessageDTO: m.messageDTOLocked(msg, viewerID), PinnedAt: msg.PinnedAt}
+		if u := m.users[msg.PinnedBy]; u != nil {
+			pm.PinnedBy = u.Email
+		}
+		out = append(out, pm)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].PinnedAt.After(out[j].PinnedAt) })
+	return out, nil
+}
+
+// ---- reads ----
+
+func (m *memStore) MarkRead(ctx context.Context, roomID, userID, lastReadMessageID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.reads[roomID] == nil {
+		m.reads[roomID] = map[int64]int64{}
+	}
+	if lastReadMessageID > m.reads[roomID][userID] {
+		m.reads[roomID][userID] = lastReadMessageID
+	}
+	return nil
+}
+
+func (m *memStore) RoomActivity(ctx context.Context, roomID int64, userIDs []int64) (int64, map[int64]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latestID int64
+	for _, msg := range m.messages {
+		if msg.RoomID == roomID && !msg.Deleted && msg.ID > latestID {
+			latestID = msg.ID
+		}
+	}
+
+	unread := make(map[int64]int64, len(userIDs))
+	for _, uid := range userIDs {
+		unread[uid] = m.unreadLocked(roomID, uid)
+	}
+	return latestID, unread, nil
+}
+
+func (m *memStore) SaveCalls(ctx context.Context, calls []CallState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, cs := range calls {
+		cs.Participants = append([]string(nil), cs.Participants...)
+		m.calls[cs.RoomID] = cs
+	}
+	return nil
+}
+
+func (m *memStore) TakeCalls(ctx context.Context) ([]CallState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]CallState, 0, len(m.calls))
+	for _, cs := range m.calls {
+		out = append(out, cs)
+	}
+	clear(m.calls)
+	return out, nil
+}
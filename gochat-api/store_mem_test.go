@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// memStore stands in for pgStore in every handler test, so it has to keep
+// the same contract; these pin down the parts the handlers lean on.
+
+var (
+	_ Store = (*memStore)(nil)
+	_ Store = (*pgStore)(nil)
+)
+
+func TestMemStoreUsersAndMembers(t *testing.T) {
+	ctx := context.Background()
+	st := newMemStore()
+
+	alice, err := st.CreateUser(ctx, "alice@x", "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateUser(ctx, "alice@x", "h"); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate email: got %v, want ErrConflict", err)
+	}
+	bob, _ := st.CreateUser(ctx, "bob@x", "h")
+
+	roomID, err := st.CreateRoom(ctx, NewRoom{Name: "general", OwnerID: alice, Visibility: visibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := st.GetMember(ctx, roomID, alice); err != nil || m.Role != roleOwner {
+		t.Errorf("creator: got %+v, %v; want the owner", m, err)
+	}
+	if _, err := st.GetMember(ctx, roomID, bob); !errors.Is(err, ErrNotFound) {
+		t.Errorf("non-member: got %v, want ErrNotFound", err)
+	}
+
+	for i, want := range []bool{true, false} {
+		if added, err := st.AddMember(ctx, roomID, bob, roleMember); err != nil || added != want {
+			t.Errorf("AddMember #%d: got %v, %v; want %v", i+1, added, err, want)
+		}
+	}
+	if ok, _ := st.IsMember(ctx, roomID, bob); !ok {
+		t.Error("bob isn't a member after AddMember")
+	}
+	if err := st.RemoveMember(ctx, roomID, bob); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.IsMember(ctx, roomID, bob); ok {
+		t.Error("bob is still a member after RemoveMember")
+	}
+}
+
+func TestMemStoreMessages(t *testing.T) {
+	ctx := context.Background()
+	st := newMemStore()
+	alice, _ := st.CreateUser(ctx, "alice@x", "h")
+	roomID, _ := st.CreateRoom(ctx, NewRoom{Name: "general", OwnerID: alice, Visibility: visibilityPublic})
+
+	var ids []int64
+	for _, body := range []string{"one", "two", "three", "four", "five"} {
+		id, _, _, err := st.InsertMessage(ctx, NewMessage{RoomID: roomID, UserID: alice, Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	page := func(q MessageQuery) []int64 {
+		t.Helper()
+		q.RoomID, q.ViewerID, q.SinceDays = roomID, alice, 10
+		msgs, err := st.ListMessages(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []int64
+		for _, m := range msgs {
+			out = append(out, m.ID)
+		}
+		return out
+	}
+	equal := func(name string, got, want []int64) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+	equal("latest", page(MessageQuery{Limit: 2}), []int64{ids[4], ids[3]})
+	equal("before", page(MessageQuery{Limit: 2, BeforeID: ids[3]}), []int64{ids[2], ids[1]})
+	equal("forward", page(MessageQuery{Limit: 2, Forward: true, AfterID: ids[1]}), []int64{ids[2], ids[3]})
+
+	if _, err := st.DeleteMessage(ctx, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := st.GetMessage(ctx, ids[0]); err != nil || !m.Deleted {
+		t.Errorf("deleted message: got %+v, %v", m, err)
+	}
+	if _, err := st.GetMessage(ctx, ids[4]+100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown message: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,1821 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type pgStore struct {
+	db *pgxpool.Pool
+}
+
+func newPGStore(db *pgxpool.Pool) *pgStore {
+	return &pgStore{db: db}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ---- users ----
+
+func (p *pgStore) CreateUser(ctx context.Context, email, passwordHash string) (int64, error) {
+	var id int64
+	err := p.db.QueryRow(ctx,
+		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
+		email, passwordHash,
+	).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return 0, ErrConflict
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+func (p *pgStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	var u User
+	err := p.db.QueryRow(ctx,
+		`SELECT id, email, password_hash FROM users WHERE email=$1`, email,
+	).Scan(&u.ID, &u.Email, &u.PasswordHash)
+	return u, notFound(err)
+}
+
+func (p *pgStore) UserByID(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := p.db.QueryRow(ctx,
+		`SELECT id, email, password_hash FROM users WHERE id=$1`, id,
+	).Scan(&u.ID, &u.Email, &u.PasswordHash)
+	return u, notFound(err)
+}
+
+func (p *pgStore) DeleteUser(ctx context.Context, userID int64) ([]OwnerChange, error) {
+	var changes []OwnerChange
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT id, name FROM rooms WHERE created_by=$1 AND kind = 'room' ORDER BY id FOR UPDATE
+		`, userID)
+		if err != nil {
+			return err
+		}
+		owned, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OwnerChange, error) {
+			var c OwnerChange
+			err := row.Scan(&c.RoomID, &c.RoomName)
+			return c, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, c := range owned {
+			// same order as ownerSuccessor
+			rows, err := tx.Query(ctx, `
+				SELECT `+memberCols+`
+				FROM room_members rm
+				JOIN users u ON u.id = rm.user_id
+				JOIN rooms r ON r.id = rm.room_id
+				WHERE rm.room_id = $1 AND rm.user_id <> $2
+				ORDER BY array_position(ARRAY['admin','moderator','member','readonly'], rm.role),
+				         rm.joined_at, rm.user_id
+				LIMIT 1
+			`, c.RoomID, userID)
+			if err != nil {
+				return err
+			}
+			next, err := pgx.CollectExactlyOneRow(rows, scanMember)
+			if errors.Is(err, pgx.ErrNoRows) {
+				changes = append(changes, c) // cascades away with the user
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := transferOwnerTx(ctx, tx, c.RoomID, next.UserID); err != nil {
+				return err
+			}
+			next.Role, next.MutedUntil = roleOwner, time.Time{}
+			c.NewOwner = next
+			changes = append(changes, c)
+		}
+
+		// DMs have no owner to hand over; created_by just has to keep
+		// pointing at someone, or the room would cascade away for everyone
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM rooms r
+			WHERE r.kind = 'dm' AND r.created_by = $1
+			  AND NOT EXISTS (SELECT 1 FROM room_members rm WHERE rm.room_id = r.id AND rm.user_id <> $1)
+		`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE rooms r SET created_by = (
+				SELECT rm.user_id FROM room_members rm
+				WHERE rm.room_id = r.id AND rm.user_id <> $1
+				ORDER BY rm.joined_at, rm.user_id
+				LIMIT 1
+			)
+			WHERE r.kind = 'dm' AND r.created_by = $1
+		`, userID); err != nil {
+			return err
+		}
+
+		// their content moves to a tombstone before the account row goes;
+		// one tombstone per account keeps the (message, user) keys unique
+		var tombID int64
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO users (email, password_hash) VALUES ($1, '') RETURNING id
+		`, deletedUserEmail(userID)).Scan(&tombID); err != nil {
+			return err
+		}
+		for _, q := range []string{
+			`UPDATE messages SET user_id = $2 WHERE user_id = $1`,
+			`UPDATE messages SET pinned_by = $2 WHERE pinned_by = $1`,
+			`UPDATE message_reactions SET user_id = $2 WHERE user_id = $1`,
+			`UPDATE poll_votes SET user_id = $2 WHERE user_id = $1`,
+			`UPDATE message_revisions SET editor_id = $2 WHERE editor_id = $1`,
+		} {
+			if _, err := tx.Exec(ctx, q, userID, tombID); err != nil {
+				return err
+			}
+		}
+
+		tag, err := tx.Exec(ctx, `DELETE FROM users WHERE id=$1`, userID)
+		if err == nil && tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// ---- rooms ----
+
+func (p *pgStore) CreateRoom(ctx context.Context, r NewRoom) (int64, error) {
+	var roomID int64
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx,
+			`INSERT INTO rooms (name, created_by, visibility, topic, description) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			r.Name, r.OwnerID, r.Visibility, r.Topic, r.Description,
+		).Scan(&roomID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx,
+			`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, 'owner')
+			 ON CONFLICT (room_id, user_id) DO NOTHING`,
+			roomID, r.OwnerID,
+		)
+		return err
+	})
+	return roomID, err
+}
+
+func (p *pgStore) OpenDM(ctx context.Context, creatorID int64, userIDs []int64) (int64, []int64, error) {
+	var roomID int64
+	var added []int64
+	key := dmKey(userIDs)
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// a concurrent open of the same key blocks here, then finds the row
+		join := userIDs
+		err := tx.QueryRow(ctx, `
+			INSERT INTO rooms (name, created_by, visibility, kind, dm_key)
+			VALUES ('', $1, 'private', 'dm', $2)
+			ON CONFLICT (dm_key) DO NOTHING
+			RETURNING id
+		`, creatorID, key).Scan(&roomID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// already there: only the caller comes back
+			join = []int64{creatorID}
+			err = tx.QueryRow(ctx, `SELECT id FROM rooms WHERE dm_key=$1`, key).Scan(&roomID)
+		}
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, `
+			INSERT INTO room_members (room_id, user_id, role)
+			SELECT $1, unnest($2::bigint[]), 'member'
+			ON CONFLICT (room_id, user_id) DO NOTHING
+			RETURNING user_id
+		`, roomID, join)
+		if err != nil {
+			return err
+		}
+		added, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+		return err
+	})
+	return roomID, added, err
+}
+
+const roomInfoCols = `id, name, created_by, created_at, visibility, kind, archived_at,
+	topic, description, avatar_url, retention_days, call_role, slow_mode_seconds`
+
+func scanRoomInfo(row pgx.Row) (RoomInfo, error) {
+	var ri RoomInfo
+	var archived *time.Time
+	err := row.Scan(&ri.ID, &ri.Name, &ri.CreatedBy, &ri.CreatedAt, &ri.Visibility, &ri.Kind, &archived,
+		&ri.Topic, &ri.Description, &ri.AvatarURL, &ri.RetentionDays, &ri.CallRole, &ri.SlowModeSeconds)
+	if archived != nil {
+		ri.ArchivedAt = *archived
+	}
+	return ri, notFound(err)
+}
+
+func (p *pgStore) GetRoom(ctx context.Context, id int64) (RoomInfo, error) {
+	return scanRoomInfo(p.db.QueryRow(ctx, `
+		SELECT `+roomInfoCols+` FROM rooms WHERE id=$1 AND deleted_at IS NULL
+	`, id))
+}
+
+func (p *pgStore) UpdateRoom(ctx context.Context, id int64, rp RoomPatch) (RoomInfo, error) {
+	return scanRoomInfo(p.db.QueryRow(ctx, `
+		UPDATE rooms SET
+			name              = COALESCE($2, name),
+			topic             = COALESCE($3, topic),
+			description       = COALESCE($4, description),
+			avatar_url        = COALESCE($5, avatar_url),
+			retention_days    = COALESCE($6, retention_days),
+			call_role         = COALESCE($7, call_role),
+			slow_mode_seconds = COALESCE($8, slow_mode_seconds)
+		WHERE id=$1 AND deleted_at IS NULL
+		RETURNING `+roomInfoCols+`
+	`, id, rp.Name, rp.Topic, rp.Description, rp.AvatarURL, rp.RetentionDays, rp.CallRole, rp.SlowModeSeconds))
+}
+
+func (p *pgStore) SetVisibility(ctx context.Context, id int64, visibility string) error {
+	tag, err := p.db.Exec(ctx, `UPDATE rooms SET visibility=$2 WHERE id=$1`, id, visibility)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) SetArchived(ctx context.Context, id int64, archived bool) error {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE rooms SET archived_at = CASE WHEN $2 THEN COALESCE(archived_at, now()) END
+		WHERE id=$1 AND deleted_at IS NULL
+	`, id, archived)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) TransferOwnership(ctx context.Context, roomID, toID int64) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// serialize with other transfers of the same room
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM rooms WHERE id=$1 FOR UPDATE`, roomID); err != nil {
+			return err
+		}
+		return transferOwnerTx(ctx, tx, roomID, toID)
+	})
+}
+
+// transferOwnerTx demotes the current owner before promoting toID so
+// idx_room_members_one_owner holds at every step.
+func transferOwnerTx(ctx context.Context, tx pgx.Tx, roomID, toID int64) error {
+	if _, err := tx.Exec(ctx, `
+		UPDATE room_members SET role='admin' WHERE room_id=$1 AND role='owner' AND user_id<>$2
+	`, roomID, toID); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE room_members SET role='owner', muted_until=NULL WHERE room_id=$1 AND user_id=$2
+	`, roomID, toID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	_, err = tx.Exec(ctx, `UPDATE rooms SET created_by=$2 WHERE id=$1`, roomID, toID)
+	return err
+}
+
+var roomViewFilters = map[string]string{
+	roomViewActive:   `r.kind = 'room' AND r.deleted_at IS NULL AND r.archived_at IS NULL`,
+	roomViewArchived: `r.kind = 'room' AND r.deleted_at IS NULL AND r.archived_at IS NOT NULL`,
+	roomViewAll:      `r.kind = 'room' AND r.deleted_at IS NULL`,
+	roomViewDeleted:  `r.kind = 'room' AND r.deleted_at IS NOT NULL AND rm.role = 'owner'`,
+	roomViewDMs:      `r.kind = 'dm' AND r.deleted_at IS NULL`,
+}
+
+func (p *pgStore) ListRooms(ctx context.Context, userID int64, view string) ([]Room, error) {
+	filter, ok := roomViewFilters[view]
+	if !ok {
+		return nil, fmt.Errorf("unknown room view %q", view)
+	}
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			r.id,
+			r.name,
+			r.created_by,
+			(rm.role = 'owner') AS is_owner,
+			rm.role,
+			r.visibility,
+			r.created_at,
+			r.archived_at,
+			r.deleted_at,
+			r.topic,
+			r.description,
+			r.avatar_url,
+			r.retention_days,
+			r.call_role,
+			r.slow_mode_seconds,
+			r.kind,
+			CASE WHEN r.kind = 'dm' THEN ARRAY(
+				SELECT u.email
+				FROM room_members o
+				JOIN users u ON u.id = o.user_id
+				WHERE o.room_id = r.id AND o.user_id <> $1
+				ORDER BY u.email
+			) END AS participants,
+			COALESCE((
+				SELECT COUNT(*)
+				FROM messages m
+				LEFT JOIN room_reads rr ON rr.room_id = r.id AND rr.user_id = $1
+				WHERE m.room_id = r.id
+				  AND m.id > COALESCE(rr.last_read_message_id, 0)
+				  AND m.deleted_at IS NULL
+			), 0)::bigint AS unread_count,
+			(
+				SELECT COUNT(*)
+				FROM message_mentions mm
+				JOIN messages m ON m.id = mm.message_id
+				LEFT JOIN room_reads rr ON rr.room_id = r.id AND rr.user_id = $1
+				WHERE mm.user_id = $1
+				  AND m.room_id = r.id
+				  AND m.deleted_at IS NULL
+				  AND mm.read_at IS NULL
+				  AND m.id > COALESCE(rr.last_read_message_id, 0)
+			)::bigint AS mention_count
+		FROM rooms r
+		JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = $1
+		WHERE `+filter+`
+		ORDER BY r.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Room{}
+	for rows.Next() {
+		var it Room
+		var participants []string
+		if err := rows.Scan(&it.ID, &it.Name, &it.OwnerID, &it.IsOwner, &it.Role, &it.Visibility, &it.CreatedAt, &it.ArchivedAt, &it.DeletedAt,
+			&it.Topic, &it.Description, &it.AvatarURL,
+			&it.Settings.RetentionDays, &it.Settings.CallRole, &it.Settings.SlowModeSeconds,
+			&it.Kind, &participants,
+			&it.UnreadCount, &it.MentionCount); err != nil {
+			return nil, err
+		}
+		for _, email := range participants {
+			it.Participants = append(it.Participants, UserPresence{Email: email})
+		}
+		out = append(out, it)
+	}
+	return out, rows.Err()
+}
+
+func (p *pgStore) SoftDeleteRoom(ctx context.Context, id int64) error {
+	tag, err := p.db.Exec(ctx, `UPDATE rooms SET deleted_at=now() WHERE id=$1 AND deleted_at IS NULL`, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) RestoreRoom(ctx context.Context, id, ownerID int64, since time.Time) error {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE rooms SET deleted_at=NULL
+		WHERE id=$1 AND created_by=$2 AND deleted_at > $3
+	`, id, ownerID, since)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) PurgeDeletedRooms(ctx context.Context, before time.Time) (int64, error) {
+	// room_members, messages, ... go with it (ON DELETE CASCADE)
+	tag, err := p.db.Exec(ctx, `DELETE FROM rooms WHERE deleted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ---- members ----
+
+func (p *pgStore) IsMember(ctx context.Context, roomID, userID int64) (bool, error) {
+	var ok bool
+	err := p.db.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM room_members rm
+			JOIN rooms r ON r.id = rm.room_id AND r.deleted_at IS NULL
+			WHERE rm.room_id=$1 AND rm.user_id=$2
+		)
+	`, roomID, userID).Scan(&ok)
+	return ok, err
+}
+
+func (p *pgStore) MemberRooms(ctx context.Context, userID int64, roomIDs []int64) ([]int64, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT rm.room_id FROM room_members rm
+		JOIN rooms r ON r.id = rm.room_id AND r.deleted_at IS NULL
+		WHERE rm.user_id=$1 AND rm.room_id = ANY($2)
+	`, userID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+func (p *pgStore) MemberEmails(ctx context.Context, roomID int64) ([]string, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT u.email
+		FROM room_members rm
+		JOIN users u ON u.id = rm.user_id
+		WHERE rm.room_id = $1
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// memberCols expects room_members rm, users u and rooms r.
+const memberCols = `rm.user_id, u.email, rm.role, rm.joined_at, rm.muted_until,
+	(r.archived_at IS NOT NULL), r.call_role, r.slow_mode_seconds`
+
+func scanMember(row pgx.CollectableRow) (Member, error) {
+	var m Member
+	var muted *time.Time
+	if err := row.Scan(&m.UserID, &m.Email, &m.Role, &m.JoinedAt, &muted, &m.Archived, &m.CallRole, &m.SlowModeSeconds); err != nil {
+		return m, err
+	}
+	if muted != nil {
+		m.MutedUntil = *muted
+	}
+	return m, nil
+}
+
+func (p *pgStore) GetMember(ctx context.Context, roomID, userID int64) (Member, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+memberCols+`
+		FROM room_members rm
+		JOIN users u ON u.id = rm.user_id
+		JOIN rooms r ON r.id = rm.room_id AND r.deleted_at IS NULL
+		WHERE rm.room_id = $1 AND rm.user_id = $2
+	`, roomID, userID)
+	if err != nil {
+		return Member{}, err
+	}
+	m, err := pgx.CollectExactlyOneRow(rows, scanMember)
+	return m, notFound(err)
+}
+
+func (p *pgStore) SetMemberRole(ctx context.Context, roomID, userID int64, role string) error {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE room_members SET role=$3 WHERE room_id=$1 AND user_id=$2
+	`, roomID, userID, role)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) ListMembers(ctx context.Context, roomID int64) ([]Member, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+memberCols+`
+		FROM room_members rm
+		JOIN users u ON u.id = rm.user_id
+		JOIN rooms r ON r.id = rm.room_id
+		WHERE rm.room_id = $1
+		ORDER BY rm.joined_at ASC, rm.user_id ASC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanMember)
+}
+
+func (p *pgStore) SetMute(ctx context.Context, roomID, userID int64, until time.Time) error {
+	var arg any
+	if !until.IsZero() {
+		arg = until
+	}
+	tag, err := p.db.Exec(ctx, `
+		UPDATE room_members SET muted_until=$3 WHERE room_id=$1 AND user_id=$2
+	`, roomID, userID, arg)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) AddMember(ctx context.Context, roomID, userID int64, role string) (bool, error) {
+	tag, err := p.db.Exec(ctx, `
+		INSERT INTO room_members (room_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`, roomID, userID, role)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (p *pgStore) RemoveMember(ctx context.Context, roomID, userID int64) error {
+	_, err := p.db.Exec(ctx, `
+		DELETE FROM room_members WHERE room_id=$1 AND user_id=$2
+	`, roomID, userID)
+	return err
+}
+
+func (p *pgStore) Ban(ctx context.Context, b Ban) error {
+	var expires any
+	if !b.ExpiresAt.IsZero() {
+		expires = b.ExpiresAt
+	}
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO room_bans (room_id, user_id, banned_by, reason, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (room_id, user_id) DO UPDATE
+			SET banned_by = EXCLUDED.banned_by,
+			    reason = EXCLUDED.reason,
+			    expires_at = EXCLUDED.expires_at,
+			    created_at = now()
+		`, b.RoomID, b.UserID, b.BannedBy, b.Reason, expires); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM room_members WHERE room_id=$1 AND user_id=$2`, b.RoomID, b.UserID)
+		return err
+	})
+}
+
+func (p *pgStore) Unban(ctx context.Context, roomID, userID int64) error {
+	tag, err := p.db.Exec(ctx, `DELETE FROM room_bans WHERE room_id=$1 AND user_id=$2`, roomID, userID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+const banCols = `
+	b.room_id, b.user_id, u.email, COALESCE(b.banned_by, 0), COALESCE(bu.email, ''),
+	b.reason, b.expires_at, b.created_at`
+
+func scanBan(row pgx.CollectableRow) (Ban, error) {
+	var b Ban
+	var expires *time.Time
+	err := row.Scan(&b.RoomID, &b.UserID, &b.Email, &b.BannedBy, &b.BannedByEmail, &b.Reason, &expires, &b.CreatedAt)
+	if expires != nil {
+		b.ExpiresAt = *expires
+	}
+	return b, err
+}
+
+func (p *pgStore) ActiveBan(ctx context.Context, roomID, userID int64) (Ban, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+banCols+`
+		FROM room_bans b
+		JOIN users u ON u.id = b.user_id
+		LEFT JOIN users bu ON bu.id = b.banned_by
+		WHERE b.room_id = $1 AND b.user_id = $2
+		  AND (b.expires_at IS NULL OR b.expires_at > now())
+	`, roomID, userID)
+	if err != nil {
+		return Ban{}, err
+	}
+	b, err := pgx.CollectExactlyOneRow(rows, scanBan)
+	return b, notFound(err)
+}
+
+func (p *pgStore) ListBans(ctx context.Context, roomID int64) ([]Ban, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+banCols+`
+		FROM room_bans b
+		JOIN users u ON u.id = b.user_id
+		LEFT JOIN users bu ON bu.id = b.banned_by
+		WHERE b.room_id = $1
+		  AND (b.expires_at IS NULL OR b.expires_at > now())
+		ORDER BY b.created_at DESC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanBan)
+}
+
+// ---- messages ----
+
+func (p *pgStore) InsertMessage(ctx context.Context, m NewMessage) (int64, time.Time, bool, error) {
+	var id int64
+	var createdAt time.Time
+	att := m.Attachment
+
+	// retries reuse the same clientMsgId -> unique (room_id, user_id, client_msg_id)
+	err := p.db.QueryRow(ctx, `
+		INSERT INTO messages (
+			room_id, user_id, body,
+			reply_to_id, thread_root_id,
+			attachment_url, attachment_mime, attachment_filename, attachment_size,
+			client_msg_id
+		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		ON CONFLICT (room_id, user_id, client_msg_id) WHERE client_msg_id IS NOT NULL
+		DO NOTHING
+		RETURNING id, created_at
+	`,
+		m.RoomID, m.UserID, m.Body,
+		nullIfZero(m.ReplyToID), nullIfZero(m.ThreadRootID),
+		nullableStr(att, func(a *Attachment) string { return a.URL }),
+		nullableStr(att, func(a *Attachment) string { return a.Mime }),
+		nullableStr(att, func(a *Attachment) string { return a.Filename }),
+		nullableSize(att),
+		nullIfEmpty(m.ClientMsgID),
+	).Scan(&id, &createdAt)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = p.db.QueryRow(ctx, `
+			SELECT id, created_at FROM messages
+			WHERE room_id=$1 AND user_id=$2 AND client_msg_id=$3
+		`, m.RoomID, m.UserID, m.ClientMsgID).Scan(&id, &createdAt)
+		return id, createdAt, true, err
+	}
+	return id, createdAt, false, err
+}
+
+func (p *pgStore) GetMessage(ctx context.Context, id int64) (MessageMeta, error) {
+	mm := MessageMeta{ID: id}
+	err := p.db.QueryRow(ctx, `
+		SELECT room_id, user_id, kind, COALESCE(poll::text, ''), (deleted_at IS NOT NULL)
+		FROM messages
+		WHERE id=$1
+	`, id).Scan(&mm.RoomID, &mm.UserID, &mm.Kind, &mm.PollJSON, &mm.Deleted)
+	return mm, notFound(err)
+}
+
+// messageCols / scanMessage are shared by every query that returns MessageDTOs.
+// The query must join users u and LEFT JOIN message_stars ms for the viewer.
+const messageCols = `
+	m.id, m.room_id, u.email, m.body, m.kind,
+	COALESCE(m.poll::text, '') AS poll_json,
+	(EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
+	COALESCE(m.reply_to_id, 0) AS reply_to_id,
+	COALESCE(m.thread_root_id, 0) AS thread_root_id,
+	(m.deleted_at IS NOT NULL) AS deleted,
+	(m.edited_at IS NOT NULL) AS edited,
+	(ms.message_id IS NOT NULL) AS starred,
+	(m.pinned_at IS NOT NULL AND m.deleted_at IS NULL) AS pinned,
+	m.attachment_url, m.attachment_mime, m.attachment_filename,
+	COALESCE(m.attachment_size, 0),
+	m.revision_count`
+
+func scanMessage(row pgx.CollectableRow) (MessageDTO, error) {
+	return scanMessageExtra(row)
+}
+
+// scanMessageExtra scans messageCols followed by extra columns into extra.
+func scanMessageExtra(row pgx.CollectableRow, extra ...any) (MessageDTO, error) {
+	var m MessageDTO
+	var pollJSON string
+	var url, mime, filename *string
+	var size int64
+
+	dest := []any{
+		&m.ID, &m.RoomID, &m.UserEmail, &m.Body, &m.Kind,
+		&pollJSON, &m.CreatedAt, &m.ReplyToID, &m.ThreadRootID,
+		&m.Deleted, &m.Edited, &m.Starred, &m.Pinned,
+		&url, &mime, &filename, &size,
+		&m.RevisionCount,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return m, err
+	}
+
+	if m.Deleted {
+		m.Body = ""
+		return m, nil
+	}
+	if url != nil && *url != "" {
+		m.Attachment = &Attachment{
+			URL:      *url,
+			Mime:     derefStr(mime),
+			Filename: derefStr(filename),
+			Size:     size,
+		}
+	}
+	if m.Kind == "poll" {
+		m.Poll = pollFromJSON(pollJSON)
+	}
+	return m, nil
+}
+
+func (p *pgStore) ListMessages(ctx context.Context, q MessageQuery) ([]MessageDTO, error) {
+	var rows pgx.Rows
+	var err error
+
+	switch {
+	case q.Forward:
+		// export: everything, oldest first
+		rows, err = p.db.Query(ctx, `
+			SELECT `+messageCols+`
+			FROM messages m
+			JOIN users u ON u.id = m.user_id
+			LEFT JOIN message_stars ms ON ms.message_id=m.id AND ms.user_id=$3
+			WHERE m.room_id=$1
+			  AND m.id > $2
+			ORDER BY m.id ASC
+			LIMIT $4
+		`, q.RoomID, q.AfterID, q.ViewerID, q.Limit)
+	case q.BeforeID <= 0:
+		// initial load: only last N days
+		rows, err = p.db.Query(ctx, `
+			SELECT `+messageCols+`
+			FROM messages m
+			JOIN users u ON u.id = m.user_id
+			LEFT JOIN message_stars ms ON ms.message_id=m.id AND ms.user_id=$3
+			WHERE m.room_id=$1
+			  AND m.created_at >= now() - ($2::int * interval '1 day')
+			ORDER BY m.id DESC
+			LIMIT $4
+		`, q.RoomID, q.SinceDays, q.ViewerID, q.Limit)
+	default:
+		// load older: no date restriction
+		rows, err = p.db.Query(ctx, `
+			SELECT `+messageCols+`
+			FROM messages m
+			JOIN users u ON u.id = m.user_id
+			LEFT JOIN message_stars ms ON ms.message_id=m.id AND ms.user_id=$3
+			WHERE m.room_id=$1
+			  AND m.id < $2
+			ORDER BY m.id DESC
+			LIMIT $4
+		`, q.RoomID, q.BeforeID, q.ViewerID, q.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanMessage)
+}
+
+func (p *pgStore) SearchMessages(ctx context.Context, q MessageSearch) ([]MessageDTO, error) {
+	beforeID := q.BeforeID
+	if beforeID <= 0 {
+		beforeID = 1 << 62
+	}
+
+	order := "m.id DESC"
+	if q.Sort == searchSortRelevance {
+		order = "rank DESC, m.id DESC"
+	}
+
+	rest, prefixes := splitPrefixTerms(q.Query)
+
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`,
+			ts_rank_cd(m.search_tsv, sq.query) AS rank,
+			`+pgSnippetCol+`
+		FROM messages m
+		CROSS JOIN (
+			-- $2: websearch part, $3: prefix part ("foo:* & bar:*"); either may be empty
+			SELECT CASE
+				WHEN $3 = '' THEN websearch_to_tsquery('english', $2)
+				WHEN $2 = '' THEN to_tsquery('english', $3)
+				ELSE websearch_to_tsquery('english', $2) && to_tsquery('english', $3)
+			END AS query
+		) sq
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $5
+		WHERE m.room_id = $1
+		  AND m.deleted_at IS NULL
+		  AND m.id < $4
+		  AND m.search_tsv @@ sq.query
+		ORDER BY `+order+`
+		LIMIT $6 OFFSET $7
+	`, q.RoomID, rest, prefixTSQuery(prefixes), beforeID, q.ViewerID, q.Limit, q.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanSearchHit)
+}
+
+// pgSnippetCol is the snippet for a search hit against sq.query. The text is
+// HTML-escaped before ts_headline sees it, so the <mark> tags it adds are the
+// only markup in the result (same escapes as html.EscapeString).
+const pgSnippetCol = `ts_headline('english',
+				replace(replace(replace(replace(replace(
+					COALESCE(NULLIF(m.body, ''), m.poll->>'question', m.attachment_filename, ''),
+					'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;'),
+				sq.query,
+				'StartSel=` + snippetStart + `, StopSel=` + snippetStop + `, MaxWords=24, MinWords=8, MaxFragments=2, FragmentDelimiter=" … "'
+			) AS snippet`
+
+func (p *pgStore) SearchAll(ctx context.Context, q GlobalSearch) ([]SearchHit, error) {
+	args := []any{q.ViewerID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"m.deleted_at IS NULL"}
+	rankCols := `0::real AS rank, '' AS snippet`
+	from := ""
+
+	if q.Text != "" {
+		rest, prefixes := splitPrefixTerms(q.Text)
+		web, pre := arg(rest), arg(prefixTSQuery(prefixes))
+		from = `
+		CROSS JOIN (
+			SELECT CASE
+				WHEN ` + pre + ` = '' THEN websearch_to_tsquery('english', ` + web + `)
+				WHEN ` + web + ` = '' THEN to_tsquery('english', ` + pre + `)
+				ELSE websearch_to_tsquery('english', ` + web + `) && to_tsquery('english', ` + pre + `)
+			END AS query
+		) sq`
+		rankCols = `ts_rank_cd(m.search_tsv, sq.query) AS rank,
+			` + pgSnippetCol
+		where = append(where, "m.search_tsv @@ sq.query")
+	}
+	if q.From != "" {
+		where = append(where, "lower(u.email) = lower("+arg(q.From)+")")
+	}
+	if q.InRoom != "" {
+		v := arg(q.InRoom)
+		where = append(where, "(r.id::text = "+v+" OR lower(r.name) = lower("+v+"))")
+	}
+	if q.HasAttachment {
+		where = append(where, "COALESCE(m.attachment_url, '') <> ''")
+	}
+	if q.HasPoll {
+		where = append(where, "m.kind = 'poll'")
+	}
+	if q.Starred {
+		where = append(where, "ms.message_id IS NOT NULL")
+	}
+	if !q.Before.IsZero() {
+		where = append(where, "m.created_at < "+arg(q.Before))
+	}
+	if !q.After.IsZero() {
+		where = append(where, "m.created_at >= "+arg(q.After))
+	}
+	if q.Mime != "" {
+		if strings.Contains(q.Mime, "/") {
+			where = append(where, "lower(m.attachment_mime) = lower("+arg(q.Mime)+")")
+		} else {
+			// a plain comparison, so % and _ in the filter aren't wildcards
+			where = append(where, "split_part(lower(m.attachment_mime), '/', 1) = lower("+arg(q.Mime)+")")
+		}
+	}
+	if q.CursorID > 0 {
+		where = append(where, "m.id < "+arg(q.CursorID))
+	}
+
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`, `+rankCols+`, r.name
+		FROM messages m`+from+`
+		JOIN room_members rm ON rm.room_id = m.room_id AND rm.user_id = $1
+		JOIN rooms r ON r.id = m.room_id AND r.deleted_at IS NULL
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $1
+		WHERE `+strings.Join(where, "\n\t\t  AND ")+`
+		ORDER BY m.id DESC
+		LIMIT `+arg(q.Limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SearchHit, error) {
+		var rank float32
+		var snippet, roomName string
+		m, err := scanMessageExtra(row, &rank, &snippet, &roomName)
+		m.Rank, m.Snippet = rank, snippet
+		return SearchHit{MessageDTO: m, RoomName: roomName}, err
+	})
+}
+
+func scanSearchHit(row pgx.CollectableRow) (MessageDTO, error) {
+	var rank float32
+	var snippet string
+	m, err := scanMessageExtra(row, &rank, &snippet)
+	m.Rank, m.Snippet = rank, snippet
+	return m, err
+}
+
+func (p *pgStore) EditMessage(ctx context.Context, id, editorID int64, body string) (bool, error) {
+	changed := false
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO message_revisions (message_id, editor_id, body, poll)
+			SELECT m.id, $2, m.body, m.poll
+			FROM messages m
+			WHERE m.id = $1 AND m.body <> $3 AND m.deleted_at IS NULL
+			FOR UPDATE OF m
+		`, id, editorID, body)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		changed = true
+		_, err = tx.Exec(ctx, `
+			UPDATE messages
+			SET body = $1, edited_at = now(), revision_count = revision_count + 1
+			WHERE id = $2
+		`, body, id)
+		return err
+	})
+	return changed, err
+}
+
+func (p *pgStore) DeleteMessage(ctx context.Context, id int64) (bool, error) {
+	var unpinned bool
+	err := p.db.QueryRow(ctx, `
+		WITH old AS (SELECT id, pinned_at FROM messages WHERE id = $1 FOR UPDATE)
+		UPDATE messages m
+		SET deleted_at = now(), body = '', pinned_at = NULL, pinned_by = NULL
+		FROM old
+		WHERE m.id = old.id
+		RETURNING old.pinned_at IS NOT NULL
+	`, id).Scan(&unpinned)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return unpinned, err
+}
+
+func (p *pgStore) LastPost(ctx context.Context, roomID, userID int64) (time.Time, string, error) {
+	var at time.Time
+	var clientMsgID string
+	err := p.db.QueryRow(ctx, `
+		SELECT created_at, COALESCE(client_msg_id, '')
+		FROM messages
+		WHERE room_id=$1 AND user_id=$2
+		ORDER BY id DESC
+		LIMIT 1
+	`, roomID, userID).Scan(&at, &clientMsgID)
+	return at, clientMsgID, notFound(err)
+}
+
+func (p *pgStore) PurgeExpiredMessages(ctx context.Context) (int64, error) {
+	// reactions, votes, stars, revisions and mentions cascade; replies
+	// outliving their root become top-level (thread_root_id SET NULL); pinned
+	// messages are kept, so no pin ever disappears without message_unpinned
+	tag, err := p.db.Exec(ctx, `
+		DELETE FROM messages m
+		USING rooms r
+		WHERE r.id = m.room_id
+		  AND r.retention_days > 0
+		  AND m.created_at < now() - r.retention_days * interval '1 day'
+		  AND m.pinned_at IS NULL
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (p *pgStore) DeleteOwnMessages(ctx context.Context, userID int64, ids []int64) ([]MessageMeta, error) {
+	rows, err := p.db.Query(ctx, `
+		WITH old AS (
+			SELECT id, pinned_at FROM messages
+			WHERE id = ANY($1)
+			  AND user_id = $2
+			  AND deleted_at IS NULL
+			FOR UPDATE
+		)
+		UPDATE messages m
+		SET deleted_at = now(), body = '', pinned_at = NULL, pinned_by = NULL
+		FROM old
+		WHERE m.id = old.id
+		RETURNING m.id, m.room_id, m.user_id, m.kind, old.pinned_at IS NOT NULL
+	`, ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (MessageMeta, error) {
+		mm := MessageMeta{Deleted: true}
+		err := row.Scan(&mm.ID, &mm.RoomID, &mm.UserID, &mm.Kind, &mm.Unpinned)
+		return mm, err
+	})
+}
+
+// ---- threads ----
+
+func (p *pgStore) MessageByID(ctx context.Context, id, viewerID int64) (MessageDTO, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $2
+		WHERE m.id = $1
+	`, id, viewerID)
+	if err != nil {
+		return MessageDTO{}, err
+	}
+	m, err := pgx.CollectExactlyOneRow(rows, scanMessage)
+	return m, notFound(err)
+}
+
+func (p *pgStore) ListReplies(ctx context.Context, rootID, viewerID, afterID int64, limit int) ([]MessageDTO, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $2
+		WHERE m.thread_root_id = $1
+		  AND m.deleted_at IS NULL
+		  AND m.id > $3
+		ORDER BY m.id ASC
+		LIMIT $4
+	`, rootID, viewerID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanMessage)
+}
+
+func (p *pgStore) ThreadSummaries(ctx context.Context, rootIDs []int64) (map[int64]ThreadSummary, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			m.thread_root_id,
+			COUNT(*)::bigint,
+			MAX(m.created_at),
+			(array_agg(DISTINCT u.email ORDER BY u.email))[1:$2]
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.thread_root_id = ANY($1)
+		  AND m.deleted_at IS NULL
+		GROUP BY m.thread_root_id
+	`, rootIDs, threadMaxParticipants)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]ThreadSummary{}
+	for rows.Next() {
+		var rootID int64
+		var t ThreadSummary
+		if err := rows.Scan(&rootID, &t.ReplyCount, &t.LastReplyAt, &t.Participants); err != nil {
+			return nil, err
+		}
+		out[rootID] = t
+	}
+	return out, rows.Err()
+}
+
+// ---- revisions ----
+
+func (p *pgStore) ListRevisions(ctx context.Context, messageID int64) ([]MessageRevision, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT r.id, r.body, COALESCE(r.poll::text, ''), r.vote_counts, COALESCE(u.email, ''), r.created_at
+		FROM message_revisions r
+		LEFT JOIN users u ON u.id = r.editor_id
+		WHERE r.message_id = $1
+		ORDER BY r.id ASC
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (MessageRevision, error) {
+		var rev MessageRevision
+		err := row.Scan(&rev.ID, &rev.Body, &rev.PollJSON, &rev.VoteCounts, &rev.EditorEmail, &rev.EditedAt)
+		return rev, err
+	})
+}
+
+// ---- mentions ----
+
+func (p *pgStore) SetMentions(ctx context.Context, messageID int64, mentions map[int64]string) ([]int64, error) {
+	userIDs := make([]int64, 0, len(mentions))
+	kinds := make([]string, 0, len(mentions))
+	for uid, kind := range mentions {
+		userIDs = append(userIDs, uid)
+		kinds = append(kinds, kind)
+	}
+
+	var added []int64
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM message_mentions
+			WHERE message_id = $1 AND NOT (user_id = ANY($2))
+		`, messageID, userIDs); err != nil {
+			return err
+		}
+
+		// xmax = 0 only for freshly inserted rows
+		rows, err := tx.Query(ctx, `
+			INSERT INTO message_mentions (message_id, user_id, kind)
+			SELECT $1, t.user_id, t.kind
+			FROM unnest($2::bigint[], $3::text[]) AS t(user_id, kind)
+			ON CONFLICT (message_id, user_id) DO UPDATE SET kind = EXCLUDED.kind
+			RETURNING user_id, (xmax = 0) AS inserted
+		`, messageID, userIDs, kinds)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var uid int64
+			var inserted bool
+			if err := rows.Scan(&uid, &inserted); err != nil {
+				return err
+			}
+			if inserted {
+				added = append(added, uid)
+			}
+		}
+		return rows.Err()
+	})
+	return added, err
+}
+
+func (p *pgStore) ListMentions(ctx context.Context, q MentionQuery) ([]Mention, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`, r.name, mm.kind, rd.is_read
+		FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		JOIN users u ON u.id = m.user_id
+		JOIN rooms r ON r.id = m.room_id AND r.deleted_at IS NULL
+		JOIN room_members rm ON rm.room_id = m.room_id AND rm.user_id = $1
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $1
+		LEFT JOIN room_reads rr ON rr.room_id = m.room_id AND rr.user_id = $1
+		CROSS JOIN LATERAL (
+			SELECT (mm.read_at IS NOT NULL OR m.id <= COALESCE(rr.last_read_message_id, 0)) AS is_read
+		) rd
+		WHERE mm.user_id = $1
+		  AND m.deleted_at IS NULL
+		  AND ($2::bigint = 0 OR m.id < $2)
+		  AND NOT ($3 AND rd.is_read)
+		ORDER BY m.id DESC
+		LIMIT $4
+	`, q.UserID, q.BeforeID, q.UnreadOnly, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Mention, error) {
+		var roomName, kind string
+		var read bool
+		m, err := scanMessageExtra(row, &roomName, &kind, &read)
+		return Mention{MessageDTO: m, RoomName: roomName, Kind: kind, Read: read}, err
+	})
+}
+
+func (p *pgStore) MarkMentionsRead(ctx context.Context, userID int64, messageIDs []int64) error {
+	if messageIDs == nil {
+		messageIDs = []int64{} // NULL would match nothing
+	}
+	_, err := p.db.Exec(ctx, `
+		UPDATE message_mentions
+		SET read_at = now()
+		WHERE user_id = $1
+		  AND read_at IS NULL
+		  AND (cardinality($2::bigint[]) = 0 OR message_id = ANY($2))
+	`, userID, messageIDs)
+	return err
+}
+
+// ---- invites ----
+
+func (p *pgStore) CreateInvite(ctx context.Context, inv Invite) error {
+	var expires any
+	if !inv.ExpiresAt.IsZero() {
+		expires = inv.ExpiresAt
+	}
+	_, err := p.db.Exec(ctx, `
+		INSERT INTO room_invites (token, room_id, created_by, expires_at, max_uses)
+		VALUES ($1, $2, $3, $4, $5)
+	`, inv.Token, inv.RoomID, inv.CreatedBy, expires, inv.MaxUses)
+	return err
+}
+
+const inviteCols = `token, room_id, COALESCE(created_by, 0), expires_at, max_uses, uses, (revoked_at IS NOT NULL), created_at`
+
+func scanInvite(row pgx.CollectableRow) (Invite, error) {
+	var inv Invite
+	var expires *time.Time
+	err := row.Scan(&inv.Token, &inv.RoomID, &inv.CreatedBy, &expires, &inv.MaxUses, &inv.Uses, &inv.Revoked, &inv.CreatedAt)
+	if expires != nil {
+		inv.ExpiresAt = *expires
+	}
+	return inv, err
+}
+
+func (p *pgStore) GetInvite(ctx context.Context, token string) (Invite, error) {
+	rows, err := p.db.Query(ctx, `SELECT `+inviteCols+` FROM room_invites WHERE token=$1`, token)
+	if err != nil {
+		return Invite{}, err
+	}
+	inv, err := pgx.CollectExactlyOneRow(rows, scanInvite)
+	return inv, notFound(err)
+}
+
+func (p *pgStore) ListInvites(ctx context.Context, roomID int64) ([]Invite, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+inviteCols+`
+		FROM room_invites
+		WHERE room_id = $1
+		  AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > now())
+		  AND (max_uses = 0 OR uses < max_uses)
+		ORDER BY created_at DESC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanInvite)
+}
+
+func (p *pgStore) RevokeInvite(ctx context.Context, roomID int64, token string) error {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE room_invites SET revoked_at = now()
+		WHERE token = $1 AND room_id = $2 AND revoked_at IS NULL
+	`, token, roomID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *pgStore) RedeemInvite(ctx context.Context, token string, userID int64) (int64, bool, error) {
+	var roomID int64
+	var added bool
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// lock the invite so two redeemers can't both take its last use
+		rows, err := tx.Query(ctx, `SELECT `+inviteCols+` FROM room_invites WHERE token=$1 FOR UPDATE`, token)
+		if err != nil {
+			return err
+		}
+		inv, err := pgx.CollectExactlyOneRow(rows, scanInvite)
+		if err != nil {
+			return notFound(err)
+		}
+		if !inv.usable(time.Now()) {
+			return ErrNotFound
+		}
+		roomID = inv.RoomID
+
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO room_members (room_id, user_id, role)
+			VALUES ($1, $2, 'member')
+			ON CONFLICT (room_id, user_id) DO NOTHING
+		`, roomID, userID)
+		if err != nil {
+			return err
+		}
+		if added = tag.RowsAffected() > 0; !added {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `DELETE FROM room_join_requests WHERE room_id=$1 AND user_id=$2`, roomID, userID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE room_invites SET uses = uses + 1 WHERE token=$1`, token)
+		return err
+	})
+	return roomID, added, err
+}
+
+func (p *pgStore) RequestJoin(ctx context.Context, roomID, userID int64, note string) (bool, error) {
+	tag, err := p.db.Exec(ctx, `
+		INSERT INTO room_join_requests (room_id, user_id, note)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`, roomID, userID, note)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (p *pgStore) ListJoinRequests(ctx context.Context, roomID int64) ([]JoinRequest, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT jr.user_id, u.email, jr.note, jr.created_at
+		FROM room_join_requests jr
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.room_id = $1
+		ORDER BY jr.created_at ASC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[JoinRequest])
+}
+
+func (p *pgStore) ResolveJoinRequest(ctx context.Context, roomID, userID int64, approve bool) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM room_join_requests WHERE room_id=$1 AND user_id=$2`, roomID, userID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		if !approve {
+			return nil
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO room_members (room_id, user_id, role)
+			VALUES ($1, $2, 'member')
+			ON CONFLICT (room_id, user_id) DO NOTHING
+		`, roomID, userID)
+		return err
+	})
+}
+
+// ---- reactions ----
+
+func (p *pgStore) ToggleReaction(ctx context.Context, messageID, userID int64, emoji string) (added bool, count int64, err error) {
+	err = pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// Try delete first (toggle behavior)
+		tag, err := tx.Exec(ctx, `
+			DELETE FROM message_reactions
+			WHERE message_id=$1 AND user_id=$2 AND emoji=$3
+		`, messageID, userID, emoji)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO message_reactions(message_id, user_id, emoji)
+				VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING
+			`, messageID, userID, emoji); err != nil {
+				return err
+			}
+			added = true
+		}
+
+		return tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM message_reactions WHERE message_id=$1 AND emoji=$2
+		`, messageID, emoji).Scan(&count)
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return added, count, nil
+}
+
+func (p *pgStore) ReactionSummaries(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64][]ReactionDTO, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			message_id,
+			emoji,
+			COUNT(*)::bigint AS cnt,
+			BOOL_OR(user_id = $2) AS me
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, emoji
+	`, messageIDs, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64][]ReactionDTO{}
+	for rows.Next() {
+		var mid int64
+		var rx ReactionDTO
+		if err := rows.Scan(&mid, &rx.Emoji, &rx.Count, &rx.Me); err != nil {
+			return nil, err
+		}
+		out[mid] = append(out[mid], rx)
+	}
+	return out, rows.Err()
+}
+
+func (p *pgStore) ReactionUsers(ctx context.Context, messageID int64) (map[string][]string, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT mr.emoji, u.email
+		FROM message_reactions mr
+		JOIN users u ON u.id = mr.user_id
+		WHERE mr.message_id = $1
+		ORDER BY mr.emoji, u.email
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string][]string{}
+	for rows.Next() {
+		var emoji, email string
+		if err := rows.Scan(&emoji, &email); err != nil {
+			return nil, err
+		}
+		out[emoji] = append(out[emoji], email)
+	}
+	return out, rows.Err()
+}
+
+// ---- polls ----
+
+func (p *pgStore) CreatePoll(ctx context.Context, roomID, userID int64, pollJSON string) (int64, time.Time, error) {
+	var id int64
+	var createdAt time.Time
+	err := p.db.QueryRow(ctx, `
+		INSERT INTO messages (room_id, user_id, body, kind, poll, created_at)
+		VALUES ($1, $2, '', 'poll', $3::jsonb, now())
+		RETURNING id, created_at
+	`, roomID, userID, pollJSON).Scan(&id, &createdAt)
+	return id, createdAt, err
+}
+
+func (p *pgStore) UpdatePoll(ctx context.Context, messageID, editorID int64, pollJSON string, remap []int) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// snapshot the tallies only when votes are about to move; option
+		// counts follow the old poll's options, zero-filled
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO message_revisions (message_id, editor_id, body, poll, vote_counts)
+			SELECT m.id, $2, m.body, m.poll,
+				CASE WHEN $3 THEN ARRAY(
+					SELECT COUNT(v.user_id)::bigint
+					FROM generate_series(0, jsonb_array_length(m.poll->'options') - 1) AS o(idx)
+					LEFT JOIN poll_votes v ON v.message_id = m.id AND v.option_idx = o.idx
+					GROUP BY o.idx
+					ORDER BY o.idx
+				) END
+			FROM messages m
+			WHERE m.id = $1 AND m.deleted_at IS NULL
+			FOR UPDATE OF m
+		`, messageID, editorID, remap != nil)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE messages
+			SET poll = $2::jsonb, edited_at = now(), revision_count = revision_count + 1
+			WHERE id = $1
+		`, messageID, pollJSON); err != nil {
+			return err
+		}
+		if remap != nil {
+			// votes follow their option to its new index ($2[idx+1]); votes
+			// for removed options (-1, or past the end) are dropped
+			if _, err := tx.Exec(ctx, `
+				DELETE FROM poll_votes
+				WHERE message_id = $1 AND COALESCE(($2::int[])[option_idx + 1], -1) < 0
+			`, messageID, remap); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `
+				UPDATE poll_votes SET option_idx = ($2::int[])[option_idx + 1]
+				WHERE message_id = $1
+			`, messageID, remap); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *pgStore) VotePoll(ctx context.Context, messageID, userID int64, optionIdx, numOptions int) (int, []int64, error) {
+	myVote := -1
+	counts := make([]int64, numOptions)
+
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		existing := -1
+		err := tx.QueryRow(ctx, `
+			SELECT option_idx FROM poll_votes WHERE message_id=$1 AND user_id=$2
+		`, messageID, userID).Scan(&existing)
+
+		switch {
+		case err == nil && existing == optionIdx:
+			// clicked same option -> cancel vote
+			_, err = tx.Exec(ctx, `
+				DELETE FROM poll_votes WHERE message_id=$1 AND user_id=$2
+			`, messageID, userID)
+		case err == nil:
+			// switch vote
+			_, err = tx.Exec(ctx, `
+				UPDATE poll_votes
+				SET option_idx=$3, created_at=now()
+				WHERE message_id=$1 AND user_id=$2
+			`, messageID, userID, optionIdx)
+			myVote = optionIdx
+		case errors.Is(err, pgx.ErrNoRows):
+			_, err = tx.Exec(ctx, `
+				INSERT INTO poll_votes (message_id, user_id, option_idx)
+				VALUES ($1, $2, $3)
+			`, messageID, userID, optionIdx)
+			myVote = optionIdx
+		}
+		if err != nil {
+			return err
+		}
+
+		// counts inside the same tx so they match the vote we just cast
+		rows, err := tx.Query(ctx, `
+			SELECT option_idx, COUNT(*)::bigint
+			FROM poll_votes
+			WHERE message_id=$1
+			GROUP BY option_idx
+		`, messageID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var idx int
+			var cnt int64
+			if err := rows.Scan(&idx, &cnt); err != nil {
+				return err
+			}
+			if idx >= 0 && idx < len(counts) {
+				counts[idx] = cnt
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+	return myVote, counts, nil
+}
+
+func (p *pgStore) PollTallies(ctx context.Context, messageIDs []int64, viewerID int64) (map[int64]PollTally, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT message_id, option_idx, COUNT(*)::bigint, BOOL_OR(user_id = $2)
+		FROM poll_votes
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, option_idx
+	`, messageIDs, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]PollTally{}
+	for rows.Next() {
+		var mid int64
+		var idx int
+		var cnt int64
+		var mine bool
+		if err := rows.Scan(&mid, &idx, &cnt, &mine); err != nil {
+			return nil, err
+		}
+		t, ok := out[mid]
+		if !ok {
+			t = PollTally{Counts: map[int]int64{}, MyVote: -1}
+		}
+		t.Counts[idx] = cnt
+		if mine {
+			t.MyVote = idx
+		}
+		out[mid] = t
+	}
+	return out, rows.Err()
+}
+
+// ---- stars ----
+
+func (p *pgStore) StarMessages(ctx context.Context, userID int64, ids []int64) error {
+	_, err := p.db.Exec(ctx, `
+		INSERT INTO message_stars(user_id, message_id)
+		SELECT $1, unnest($2::bigint[])
+		ON CONFLICT DO NOTHING
+	`, userID, ids)
+	return err
+}
+
+func (p *pgStore) UnstarMessages(ctx context.Context, userID int64, ids []int64) error {
+	_, err := p.db.Exec(ctx, `
+		DELETE FROM message_stars
+		WHERE user_id = $1
+		  AND message_id = ANY($2)
+	`, userID, ids)
+	return err
+}
+
+func (p *pgStore) ListStarred(ctx context.Context, userID int64, before time.Time, limit int) ([]StarredMessageDTO, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			m.id,
+			m.room_id,
+			COALESCE(r.name, '') AS room_name,
+			u.email,
+			m.body,
+			(EXTRACT(EPOCH FROM m.created_at) * 1000)::bigint AS created_ms,
+			COALESCE(m.reply_to_id, 0) AS reply_to_id,
+			(m.deleted_at IS NOT NULL) AS deleted,
+			(m.edited_at IS NOT NULL) AS edited,
+			m.attachment_url,
+			m.attachment_mime,
+			m.attachment_filename,
+			COALESCE(m.attachment_size, 0)
+		FROM message_stars ms
+		JOIN messages m ON m.id = ms.message_id
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN rooms r ON r.id = m.room_id
+		WHERE ms.user_id = $1 AND ms.created_at < $2
+		  AND r.deleted_at IS NULL
+		ORDER BY ms.created_at DESC
+		LIMIT $3
+	`, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StarredMessageDTO, error) {
+		m := StarredMessageDTO{Starred: true}
+		var url, mime, filename *string
+		var size int64
+
+		if err := row.Scan(
+			&m.ID, &m.RoomID, &m.RoomName, &m.UserEmail, &m.Body,
+			&m.CreatedAt, &m.ReplyToID, &m.Deleted, &m.Edited,
+			&url, &mime, &filename, &size,
+		); err != nil {
+			return m, err
+		}
+
+		if m.Deleted {
+			m.Body = ""
+		} else if url != nil && *url != "" {
+			m.Attachment = &Attachment{
+				URL:      *url,
+				Mime:     derefStr(mime),
+				Filename: derefStr(filename),
+				Size:     size,
+			}
+		}
+		return m, nil
+	})
+}
+
+// ---- pins ----
+
+func (p *pgStore) PinMessage(ctx context.Context, id, userID int64, limit int) (bool, error) {
+	var pinned bool
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		var roomID int64
+		var already bool
+		err := tx.QueryRow(ctx, `
+			SELECT room_id, pinned_at IS NOT NULL FROM messages WHERE id=$1 AND deleted_at IS NULL
+		`, id).Scan(&roomID, &already)
+		if err != nil || already {
+			return notFound(err)
+		}
+
+		// serialise pins per room so concurrent ones can't overshoot limit
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM rooms WHERE id=$1 FOR UPDATE`, roomID); err != nil {
+			return err
+		}
+		var n int
+		if err := tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM messages
+			WHERE room_id=$1 AND pinned_at IS NOT NULL AND deleted_at IS NULL
+		`, roomID).Scan(&n); err != nil {
+			return err
+		}
+		if n >= limit {
+			return ErrPinLimit
+		}
+
+		tag, err := tx.Exec(ctx, `
+			UPDATE messages SET pinned_at=now(), pinned_by=$2 WHERE id=$1 AND pinned_at IS NULL
+		`, id, userID)
+		pinned = err == nil && tag.RowsAffected() == 1
+		return err
+	})
+	return pinned, err
+}
+
+func (p *pgStore) UnpinMessage(ctx context.Context, id int64) (bool, error) {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE messages SET pinned_at=NULL, pinned_by=NULL WHERE id=$1 AND pinned_at IS NOT NULL
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *pgStore) ListPins(ctx context.Context, roomID, viewerID int64) ([]PinnedMessage, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT `+messageCols+`, COALESCE(pu.email, ''), m.pinned_at
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN message_stars ms ON ms.message_id = m.id AND ms.user_id = $2
+		LEFT JOIN users pu ON pu.id = m.pinned_by
+		WHERE m.room_id = $1 AND m.pinned_at IS NOT NULL AND m.deleted_at IS NULL
+		ORDER BY m.pinned_at DESC, m.id DESC
+	`, roomID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PinnedMessage, error) {
+		var pm PinnedMessage
+		m, err := scanMessageExtra(row, &pm.PinnedBy, &pm.PinnedAt)
+		pm.MessageDTO = m
+		return pm, err
+	})
+}
+
+// ---- reads ----
+
+func (p *pgStore) MarkRead(ctx context.Context, roomID, userID, lastReadMessageID int64) error {
+	_, err := p.db.Exec(ctx, `
+		INSERT INTO room_reads(room_id, user_id, last_read_message_id, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (room_id, user_id)
+		DO UPDATE SET last_read_message_id = GREATEST(room_reads.last_read_message_id, EXCLUDED.last_read_message_id),
+		              updated_at = now()
+	`, roomID, userID, lastReadMessageID)
+	return err
+}
+
+func (p *pgStore) RoomActivity(ctx context.Context, roomID int64, userIDs []int64) (int64, map[int64]int64, error) {
+	var latestID int64
+	if err := p.db.QueryRow(ctx, `
+		SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id=$1 AND deleted_at IS NULL
+	`, roomID).Scan(&latestID); err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := p.db.Query(ctx, `
+		SELECT u.user_id, COUNT(m.id)::bigint
+		FROM unnest($2::bigint[]) AS u(user_id)
+		LEFT JOIN room_reads rr ON rr.room_id = $1 AND rr.user_id = u.user_id
+		LEFT JOIN messages m ON m.room_id = $1
+			AND m.id > COALESCE(rr.last_read_message_id, 0)
+			AND m.deleted_at IS NULL
+		GROUP BY u.user_id
+	`, roomID, userIDs)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	unread := make(map[int64]int64, len(userIDs))
+	for rows.Next() {
+		var uid, n int64
+		if err := rows.Scan(&uid, &n); err != nil {
+			return 0, nil, err
+		}
+		unread[uid] = n
+	}
+	return latestID, unread, rows.Err()
+}
+
+func (p *pgStore) SaveCalls(ctx context.Context, calls []CallState) error {
+	for _, cs := range calls {
+		b, err := json.Marshal(cs)
+		if err != nil {
+			return err
+		}
+		if _, err := p.db.Exec(ctx, `
+			INSERT INTO room_calls (room_id, state) VALUES ($1, $2)
+			ON CONFLICT (room_id) DO UPDATE SET state = EXCLUDED.state, saved_at = now()
+		`, cs.RoomID, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pgStore) TakeCalls(ctx context.Context) ([]CallState, error) {
+	rows, err := p.db.Query(ctx, `DELETE FROM room_calls RETURNING state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []CallState
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var cs CallState
+		if err := json.Unmarshal(b, &cs); err != nil {
+			return nil, err
+		}
+		out = append(out, cs)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	maxSubscriptions = 200
+	activityDebounce = 500 * time.Millisecond
+)
+
+// activityEvents are the room frames that change what a background
+// subscriber's sidebar shows (latest message / unread count).
+var activityEvents = map[string]bool{
+	"message":         true,
+	"message_deleted": true,
+}
+
+// ActivityFunc returns the latest message id in roomID and each user's
+// unread count there.
+type ActivityFunc func(ctx context.Context, roomID int64, userIDs []int64) (latestID int64, unread map[int64]int64, err error)
+
+// subscribe adds background subscriptions for c; it returns the rooms that
+// were accepted (the per-connection cap can cut the list short).
+func (h *Hub) subscribe(c *Client, roomIDs []int64) []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.subs == nil {
+		c.subs = make(map[int64]bool)
+	}
+
+	out := make([]int64, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if !c.subs[roomID] && len(c.subs) >= maxSubscriptions {
+			continue
+		}
+		c.subs[roomID] = true
+		if h.subs[roomID] == nil {
+			h.subs[roomID] = make(map[*Client]bool)
+		}
+		h.subs[roomID][c] = true
+		out = append(out, roomID)
+	}
+	return out
+}
+
+func (h *Hub) unsubscribe(c *Client, roomIDs []int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(c, roomIDs)
+}
+
+func (h *Hub) unsubscribeAll(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	roomIDs := make([]int64, 0, len(c.subs))
+	for roomID := range c.subs {
+		roomIDs = append(roomIDs, roomID)
+	}
+	h.unsubscribeLocked(c, roomIDs)
+}
+
+func (h *Hub) unsubscribeLocked(c *Client, roomIDs []int64) {
+	for _, roomID := range roomIDs {
+		delete(c.subs, roomID)
+		if m := h.subs[roomID]; m != nil {
+			delete(m, c)
+			if len(m) == 0 {
+				delete(h.subs, roomID)
+			}
+		}
+	}
+}
+
+// backgroundSubsLocked lists roomID's subscribers that aren't focused on it
+// (focused clients already get the full event stream).
+func (h *Hub) backgroundSubsLocked(roomID int64) []*Client {
+	var out []*Client
+	for c := range h.subs[roomID] {
+		if c.room != roomID {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// roomActivity schedules a room_activity push to background subscribers.
+// Bursts within activityDebounce collapse into one query.
+func (h *Hub) roomActivity(roomID int64) {
+	h.mu.Lock()
+	if h.activityPending[roomID] || len(h.backgroundSubsLocked(roomID)) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	h.activityPending[roomID] = true
+	h.mu.Unlock()
+
+	time.AfterFunc(activityDebounce, func() { h.sendActivity(roomID, nil) })
+}
+
+// sendActivity pushes room_activity for roomID to only (if set) or to every
+// background subscriber.
+func (h *Hub) sendActivity(roomID int64, only *Client) {
+	h.mu.Lock()
+	var targets []*Client
+	if only != nil {
+		targets = []*Client{only}
+	} else {
+		delete(h.activityPending, roomID)
+		targets = h.backgroundSubsLocked(roomID)
+	}
+	fn := h.activityFn
+	h.mu.Unlock()
+
+	if len(targets) == 0 || fn == nil {
+		return
+	}
+
+	seen := map[int64]bool{}
+	userIDs := make([]int64, 0, len(targets))
+	for _, c := range targets {
+		if !seen[c.userID] {
+			seen[c.userID] = true
+			userIDs = append(userIDs, c.userID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	latestID, unread, err := fn(ctx, roomID, userIDs)
+	if err != nil {
+		log.Println("room_activity error:", err)
+		return
+	}
+
+	for _, c := range targets {
+		b, _ := json.Marshal(map[string]any{
+			"type":            "room_activity",
+			"roomId":          roomID,
+			"latestMessageId": latestID,
+			"unreadCount":     unread[c.userID],
+		})
+		if only != nil {
+			h.sendWait(c, b) // initial burst after subscribe: don't trip the slow-consumer check
+		} else {
+			h.enqueue(c, b)
+		}
+	}
+}
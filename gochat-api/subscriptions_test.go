@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoomActivity(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.activityFn = func(ctx context.Context, roomID int64, userIDs []int64) (int64, map[int64]int64, error) {
+		unread := map[int64]int64{}
+		for _, id := range userIDs {
+			unread[id] = id * 10
+		}
+		return 99, unread, nil
+	}
+
+	// alice watches room 1 from room 2; bob has room 1 open
+	alice, ap := wsClient(t, h, 1, "alice@x")
+	bob, bp := wsClient(t, h, 2, "bob@x")
+	h.join(alice, 2)
+	h.join(bob, 1)
+	if got := h.subscribe(alice, []int64{1}); len(got) != 1 {
+		t.Fatalf("subscribe: got %v", got)
+	}
+	h.subscribe(bob, []int64{1})
+
+	// a burst collapses into one room_activity, for background subscribers only
+	for i := 0; i < 3; i++ {
+		h.deliverLocal(1, "message", []byte(`{"type":"message","roomId":1}`))
+	}
+	f := readUntil(t, ap, "room_activity")
+	if f.RoomID != 1 || !jsonHas(f.raw, `"latestMessageId":99`) || !jsonHas(f.raw, `"unreadCount":10`) {
+		t.Errorf("got %s", f.raw)
+	}
+
+	for i := 0; i < 3; i++ {
+		if f := readFrame(t, bp); f.Type != "message" {
+			t.Errorf("bob got %s; focused clients get the room's own frames", f.raw)
+		}
+	}
+
+	// with no background subscribers left there's nothing to schedule
+	h.unsubscribe(alice, []int64{1})
+	h.deliverLocal(1, "message", []byte(`{"type":"message","roomId":1}`))
+	h.mu.Lock()
+	pending := h.activityPending[1]
+	h.mu.Unlock()
+	if pending {
+		t.Error("room_activity scheduled with nobody subscribed in the background")
+	}
+}
+
+func TestSubscriptionCap(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	c, _ := dialHub(t, h, 1, "alice@x", false)
+
+	ids := make([]int64, maxSubscriptions+10)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	if got := h.subscribe(c, ids); len(got) != maxSubscriptions {
+		t.Errorf("accepted %d subscriptions, want the cap of %d", len(got), maxSubscriptions)
+	}
+	h.unsubscribeAll(c)
+	if len(c.subs) != 0 || len(h.subs) != 0 {
+		t.Errorf("left behind: %d on the client, %d rooms on the hub", len(c.subs), len(h.subs))
+	}
+}
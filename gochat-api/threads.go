@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ThreadDTO struct {
+	Root       MessageDTO   `json:"root"`
+	Replies    []MessageDTO `json:"replies"`              // oldest first
+	NextCursor string       `json:"nextCursor,omitempty"` // pass back as ?after= for the next page
+}
+
+// handleThread is GET /messages/{messageID}/thread?after=&limit=: the root
+// message plus a page of its replies.
+func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromCtx(r)
+
+	rootID, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+	if err != nil || rootID <= 0 {
+		writeErr(w, http.StatusBadRequest, "bad message id")
+		return
+	}
+
+	root, err := s.store.MessageByID(r.Context(), rootID, userID)
+	if errors.Is(err, ErrNotFound) {
+		writeErr(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println("handleThread root error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if ok, err := s.store.IsMember(r.Context(), root.RoomID, userID); err != nil || !ok {
+		writeErr(w, http.StatusForbidden, "not a room member")
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, _ := strconv.Atoi(v); n > 0 && n <= 200 {
+			limit = n
+		}
+	}
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeErr(w, http.StatusBadRequest, "bad after")
+			return
+		}
+		after = n
+	}
+
+	replies, err := s.store.ListReplies(r.Context(), rootID, userID, after, limit)
+	if err != nil {
+		log.Println("handleThread replies error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	// hydrate root and replies in one go
+	all := append([]MessageDTO{root}, replies...)
+	if err := hydratePolls(r.Context(), s.store, all, userID); err != nil {
+		log.Println("handleThread poll counts error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := hydrateReactions(r.Context(), s.store, all, userID); err != nil {
+		log.Println("handleThread reactions error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := hydrateThreads(r.Context(), s.store, all[:1]); err != nil {
+		log.Println("handleThread summary error:", err)
+		writeErr(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	out := ThreadDTO{Root: all[0], Replies: all[1:]}
+	if len(replies) == limit {
+		out.NextCursor = strconv.FormatInt(replies[len(replies)-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// threadRoot resolves the thread a new message replying to replyToID hangs
+// off. Threads are one level deep, so replying to a reply joins the same
+// thread.
+func (s *Server) threadRoot(ctx context.Context, roomID, replyToID, viewerID int64) (int64, error) {
+	parent, err := s.store.MessageByID(ctx, replyToID, viewerID)
+	if err != nil {
+		return 0, err
+	}
+	if parent.RoomID != roomID || parent.Deleted {
+		return 0, ErrNotFound
+	}
+	if parent.ThreadRootID > 0 {
+		return parent.ThreadRootID, nil
+	}
+	return parent.ID, nil
+}
+
+// broadcastThreadReply tells the room a thread grew, with the root's fresh
+// summary so clients can update the "N replies" line without refetching.
+func (s *Server) broadcastThreadReply(ctx context.Context, roomID, rootID, replyID int64, email string) {
+	sums, err := s.store.ThreadSummaries(ctx, []int64{rootID})
+	if err != nil {
+		log.Println("thread summary error:", err)
+		return
+	}
+	t := sums[rootID]
+
+	s.hub.BroadcastToRoom(roomID, map[string]any{
+		"type":               "thread_reply",
+		"roomId":             roomID,
+		"messageId":          rootID,
+		"replyId":            replyID,
+		"userEmail":          email,
+		"replyCount":         t.ReplyCount,
+		"lastReplyAt":        t.LastReplyAt.UnixMilli(),
+		"threadParticipants": t.Participants,
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+func TestThreads(t *testing.T) {
+	ts := newTestServer(t)
+	aliceID, alice := ts.user("alice@example.com")
+	_, bob := ts.user("bob@example.com")
+	roomID := ts.room(alice, "general", visibilityPublic)
+	otherRoom := ts.room(alice, "random", visibilityPublic)
+	ts.expect(http.StatusOK, bob, "POST", fmt.Sprintf("/rooms/%d/join", roomID), nil)
+	root := ts.message(roomID, aliceID, "lunch?")
+	elsewhere := ts.message(otherRoom, aliceID, "not here")
+
+	conns := map[string]*websocket.Conn{}
+	for name, tok := range map[string]string{"alice": alice, "bob": bob} {
+		conns[name] = ts.ws(tok)
+		wsSend(t, conns[name], WSIn{Type: "join_room", RoomID: roomID})
+		readUntil(t, conns[name], "user_list")
+	}
+
+	// reply sends the message and returns its ack
+	reply := func(who string, replyTo int64) WSOut {
+		t.Helper()
+		wsSend(t, conns[who], WSIn{Type: "message", RoomID: roomID, Body: who + " says yes", ReplyToID: replyTo})
+		var ack WSOut
+		f := readFrame(t, conns[who])
+		for f.Type != "message_ack" && f.Type != "message_error" {
+			f = readFrame(t, conns[who])
+		}
+		if err := json.Unmarshal(f.raw, &ack); err != nil {
+			t.Fatal(err)
+		}
+		return ack
+	}
+
+	r1 := reply("bob", root)
+	var tr struct {
+		MessageID          int64    `json:"messageId"`
+		ReplyID            int64    `json:"replyId"`
+		ReplyCount         int64    `json:"replyCount"`
+		ThreadParticipants []string `json:"threadParticipants"`
+	}
+	if err := json.Unmarshal(readUntil(t, conns["alice"], "thread_reply").raw, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.MessageID != root || tr.ReplyID != r1.MessageID || tr.ReplyCount != 1 {
+		t.Errorf("thread_reply: got %+v", tr)
+	}
+
+	// answering a reply files the message under the same root
+	r2 := reply("alice", r1.MessageID)
+	if ack := reply("bob", elsewhere); ack.Type != "message_error" {
+		t.Errorf("reply to another room's message: got %+v", ack)
+	}
+
+	var th ThreadDTO
+	path := fmt.Sprintf("/messages/%d/thread?limit=1", root)
+	if st, msg := ts.call(bob, "GET", path, nil, &th); st != http.StatusOK {
+		t.Fatalf("thread: status %d (%q)", st, msg)
+	}
+	if th.Root.ID != root || th.Root.ReplyCount != 2 || len(th.Replies) != 1 || th.Replies[0].ID != r1.MessageID {
+		t.Fatalf("first page: got root %+v, replies %+v", th.Root, th.Replies)
+	}
+	slices.Sort(th.Root.ThreadParticipants)
+	if !slices.Equal(th.Root.ThreadParticipants, []string{"alice@example.com", "bob@example.com"}) {
+		t.Errorf("participants: got %v", th.Root.ThreadParticipants)
+	}
+	if st, msg := ts.call(bob, "GET", path+"&after="+th.NextCursor, nil, &th); st != http.StatusOK {
+		t.Fatalf("thread page 2: status %d (%q)", st, msg)
+	}
+	if len(th.Replies) != 1 || th.Replies[0].ID != r2.MessageID || th.Replies[0].ThreadRootID != root || th.Replies[0].ReplyToID != r1.MessageID {
+		t.Errorf("second page: got %+v", th.Replies)
+	}
+
+	// a deleted reply drops out of the thread and its count
+	ts.expect(http.StatusNoContent, bob, "DELETE", fmt.Sprintf("/messages/%d", r1.MessageID), nil)
+	if st, _ := ts.call(bob, "GET", fmt.Sprintf("/messages/%d/thread", root), nil, &th); st != http.StatusOK {
+		t.Fatal("thread after delete")
+	}
+	if th.Root.ReplyCount != 1 || len(th.Replies) != 1 {
+		t.Errorf("after delete: %d replies listed, count %d; want 1", len(th.Replies), th.Root.ReplyCount)
+	}
+}
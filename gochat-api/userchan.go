@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// register indexes c by email so frames can be addressed to a user rather
+// than a whole room.
+func (h *Hub) register(c *Client) {
+	key := strings.ToLower(c.email)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users[key] == nil {
+		h.users[key] = make(map[*Client]bool)
+	}
+	h.users[key][c] = true
+}
+
+func (h *Hub) unregister(c *Client) {
+	key := strings.ToLower(c.email)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m := h.users[key]; m != nil {
+		delete(m, c)
+		if len(m) == 0 {
+			delete(h.users, key)
+		}
+	}
+}
+
+// sendToUser delivers b to email's connections on every node. With roomID > 0
+// only connections currently focused on that room get it.
+func (h *Hub) sendToUser(email string, roomID int64, b []byte) {
+	h.deliverUserLocal(email, roomID, b)
+	h.sendEnvelope(hubEnvelope{Kind: "user", Email: email, RoomID: roomID, Data: b})
+}
+
+func (h *Hub) deliverUserLocal(email string, roomID int64, b []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.users[strings.ToLower(email)] {
+		if roomID > 0 && c.room != roomID {
+			continue
+		}
+		h.enqueue(c, b)
+	}
+}
+
+// user_event kinds pushed on the per-user channel.
+const (
+	userEventRoomAdded    = "room_added"    // you joined / created a room (sync other tabs)
+	userEventRoomRemoved  = "room_removed"  // you left a room, or were kicked / banned (data.reason)
+	userEventRoomDeleted  = "room_deleted"  // a room you were in was deleted (data.restoreUntil)
+	userEventRoomRestored = "room_restored" // ...and its owner brought it back
+	userEventCallRinging  = "call_ringing"  // someone started a call in one of your rooms
+	userEventMention      = "mention"       // a message mentions you (data.messageId, kind, from, body)
+	userEventMuted        = "muted"         // a moderator muted you in a room (data.until, 0 = indefinitely)
+	userEventUnmuted      = "unmuted"
+	userEventJoinRequest  = "join_request"        // to owners/admins: someone asked to join (data.email)
+	userEventJoinDenied   = "join_request_denied" // your request to join was turned down
+	userEventOwnerChanged = "room_ownership"      // you now own a room (data.from: previous owner)
+)
+
+// UserEvent is the envelope for everything addressed to a user rather than
+// a room. Clients switch on Event; Data depends on it.
+type UserEvent struct {
+	Type      string `json:"type"` // always "user_event"
+	Event     string `json:"event"`
+	RoomID    int64  `json:"roomId,omitempty"`
+	Data      any    `json:"data,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// notifyUser pushes a user_event to every live connection of email, across
+// tabs, devices and nodes.
+func (h *Hub) notifyUser(email, event string, roomID int64, data any) {
+	b, err := json.Marshal(UserEvent{
+		Type:      "user_event",
+		Event:     event,
+		RoomID:    roomID,
+		Data:      data,
+		CreatedAt: nowMS(),
+	})
+	if err != nil {
+		return
+	}
+	h.sendToUser(email, 0, b)
+}
+
+func (h *Hub) notifyUsers(emails []string, event string, roomID int64, data any) {
+	for _, em := range emails {
+		h.notifyUser(em, event, roomID, data)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+func TestNotifyUser(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	tab1, peer1 := wsClient(t, h, 1, "alice@x")
+	_, peer2 := wsClient(t, h, 1, "alice@x")
+	_, bobPeer := wsClient(t, h, 2, "bob@x")
+	h.join(tab1, 7)
+
+	// every tab gets it, focused on a room or not, whatever the email's case
+	h.notifyUser("Alice@X", userEventCallRinging, 7, map[string]any{"host": "bob@x"})
+	for i, peer := range []*websocket.Conn{peer1, peer2} {
+		f := readUntil(t, peer, "user_event")
+		if f.Event != userEventCallRinging || f.RoomID != 7 {
+			t.Errorf("tab %d: got %s", i+1, f.raw)
+		}
+	}
+
+	// frames addressed to a room only reach tabs focused on it
+	h.sendToUser("alice@x", 7, []byte(`{"type":"webrtc_offer","roomId":7}`))
+	h.notifyUser("alice@x", userEventRoomAdded, 8, nil)
+	if f := readUntil(t, peer2, "user_event"); f.Event != userEventRoomAdded {
+		t.Errorf("unfocused tab: got %s, want the room_added after the skipped offer", f.raw)
+	}
+	if f := readUntil(t, peer1, "webrtc_offer"); f.RoomID != 7 {
+		t.Errorf("focused tab: got %s", f.raw)
+	}
+
+	// nothing for alice reached bob
+	h.notifyUser("bob@x", userEventRoomAdded, 9, nil)
+	if f := readUntil(t, bobPeer, "user_event"); f.RoomID != 9 {
+		t.Errorf("bob: got %s, want only his own room_added", f.raw)
+	}
+}
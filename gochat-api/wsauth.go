@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const memberCacheTTL = 30 * time.Second
+
+// roomScopedEvents must come from a member of in.RoomID. join_room is where
+// most clients hit this first; the rest are checked too because nothing
+// stops a client from skipping join_room and sending frames directly.
+var roomScopedEvents = map[string]bool{
+	"join_room":        true,
+	"message":          true,
+	"typing":           true,
+	"presence":         true,
+	"call_sync":        true,
+	"call_start":       true,
+	"call_join":        true,
+	"call_leave":       true,
+	"call_end":         true,
+	"call_share_start": true,
+	"call_share_stop":  true,
+	"webrtc_offer":     true,
+	"webrtc_answer":    true,
+	"webrtc_ice":       true,
+}
+
+// authorizeRoom returns c's membership in roomID (Role "" if c's user
+// isn't a member). Answers are cached briefly per connection; evict() and
+// forgetMember() clear the cache, so a removed, re-roled or muted member
+// sees the change right away rather than after the TTL.
+func (s *Server) authorizeRoom(ctx context.Context, c *Client, roomID int64) (Member, error) {
+	if roomID <= 0 {
+		return Member{}, nil
+	}
+	if m, ok := s.hub.memberCached(c, roomID); ok {
+		return m, nil
+	}
+
+	m, err := s.roomMember(ctx, roomID, c.userID)
+	if err != nil {
+		return m, err
+	}
+	if m.Role != "" {
+		s.hub.cacheMember(c, roomID, m)
+	}
+	return m, nil
+}
+
+// rejectWS answers a refused frame. message sends get message_error so the
+// client can settle the pending bubble; everything else gets a typed error.
+func (s *Server) rejectWS(c *Client, in WSIn, code, msg string) {
+	typ := "error"
+	if in.Type == "message" {
+		typ = "message_error"
+	}
+	s.hub.sendToClient(c, WSOut{
+		Type:        typ,
+		RoomID:      in.RoomID,
+		Code:        code,
+		Ref:         in.Type,
+		ClientMsgID: in.ClientMsgID,
+		Error:       msg,
+	})
+}
+
+type memberCacheEntry struct {
+	member Member
+	exp    time.Time
+}
+
+func (h *Hub) memberCached(c *Client, roomID int64) (Member, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := c.members[roomID]
+	return e.member, ok && time.Now().Before(e.exp)
+}
+
+func (h *Hub) cacheMember(c *Client, roomID int64, m Member) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.members == nil {
+		c.members = make(map[int64]memberCacheEntry)
+	}
+	c.members[roomID] = memberCacheEntry{member: m, exp: time.Now().Add(memberCacheTTL)}
+}
+
+// forgetMember drops userID's cached role in roomID (everyone's if userID
+// is 0) on every node, so the next frame re-reads it. Use after a role, mute
+// or archive change that keeps them in the room.
+func (h *Hub) forgetMember(roomID, userID int64) {
+	h.forgetMemberLocal(roomID, userID)
+
+	b, _ := json.Marshal(evictPayload{UserID: userID})
+	h.sendEnvelope(hubEnvelope{Kind: "member", RoomID: roomID, Data: b})
+}
+
+func (h *Hub) forgetMemberLocal(roomID, userID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conns := range h.users {
+		for c := range conns {
+			if userID == 0 || c.userID == userID {
+				delete(c.members, roomID)
+			}
+		}
+	}
+}
+
+type evictPayload struct {
+	UserID int64  `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// evict removes userID's connections (every connection if userID is 0) from
+// roomID on all nodes: focus, background subscription and membership cache.
+// Evicted clients get room_evicted with the reason.
+func (h *Hub) evict(roomID, userID int64, reason string) {
+	h.evictLocal(roomID, userID, reason)
+
+	b, _ := json.Marshal(evictPayload{UserID: userID, Reason: reason})
+	h.sendEnvelope(hubEnvelope{Kind: "evict", RoomID: roomID, Data: b})
+}
+
+func (h *Hub) evictLocal(roomID, userID int64, reason string) {
+	var targets []*Client
+	var focused []*Client
+
+	h.mu.Lock()
+	seen := map[*Client]bool{}
+	collect := func(m map[*Client]bool) {
+		for c := range m {
+			if seen[c] || (userID != 0 && c.userID != userID) {
+				continue
+			}
+			seen[c] = true
+			targets = append(targets, c)
+			if c.room == roomID {
+				focused = append(focused, c)
+			}
+		}
+	}
+	collect(h.rooms[roomID])
+	collect(h.subs[roomID])
+
+	for _, c := range targets {
+		h.unsubscribeLocked(c, []int64{roomID})
+	}
+	// a connection that's neither focused nor subscribed can still have the
+	// role cached from an earlier frame
+	for _, conns := range h.users {
+		for c := range conns {
+			if userID == 0 || c.userID == userID {
+				delete(c.members, roomID)
+			}
+		}
+	}
+	onEvict := h.onEvict
+	h.mu.Unlock()
+
+	// c's own read loop may be switching rooms meanwhile; only unfocus
+	// clients still on roomID
+	for _, c := range focused {
+		if h.leaveRoom(c, roomID) != 0 && onEvict != nil {
+			onEvict(roomID, c)
+		}
+	}
+
+	b, _ := json.Marshal(WSOut{Type: "room_evicted", RoomID: roomID, Code: reason})
+	for _, c := range targets {
+		h.enqueue(c, b)
+	}
+}
+
+// dropFromCall is the Hub's onEvict hook: an evicted user can't stay in the
+// room's call either.
+func (s *Server) dropFromCall(roomID int64, c *Client) {
+	ended := s.callRemoveParticipant(roomID, c.email)
+	s.broadcastCallState(roomID)
+	if ended {
+		s.broadcastSystem(roomID, "📹 call ended (no participants)")
+	}
+}
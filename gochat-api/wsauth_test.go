@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestEvictRacesJoin(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.sendBuffer = 1024 // each round queues a handful of presence frames
+	var evicted sync.Map
+	h.onEvict = func(roomID int64, c *Client) { evicted.Store(c, roomID) }
+
+	c, peer := wsClient(t, h, 1, "bob@x")
+	go func() {
+		for {
+			if _, _, err := peer.Read(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		h.cacheMember(c, 1, Member{UserID: 1, Role: roleMember})
+
+		// the read loop joins, sets presence and types while a kick on
+		// another goroutine evicts
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.join(c, 1)
+			h.setStatus(c, "idle")
+			h.touch(c, WSIn{Type: "typing", RoomID: 1})
+			_ = h.focusedRoom(c)
+		}()
+		go func() {
+			defer wg.Done()
+			h.evictLocal(1, 1, "kicked")
+		}()
+		wg.Wait()
+
+		// whichever won, the hub and the client agree on where it is
+		h.mu.Lock()
+		inRoom, room := h.rooms[1][c], c.room
+		h.mu.Unlock()
+		if inRoom != (room == 1) {
+			t.Fatalf("round %d: in hub room=%v, client room=%d", i, inRoom, room)
+		}
+		if _, ok := h.memberCached(c, 1); ok {
+			t.Fatalf("round %d: membership still cached after the evict", i)
+		}
+		h.leave(c)
+	}
+}
+
+func TestEvictOnlyTouchesThatRoom(t *testing.T) {
+	h := NewHub("test", nil, nil)
+	h.onEvict = func(int64, *Client) { t.Error("onEvict for a client focused elsewhere") }
+
+	c, peer := wsClient(t, h, 1, "bob@x")
+	h.join(c, 2)
+	h.subscribe(c, []int64{1, 3})
+
+	h.evictLocal(1, 1, "kicked")
+	if got := h.focusedRoom(c); got != 2 {
+		t.Errorf("focused room: got %d, want 2", got)
+	}
+	if c.subs[1] || !c.subs[3] {
+		t.Errorf("subscriptions: got %v, want only room 3", c.subs)
+	}
+	if f := readUntil(t, peer, "room_evicted"); f.RoomID != 1 {
+		t.Errorf("got %s", f.raw)
+	}
+}